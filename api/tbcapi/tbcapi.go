@@ -53,12 +53,24 @@ const (
 	CmdUTXOsByAddressRequest  = "tbcapi-utxos-by-address-request"
 	CmdUTXOsByAddressResponse = "tbcapi-utxos-by-address-response"
 
+	CmdTxsByAddressRequest  = "tbcapi-txs-by-address-request"
+	CmdTxsByAddressResponse = "tbcapi-txs-by-address-response"
+
+	CmdTxsByScriptHashRequest  = "tbcapi-txs-by-script-hash-request"
+	CmdTxsByScriptHashResponse = "tbcapi-txs-by-script-hash-response"
+
 	CmdTxByIdRawRequest  = "tbcapi-tx-by-id-raw-request"
 	CmdTxByIdRawResponse = "tbcapi-tx-by-id-raw-response"
 
 	CmdTxByIdRequest  = "tbcapi-tx-by-id-request"
 	CmdTxByIdResponse = "tbcapi-tx-by-id-response"
 
+	CmdTxMerkleProofRequest  = "tbcapi-tx-merkle-proof-request"
+	CmdTxMerkleProofResponse = "tbcapi-tx-merkle-proof-response"
+
+	CmdOutpointSpentByRequest  = "tbcapi-outpoint-spent-by-request"
+	CmdOutpointSpentByResponse = "tbcapi-outpoint-spent-by-response"
+
 	CmdTxBroadcastRequest  = "tbcapi-tx-broadcast-request"
 	CmdTxBroadcastResponse = "tbcapi-tx-broadcast-response"
 
@@ -76,6 +88,52 @@ const (
 
 	CmdBlockDownloadAsyncRawRequest  = "tbcapi-block-download-async-raw-request"
 	CmdBlockDownloadAsyncRawResponse = "tbcapi-block-download-async-raw-response"
+
+	CmdBlockFilterByHashRequest  = "tbcapi-block-filter-by-hash-request"
+	CmdBlockFilterByHashResponse = "tbcapi-block-filter-by-hash-response"
+
+	CmdBlockFiltersByHeightRequest  = "tbcapi-block-filters-by-height-request"
+	CmdBlockFiltersByHeightResponse = "tbcapi-block-filters-by-height-response"
+
+	CmdBlockFilterHeaderByHashRequest  = "tbcapi-block-filter-header-by-hash-request"
+	CmdBlockFilterHeaderByHashResponse = "tbcapi-block-filter-header-by-hash-response"
+
+	CmdBlockFilterHeadersByHeightRequest  = "tbcapi-block-filter-headers-by-height-request"
+	CmdBlockFilterHeadersByHeightResponse = "tbcapi-block-filter-headers-by-height-response"
+
+	CmdFeeEstimateRequest  = "tbcapi-fee-estimate-request"
+	CmdFeeEstimateResponse = "tbcapi-fee-estimate-response"
+
+	CmdMempoolInfoRequest  = "tbcapi-mempool-info-request"
+	CmdMempoolInfoResponse = "tbcapi-mempool-info-response"
+
+	CmdMempoolTxsRequest  = "tbcapi-mempool-txs-request"
+	CmdMempoolTxsResponse = "tbcapi-mempool-txs-response"
+
+	CmdPeersRequest  = "tbcapi-peers-request"
+	CmdPeersResponse = "tbcapi-peers-response"
+
+	CmdPeerBanRequest  = "tbcapi-peer-ban-request"
+	CmdPeerBanResponse = "tbcapi-peer-ban-response"
+
+	CmdPeerUnbanRequest  = "tbcapi-peer-unban-request"
+	CmdPeerUnbanResponse = "tbcapi-peer-unban-response"
+
+	CmdSubscribeRequest  = "tbcapi-subscribe-request"
+	CmdSubscribeResponse = "tbcapi-subscribe-response"
+
+	CmdUnsubscribeRequest  = "tbcapi-unsubscribe-request"
+	CmdUnsubscribeResponse = "tbcapi-unsubscribe-response"
+
+	CmdBlockNotification      = "tbcapi-block-notification"
+	CmdReorgNotification      = "tbcapi-reorg-notification"
+	CmdScriptHashNotification = "tbcapi-script-hash-notification"
+)
+
+// Notification topics, see [SubscribeRequest].
+const (
+	TopicBlocks = "blocks" // [BlockNotification]
+	TopicReorgs = "reorgs" // [ReorgNotification]
 )
 
 var (
@@ -233,6 +291,45 @@ type UTXOsByAddressResponse struct {
 	Error *protocol.Error `json:"error,omitempty"`
 }
 
+// TxHistory is a transaction that created or spent an output of an address or
+// script hash.
+type TxHistory struct {
+	TxId   chainhash.Hash `json:"tx_id"`
+	Height uint64         `json:"height"`
+}
+
+// TxsByAddressRequest requests up to count [TxHistory] for an address, ordered
+// by height. Cursor must be empty for the first page and set to the
+// NextCursor of the previous response to retrieve the following pages.
+type TxsByAddressRequest struct {
+	Address string        `json:"address"`
+	Cursor  api.ByteSlice `json:"cursor,omitempty"`
+	Count   uint          `json:"count"`
+}
+
+// TxsByAddressResponse is the response for [TxsByAddressRequest]. NextCursor
+// is omitted when there are no more transactions.
+type TxsByAddressResponse struct {
+	Txs        []*TxHistory    `json:"txs"`
+	NextCursor api.ByteSlice   `json:"next_cursor,omitempty"`
+	Error      *protocol.Error `json:"error,omitempty"`
+}
+
+// TxsByScriptHashRequest requests up to count [TxHistory] for a script hash,
+// which is the sha256 of the output script. See [TxsByAddressRequest].
+type TxsByScriptHashRequest struct {
+	ScriptHash api.ByteSlice `json:"script_hash"`
+	Cursor     api.ByteSlice `json:"cursor,omitempty"`
+	Count      uint          `json:"count"`
+}
+
+// TxsByScriptHashResponse is the response for [TxsByScriptHashRequest].
+type TxsByScriptHashResponse struct {
+	Txs        []*TxHistory    `json:"txs"`
+	NextCursor api.ByteSlice   `json:"next_cursor,omitempty"`
+	Error      *protocol.Error `json:"error,omitempty"`
+}
+
 type TxByIdRawRequest struct {
 	TxID *chainhash.Hash `json:"tx_id"`
 }
@@ -251,6 +348,39 @@ type TxByIdResponse struct {
 	Error *protocol.Error `json:"error,omitempty"`
 }
 
+// TxMerkleProofRequest requests the merkle inclusion proof of a confirmed tx.
+type TxMerkleProofRequest struct {
+	TxID *chainhash.Hash `json:"tx_id"`
+}
+
+// TxMerkleProofResponse is the response for [TxMerkleProofRequest]. The
+// merkle hashes are ordered from the leaf up and, together with the tx index,
+// prove that the tx is committed to by the merkle root of the block header.
+// See bitcoin.CheckMerkleChain.
+type TxMerkleProofResponse struct {
+	BlockHash    *chainhash.Hash  `json:"block_hash"`
+	BlockHeight  uint64           `json:"block_height"`
+	TxIndex      uint32           `json:"tx_index"`
+	MerkleHashes []chainhash.Hash `json:"merkle_hashes"`
+	Error        *protocol.Error  `json:"error,omitempty"`
+}
+
+// OutpointSpentByRequest requests the tx that spends an outpoint.
+type OutpointSpentByRequest struct {
+	OutPoint *OutPoint `json:"outpoint"`
+}
+
+// OutpointSpentByResponse is the response for [OutpointSpentByRequest]. When
+// the spending tx is in the mempool Mempool is set and BlockHash is omitted.
+type OutpointSpentByResponse struct {
+	TxId        *chainhash.Hash `json:"tx_id"`
+	InputIndex  uint32          `json:"input_index"`
+	BlockHash   *chainhash.Hash `json:"block_hash,omitempty"`
+	BlockHeight uint64          `json:"block_height"`
+	Mempool     bool            `json:"mempool"`
+	Error       *protocol.Error `json:"error,omitempty"`
+}
+
 type TxBroadcastRequest struct {
 	Tx    *wire.MsgTx `json:"tx"`
 	Force bool        `json:"force"`
@@ -314,43 +444,306 @@ type BlockDownloadAsyncRawResponse struct {
 	Error *protocol.Error `json:"error,omitempty"`
 }
 
+// BlockFilter represents a BIP158 basic block filter.
+type BlockFilter struct {
+	BlockHash chainhash.Hash `json:"block_hash"`
+	Height    uint64         `json:"height"`
+	Header    chainhash.Hash `json:"header"`
+	Filter    api.ByteSlice  `json:"filter"`
+}
+
+// BlockFilterHeader represents a BIP157 block filter header.
+type BlockFilterHeader struct {
+	BlockHash chainhash.Hash `json:"block_hash"`
+	Height    uint64         `json:"height"`
+	Header    chainhash.Hash `json:"header"`
+}
+
+// BlockFilterByHashRequest requests a [BlockFilter] by block hash.
+type BlockFilterByHashRequest struct {
+	Hash *chainhash.Hash `json:"hash"`
+}
+
+// BlockFilterByHashResponse is the response for [BlockFilterByHashRequest].
+type BlockFilterByHashResponse struct {
+	BlockFilter *BlockFilter    `json:"block_filter"`
+	Error       *protocol.Error `json:"error,omitempty"`
+}
+
+// BlockFiltersByHeightRequest requests up to count [BlockFilter] starting at
+// height.
+type BlockFiltersByHeightRequest struct {
+	Height uint64 `json:"height"`
+	Count  uint   `json:"count"`
+}
+
+// BlockFiltersByHeightResponse is the response for
+// [BlockFiltersByHeightRequest].
+type BlockFiltersByHeightResponse struct {
+	BlockFilters []*BlockFilter  `json:"block_filters"`
+	Error        *protocol.Error `json:"error,omitempty"`
+}
+
+// BlockFilterHeaderByHashRequest requests a [BlockFilterHeader] by block hash.
+type BlockFilterHeaderByHashRequest struct {
+	Hash *chainhash.Hash `json:"hash"`
+}
+
+// BlockFilterHeaderByHashResponse is the response for
+// [BlockFilterHeaderByHashRequest].
+type BlockFilterHeaderByHashResponse struct {
+	BlockFilterHeader *BlockFilterHeader `json:"block_filter_header"`
+	Error             *protocol.Error    `json:"error,omitempty"`
+}
+
+// BlockFilterHeadersByHeightRequest requests up to count [BlockFilterHeader]
+// starting at height.
+type BlockFilterHeadersByHeightRequest struct {
+	Height uint64 `json:"height"`
+	Count  uint   `json:"count"`
+}
+
+// BlockFilterHeadersByHeightResponse is the response for
+// [BlockFilterHeadersByHeightRequest].
+type BlockFilterHeadersByHeightResponse struct {
+	BlockFilterHeaders []*BlockFilterHeader `json:"block_filter_headers"`
+	Error              *protocol.Error      `json:"error,omitempty"`
+}
+
+// FeeEstimate is the recommended fee rate, in sat/vB, to be included within
+// the number of blocks.
+type FeeEstimate struct {
+	Blocks       uint    `json:"blocks"`
+	SatsPerVByte float64 `json:"sats_per_vbyte"`
+}
+
+// FeeEstimateRequest requests fee estimates based on the mempool.
+type FeeEstimateRequest struct{}
+
+// FeeEstimateResponse is the response for [FeeEstimateRequest]. Estimates are
+// ordered by ascending number of blocks.
+type FeeEstimateResponse struct {
+	FeeEstimates []*FeeEstimate  `json:"fee_estimates"`
+	Error        *protocol.Error `json:"error,omitempty"`
+}
+
+// FeeRateBucket is the total virtual size of the mempool transactions with a
+// fee rate of at least SatsPerVByte and below the next bucket.
+type FeeRateBucket struct {
+	SatsPerVByte float64 `json:"sats_per_vbyte"`
+	VSize        int64   `json:"vsize"`
+}
+
+// MempoolInfoRequest requests the mempool statistics.
+type MempoolInfoRequest struct{}
+
+// MempoolInfoResponse is the response for [MempoolInfoRequest]. Count is the
+// number of downloaded transactions and Pending the number of announced
+// transactions that have not been downloaded yet.
+type MempoolInfoResponse struct {
+	Count     int              `json:"count"`
+	Pending   int              `json:"pending"`
+	Size      int              `json:"size"`
+	MaxSize   int              `json:"max_size"`
+	Histogram []*FeeRateBucket `json:"histogram"`
+	Error     *protocol.Error  `json:"error,omitempty"`
+}
+
+// MempoolTx is a mempool transaction. Fee and SatsPerVByte are -1 when the
+// fee is unknown.
+type MempoolTx struct {
+	TxId         chainhash.Hash `json:"tx_id"`
+	Size         int            `json:"size"`
+	VSize        int64          `json:"vsize"`
+	Fee          int64          `json:"fee"`
+	SatsPerVByte float64        `json:"sats_per_vbyte"`
+	Time         int64          `json:"time"`
+}
+
+// MempoolTxsRequest requests up to count mempool transactions, starting at
+// start, ordered by descending fee rate.
+type MempoolTxsRequest struct {
+	Start uint `json:"start"`
+	Count uint `json:"count"`
+}
+
+// MempoolTxsResponse is the response for [MempoolTxsRequest].
+type MempoolTxsResponse struct {
+	Txs   []*MempoolTx    `json:"txs"`
+	Error *protocol.Error `json:"error,omitempty"`
+}
+
+// Peer is a bitcoin p2p address book entry. LastSeen and BanUntil are unix
+// times and zero when not set.
+type Peer struct {
+	Address   string `json:"address"`
+	LastSeen  int64  `json:"last_seen"`
+	Successes uint32 `json:"successes"`
+	Failures  uint32 `json:"failures"`
+	Score     uint32 `json:"score"`
+	BanUntil  int64  `json:"ban_until"`
+}
+
+// PeersRequest requests the address book.
+type PeersRequest struct{}
+
+// PeersResponse is the response for [PeersRequest].
+type PeersResponse struct {
+	Peers []*Peer         `json:"peers"`
+	Error *protocol.Error `json:"error,omitempty"`
+}
+
+// PeerBanRequest bans the host of address for Duration seconds and
+// disconnects it. The default ban duration is used when Duration is 0.
+type PeerBanRequest struct {
+	Address  string `json:"address"`
+	Duration uint   `json:"duration"`
+}
+
+// PeerBanResponse is the response for [PeerBanRequest].
+type PeerBanResponse struct {
+	Error *protocol.Error `json:"error,omitempty"`
+}
+
+// PeerUnbanRequest lifts the ban of the host of address.
+type PeerUnbanRequest struct {
+	Address string `json:"address"`
+}
+
+// PeerUnbanResponse is the response for [PeerUnbanRequest].
+type PeerUnbanResponse struct {
+	Error *protocol.Error `json:"error,omitempty"`
+}
+
+// SubscribeRequest subscribes the connection to notifications for the provided
+// topics and to a [ScriptHashNotification] for every tx that touches one of
+// the provided script hashes.
+type SubscribeRequest struct {
+	Topics       []string        `json:"topics,omitempty"`
+	ScriptHashes []api.ByteSlice `json:"script_hashes,omitempty"`
+}
+
+// SubscribeResponse is the response for [SubscribeRequest].
+type SubscribeResponse struct {
+	Error *protocol.Error `json:"error,omitempty"`
+}
+
+// UnsubscribeRequest removes the provided topics and script hashes from the
+// connection subscriptions.
+type UnsubscribeRequest struct {
+	Topics       []string        `json:"topics,omitempty"`
+	ScriptHashes []api.ByteSlice `json:"script_hashes,omitempty"`
+}
+
+// UnsubscribeResponse is the response for [UnsubscribeRequest].
+type UnsubscribeResponse struct {
+	Error *protocol.Error `json:"error,omitempty"`
+}
+
+// HashHeight identifies a block by its hash and height.
+type HashHeight struct {
+	Hash   chainhash.Hash `json:"hash"`
+	Height uint64         `json:"height"`
+}
+
+// BlockNotification is sent when the canonical tip changes.
+type BlockNotification struct {
+	Hash        chainhash.Hash `json:"hash"`
+	Height      uint64         `json:"height"`
+	BlockHeader *BlockHeader   `json:"block_header"`
+}
+
+// ReorgNotification is sent when the canonical chain switches to a fork. It is
+// followed by a [BlockNotification] for the new tip.
+type ReorgNotification struct {
+	OldTip    HashHeight `json:"old_tip"`
+	NewTip    HashHeight `json:"new_tip"`
+	ForkPoint HashHeight `json:"fork_point"`
+}
+
+// ScriptHashNotification is sent when a tx that touches a subscribed script
+// hash enters the mempool, is indexed in a block or is unwound with its block.
+// Height is 0 for mempool txs.
+type ScriptHashNotification struct {
+	ScriptHash api.ByteSlice  `json:"script_hash"`
+	TxId       chainhash.Hash `json:"tx_id"`
+	Height     uint64         `json:"height"`
+	Mempool    bool           `json:"mempool"`
+	Unwound    bool           `json:"unwound"`
+}
+
 var commands = map[protocol.Command]reflect.Type{
-	CmdPingRequest:                     reflect.TypeOf(PingRequest{}),
-	CmdPingResponse:                    reflect.TypeOf(PingResponse{}),
-	CmdBlockByHashRequest:              reflect.TypeOf(BlockByHashRequest{}),
-	CmdBlockByHashResponse:             reflect.TypeOf(BlockByHashResponse{}),
-	CmdBlockByHashRawRequest:           reflect.TypeOf(BlockByHashRawRequest{}),
-	CmdBlockByHashRawResponse:          reflect.TypeOf(BlockByHashRawResponse{}),
-	CmdBlockHeadersByHeightRawRequest:  reflect.TypeOf(BlockHeadersByHeightRawRequest{}),
-	CmdBlockHeadersByHeightRawResponse: reflect.TypeOf(BlockHeadersByHeightRawResponse{}),
-	CmdBlockHeadersByHeightRequest:     reflect.TypeOf(BlockHeadersByHeightRequest{}),
-	CmdBlockHeadersByHeightResponse:    reflect.TypeOf(BlockHeadersByHeightResponse{}),
-	CmdBlockHeaderBestRawRequest:       reflect.TypeOf(BlockHeaderBestRawRequest{}),
-	CmdBlockHeaderBestRawResponse:      reflect.TypeOf(BlockHeaderBestRawResponse{}),
-	CmdBlockHeaderBestRequest:          reflect.TypeOf(BlockHeaderBestRequest{}),
-	CmdBlockHeaderBestResponse:         reflect.TypeOf(BlockHeaderBestResponse{}),
-	CmdBalanceByAddressRequest:         reflect.TypeOf(BalanceByAddressRequest{}),
-	CmdBalanceByAddressResponse:        reflect.TypeOf(BalanceByAddressResponse{}),
-	CmdUTXOsByAddressRawRequest:        reflect.TypeOf(UTXOsByAddressRawRequest{}),
-	CmdUTXOsByAddressRawResponse:       reflect.TypeOf(UTXOsByAddressRawResponse{}),
-	CmdUTXOsByAddressRequest:           reflect.TypeOf(UTXOsByAddressRequest{}),
-	CmdUTXOsByAddressResponse:          reflect.TypeOf(UTXOsByAddressResponse{}),
-	CmdTxByIdRawRequest:                reflect.TypeOf(TxByIdRawRequest{}),
-	CmdTxByIdRawResponse:               reflect.TypeOf(TxByIdRawResponse{}),
-	CmdTxByIdRequest:                   reflect.TypeOf(TxByIdRequest{}),
-	CmdTxByIdResponse:                  reflect.TypeOf(TxByIdResponse{}),
-	CmdTxBroadcastRequest:              reflect.TypeOf(TxBroadcastRequest{}),
-	CmdTxBroadcastResponse:             reflect.TypeOf(TxBroadcastResponse{}),
-	CmdTxBroadcastRawRequest:           reflect.TypeOf(TxBroadcastRawRequest{}),
-	CmdTxBroadcastRawResponse:          reflect.TypeOf(TxBroadcastRawResponse{}),
-	CmdBlockInsertRequest:              reflect.TypeOf(BlockInsertRequest{}),
-	CmdBlockInsertResponse:             reflect.TypeOf(BlockInsertResponse{}),
-	CmdBlockInsertRawRequest:           reflect.TypeOf(BlockInsertRawRequest{}),
-	CmdBlockInsertRawResponse:          reflect.TypeOf(BlockInsertRawResponse{}),
-	CmdBlockDownloadAsyncRequest:       reflect.TypeOf(BlockDownloadAsyncRequest{}),
-	CmdBlockDownloadAsyncResponse:      reflect.TypeOf(BlockDownloadAsyncResponse{}),
-	CmdBlockDownloadAsyncRawRequest:    reflect.TypeOf(BlockDownloadAsyncRawRequest{}),
-	CmdBlockDownloadAsyncRawResponse:   reflect.TypeOf(BlockDownloadAsyncRawResponse{}),
+	CmdPingRequest:                        reflect.TypeOf(PingRequest{}),
+	CmdPingResponse:                       reflect.TypeOf(PingResponse{}),
+	CmdBlockByHashRequest:                 reflect.TypeOf(BlockByHashRequest{}),
+	CmdBlockByHashResponse:                reflect.TypeOf(BlockByHashResponse{}),
+	CmdBlockByHashRawRequest:              reflect.TypeOf(BlockByHashRawRequest{}),
+	CmdBlockByHashRawResponse:             reflect.TypeOf(BlockByHashRawResponse{}),
+	CmdBlockHeadersByHeightRawRequest:     reflect.TypeOf(BlockHeadersByHeightRawRequest{}),
+	CmdBlockHeadersByHeightRawResponse:    reflect.TypeOf(BlockHeadersByHeightRawResponse{}),
+	CmdBlockHeadersByHeightRequest:        reflect.TypeOf(BlockHeadersByHeightRequest{}),
+	CmdBlockHeadersByHeightResponse:       reflect.TypeOf(BlockHeadersByHeightResponse{}),
+	CmdBlockHeaderBestRawRequest:          reflect.TypeOf(BlockHeaderBestRawRequest{}),
+	CmdBlockHeaderBestRawResponse:         reflect.TypeOf(BlockHeaderBestRawResponse{}),
+	CmdBlockHeaderBestRequest:             reflect.TypeOf(BlockHeaderBestRequest{}),
+	CmdBlockHeaderBestResponse:            reflect.TypeOf(BlockHeaderBestResponse{}),
+	CmdBalanceByAddressRequest:            reflect.TypeOf(BalanceByAddressRequest{}),
+	CmdBalanceByAddressResponse:           reflect.TypeOf(BalanceByAddressResponse{}),
+	CmdUTXOsByAddressRawRequest:           reflect.TypeOf(UTXOsByAddressRawRequest{}),
+	CmdUTXOsByAddressRawResponse:          reflect.TypeOf(UTXOsByAddressRawResponse{}),
+	CmdUTXOsByAddressRequest:              reflect.TypeOf(UTXOsByAddressRequest{}),
+	CmdUTXOsByAddressResponse:             reflect.TypeOf(UTXOsByAddressResponse{}),
+	CmdTxsByAddressRequest:                reflect.TypeOf(TxsByAddressRequest{}),
+	CmdTxsByAddressResponse:               reflect.TypeOf(TxsByAddressResponse{}),
+	CmdTxsByScriptHashRequest:             reflect.TypeOf(TxsByScriptHashRequest{}),
+	CmdTxsByScriptHashResponse:            reflect.TypeOf(TxsByScriptHashResponse{}),
+	CmdTxByIdRawRequest:                   reflect.TypeOf(TxByIdRawRequest{}),
+	CmdTxByIdRawResponse:                  reflect.TypeOf(TxByIdRawResponse{}),
+	CmdTxByIdRequest:                      reflect.TypeOf(TxByIdRequest{}),
+	CmdTxByIdResponse:                     reflect.TypeOf(TxByIdResponse{}),
+	CmdTxMerkleProofRequest:               reflect.TypeOf(TxMerkleProofRequest{}),
+	CmdTxMerkleProofResponse:              reflect.TypeOf(TxMerkleProofResponse{}),
+	CmdOutpointSpentByRequest:             reflect.TypeOf(OutpointSpentByRequest{}),
+	CmdOutpointSpentByResponse:            reflect.TypeOf(OutpointSpentByResponse{}),
+	CmdTxBroadcastRequest:                 reflect.TypeOf(TxBroadcastRequest{}),
+	CmdTxBroadcastResponse:                reflect.TypeOf(TxBroadcastResponse{}),
+	CmdTxBroadcastRawRequest:              reflect.TypeOf(TxBroadcastRawRequest{}),
+	CmdTxBroadcastRawResponse:             reflect.TypeOf(TxBroadcastRawResponse{}),
+	CmdBlockInsertRequest:                 reflect.TypeOf(BlockInsertRequest{}),
+	CmdBlockInsertResponse:                reflect.TypeOf(BlockInsertResponse{}),
+	CmdBlockInsertRawRequest:              reflect.TypeOf(BlockInsertRawRequest{}),
+	CmdBlockInsertRawResponse:             reflect.TypeOf(BlockInsertRawResponse{}),
+	CmdBlockDownloadAsyncRequest:          reflect.TypeOf(BlockDownloadAsyncRequest{}),
+	CmdBlockDownloadAsyncResponse:         reflect.TypeOf(BlockDownloadAsyncResponse{}),
+	CmdBlockDownloadAsyncRawRequest:       reflect.TypeOf(BlockDownloadAsyncRawRequest{}),
+	CmdBlockDownloadAsyncRawResponse:      reflect.TypeOf(BlockDownloadAsyncRawResponse{}),
+	CmdBlockFilterByHashRequest:           reflect.TypeOf(BlockFilterByHashRequest{}),
+	CmdBlockFilterByHashResponse:          reflect.TypeOf(BlockFilterByHashResponse{}),
+	CmdBlockFiltersByHeightRequest:        reflect.TypeOf(BlockFiltersByHeightRequest{}),
+	CmdBlockFiltersByHeightResponse:       reflect.TypeOf(BlockFiltersByHeightResponse{}),
+	CmdBlockFilterHeaderByHashRequest:     reflect.TypeOf(BlockFilterHeaderByHashRequest{}),
+	CmdBlockFilterHeaderByHashResponse:    reflect.TypeOf(BlockFilterHeaderByHashResponse{}),
+	CmdBlockFilterHeadersByHeightRequest:  reflect.TypeOf(BlockFilterHeadersByHeightRequest{}),
+	CmdBlockFilterHeadersByHeightResponse: reflect.TypeOf(BlockFilterHeadersByHeightResponse{}),
+	CmdFeeEstimateRequest:                 reflect.TypeOf(FeeEstimateRequest{}),
+	CmdFeeEstimateResponse:                reflect.TypeOf(FeeEstimateResponse{}),
+	CmdMempoolInfoRequest:                 reflect.TypeOf(MempoolInfoRequest{}),
+	CmdMempoolInfoResponse:                reflect.TypeOf(MempoolInfoResponse{}),
+	CmdMempoolTxsRequest:                  reflect.TypeOf(MempoolTxsRequest{}),
+	CmdMempoolTxsResponse:                 reflect.TypeOf(MempoolTxsResponse{}),
+	CmdPeersRequest:                       reflect.TypeOf(PeersRequest{}),
+	CmdPeersResponse:                      reflect.TypeOf(PeersResponse{}),
+	CmdPeerBanRequest:                     reflect.TypeOf(PeerBanRequest{}),
+	CmdPeerBanResponse:                    reflect.TypeOf(PeerBanResponse{}),
+	CmdPeerUnbanRequest:                   reflect.TypeOf(PeerUnbanRequest{}),
+	CmdPeerUnbanResponse:                  reflect.TypeOf(PeerUnbanResponse{}),
+	CmdSubscribeRequest:                   reflect.TypeOf(SubscribeRequest{}),
+	CmdSubscribeResponse:                  reflect.TypeOf(SubscribeResponse{}),
+	CmdUnsubscribeRequest:                 reflect.TypeOf(UnsubscribeRequest{}),
+	CmdUnsubscribeResponse:                reflect.TypeOf(UnsubscribeResponse{}),
+	CmdBlockNotification:                  reflect.TypeOf(BlockNotification{}),
+	CmdReorgNotification:                  reflect.TypeOf(ReorgNotification{}),
+	CmdScriptHashNotification:             reflect.TypeOf(ScriptHashNotification{}),
 }
 
 type tbcAPI struct{}
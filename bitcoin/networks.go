@@ -0,0 +1,103 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package bitcoin
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// TestNet4 is the testnet4 (BIP94) network magic, it is not provided by wire.
+const TestNet4 wire.BitcoinNet = 0x283f161c
+
+// testNet4GenesisBlock is the first block of testnet4.
+var testNet4GenesisBlock = func() *wire.MsgBlock {
+	msg := []byte("03/May/2024 000000000000000000001ebd58c244970b3aa9d783bb001011fbe8ea8e98e00e")
+	sigScript := append([]byte{
+		0x04, 0xff, 0xff, 0x00, 0x1d, // push 486604799
+		0x01, 0x04, // push 4
+		0x4c, byte(len(msg)), // OP_PUSHDATA1
+	}, msg...)
+	pkScript := append([]byte{0x21}, make([]byte, 33)...) // push 33 zeroes
+	pkScript = append(pkScript, 0xac)                     // OP_CHECKSIG
+
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  sigScript,
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	tx.AddTxOut(wire.NewTxOut(50*1e8, pkScript))
+
+	return &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:    1,
+			MerkleRoot: tx.TxHash(),
+			Timestamp:  time.Unix(1714777860, 0),
+			Bits:       0x1d00ffff,
+			Nonce:      393743547,
+		},
+		Transactions: []*wire.MsgTx{tx},
+	}
+}()
+
+var testNet4GenesisHash = testNet4GenesisBlock.BlockHash()
+
+// TestNet4Params are the testnet4 chain parameters. Addresses are encoded
+// the same as on testnet3.
+var TestNet4Params = func() chaincfg.Params {
+	params := chaincfg.TestNet3Params
+	params.Name = "testnet4"
+	params.Net = TestNet4
+	params.DefaultPort = "48333"
+	params.DNSSeeds = []chaincfg.DNSSeed{
+		{Host: "seed.testnet4.bitcoin.sprovoost.nl", HasFiltering: true},
+		{Host: "seed.testnet4.wiz.biz", HasFiltering: true},
+	}
+	params.GenesisBlock = testNet4GenesisBlock
+	params.GenesisHash = &testNet4GenesisHash
+	params.BIP0034Height = 1
+	params.BIP0065Height = 1
+	params.BIP0066Height = 1
+	params.Checkpoints = nil
+	return params
+}()
+
+// NetworkParams returns the chain parameters of the named bitcoin network.
+// The optional hex encoded signet challenge selects a custom signet, the
+// default signet is used when it is empty.
+func NetworkParams(network, signetChallenge string) (*chaincfg.Params, error) {
+	network = strings.ToLower(network)
+	if signetChallenge != "" && network != "signet" {
+		return nil, fmt.Errorf("signet challenge on network %v", network)
+	}
+	switch network {
+	case "mainnet":
+		return &chaincfg.MainNetParams, nil
+	case "testnet", "testnet3":
+		return &chaincfg.TestNet3Params, nil
+	case "testnet4":
+		return &TestNet4Params, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	case "signet":
+		if signetChallenge == "" {
+			return &chaincfg.SigNetParams, nil
+		}
+		challenge, err := hex.DecodeString(signetChallenge)
+		if err != nil {
+			return nil, fmt.Errorf("signet challenge: %w", err)
+		}
+		params := chaincfg.CustomSignetParams(challenge, nil)
+		return &params, nil
+	default:
+		return nil, fmt.Errorf("invalid network: %v", network)
+	}
+}
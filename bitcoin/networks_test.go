@@ -0,0 +1,83 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package bitcoin
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// defaultSignetChallenge is the challenge of the default signet.
+const defaultSignetChallenge = "512103ad5e0edad18cb1f0fc0d28a3d4f1f3e445640337489abb10404f2d1e086be430210359ef5021964fe22d6f8e05b2463c9540ce96883fe3b278760f048f5189f2e6c452ae"
+
+func TestTestNet4Genesis(t *testing.T) {
+	const (
+		hash   = "00000000da84f2bafbbc53dee25a72ae507ff4914b867c565be350b0da8bf043"
+		merkle = "7aa0a7ae1e223414cb807e40cd57e667b718e42aaf9306db9102fe28912b7b4e"
+	)
+	if got := TestNet4Params.GenesisHash.String(); got != hash {
+		t.Fatalf("genesis hash %v, want %v", got, hash)
+	}
+	if got := TestNet4Params.GenesisBlock.BlockHash().String(); got != hash {
+		t.Fatalf("genesis block hash %v, want %v", got, hash)
+	}
+	if got := TestNet4Params.GenesisBlock.Header.MerkleRoot.String(); got != merkle {
+		t.Fatalf("genesis merkle root %v, want %v", got, merkle)
+	}
+}
+
+func TestNetworkParams(t *testing.T) {
+	tests := []struct {
+		network   string
+		challenge string
+		net       wire.BitcoinNet
+		port      string
+		custom    bool // net differs from the default signet
+		wantErr   bool
+	}{
+		{network: "mainnet", net: wire.MainNet, port: "8333"},
+		{network: "testnet", net: wire.TestNet3, port: "18333"},
+		{network: "testnet3", net: wire.TestNet3, port: "18333"},
+		{network: "testnet4", net: TestNet4, port: "48333"},
+		{network: "regtest", net: wire.TestNet, port: "18444"},
+		{network: "signet", net: chaincfg.SigNetParams.Net, port: "38333"},
+		{
+			network:   "signet",
+			challenge: defaultSignetChallenge,
+			net:       chaincfg.SigNetParams.Net,
+			port:      "38333",
+		},
+		{network: "signet", challenge: "51", custom: true, port: "38333"},
+		{network: "signet", challenge: "zz", wantErr: true},
+		{network: "mainnet", challenge: "51", wantErr: true},
+		{network: "testnet2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network+tt.challenge, func(t *testing.T) {
+			params, err := NetworkParams(tt.network, tt.challenge)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.custom {
+				if params.Net == chaincfg.SigNetParams.Net {
+					t.Fatalf("custom signet uses default magic")
+				}
+			} else if params.Net != tt.net {
+				t.Fatalf("net %v, want %v", params.Net, tt.net)
+			}
+			if params.DefaultPort != tt.port {
+				t.Fatalf("port %v, want %v", params.DefaultPort, tt.port)
+			}
+		})
+	}
+}
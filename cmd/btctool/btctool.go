@@ -20,7 +20,6 @@ import (
 	"time"
 
 	"github.com/btcsuite/btcd/btcutil"
-	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
@@ -28,6 +27,7 @@ import (
 	"github.com/juju/loggo"
 	"github.com/mitchellh/go-homedir"
 
+	"github.com/hemilabs/heminetwork/bitcoin"
 	"github.com/hemilabs/heminetwork/cmd/btctool/bdf"
 	"github.com/hemilabs/heminetwork/cmd/btctool/blockstream"
 	"github.com/hemilabs/heminetwork/cmd/btctool/btctool"
@@ -252,27 +252,13 @@ func btcConnect(ctx context.Context, btcNet string) error {
 	//	return err
 	// }
 
-	mainnetPort := "8333"
-	testnetPort := "18333"
-	var (
-		port        string
-		wireNet     wire.BitcoinNet
-		chainParams *chaincfg.Params
-	)
-	switch btcNet {
-	case "mainnet":
-		port = mainnetPort
-		wireNet = wire.MainNet
-		chainParams = &chaincfg.MainNetParams
-	case "testnet", "testnet3":
-		port = testnetPort
-		wireNet = wire.TestNet3
-		chainParams = &chaincfg.TestNet3Params
-	default:
-		return fmt.Errorf("invalid network: %v", btcNet)
+	chainParams, err := bitcoin.NetworkParams(btcNet, "")
+	if err != nil {
+		return err
 	}
 
-	p, err := NewPeer(wireNet, "140.238.169.133"+port)
+	p, err := NewPeer(chainParams.Net,
+		net.JoinHostPort("140.238.169.133", chainParams.DefaultPort))
 	if err != nil {
 		return fmt.Errorf("new peer: %w", err)
 	}
@@ -483,8 +469,20 @@ func parseArgs(args []string) (string, map[string]string, error) {
 	return action, parsed, nil
 }
 
-func addressToScript(addr string) (btcutil.Address, error) {
-	return btcutil.DecodeAddress(addr, &chaincfg.TestNet3Params)
+func addressToScript(addr, btcNet string) (btcutil.Address, error) {
+	chainParams, err := bitcoin.NetworkParams(btcNet, "")
+	if err != nil {
+		return nil, err
+	}
+	return btcutil.DecodeAddress(addr, chainParams)
+}
+
+// network returns the bitcoin network argument, testnet3 when omitted.
+func network(args map[string]string) string {
+	if n := args["net"]; n != "" {
+		return n
+	}
+	return "testnet3"
 }
 
 func init() {
@@ -498,9 +496,12 @@ func _main() error {
 		fmt.Fprintf(f, "Flags:\n")
 		flag.PrintDefaults()
 		fmt.Fprintf(f, "Actions:\n")
+		fmt.Fprintf(f, "  net is mainnet, testnet3 (default), testnet4, signet or regtest\n")
 		fmt.Fprintf(f, "  block <hash=hash> [json=bool] [wire=bool] - retrieve block for hash\n")
 		fmt.Fprintf(f, "  blockheader <hash=string>                 - retrieve blockheader for hash\n")
 		fmt.Fprintf(f, "  blockheighthash <heigh=int>               - block hash at height\n")
+		fmt.Fprintf(f, "  p2p [net=string]                          - connect to a bitcoin p2p node\n")
+		fmt.Fprintf(f, "  standardscript <address=string> [net=string] - print the script of an address\n")
 		fmt.Fprintf(f, "  storeblockheaders [start=int] [count=int] - store block headers\n")
 		fmt.Fprintf(f, "  tip                                       - retrieve tip height\n")
 	}
@@ -533,7 +534,7 @@ func _main() error {
 		if address == "" {
 			return errors.New("address: must be set")
 		}
-		a, err := addressToScript(address)
+		a, err := addressToScript(address, network(args))
 		if err != nil {
 			return err
 		}
@@ -613,7 +614,7 @@ func _main() error {
 		}
 
 	case "p2p":
-		err = btcConnect(ctx, "testnet3")
+		err = btcConnect(ctx, network(args))
 
 	case "parseblock":
 		filename := args["filename"]
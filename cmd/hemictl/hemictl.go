@@ -8,11 +8,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -30,6 +32,7 @@ import (
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/davecgh/go-spew/spew"
+	"github.com/dustin/go-humanize"
 	"github.com/juju/loggo"
 	"github.com/mitchellh/go-homedir"
 	"github.com/syndtr/goleveldb/leveldb/util"
@@ -38,6 +41,7 @@ import (
 	"github.com/hemilabs/heminetwork/api/bssapi"
 	"github.com/hemilabs/heminetwork/api/protocol"
 	"github.com/hemilabs/heminetwork/api/tbcapi"
+	"github.com/hemilabs/heminetwork/bitcoin"
 	"github.com/hemilabs/heminetwork/config"
 	"github.com/hemilabs/heminetwork/database/bfgd/postgres"
 	ldb "github.com/hemilabs/heminetwork/database/level"
@@ -204,6 +208,7 @@ func tbcdb() error {
 	cfg := tbc.NewDefaultConfig()
 	cfg.LevelDBHome = "~/.tbcd"
 	cfg.Network = "testnet3"
+	cfg.BlockCompression = args["compression"] // used by blockfilecompact
 	s, err := tbc.NewServer(cfg)
 	if err != nil {
 		return fmt.Errorf("new server: %w", err)
@@ -280,6 +285,42 @@ func tbcdb() error {
 
 	// case "blockinsert":
 
+	case "blockfiles":
+		bfs, err := s.BlockFiles(ctx)
+		if err != nil {
+			return fmt.Errorf("block files: %w", err)
+		}
+		var size, pruned, prunedFiles uint64
+		for _, bf := range bfs {
+			state := ""
+			if bf.Pruned {
+				state = " pruned"
+				prunedFiles++
+				pruned += uint64(bf.Size)
+			} else {
+				size += uint64(bf.Size)
+			}
+			fmt.Printf("%v: height %v size %v%v\n", bf.Number, bf.Height,
+				humanize.IBytes(uint64(bf.Size)), state)
+		}
+		fmt.Printf("files : %v pruned: %v\n", len(bfs), prunedFiles)
+		fmt.Printf("stored: %v pruned: %v\n", humanize.IBytes(size),
+			humanize.IBytes(pruned))
+
+	case "blockfilecompact":
+		// Require the compression, an unset compression would silently
+		// decompress the file.
+		if args["compression"] == "" {
+			return errors.New("compression: must be set")
+		}
+		number, err := strconv.ParseUint(args["number"], 10, 32)
+		if err != nil {
+			return fmt.Errorf("number: %w", err)
+		}
+		if err := s.BlockFileCompact(ctx, uint32(number)); err != nil {
+			return fmt.Errorf("block file compact: %w", err)
+		}
+
 	case "blockbyhash":
 		hash := args["hash"]
 		if hash == "" {
@@ -359,6 +400,93 @@ func tbcdb() error {
 			fmt.Printf("outputs key %vvalue %v", spew.Sdump(it.Key()), spew.Sdump(it.Value()))
 		}
 
+	case "peers":
+		s.DBClose()
+
+		levelDBHome := "~/.tbcd" // XXX
+		network := "testnet3"
+		db, err := level.New(ctx, level.NewConfig(filepath.Join(levelDBHome, network)))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		peers, err := db.Peers(ctx)
+		if err != nil {
+			return fmt.Errorf("peers: %w", err)
+		}
+		now := time.Now()
+		for _, p := range peers {
+			banned := ""
+			if p.Banned(now) {
+				banned = fmt.Sprintf(" banned until %v",
+					p.BanUntil.Format(time.RFC3339))
+			}
+			lastSeen := "never"
+			if !p.LastSeen.IsZero() {
+				lastSeen = p.LastSeen.Format(time.RFC3339)
+			}
+			fmt.Printf("%v: last seen %v successes %v failures %v "+
+				"score %v%v\n", p.Address, lastSeen, p.Successes,
+				p.Failures, p.Score, banned)
+		}
+		fmt.Printf("peers: %v\n", len(peers))
+
+	case "peerban", "peerunban":
+		address := args["address"]
+		if address == "" {
+			return errors.New("address: must be set")
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("address: %w", err)
+		}
+		d := 24 * time.Hour
+		if duration := args["duration"]; duration != "" {
+			if d, err = time.ParseDuration(duration); err != nil {
+				return fmt.Errorf("duration: %w", err)
+			}
+		}
+
+		s.DBClose()
+
+		levelDBHome := "~/.tbcd" // XXX
+		network := "testnet3"
+		db, err := level.New(ctx, level.NewConfig(filepath.Join(levelDBHome, network)))
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		peers, err := db.Peers(ctx)
+		if err != nil {
+			return fmt.Errorf("peers: %w", err)
+		}
+		var update []tbcd.Peer
+		switch action {
+		case "peerban":
+			p := tbcd.Peer{Address: address}
+			for k := range peers {
+				if peers[k].Address == address {
+					p = peers[k]
+					break
+				}
+			}
+			p.BanUntil = time.Now().Add(d)
+			update = append(update, p)
+		case "peerunban":
+			// Bans apply to all ports of a host.
+			for _, p := range peers {
+				if h, _, err := net.SplitHostPort(p.Address); err != nil || h != host {
+					continue
+				}
+				p.BanUntil = time.Time{}
+				p.Score = 0
+				update = append(update, p)
+			}
+		}
+		if err := db.PeersInsert(ctx, update); err != nil {
+			return fmt.Errorf("peers insert: %w", err)
+		}
+
 	case "feesbyheight":
 		height := args["height"]
 		if height == "" {
@@ -386,6 +514,9 @@ func tbcdb() error {
 		fmt.Println("tbcd db manipulator commands:")
 		fmt.Println("\tbalancebyscripthash [hash]")
 		fmt.Println("\tblockbyhash [hash]")
+		fmt.Println("\tblockfilecompact [number] [compression]")
+		fmt.Println("\tblockfiles")
+		fmt.Println("\tblockfilterbyhash [hash]")
 		fmt.Println("\tblockheaderbyhash [hash]")
 		fmt.Println("\tblockheaderbest")
 		fmt.Println("\tblockheadersbyheight [height]")
@@ -394,13 +525,26 @@ func tbcdb() error {
 		fmt.Println("\tdeletemetadata")
 		fmt.Println("\tdumpmetadata")
 		fmt.Println("\tdumpoutputs <prefix>")
+		fmt.Println("\tfilterindex <hash> <maxcache>")
 		fmt.Println("\thelp")
+		fmt.Println("\tinvalidblocks")
+		fmt.Println("\toutpointspentby [txid] [index]")
+		fmt.Println("\tpeerban [address] <duration>")
+		fmt.Println("\tpeers")
+		fmt.Println("\tpeerunban [address]")
+		fmt.Println("\trebuildindex <index> <hash>")
+		fmt.Println("\treconsiderblock <hash>")
 		fmt.Println("\tscripthashbyoutpoint [txid] [index]")
 		fmt.Println("\tspentoutputsbytxid <txid>")
 		fmt.Println("\ttxbyid <hash>")
 		fmt.Println("\ttxindex <height> <count> <maxcache>")
+		fmt.Println("\ttxmerkleproof [txid]")
+		fmt.Println("\ttxsbyscripthash [hash] <cursor> <count>")
 		fmt.Println("\tutxoindex <height> <count> <maxcache>")
 		fmt.Println("\tutxosbyscripthash [hash]")
+		fmt.Println("\tutxosnapshotexport [filename] <hash>")
+		fmt.Println("\tutxosnapshotimport [filename] <digest>")
+		fmt.Println("\tverify <samples> <repair>")
 
 	case "utxoindex":
 		hash := args["hash"]
@@ -447,6 +591,44 @@ func tbcdb() error {
 			return fmt.Errorf("indexer: %w", err)
 		}
 
+	case "filterindex":
+		hash := args["hash"]
+		if hash == "" {
+			return errors.New("must provide hash")
+		}
+		eh, err := chainhash.NewHashFromStr(hash)
+		if err != nil {
+			return fmt.Errorf("parse hash: %w", err)
+		}
+
+		maxCache := args["maxcache"]
+		var mc uint64
+		if maxCache != "" {
+			if mc, err = strconv.ParseUint(maxCache, 10, 64); err != nil {
+				return fmt.Errorf("maxCache: %w", err)
+			}
+			cfg.MaxCachedFilters = int(mc)
+		}
+		if err = s.FilterIndexer(ctx, eh); err != nil {
+			return fmt.Errorf("indexer: %w", err)
+		}
+
+	case "blockfilterbyhash":
+		hash := args["hash"]
+		if hash == "" {
+			return errors.New("hash: must be set")
+		}
+		ch, err := chainhash.NewHashFromStr(hash)
+		if err != nil {
+			return fmt.Errorf("chainhash: %w", err)
+		}
+		bf, err := s.BlockFilterByHash(ctx, ch)
+		if err != nil {
+			return fmt.Errorf("block filter by hash: %w", err)
+		}
+		fmt.Printf("header: %v\n", bf.Header)
+		fmt.Printf("filter: %x\n", bf.Filter)
+
 	case "blockhashbytxid":
 		txid := args["txid"]
 		if txid == "" {
@@ -479,6 +661,22 @@ func tbcdb() error {
 		}
 		fmt.Printf("%v\n", spew.Sdump(tx))
 
+	case "txmerkleproof":
+		txid := args["txid"]
+		if txid == "" {
+			return errors.New("txid: must be set")
+		}
+		chtxid, err := chainhash.NewHashFromStr(txid)
+		if err != nil {
+			return fmt.Errorf("chainhash: %w", err)
+		}
+
+		mp, err := s.TxMerkleProof(ctx, chtxid)
+		if err != nil {
+			return fmt.Errorf("tx merkle proof: %w", err)
+		}
+		fmt.Printf("%v\n", spew.Sdump(mp))
+
 	case "spentoutputsbytxid":
 		txid := args["txid"]
 		if txid == "" {
@@ -497,6 +695,27 @@ func tbcdb() error {
 			fmt.Printf("%v\n", si[k])
 		}
 
+	case "outpointspentby":
+		txid := args["txid"]
+		if txid == "" {
+			return errors.New("txid: must be set")
+		}
+		chtxid, err := chainhash.NewHashFromStr(txid)
+		if err != nil {
+			return fmt.Errorf("chainhash: %w", err)
+		}
+		index, err := strconv.ParseUint(args["index"], 10, 32)
+		if err != nil {
+			return fmt.Errorf("index: %w", err)
+		}
+
+		sb, err := s.OutpointSpentBy(ctx, *wire.NewOutPoint(chtxid,
+			uint32(index)))
+		if err != nil {
+			return fmt.Errorf("outpoint spent by: %w", err)
+		}
+		fmt.Printf("%v\n", spew.Sdump(sb))
+
 	case "scripthashbyoutpoint":
 		txid := args["txid"]
 		if txid == "" {
@@ -626,6 +845,198 @@ func tbcdb() error {
 		}
 		fmt.Printf("utxos: %v total: %v\n", len(utxos), balance)
 
+	case "txsbyscripthash":
+		address := args["address"]
+		hash := args["hash"]
+		count := args["count"]
+		cursor := args["cursor"]
+
+		if address == "" && hash == "" {
+			return errors.New("hash or address: must be set")
+		} else if address != "" && hash != "" {
+			return errors.New("hash or address: both set")
+		}
+
+		if count == "" {
+			count = "100"
+		}
+
+		countNum, err := strconv.ParseUint(count, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		var c []byte
+		if cursor != "" {
+			c, err = hex.DecodeString(cursor)
+			if err != nil {
+				return fmt.Errorf("cursor: %w", err)
+			}
+		}
+
+		var sh tbcd.ScriptHash
+		if hash != "" {
+			sh, err = tbcd.NewScriptHashFromString(hash)
+			if err != nil {
+				return err
+			}
+		}
+		if address != "" {
+			// XXX set params
+			a, err := btcutil.DecodeAddress(address, &chaincfg.TestNet3Params)
+			if err != nil {
+				return err
+			}
+			h, err := txscript.PayToAddrScript(a)
+			if err != nil {
+				return err
+			}
+			sh = tbcd.NewScriptHashFromScript(h)
+		}
+
+		txs, next, err := s.TxsByScriptHash(ctx, sh, c, countNum)
+		if err != nil {
+			return fmt.Errorf("txs by script hash: %w", err)
+		}
+		for k := range txs {
+			fmt.Printf("%v @ %v\n", txs[k].TxId, txs[k].Height)
+		}
+		fmt.Printf("txs: %v next cursor: %x\n", len(txs), next)
+
+	case "utxosnapshotexport":
+		filename := args["filename"]
+		if filename == "" {
+			return errors.New("filename: must be set")
+		}
+		var eh *chainhash.Hash
+		if hash := args["hash"]; hash != "" {
+			eh, err = chainhash.NewHashFromStr(hash)
+			if err != nil {
+				return fmt.Errorf("parse hash: %w", err)
+			}
+		}
+		us, err := s.UtxoSnapshotExport(ctx, filename, eh)
+		if err != nil {
+			return fmt.Errorf("utxo snapshot export: %w", err)
+		}
+		fmt.Printf("hash  : %v\n", us.Hash)
+		fmt.Printf("height: %v\n", us.Height)
+		fmt.Printf("utxos : %v\n", us.Count)
+		fmt.Printf("digest: %v\n", us.DigestString())
+
+	case "utxosnapshotimport":
+		filename := args["filename"]
+		if filename == "" {
+			return errors.New("filename: must be set")
+		}
+		us, err := s.UtxoSnapshotImport(ctx, filename, args["digest"])
+		if err != nil {
+			return fmt.Errorf("utxo snapshot import: %w", err)
+		}
+		fmt.Printf("hash  : %v\n", us.Hash)
+		fmt.Printf("height: %v\n", us.Height)
+		fmt.Printf("utxos : %v\n", us.Count)
+		fmt.Printf("digest: %v\n", us.DigestString())
+
+	case "invalidblocks":
+		ibs, err := s.InvalidBlocks(ctx)
+		if err != nil {
+			return fmt.Errorf("invalid blocks: %w", err)
+		}
+		for _, ib := range ibs {
+			fmt.Println(ib)
+		}
+
+	case "reconsiderblock":
+		// Without a hash all invalid blocks are reconsidered.
+		var ch *chainhash.Hash
+		if hash := args["hash"]; hash != "" {
+			ch, err = chainhash.NewHashFromStr(hash)
+			if err != nil {
+				return fmt.Errorf("chainhash: %w", err)
+			}
+		}
+		if err := s.ReconsiderBlock(ctx, ch); err != nil {
+			return fmt.Errorf("reconsider block: %w", err)
+		}
+
+	case "rebuildindex":
+		var utxo, tx bool
+		switch index := args["index"]; index {
+		case "", "all":
+			utxo, tx = true, true
+		case "utxo":
+			utxo = true
+		case "tx":
+			tx = true
+		default:
+			return fmt.Errorf("invalid index: %v", index)
+		}
+		var eh *chainhash.Hash
+		if hash := args["hash"]; hash != "" {
+			eh, err = chainhash.NewHashFromStr(hash)
+			if err != nil {
+				return fmt.Errorf("parse hash: %w", err)
+			}
+		}
+		if err := s.IndexRebuild(ctx, utxo, tx, eh); err != nil {
+			return fmt.Errorf("rebuild index: %w", err)
+		}
+		if utxo {
+			hh, err := s.UtxoIndexHash(ctx)
+			if err != nil {
+				return fmt.Errorf("utxo index hash: %w", err)
+			}
+			fmt.Printf("utxo index: %v\n", hh)
+		}
+		if tx {
+			hh, err := s.TxIndexHash(ctx)
+			if err != nil {
+				return fmt.Errorf("tx index hash: %w", err)
+			}
+			fmt.Printf("tx index  : %v\n", hh)
+		}
+
+	case "verify":
+		samples := 100
+		if v := args["samples"]; v != "" {
+			if samples, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("samples: %w", err)
+			}
+		}
+		var repair bool
+		if v := args["repair"]; v != "" {
+			if repair, err = strconv.ParseBool(v); err != nil {
+				return fmt.Errorf("repair: %w", err)
+			}
+		}
+		r, err := s.DBVerify(ctx, samples)
+		if err != nil {
+			return fmt.Errorf("verify: %w", err)
+		}
+		fmt.Printf("best        : %v\n", r.Best)
+		fmt.Printf("headers     : %v\n", r.Headers)
+		fmt.Printf("absent      : %v\n", len(r.Absent))
+		for _, index := range r.Indexes {
+			fmt.Printf("%-12v: %v consistent %v\n", index.Name+" index",
+				index.HashHeight, index.Consistent.Height)
+		}
+		fmt.Printf("scripthashes: %v\n", r.ScriptHashes)
+		for _, p := range r.Problems {
+			fmt.Printf("problem     : %v\n", p)
+		}
+		if len(r.Problems) == 0 {
+			fmt.Println("database is consistent")
+			break
+		}
+		if !repair {
+			return fmt.Errorf("%v problems found", len(r.Problems))
+		}
+		if err := s.DBRepair(ctx, r); err != nil {
+			return fmt.Errorf("repair: %w", err)
+		}
+		fmt.Println("database repaired")
+
 	default:
 		return fmt.Errorf("invalid action: %v", action)
 	}
@@ -651,7 +1062,7 @@ func p2p() error {
 		fmt.Println("\tping <nonce>                   - ping remote node with a nonce")
 		fmt.Println("\tremote                         - return remote version")
 		fmt.Println("")
-		fmt.Println("All actions support [addr=netaddress] <out=[json|raw|spew]> <net=[mainnet|testnet|testnet3]> <timeout=duration>")
+		fmt.Println("All actions support [addr=netaddress] <out=[json|raw|spew]> <net=[mainnet|testnet|testnet3|testnet4|signet|regtest]> <timeout=duration>")
 		fmt.Println("")
 		fmt.Println("Example: hemictl p2p ping addr=127.0.0.1:18333 nonce=1337 out=json")
 
@@ -677,10 +1088,14 @@ func p2p() error {
 	switch net {
 	case "mainnet":
 		network = wire.MainNet
-	case "testnet":
+	case "testnet", "regtest":
 		network = wire.TestNet
 	case "", "testnet3":
 		network = wire.TestNet3
+	case "testnet4":
+		network = bitcoin.TestNet4
+	case "signet":
+		network = chaincfg.SigNetParams.Net
 	default:
 		return fmt.Errorf("invalid net: %v", net)
 	}
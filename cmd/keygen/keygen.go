@@ -13,9 +13,9 @@ import (
 	"os"
 
 	"github.com/btcsuite/btcd/btcutil"
-	btcchaincfg "github.com/btcsuite/btcd/chaincfg"
 	dcrsecpk256k1 "github.com/decred/dcrd/dcrec/secp256k1/v4"
 
+	"github.com/hemilabs/heminetwork/bitcoin"
 	"github.com/hemilabs/heminetwork/ethereum"
 	"github.com/hemilabs/heminetwork/version"
 )
@@ -30,7 +30,7 @@ var (
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "%v\n", welcome)
-	fmt.Fprintf(os.Stderr, "\t%v [-net mainnet|testnet3] [-json] <-secp256k1>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\t%v [-net mainnet|testnet3|testnet4|signet|regtest] [-json] <-secp256k1>\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
@@ -40,13 +40,8 @@ func init() {
 }
 
 func _main() error {
-	var btcChainParams *btcchaincfg.Params
-	switch *net {
-	case "testnet3", "testnet":
-		btcChainParams = &btcchaincfg.TestNet3Params
-	case "mainnet":
-		btcChainParams = &btcchaincfg.MainNetParams
-	default:
+	btcChainParams, err := bitcoin.NetworkParams(*net, "")
+	if err != nil {
 		return fmt.Errorf("invalid net: %v", *net)
 	}
 
@@ -40,10 +40,16 @@ var (
 			Help:         "address port to listen on",
 			Print:        config.PrintAll,
 		},
+		"TBC_ASSUME_VALID": config.Config{
+			Value:        &cfg.AssumeValid,
+			DefaultValue: "",
+			Help:         "block hash below which scripts are not validated when TBC_FULL_VALIDATION is enabled",
+			Print:        config.PrintAll,
+		},
 		"TBC_AUTO_INDEX": config.Config{
 			Value:        &cfg.AutoIndex,
 			DefaultValue: true,
-			Help:         "enable auto utxo and tx indexes",
+			Help:         "enable auto utxo, tx and filter indexes",
 			Print:        config.PrintAll,
 		},
 		"TBC_BLOCK_CACHE": config.Config{
@@ -52,6 +58,12 @@ var (
 			Help:         "number of cached blocks",
 			Print:        config.PrintAll,
 		},
+		"TBC_BLOCK_COMPRESSION": config.Config{
+			Value:        &cfg.BlockCompression,
+			DefaultValue: "none",
+			Help:         "compression of stored blocks; none, snappy or zstd, existing blocks are read regardless",
+			Print:        config.PrintAll,
+		},
 		"TBC_BLOCKHEADER_CACHE": config.Config{
 			Value:        &cfg.BlockheaderCache,
 			DefaultValue: bhsDefault,
@@ -64,6 +76,54 @@ var (
 			Help:         "enable/disable block sanity checks before inserting",
 			Print:        config.PrintAll,
 		},
+		"TBC_CHECKPOINTS": config.Config{
+			Value:        &cfg.Checkpoints,
+			DefaultValue: []string{},
+			Help:         "list of extra checkpoints in the format '<height>:<hash>', conflicting headers are rejected",
+			Print:        config.PrintAll,
+		},
+		"TBC_ELECTRUM_ADDRESS": config.Config{
+			Value:        &cfg.ElectrumListenAddress,
+			DefaultValue: "",
+			Help:         "address and port tbcd accepts electrum protocol connections on",
+			Print:        config.PrintAll,
+		},
+		"TBC_ELECTRUM_MAX_CONNECTIONS": config.Config{
+			Value:        &cfg.ElectrumMaxConnections,
+			DefaultValue: 128,
+			Help:         "maximum number of concurrent electrum connections",
+			Print:        config.PrintAll,
+		},
+		"TBC_ESPLORA_ADDRESS": config.Config{
+			Value:        &cfg.EsploraListenAddress,
+			DefaultValue: "",
+			Help:         "address and port tbcd serves the esplora http api on",
+			Print:        config.PrintAll,
+		},
+		"TBC_FULL_VALIDATION": config.Config{
+			Value:        &cfg.FullValidation,
+			DefaultValue: false,
+			Help:         "enable/disable input script validation during utxo indexing",
+			Print:        config.PrintAll,
+		},
+		"TBC_JSONRPC_ADDRESS": config.Config{
+			Value:        &cfg.JSONRPCListenAddress,
+			DefaultValue: "",
+			Help:         "address and port tbcd serves the bitcoind compatible json-rpc api on",
+			Print:        config.PrintAll,
+		},
+		"TBC_JSONRPC_PASSWORD": config.Config{
+			Value:        &cfg.JSONRPCPassword,
+			DefaultValue: "",
+			Help:         "json-rpc basic auth password",
+			Print:        config.PrintSecret,
+		},
+		"TBC_JSONRPC_USER": config.Config{
+			Value:        &cfg.JSONRPCUser,
+			DefaultValue: "",
+			Help:         "json-rpc basic auth user",
+			Print:        config.PrintAll,
+		},
 		"TBC_LEVELDB_HOME": config.Config{
 			Value:        &cfg.LevelDBHome,
 			DefaultValue: defaultHome,
@@ -76,6 +136,12 @@ var (
 			Help:         "loglevel for various packages; INFO, DEBUG and TRACE",
 			Print:        config.PrintAll,
 		},
+		"TBC_MAX_CACHED_FILTERS": config.Config{
+			Value:        &cfg.MaxCachedFilters,
+			DefaultValue: int(1e4),
+			Help:         "maximum cached block filters during indexing",
+			Print:        config.PrintAll,
+		},
 		"TBC_MAX_CACHED_TXS": config.Config{
 			Value:        &cfg.MaxCachedTxs,
 			DefaultValue: int(1e6),
@@ -88,10 +154,46 @@ var (
 			Help:         "bitcoin network mempool enable/disable switch",
 			Print:        config.PrintAll,
 		},
+		"TBC_MEMPOOL_EXPIRY_HOURS": config.Config{
+			Value:        &cfg.MempoolExpiryHours,
+			DefaultValue: 336,
+			Help:         "hours after which mempool transactions expire",
+			Print:        config.PrintAll,
+		},
+		"TBC_MEMPOOL_MAX_SIZE": config.Config{
+			Value:        &cfg.MempoolMaxSize,
+			DefaultValue: 300 * 1024 * 1024,
+			Help:         "maximum mempool size in bytes, lowest fee rate transactions are evicted beyond it",
+			Print:        config.PrintAll,
+		},
 		"TBC_NETWORK": config.Config{
 			Value:        &cfg.Network,
 			DefaultValue: defaultNetwork,
-			Help:         "bitcoin network; mainnet or testnet3",
+			Help:         "bitcoin network; mainnet, testnet3, testnet4, signet or regtest",
+			Print:        config.PrintAll,
+		},
+		"TBC_ONION_ONLY": config.Config{
+			Value:        &cfg.OnionOnly,
+			DefaultValue: false,
+			Help:         "only connect to tor onion peers, requires TBC_SOCKS5_PROXY and onion TBC_SEEDS",
+			Print:        config.PrintAll,
+		},
+		"TBC_P2P_ADDRESS": config.Config{
+			Value:        &cfg.P2PListenAddress,
+			DefaultValue: "",
+			Help:         "address and port tbcd accepts inbound bitcoin p2p connections on",
+			Print:        config.PrintAll,
+		},
+		"TBC_P2P_V2": config.Config{
+			Value:        &cfg.P2PV2,
+			DefaultValue: true,
+			Help:         "try the BIP324 encrypted transport on outbound peers before falling back to v1",
+			Print:        config.PrintAll,
+		},
+		"TBC_PEERS_INBOUND": config.Config{
+			Value:        &cfg.PeersInbound,
+			DefaultValue: 16,
+			Help:         "maximum number of inbound p2p peers",
 			Print:        config.PrintAll,
 		},
 		"TBC_PEERS_WANTED": config.Config{
@@ -112,10 +214,58 @@ var (
 			Help:         "address and port tbcd pprof listens on (open <address>/debug/pprof to see available profiles)",
 			Print:        config.PrintAll,
 		},
+		"TBC_PRUNE_BLOCKS": config.Config{
+			Value:        &cfg.PruneBlocks,
+			DefaultValue: uint64(0),
+			Help:         "prune raw blocks deeper than this many blocks (minimum 288), 0 disables",
+			Print:        config.PrintAll,
+		},
+		"TBC_PRUNE_GB": config.Config{
+			Value:        &cfg.PruneGB,
+			DefaultValue: uint64(0),
+			Help:         "prune raw blocks beyond this many GiB of storage, 0 disables",
+			Print:        config.PrintAll,
+		},
 		"TBC_SEEDS": config.Config{
 			Value:        &cfg.Seeds,
 			DefaultValue: []string{},
-			Help:         "list of seed domains for Bitcoin P2P, in the format '<host>:<port>' (for localnet, must be a single host:port)",
+			Help:         "list of seed domains for Bitcoin P2P, in the format '<host>:<port>' (for localnet, must be a single host:port), the port defaults to the network port",
+			Print:        config.PrintAll,
+		},
+		"TBC_SIGNET_CHALLENGE": config.Config{
+			Value:        &cfg.SignetChallenge,
+			DefaultValue: "",
+			Help:         "hex encoded challenge of a custom signet, the default signet is used when empty",
+			Print:        config.PrintAll,
+		},
+		"TBC_SOCKS5_PASSWORD": config.Config{
+			Value:        &cfg.SOCKS5ProxyPassword,
+			DefaultValue: "",
+			Help:         "socks5 proxy password",
+			Print:        config.PrintSecret,
+		},
+		"TBC_SOCKS5_PROXY": config.Config{
+			Value:        &cfg.SOCKS5Proxy,
+			DefaultValue: "",
+			Help:         "address and port of a socks5 proxy (e.g. tor) bitcoin p2p peers are dialed through",
+			Print:        config.PrintAll,
+		},
+		"TBC_SOCKS5_USER": config.Config{
+			Value:        &cfg.SOCKS5ProxyUser,
+			DefaultValue: "",
+			Help:         "socks5 proxy user",
+			Print:        config.PrintAll,
+		},
+		"TBC_UTXO_SNAPSHOT": config.Config{
+			Value:        &cfg.UtxoSnapshot,
+			DefaultValue: "",
+			Help:         "utxo snapshot file that is imported when the utxo index is empty",
+			Print:        config.PrintAll,
+		},
+		"TBC_UTXO_SNAPSHOT_DIGEST": config.Config{
+			Value:        &cfg.UtxoSnapshotDigest,
+			DefaultValue: "",
+			Help:         "hex encoded digest the utxo snapshot must match",
 			Print:        config.PrintAll,
 		},
 	}
@@ -50,6 +50,19 @@ func (bnfe BlockNotFoundError) Is(target error) bool {
 	return ok
 }
 
+type BlockPrunedError struct {
+	chainhash.Hash
+}
+
+func (bpe BlockPrunedError) Error() string {
+	return fmt.Sprintf("block pruned: %v", bpe.Hash)
+}
+
+func (bpe BlockPrunedError) Is(target error) bool {
+	_, ok := target.(BlockPrunedError)
+	return ok
+}
+
 type DuplicateError string
 
 func (de DuplicateError) Error() string {
@@ -88,6 +101,7 @@ var (
 	ErrNotFound      = NotFoundError("not found")
 	ErrValidation    = ValidationError("validation")
 	ErrBlockNotFound BlockNotFoundError
+	ErrBlockPruned   BlockPrunedError
 )
 
 // ByteArray is a type that corresponds to BYTEA in a database. It supports
@@ -33,6 +33,8 @@ const (
 	PeersDB         = "peers"
 	OutputsDB       = "outputs"
 	TransactionsDB  = "transactions"
+	FiltersDB       = "filters"
+	HistoryDB       = "history"
 
 	BlocksDB = "blocks" // raw database
 
@@ -221,6 +223,14 @@ func New(ctx context.Context, home string, version int) (*Database, error) {
 	if err != nil {
 		return nil, fmt.Errorf("leveldb %v: %w", TransactionsDB, err)
 	}
+	err = l.openDB(FiltersDB, nil)
+	if err != nil {
+		return nil, fmt.Errorf("leveldb %v: %w", FiltersDB, err)
+	}
+	err = l.openDB(HistoryDB, nil)
+	if err != nil {
+		return nil, fmt.Errorf("leveldb %v: %w", HistoryDB, err)
+	}
 
 	// Blocks database is special
 	err = l.openRawDB(BlocksDB, rawdb.DefaultMaxFileSize)
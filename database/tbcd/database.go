@@ -84,6 +84,7 @@ type Database interface {
 	Version(ctx context.Context) (int, error)
 	MetadataGet(ctx context.Context, key []byte) ([]byte, error)
 	MetadataPut(ctx context.Context, key, value []byte) error
+	MetadataDel(ctx context.Context, key []byte) error
 	MetadataBatchGet(ctx context.Context, allOrNone bool, keys [][]byte) ([]Row, error)
 	MetadataBatchPut(ctx context.Context, rows []Row) error
 
@@ -103,18 +104,44 @@ type Database interface {
 	BlockInsert(ctx context.Context, b *btcutil.Block) (int64, error)
 	// BlocksInsert(ctx context.Context, bs []*btcutil.Block) (int64, error)
 	BlockByHash(ctx context.Context, hash *chainhash.Hash) (*btcutil.Block, error)
+	BlockExistsByHash(ctx context.Context, hash *chainhash.Hash) (bool, error)
+	BlockFiles(ctx context.Context) ([]BlockFile, error)
+	BlockFilePrune(ctx context.Context, number uint32) error
+	BlockFileCompact(ctx context.Context, number uint32) error
 
 	// Transactions
 	BlockUtxoUpdate(ctx context.Context, direction int, utxos map[Outpoint]CacheOutput) error
+	BlockScriptUpdate(ctx context.Context, direction int, scripts map[Outpoint][]byte) error
+	BlockUndoUpdate(ctx context.Context, direction int, undo map[chainhash.Hash]*BlockUndo) error
+	BlockUndoByHash(ctx context.Context, hash *chainhash.Hash) (*BlockUndo, error)
 	BlockTxUpdate(ctx context.Context, direction int, txs map[TxKey]*TxValue) error
+	UtxoIndexDrop(ctx context.Context) error // utxos and history
+	TxIndexDrop(ctx context.Context) error
 	BlockHashByTxId(ctx context.Context, txId *chainhash.Hash) (*chainhash.Hash, error)
 	SpentOutputsByTxId(ctx context.Context, txId *chainhash.Hash) ([]SpentInfo, error)
+	SpentOutputsByOutpoint(ctx context.Context, op Outpoint) ([]SpentInfo, error)
+
+	// Filters
+	BlockFilterUpdate(ctx context.Context, direction int, filters map[chainhash.Hash]*BlockFilter) error
+	BlockFilterByHash(ctx context.Context, hash *chainhash.Hash) (*BlockFilter, error)
+
+	// History
+	BlockHistoryUpdate(ctx context.Context, direction int, history map[HistoryKey]struct{}) error
+	TxsByScriptHash(ctx context.Context, sh ScriptHash, cursor []byte, count uint64) ([]TxHistory, []byte, error)
 
 	// ScriptHash returns the sha256 of PkScript for the provided outpoint.
 	BalanceByScriptHash(ctx context.Context, sh ScriptHash) (uint64, error)
 	BlockInTxIndex(ctx context.Context, hash *chainhash.Hash) (bool, error)
 	ScriptHashByOutpoint(ctx context.Context, op Outpoint) (*ScriptHash, error)
+	UtxoByOutpoint(ctx context.Context, op Outpoint) (*CacheOutput, error)
+	ScriptByOutpoint(ctx context.Context, op Outpoint) ([]byte, error)
 	UtxosByScriptHash(ctx context.Context, sh ScriptHash, start uint64, count uint64) ([]Utxo, error)
+	UtxosWalk(ctx context.Context, f func(op Outpoint, co CacheOutput) error) error
+
+	// Peers
+	Peers(ctx context.Context) ([]Peer, error)
+	PeersInsert(ctx context.Context, peers []Peer) error
+	PeersDelete(ctx context.Context, addresses []string) error
 }
 
 // XXX there exist various types in this file that need to be reevaluated.
@@ -123,6 +150,15 @@ type Database interface {
 // thought because we have composites that are needed for the code to function
 // properly.
 
+// BlockFile describes a raw block storage file. Height is the highest block
+// stored in the file.
+type BlockFile struct {
+	Number uint32
+	Size   int64
+	Height uint64
+	Pruned bool
+}
+
 // BlockHeader contains the first 80 raw bytes of a bitcoin block plus its
 // location information (hash+height) and the cumulative difficulty.
 type BlockHeader struct {
@@ -170,6 +206,21 @@ func (bh BlockHeader) ParentHash() *chainhash.Hash {
 	return &wh.PrevBlock
 }
 
+// Peer is an address book entry of a bitcoin p2p peer.
+type Peer struct {
+	Address   string
+	LastSeen  time.Time // last successful connect
+	Successes uint32    // number of successful connects
+	Failures  uint32    // number of failed connects
+	Score     uint32    // misbehavior score
+	BanUntil  time.Time // zero if not banned
+}
+
+// Banned returns true if the peer is banned at time now.
+func (p Peer) Banned(now time.Time) bool {
+	return now.Before(p.BanUntil)
+}
+
 // BlockIdentifier uniquely identifies a block using it's hash and height.
 type BlockIdentifier struct {
 	Height uint64
@@ -182,6 +233,61 @@ type SpentInfo struct {
 	InputIndex uint32
 }
 
+// BlockFilter is a BIP158 basic filter and its BIP157 filter header.
+type BlockFilter struct {
+	BlockHash chainhash.Hash
+	Header    chainhash.Hash // filter header, commits to all prior filters
+	Filter    []byte         // serialized N + filter data
+}
+
+// TxHistory is a transaction that touched a script hash, either by creating
+// or by spending an output.
+type TxHistory struct {
+	Height uint64
+	TxId   chainhash.Hash
+}
+
+// HistoryCursorSize is the length of a script hash history cursor.
+const HistoryCursorSize = 8 + 32 // height + tx_id
+
+// HistoryKey records that a transaction touched a script hash. The fields are
+// script_hash + height + tx_id and it is used as is as the database key in
+// order to return the history ordered by height.
+type HistoryKey [32 + HistoryCursorSize]byte
+
+// String returns a pretty printable HistoryKey. It prints
+// script_hash:height:tx_id.
+func (hk HistoryKey) String() string {
+	txId, _ := chainhash.NewHash(hk[40:])
+	return fmt.Sprintf("%x:%d:%v", hk[0:32], hk.Height(), txId)
+}
+
+func (hk HistoryKey) ScriptHash() (hash ScriptHash) {
+	copy(hash[:], hk[0:32])
+	return
+}
+
+func (hk HistoryKey) Height() uint64 {
+	return binary.BigEndian.Uint64(hk[32:40])
+}
+
+func (hk HistoryKey) TxId() (txId chainhash.Hash) {
+	copy(txId[:], hk[40:])
+	return
+}
+
+// Cursor returns the height + tx_id portion of the key.
+func (hk HistoryKey) Cursor() []byte {
+	return hk[32:]
+}
+
+func NewHistoryKey(sh ScriptHash, height uint64, txId *chainhash.Hash) (hk HistoryKey) {
+	copy(hk[0:32], sh[:])
+	binary.BigEndian.PutUint64(hk[32:40], height)
+	copy(hk[40:], txId[:])
+	return
+}
+
 // XXX we can probably save a bunch of bcopy if we construct the key directly
 // for the db. Peek at the s + t cache which does this.
 
@@ -286,6 +392,50 @@ func NewDeleteCacheOutput(hash [32]byte, outIndex uint32) (co CacheOutput) {
 	return
 }
 
+// BlockUndo records how a block changed the utxo index. It is recorded when
+// the block is indexed so that the utxo index can be unwound without the block
+// and without the blocks that created the outputs it spends.
+type BlockUndo struct {
+	Txs []TxUndo // in block order
+}
+
+// SpentOutputs returns the outputs that were spent by the block in input
+// order.
+func (bu *BlockUndo) SpentOutputs() []SpentOutput {
+	n := 0
+	for _, tu := range bu.Txs {
+		n += len(tu.Spent)
+	}
+	spent := make([]SpentOutput, 0, n)
+	for _, tu := range bu.Txs {
+		spent = append(spent, tu.Spent...)
+	}
+	return spent
+}
+
+// TxUndo records the outputs a tx spent, in input order, and the spendable
+// outputs it created. Coinbase txs spend nothing.
+type TxUndo struct {
+	TxId    chainhash.Hash
+	Spent   []SpentOutput
+	Created []CreatedOutput
+}
+
+// SpentOutput is an output that was spent by a tx. PkScript is nil when
+// unknown, e.g. for outputs that were indexed by older releases.
+type SpentOutput struct {
+	Outpoint   Outpoint
+	ScriptHash ScriptHash
+	Value      uint64
+	PkScript   []byte
+}
+
+// CreatedOutput is a spendable output that was created by a tx.
+type CreatedOutput struct {
+	Index      uint32
+	ScriptHash ScriptHash
+}
+
 // Utxo packs a transaction id, the value and the out index.
 type Utxo [32 + 8 + 4]byte // tx_id + value + out_idx
 
@@ -47,6 +47,13 @@ func (l *lowIQMap) Get(k *chainhash.Hash) (*tbcd.BlockHeader, bool) {
 	return bh, ok
 }
 
+func (l *lowIQMap) Delete(k *chainhash.Hash) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	delete(l.m, *k)
+}
+
 func lowIQMapNew(count int) *lowIQMap {
 	return &lowIQMap{
 		count: count,
@@ -11,6 +11,8 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"sync"
+	"time"
 
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/btcutil"
@@ -25,6 +27,7 @@ import (
 	"github.com/hemilabs/heminetwork/database"
 	"github.com/hemilabs/heminetwork/database/level"
 	"github.com/hemilabs/heminetwork/database/tbcd"
+	"github.com/hemilabs/heminetwork/rawdb"
 )
 
 // Locking order:
@@ -48,6 +51,7 @@ const (
 	verbose  = false
 
 	bhsCanonicalTipKey = "canonicaltip"
+	blockFileKeyPrefix = "blockfile" // highest block height in raw file
 )
 
 type IteratorError error
@@ -69,6 +73,8 @@ type ldb struct {
 
 	blockCache *lru.Cache[chainhash.Hash, *btcutil.Block] // block cache
 
+	blockFileMtx sync.Mutex // serializes raw block file height updates
+
 	// Block Header cache. Note that it is only primed during reads. Doing
 	// this during writes would be relatively expensive at nearly no gain.
 	headerCache *lowIQMap
@@ -108,9 +114,10 @@ func headerHash(header []byte) *chainhash.Hash {
 }
 
 type Config struct {
-	Home             string // home directory
-	BlockCache       int    // number of blocks to cache
-	BlockheaderCache int    // number of blocks headers to cache
+	Home             string            // home directory
+	BlockCache       int               // number of blocks to cache
+	BlockheaderCache int               // number of blocks headers to cache
+	BlockCompression rawdb.Compression // compression of inserted blocks
 }
 
 func NewConfig(home string) *Config {
@@ -137,6 +144,12 @@ func New(ctx context.Context, cfg *Config) (*ldb, error) {
 		cfg:      cfg,
 	}
 
+	err = l.rawPool[level.BlocksDB].SetCompression(cfg.BlockCompression)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("block compression: %v", cfg.BlockCompression)
+
 	if cfg.BlockCache > 0 {
 		l.blockCache, err = lru.New[chainhash.Hash, *btcutil.Block](cfg.BlockCache)
 		if err != nil {
@@ -285,6 +298,19 @@ func (l *ldb) MetadataBatchPut(ctx context.Context, rows []tbcd.Row) error {
 	return nil
 }
 
+// MetadataDel deletes the provided key. It is not an error if the key does not
+// exist.
+func (l *ldb) MetadataDel(ctx context.Context, key []byte) error {
+	log.Tracef("MetadataDel")
+	defer log.Tracef("MetadataDel exit")
+
+	mdDB := l.pool[level.MetadataDB]
+	if err := mdDB.Delete(key, nil); err != nil {
+		return fmt.Errorf("metadata delete: %w", err)
+	}
+	return nil
+}
+
 func (l *ldb) MetadataPut(ctx context.Context, key, value []byte) error {
 	log.Tracef("MetadataPut")
 	defer log.Tracef("MetadataPut exit")
@@ -929,6 +955,14 @@ func (l *ldb) BlockHeadersRemove(ctx context.Context, bhs *wire.MsgHeaders, tipA
 			fmt.Errorf("metadata commit: %w", err)
 	}
 
+	// Purge removed headers from the cache.
+	if l.cfg.BlockheaderCache > 0 {
+		for i := 0; i < len(headersParsed); i++ {
+			bhash := headersParsed[i].BlockHash()
+			l.headerCache.Delete(&bhash)
+		}
+	}
+
 	return removalType, parentToRemovalSet, nil
 }
 
@@ -1242,6 +1276,9 @@ func (l *ldb) BlockInsert(ctx context.Context, b *btcutil.Block) (int64, error)
 		if err = bDB.Insert(b.Hash()[:], raw); err != nil {
 			return -1, fmt.Errorf("blocks insert put: %w", err)
 		}
+		if err = l.blockFileHeightUpdate(b.Hash(), bh.Height); err != nil {
+			return -1, fmt.Errorf("blocks insert file height: %w", err)
+		}
 		if l.cfg.BlockCache > 0 {
 			l.blockCache.Add(*b.Hash(), b)
 		}
@@ -1292,6 +1329,9 @@ func (l *ldb) BlockByHash(ctx context.Context, hash *chainhash.Hash) (*btcutil.B
 		if errors.Is(err, leveldb.ErrNotFound) {
 			return nil, database.BlockNotFoundError{Hash: *hash}
 		}
+		if errors.Is(err, rawdb.ErrPruned) {
+			return nil, database.BlockPrunedError{Hash: *hash}
+		}
 		return nil, fmt.Errorf("block get: %w", err)
 	}
 	b, err := btcutil.NewBlockFromBytes(eb)
@@ -1304,6 +1344,149 @@ func (l *ldb) BlockByHash(ctx context.Context, hash *chainhash.Hash) (*btcutil.B
 	return b, nil
 }
 
+// BlockExistsByHash returns true if the block is in the block store. Blocks in
+// pruned block files exist.
+func (l *ldb) BlockExistsByHash(ctx context.Context, hash *chainhash.Hash) (bool, error) {
+	log.Tracef("BlockExistsByHash")
+	defer log.Tracef("BlockExistsByHash exit")
+
+	bDB := l.rawPool[level.BlocksDB]
+	return bDB.Has(hash[:])
+}
+
+func blockFileKey(number uint32) []byte {
+	key := make([]byte, len(blockFileKeyPrefix)+4)
+	copy(key, blockFileKeyPrefix)
+	binary.BigEndian.PutUint32(key[len(blockFileKeyPrefix):], number)
+	return key
+}
+
+// blockFileHeightUpdate records the height of the provided block as the
+// highest height in its raw block file if it exceeds the recorded height.
+func (l *ldb) blockFileHeightUpdate(hash *chainhash.Hash, height uint64) error {
+	bDB := l.rawPool[level.BlocksDB]
+	number, err := bDB.Location(hash[:])
+	if err != nil {
+		return fmt.Errorf("location: %w", err)
+	}
+
+	l.blockFileMtx.Lock()
+	defer l.blockFileMtx.Unlock()
+
+	mdDB := l.pool[level.MetadataDB]
+	key := blockFileKey(number)
+	value, err := mdDB.Get(key, nil)
+	switch {
+	case errors.Is(err, leveldb.ErrNotFound):
+	case err != nil:
+		return err
+	case binary.BigEndian.Uint64(value) >= height:
+		return nil
+	}
+	value = make([]byte, 8)
+	binary.BigEndian.PutUint64(value, height)
+	return mdDB.Put(key, value, nil)
+}
+
+// blockFileHeightsRecreate walks all raw blocks to recreate the highest height
+// of every raw block file. This is only required for databases that predate
+// tracking of raw block file heights.
+func (l *ldb) blockFileHeightsRecreate(ctx context.Context) (map[uint32]uint64, error) {
+	log.Infof("Recreating raw block file heights")
+
+	heights := make(map[uint32]uint64)
+	bDB := l.rawPool[level.BlocksDB]
+	err := bDB.Walk(func(key []byte, number uint32) error {
+		hash, err := chainhash.NewHash(key)
+		if err != nil {
+			return fmt.Errorf("invalid block hash %x: %w", key, err)
+		}
+		bh, err := l.BlockHeaderByHash(ctx, hash)
+		if err != nil {
+			return fmt.Errorf("block header %v: %w", hash, err)
+		}
+		heights[number] = max(heights[number], bh.Height)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk: %w", err)
+	}
+
+	batch := new(leveldb.Batch)
+	for number, height := range heights {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, height)
+		batch.Put(blockFileKey(number), value)
+	}
+	mdDB := l.pool[level.MetadataDB]
+	if err := mdDB.Write(batch, nil); err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+	return heights, nil
+}
+
+func (l *ldb) BlockFiles(ctx context.Context) ([]tbcd.BlockFile, error) {
+	log.Tracef("BlockFiles")
+	defer log.Tracef("BlockFiles exit")
+
+	bDB := l.rawPool[level.BlocksDB]
+	dfs, err := bDB.DataFiles()
+	if err != nil {
+		return nil, fmt.Errorf("data files: %w", err)
+	}
+
+	l.blockFileMtx.Lock()
+	defer l.blockFileMtx.Unlock()
+
+	mdDB := l.pool[level.MetadataDB]
+	bfs := make([]tbcd.BlockFile, 0, len(dfs))
+	recreate := false
+	for _, df := range dfs {
+		bf := tbcd.BlockFile{
+			Number: df.Number,
+			Size:   df.Size,
+			Pruned: df.Pruned,
+		}
+		value, err := mdDB.Get(blockFileKey(df.Number), nil)
+		switch {
+		case err == nil:
+			bf.Height = binary.BigEndian.Uint64(value)
+		case !errors.Is(err, leveldb.ErrNotFound):
+			return nil, err
+		case !df.Pruned && df.Size > 0:
+			recreate = true
+		}
+		bfs = append(bfs, bf)
+	}
+	if recreate {
+		heights, err := l.blockFileHeightsRecreate(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("recreate heights: %w", err)
+		}
+		for k := range bfs {
+			bfs[k].Height = max(bfs[k].Height, heights[bfs[k].Number])
+		}
+	}
+
+	return bfs, nil
+}
+
+func (l *ldb) BlockFilePrune(ctx context.Context, number uint32) error {
+	log.Tracef("BlockFilePrune")
+	defer log.Tracef("BlockFilePrune exit")
+
+	bDB := l.rawPool[level.BlocksDB]
+	return bDB.Prune(number)
+}
+
+func (l *ldb) BlockFileCompact(ctx context.Context, number uint32) error {
+	log.Tracef("BlockFileCompact")
+	defer log.Tracef("BlockFileCompact exit")
+
+	bDB := l.rawPool[level.BlocksDB]
+	return bDB.Compact(number)
+}
+
 func (l *ldb) BlockHashByTxId(ctx context.Context, txId *chainhash.Hash) (*chainhash.Hash, error) {
 	log.Tracef("BlockHashByTxId")
 	defer log.Tracef("BlockHashByTxId exit")
@@ -1330,10 +1513,26 @@ func (l *ldb) BlockHashByTxId(ctx context.Context, txId *chainhash.Hash) (*chain
 		return nil, database.NotFoundError(fmt.Sprintf("tx not found: %v", txId))
 	case 1:
 		return blocks[0], nil
-	default:
-		panic(fmt.Sprintf("invalid blocks count %v: %v",
-			len(blocks), spew.Sdump(blocks)))
 	}
+
+	// A txid can be in more than one block, e.g. the BIP30 duplicate
+	// coinbases. Return the highest block, its outputs replaced the ones
+	// of the earlier blocks.
+	var (
+		block  *chainhash.Hash
+		height uint64
+	)
+	for _, b := range blocks {
+		bh, err := l.BlockHeaderByHash(ctx, b)
+		if err != nil {
+			return nil, fmt.Errorf("block header %v: %w", b, err)
+		}
+		if block == nil || bh.Height > height {
+			block = b
+			height = bh.Height
+		}
+	}
+	return block, nil
 }
 
 func (l *ldb) SpentOutputsByTxId(ctx context.Context, txId *chainhash.Hash) ([]tbcd.SpentInfo, error) {
@@ -1376,36 +1575,60 @@ func (l *ldb) SpentOutputsByTxId(ctx context.Context, txId *chainhash.Hash) ([]t
 	return si, nil
 }
 
-func (l *ldb) BlockInTxIndex(ctx context.Context, hash *chainhash.Hash) (bool, error) {
-	log.Tracef("BlockInTxIndex")
-	defer log.Tracef("BlockInTxIndex exit")
+// SpentOutputsByOutpoint returns the txs that spend the provided outpoint. More
+// than one tx is returned when the outpoint is spent in blocks on different
+// forks.
+func (l *ldb) SpentOutputsByOutpoint(ctx context.Context, op tbcd.Outpoint) ([]tbcd.SpentInfo, error) {
+	log.Tracef("SpentOutputsByOutpoint")
+	defer log.Tracef("SpentOutputsByOutpoint exit")
 
-	blocks := make([]*chainhash.Hash, 0, 2)
+	si := make([]tbcd.SpentInfo, 0, 1)
 	txDB := l.pool[level.TransactionsDB]
-	var blkid [33]byte
-	blkid[0] = 'b'
-	copy(blkid[1:], hash[:])
-	it := txDB.NewIterator(util.BytesPrefix(blkid[:]), nil)
+	var key [1 + 32 + 4]byte
+	key[0] = 's'
+	copy(key[1:], op.TxId())
+	copy(key[33:], op.TxIndexBytes())
+	it := txDB.NewIterator(util.BytesPrefix(key[:]), nil)
 	defer it.Release()
 	for it.Next() {
-		block, err := chainhash.NewHash(it.Key()[33:])
+		var (
+			s   tbcd.SpentInfo
+			err error
+		)
+		s.TxId, err = chainhash.NewHash(it.Value()[0:32])
 		if err != nil {
-			return false, err
+			return nil, fmt.Errorf("new tx id: %w", err)
 		}
-		blocks = append(blocks, block)
+		s.BlockHash, err = chainhash.NewHash(it.Key()[37:])
+		if err != nil {
+			return nil, fmt.Errorf("new block hash: %w", err)
+		}
+		s.InputIndex = binary.BigEndian.Uint32(it.Value()[32:36])
+		si = append(si, s)
 	}
 	if err := it.Error(); err != nil {
-		return false, fmt.Errorf("blocks by id iterator: %w", err)
+		return nil, fmt.Errorf("spent outputs iterator: %w", err)
 	}
-	switch len(blocks) {
-	case 0:
-		return false, nil
-	case 1:
-		return true, nil
-	default:
-		panic(fmt.Sprintf("invalid blocks count %v: %v",
-			len(blocks), spew.Sdump(blocks)))
+	if len(si) == 0 {
+		return nil, database.NotFoundError(fmt.Sprintf("not found %v", op))
 	}
+
+	return si, nil
+}
+
+func (l *ldb) BlockInTxIndex(ctx context.Context, hash *chainhash.Hash) (bool, error) {
+	log.Tracef("BlockInTxIndex")
+	defer log.Tracef("BlockInTxIndex exit")
+
+	txDB := l.pool[level.TransactionsDB]
+	var blkid [33]byte
+	blkid[0] = 'b'
+	copy(blkid[1:], hash[:])
+	ok, err := txDB.Has(blkid[:], nil)
+	if err != nil {
+		return false, fmt.Errorf("block in tx index: %w", err)
+	}
+	return ok, nil
 }
 
 func (l *ldb) ScriptHashByOutpoint(ctx context.Context, op tbcd.Outpoint) (*tbcd.ScriptHash, error) {
@@ -1422,6 +1645,66 @@ func (l *ldb) ScriptHashByOutpoint(ctx context.Context, op tbcd.Outpoint) (*tbcd
 	return &sh, err
 }
 
+// UtxoByOutpoint returns the unspent output the outpoint points to.
+func (l *ldb) UtxoByOutpoint(ctx context.Context, op tbcd.Outpoint) (*tbcd.CacheOutput, error) {
+	log.Tracef("UtxoByOutpoint")
+	defer log.Tracef("UtxoByOutpoint exit")
+
+	oDB := l.pool[level.OutputsDB]
+	sh, err := oDB.Get(op[:], nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, database.NotFoundError(fmt.Sprintf("utxo not found: %v", op))
+		}
+		return nil, fmt.Errorf("utxo get: %w", err)
+	}
+	if len(sh) != 32 {
+		return nil, fmt.Errorf("invalid script hash: %x", sh)
+	}
+
+	var hop [69]byte // 'h' script_hash tx_id tx_output_idx
+	hop[0] = 'h'
+	copy(hop[1:33], sh)
+	copy(hop[33:65], op.TxId())
+	copy(hop[65:], op.TxIndexBytes())
+	value, err := oDB.Get(hop[:], nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, database.NotFoundError(fmt.Sprintf("utxo value not found: %v", op))
+		}
+		return nil, fmt.Errorf("utxo value get: %w", err)
+	}
+	if len(value) != 8 {
+		return nil, fmt.Errorf("invalid utxo value: %x", value)
+	}
+
+	co := tbcd.NewCacheOutput([32]byte(sh), binary.BigEndian.Uint64(value),
+		op.TxIndex())
+	return &co, nil
+}
+
+// ScriptByOutpoint returns the pk script of the unspent output the outpoint
+// points to. Outputs that were indexed by older releases or imported from a
+// utxo snapshot have no pk script recorded.
+func (l *ldb) ScriptByOutpoint(ctx context.Context, op tbcd.Outpoint) ([]byte, error) {
+	log.Tracef("ScriptByOutpoint")
+	defer log.Tracef("ScriptByOutpoint exit")
+
+	oDB := l.pool[level.OutputsDB]
+	script, err := oDB.Get(scriptKey(op), nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, database.NotFoundError(fmt.Sprintf("script not found: %v", op))
+		}
+		return nil, fmt.Errorf("script get: %w", err)
+	}
+	if script == nil {
+		// Empty pk scripts are valid.
+		script = []byte{}
+	}
+	return script, nil
+}
+
 func (l *ldb) BalanceByScriptHash(ctx context.Context, sh tbcd.ScriptHash) (uint64, error) {
 	log.Tracef("BalanceByScriptHash")
 	defer log.Tracef("BalanceByScriptHash exit")
@@ -1479,6 +1762,42 @@ func (l *ldb) UtxosByScriptHash(ctx context.Context, sh tbcd.ScriptHash, start u
 	return utxos, nil
 }
 
+// UtxosWalk calls f for every unspent output in the utxo index. The walk is
+// aborted when f returns an error.
+func (l *ldb) UtxosWalk(ctx context.Context, f func(op tbcd.Outpoint, co tbcd.CacheOutput) error) error {
+	log.Tracef("UtxosWalk")
+	defer log.Tracef("UtxosWalk exit")
+
+	oDB := l.pool[level.OutputsDB]
+	it := oDB.NewIterator(util.BytesPrefix([]byte{'h'}), nil)
+	defer it.Release()
+	for it.Next() {
+		// 'h' script_hash tx_id tx_output_idx
+		key := it.Key()
+		if len(key) != 69 || len(it.Value()) != 8 {
+			return fmt.Errorf("invalid utxo: %x", key)
+		}
+		var (
+			sh   [32]byte
+			txId [32]byte
+		)
+		copy(sh[:], key[1:33])
+		copy(txId[:], key[33:65])
+		index := binary.BigEndian.Uint32(key[65:])
+		value := binary.BigEndian.Uint64(it.Value())
+		err := f(tbcd.NewOutpoint(txId, index),
+			tbcd.NewCacheOutput(sh, value, index))
+		if err != nil {
+			return err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return IteratorError(err)
+	}
+
+	return nil
+}
+
 func (l *ldb) BlockUtxoUpdate(ctx context.Context, direction int, utxos map[tbcd.Outpoint]tbcd.CacheOutput) error {
 	log.Tracef("BlockUtxoUpdate")
 	defer log.Tracef("BlockUtxoUpdate exit")
@@ -1535,6 +1854,192 @@ func (l *ldb) BlockUtxoUpdate(ctx context.Context, direction int, utxos map[tbcd
 	return nil
 }
 
+// scriptKey returns the pk script key of the provided outpoint,
+// 'p' tx_id tx_output_idx.
+func scriptKey(op tbcd.Outpoint) []byte {
+	key := make([]byte, len(op))
+	key[0] = 'p'
+	copy(key[1:], op[1:])
+	return key
+}
+
+// undoKey returns the undo record key of the provided block, 'r' block_hash.
+func undoKey(hash *chainhash.Hash) []byte {
+	key := make([]byte, 1+chainhash.HashSize)
+	key[0] = 'r'
+	copy(key[1:], hash[:])
+	return key
+}
+
+// BlockScriptUpdate records the pk scripts of unspent outputs. A nil script
+// deletes the pk script of a spent output.
+func (l *ldb) BlockScriptUpdate(ctx context.Context, direction int, scripts map[tbcd.Outpoint][]byte) error {
+	log.Tracef("BlockScriptUpdate")
+	defer log.Tracef("BlockScriptUpdate exit")
+
+	if !(direction == 1 || direction == -1) {
+		return fmt.Errorf("invalid direction: %v", direction)
+	}
+
+	// outputs
+	outsTx, outsCommit, outsDiscard, err := l.startTransaction(level.OutputsDB)
+	if err != nil {
+		return fmt.Errorf("outputs open db transaction: %w", err)
+	}
+	defer outsDiscard()
+
+	outsBatch := new(leveldb.Batch)
+	for op, script := range scripts {
+		// The cache is updated in a way that makes the direction
+		// irrelevant.
+		if script == nil {
+			outsBatch.Delete(scriptKey(op))
+		} else {
+			outsBatch.Put(scriptKey(op), script)
+		}
+
+		// XXX this probably should be done by the caller but we do it
+		// here to lower memory pressure as large gobs of data are
+		// written to disk.
+		delete(scripts, op)
+	}
+
+	// Write outputs batch
+	if err = outsTx.Write(outsBatch, nil); err != nil {
+		return fmt.Errorf("scripts insert: %w", err)
+	}
+
+	// outputs commit
+	if err = outsCommit(); err != nil {
+		return fmt.Errorf("scripts commit: %w", err)
+	}
+
+	return nil
+}
+
+// BlockUndoUpdate records how the provided blocks changed the utxo index when
+// direction is 1 and deletes the records when direction is -1.
+func (l *ldb) BlockUndoUpdate(ctx context.Context, direction int, undo map[chainhash.Hash]*tbcd.BlockUndo) error {
+	log.Tracef("BlockUndoUpdate")
+	defer log.Tracef("BlockUndoUpdate exit")
+
+	if !(direction == 1 || direction == -1) {
+		return fmt.Errorf("invalid direction: %v", direction)
+	}
+
+	// outputs
+	outsTx, outsCommit, outsDiscard, err := l.startTransaction(level.OutputsDB)
+	if err != nil {
+		return fmt.Errorf("outputs open db transaction: %w", err)
+	}
+	defer outsDiscard()
+
+	outsBatch := new(leveldb.Batch)
+	for hash, bu := range undo {
+		switch direction {
+		case -1:
+			outsBatch.Delete(undoKey(&hash))
+		case 1:
+			outsBatch.Put(undoKey(&hash), encodeBlockUndo(bu))
+		}
+
+		// XXX this probably should be done by the caller but we do it
+		// here to lower memory pressure as large gobs of data are
+		// written to disk.
+		delete(undo, hash)
+	}
+
+	// Write outputs batch
+	if err = outsTx.Write(outsBatch, nil); err != nil {
+		return fmt.Errorf("undo insert: %w", err)
+	}
+
+	// outputs commit
+	if err = outsCommit(); err != nil {
+		return fmt.Errorf("undo commit: %w", err)
+	}
+
+	return nil
+}
+
+// BlockUndoByHash returns how the provided block changed the utxo index.
+// Blocks that were indexed by older releases have no undo record.
+func (l *ldb) BlockUndoByHash(ctx context.Context, hash *chainhash.Hash) (*tbcd.BlockUndo, error) {
+	log.Tracef("BlockUndoByHash")
+	defer log.Tracef("BlockUndoByHash exit")
+
+	oDB := l.pool[level.OutputsDB]
+	value, err := oDB.Get(undoKey(hash), nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, database.NotFoundError(fmt.Sprintf("undo not found: %v", hash))
+		}
+		return nil, fmt.Errorf("undo get: %w", err)
+	}
+	bu, err := decodeBlockUndo(value)
+	if err != nil {
+		return nil, fmt.Errorf("undo %v: %w", hash, err)
+	}
+	return bu, nil
+}
+
+// dbDrop deletes all keys from the provided database and compacts it.
+func (l *ldb) dbDrop(ctx context.Context, db string) error {
+	const batchSize = 100000
+
+	dropDB := l.pool[db]
+	it := dropDB.NewIterator(nil, nil)
+	defer it.Release()
+	batch := new(leveldb.Batch)
+	for it.Next() {
+		batch.Delete(it.Key())
+		if batch.Len() < batchSize {
+			continue
+		}
+		if err := dropDB.Write(batch, nil); err != nil {
+			return fmt.Errorf("%v delete: %w", db, err)
+		}
+		batch.Reset()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+	}
+	if err := it.Error(); err != nil {
+		return IteratorError(err)
+	}
+	if err := dropDB.Write(batch, nil); err != nil {
+		return fmt.Errorf("%v delete: %w", db, err)
+	}
+	if err := dropDB.CompactRange(util.Range{}); err != nil {
+		return fmt.Errorf("%v compact: %w", db, err)
+	}
+	return nil
+}
+
+// UtxoIndexDrop deletes the utxo and history indexes. The caller is
+// responsible for resetting the index metadata.
+func (l *ldb) UtxoIndexDrop(ctx context.Context) error {
+	log.Tracef("UtxoIndexDrop")
+	defer log.Tracef("UtxoIndexDrop exit")
+
+	if err := l.dbDrop(ctx, level.OutputsDB); err != nil {
+		return err
+	}
+	return l.dbDrop(ctx, level.HistoryDB)
+}
+
+// TxIndexDrop deletes the tx index. The caller is responsible for resetting
+// the index metadata.
+func (l *ldb) TxIndexDrop(ctx context.Context) error {
+	log.Tracef("TxIndexDrop")
+	defer log.Tracef("TxIndexDrop exit")
+
+	return l.dbDrop(ctx, level.TransactionsDB)
+}
+
 func (l *ldb) BlockTxUpdate(ctx context.Context, direction int, txs map[tbcd.TxKey]*tbcd.TxValue) error {
 	log.Tracef("BlockTxUpdate")
 	defer log.Tracef("BlockTxUpdate exit")
@@ -1613,3 +2118,382 @@ func (l *ldb) BlockTxUpdate(ctx context.Context, direction int, txs map[tbcd.TxK
 
 	return nil
 }
+
+// encodeBlockFilter encodes a block filter as [header,filter]. The block hash
+// is the leveldb table key.
+func encodeBlockFilter(bf *tbcd.BlockFilter) []byte {
+	ebf := make([]byte, chainhash.HashSize+len(bf.Filter))
+	copy(ebf[0:chainhash.HashSize], bf.Header[:])
+	copy(ebf[chainhash.HashSize:], bf.Filter)
+	return ebf
+}
+
+// decodeBlockFilter reverses the process of encodeBlockFilter.
+func decodeBlockFilter(hash *chainhash.Hash, ebf []byte) (*tbcd.BlockFilter, error) {
+	if len(ebf) < chainhash.HashSize {
+		return nil, fmt.Errorf("invalid block filter length: %v", len(ebf))
+	}
+	bf := &tbcd.BlockFilter{
+		BlockHash: *hash,
+		Filter:    make([]byte, len(ebf)-chainhash.HashSize),
+	}
+	copy(bf.Header[:], ebf[0:chainhash.HashSize])
+	copy(bf.Filter, ebf[chainhash.HashSize:])
+	return bf, nil
+}
+
+func (l *ldb) BlockFilterByHash(ctx context.Context, hash *chainhash.Hash) (*tbcd.BlockFilter, error) {
+	log.Tracef("BlockFilterByHash")
+	defer log.Tracef("BlockFilterByHash exit")
+
+	fDB := l.pool[level.FiltersDB]
+	ebf, err := fDB.Get(hash[:], nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, database.NotFoundError(fmt.Sprintf("block filter not found: %v", hash))
+		}
+		return nil, fmt.Errorf("block filter get: %w", err)
+	}
+	return decodeBlockFilter(hash, ebf)
+}
+
+func (l *ldb) BlockFilterUpdate(ctx context.Context, direction int, filters map[chainhash.Hash]*tbcd.BlockFilter) error {
+	log.Tracef("BlockFilterUpdate")
+	defer log.Tracef("BlockFilterUpdate exit")
+
+	if !(direction == 1 || direction == -1) {
+		return fmt.Errorf("invalid direction: %v", direction)
+	}
+
+	// filters
+	fTx, fCommit, fDiscard, err := l.startTransaction(level.FiltersDB)
+	if err != nil {
+		return fmt.Errorf("filters open db transaction: %w", err)
+	}
+	defer fDiscard()
+
+	fBatch := new(leveldb.Batch)
+	for hash, bf := range filters {
+		switch direction {
+		case -1:
+			fBatch.Delete(hash[:])
+		case 1:
+			if bf == nil {
+				return fmt.Errorf("invalid filter cache entry: %v", hash)
+			}
+			fBatch.Put(hash[:], encodeBlockFilter(bf))
+		}
+
+		// XXX this probably should be done by the caller but we do it
+		// here to lower memory pressure as large gobs of data are
+		// written to disk.
+		delete(filters, hash)
+	}
+
+	// Write filters batch
+	if err = fTx.Write(fBatch, nil); err != nil {
+		return fmt.Errorf("filters insert: %w", err)
+	}
+
+	// filters commit
+	if err = fCommit(); err != nil {
+		return fmt.Errorf("filters commit: %w", err)
+	}
+
+	return nil
+}
+
+func (l *ldb) TxsByScriptHash(ctx context.Context, sh tbcd.ScriptHash, cursor []byte, count uint64) ([]tbcd.TxHistory, []byte, error) {
+	log.Tracef("TxsByScriptHash")
+	defer log.Tracef("TxsByScriptHash exit")
+
+	if len(cursor) != 0 && len(cursor) != tbcd.HistoryCursorSize {
+		return nil, nil, fmt.Errorf("invalid cursor length: %v", len(cursor))
+	}
+
+	r := util.BytesPrefix(sh[:])
+	if len(cursor) != 0 {
+		r.Start = append(sh[:], cursor...)
+	}
+	hDB := l.pool[level.HistoryDB]
+	it := hDB.NewIterator(r, nil)
+	defer it.Release()
+
+	var next []byte
+	txs := make([]tbcd.TxHistory, 0, min(count, 32))
+	for it.Next() {
+		// Return the key of the next entry as the cursor so that the
+		// caller can resume from there.
+		if uint64(len(txs)) >= count {
+			next = bytes.Clone(it.Key()[len(sh):])
+			break
+		}
+		var th tbcd.TxHistory
+		th.Height = binary.BigEndian.Uint64(it.Key()[32:40])
+		copy(th.TxId[:], it.Key()[40:])
+		txs = append(txs, th)
+	}
+	if err := it.Error(); err != nil {
+		return nil, nil, IteratorError(err)
+	}
+
+	return txs, next, nil
+}
+
+func (l *ldb) BlockHistoryUpdate(ctx context.Context, direction int, history map[tbcd.HistoryKey]struct{}) error {
+	log.Tracef("BlockHistoryUpdate")
+	defer log.Tracef("BlockHistoryUpdate exit")
+
+	if !(direction == 1 || direction == -1) {
+		return fmt.Errorf("invalid direction: %v", direction)
+	}
+
+	// history
+	hTx, hCommit, hDiscard, err := l.startTransaction(level.HistoryDB)
+	if err != nil {
+		return fmt.Errorf("history open db transaction: %w", err)
+	}
+	defer hDiscard()
+
+	hBatch := new(leveldb.Batch)
+	for hk := range history {
+		switch direction {
+		case -1:
+			hBatch.Delete(hk[:])
+		case 1:
+			hBatch.Put(hk[:], nil)
+		}
+
+		// XXX this probably should be done by the caller but we do it
+		// here to lower memory pressure as large gobs of data are
+		// written to disk.
+		delete(history, hk)
+	}
+
+	// Write history batch
+	if err = hTx.Write(hBatch, nil); err != nil {
+		return fmt.Errorf("history insert: %w", err)
+	}
+
+	// history commit
+	if err = hCommit(); err != nil {
+		return fmt.Errorf("history commit: %w", err)
+	}
+
+	return nil
+}
+
+// unixTime returns the unix time of t or 0 for the zero time.
+func unixTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.Unix())
+}
+
+// timeUnix reverses the process of unixTime.
+func timeUnix(u uint64) time.Time {
+	if u == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(u), 0)
+}
+
+// encodeBlockUndo encodes a block undo record as [tx_count] followed by
+// tx_count times [tx_id,spent_count,spent,created_count,created]. Spent
+// outputs are encoded as [tx_id,index,script_hash,value,script_len,script] or
+// [32+4+32+8+uvarint+script_len] bytes and created outputs as
+// [index,script_hash] or [4+32] bytes. Counts are uvarints. The script length
+// is stored plus one so that zero denotes an unknown pk script.
+func encodeBlockUndo(bu *tbcd.BlockUndo) []byte {
+	size := binary.MaxVarintLen64
+	for _, tu := range bu.Txs {
+		size += 32 + 2*binary.MaxVarintLen64 + len(tu.Created)*(4+32)
+		for _, so := range tu.Spent {
+			size += 32 + 4 + 32 + 8 + binary.MaxVarintLen64 +
+				len(so.PkScript)
+		}
+	}
+	value := make([]byte, 0, size)
+	value = binary.AppendUvarint(value, uint64(len(bu.Txs)))
+	for _, tu := range bu.Txs {
+		value = append(value, tu.TxId[:]...)
+		value = binary.AppendUvarint(value, uint64(len(tu.Spent)))
+		for _, so := range tu.Spent {
+			value = append(value, so.Outpoint[1:]...)
+			value = append(value, so.ScriptHash[:]...)
+			value = binary.BigEndian.AppendUint64(value, so.Value)
+			if so.PkScript == nil {
+				value = binary.AppendUvarint(value, 0)
+				continue
+			}
+			value = binary.AppendUvarint(value,
+				uint64(len(so.PkScript))+1)
+			value = append(value, so.PkScript...)
+		}
+		value = binary.AppendUvarint(value, uint64(len(tu.Created)))
+		for _, co := range tu.Created {
+			value = binary.BigEndian.AppendUint32(value, co.Index)
+			value = append(value, co.ScriptHash[:]...)
+		}
+	}
+	return value
+}
+
+// undoCount decodes a count from a block undo record. The count is bounded by
+// the remaining record length divided by the minimum size of an element.
+func undoCount(value []byte, elementSize int) (int, []byte, error) {
+	c, n := binary.Uvarint(value)
+	if n <= 0 || c > uint64(len(value)-n)/uint64(elementSize) {
+		return 0, nil, errors.New("invalid undo count")
+	}
+	return int(c), value[n:], nil
+}
+
+// decodeBlockUndo reverses the process of encodeBlockUndo.
+func decodeBlockUndo(value []byte) (*tbcd.BlockUndo, error) {
+	txs, value, err := undoCount(value, 32+1+1)
+	if err != nil {
+		return nil, err
+	}
+	bu := &tbcd.BlockUndo{Txs: make([]tbcd.TxUndo, txs)}
+	for k := range bu.Txs {
+		tu := &bu.Txs[k]
+		if len(value) < 32 {
+			return nil, fmt.Errorf("invalid tx undo length: %v",
+				len(value))
+		}
+		copy(tu.TxId[:], value[:32])
+		var spent int
+		spent, value, err = undoCount(value[32:], 32+4+32+8+1)
+		if err != nil {
+			return nil, err
+		}
+		tu.Spent = make([]tbcd.SpentOutput, spent)
+		for i := range tu.Spent {
+			so := &tu.Spent[i]
+			if len(value) < 32+4+32+8 {
+				return nil, fmt.Errorf("invalid spent output "+
+					"length: %v", len(value))
+			}
+			so.Outpoint = tbcd.NewOutpoint([32]byte(value[:32]),
+				binary.BigEndian.Uint32(value[32:36]))
+			copy(so.ScriptHash[:], value[36:68])
+			so.Value = binary.BigEndian.Uint64(value[68:76])
+			value = value[76:]
+			l, n := binary.Uvarint(value)
+			if n <= 0 || l > uint64(len(value)-n)+1 {
+				return nil, errors.New("invalid spent output " +
+					"script length")
+			}
+			value = value[n:]
+			if l > 0 {
+				so.PkScript = value[:l-1]
+				value = value[l-1:]
+			}
+		}
+		var created int
+		created, value, err = undoCount(value, 4+32)
+		if err != nil {
+			return nil, err
+		}
+		tu.Created = make([]tbcd.CreatedOutput, created)
+		for i := range tu.Created {
+			co := &tu.Created[i]
+			co.Index = binary.BigEndian.Uint32(value[:4])
+			copy(co.ScriptHash[:], value[4:36])
+			value = value[36:]
+		}
+	}
+	if len(value) != 0 {
+		return nil, fmt.Errorf("invalid undo length: %v", len(value))
+	}
+	return bu, nil
+}
+
+// encodePeer encodes a peer as [last_seen,successes,failures,score,ban_until]
+// or [8+4+4+4+8] bytes. The address is the leveldb table key.
+func encodePeer(p *tbcd.Peer) (ep [28]byte) {
+	binary.BigEndian.PutUint64(ep[0:8], unixTime(p.LastSeen))
+	binary.BigEndian.PutUint32(ep[8:12], p.Successes)
+	binary.BigEndian.PutUint32(ep[12:16], p.Failures)
+	binary.BigEndian.PutUint32(ep[16:20], p.Score)
+	binary.BigEndian.PutUint64(ep[20:28], unixTime(p.BanUntil))
+	return
+}
+
+// decodePeer reverses the process of encodePeer.
+func decodePeer(address string, ep []byte) (*tbcd.Peer, error) {
+	if len(ep) != 28 {
+		return nil, fmt.Errorf("invalid peer length: %v", len(ep))
+	}
+	return &tbcd.Peer{
+		Address:   address,
+		LastSeen:  timeUnix(binary.BigEndian.Uint64(ep[0:8])),
+		Successes: binary.BigEndian.Uint32(ep[8:12]),
+		Failures:  binary.BigEndian.Uint32(ep[12:16]),
+		Score:     binary.BigEndian.Uint32(ep[16:20]),
+		BanUntil:  timeUnix(binary.BigEndian.Uint64(ep[20:28])),
+	}, nil
+}
+
+// Peers returns all peers in the address book.
+func (l *ldb) Peers(ctx context.Context) ([]tbcd.Peer, error) {
+	log.Tracef("Peers")
+	defer log.Tracef("Peers exit")
+
+	pDB := l.pool[level.PeersDB]
+	it := pDB.NewIterator(nil, nil)
+	defer it.Release()
+
+	var peers []tbcd.Peer
+	for it.Next() {
+		p, err := decodePeer(string(it.Key()), it.Value())
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", it.Key(), err)
+		}
+		peers = append(peers, *p)
+	}
+	if err := it.Error(); err != nil {
+		return nil, IteratorError(err)
+	}
+
+	return peers, nil
+}
+
+// PeersInsert inserts or overwrites peers in the address book.
+func (l *ldb) PeersInsert(ctx context.Context, peers []tbcd.Peer) error {
+	log.Tracef("PeersInsert")
+	defer log.Tracef("PeersInsert exit")
+
+	pBatch := new(leveldb.Batch)
+	for k := range peers {
+		ep := encodePeer(&peers[k])
+		pBatch.Put([]byte(peers[k].Address), ep[:])
+	}
+
+	pDB := l.pool[level.PeersDB]
+	if err := pDB.Write(pBatch, nil); err != nil {
+		return fmt.Errorf("peers insert: %w", err)
+	}
+
+	return nil
+}
+
+// PeersDelete removes peers from the address book.
+func (l *ldb) PeersDelete(ctx context.Context, addresses []string) error {
+	log.Tracef("PeersDelete")
+	defer log.Tracef("PeersDelete exit")
+
+	pBatch := new(leveldb.Batch)
+	for _, address := range addresses {
+		pBatch.Delete([]byte(address))
+	}
+
+	pDB := l.pool[level.PeersDB]
+	if err := pDB.Write(pBatch, nil); err != nil {
+		return fmt.Errorf("peers delete: %w", err)
+	}
+
+	return nil
+}
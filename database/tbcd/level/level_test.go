@@ -6,7 +6,10 @@ import (
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/davecgh/go-spew/spew"
 
 	"github.com/hemilabs/heminetwork/database"
@@ -112,3 +115,235 @@ func TestMD(t *testing.T) {
 		t.Fatal("expected no return value")
 	}
 }
+
+func TestPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	cfg := level.NewConfig(t.TempDir())
+	db, err := level.New(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	now := time.Unix(time.Now().Unix(), 0)
+	peers := []tbcd.Peer{
+		{
+			Address:   "127.0.0.1:18333",
+			LastSeen:  now,
+			Successes: 3,
+			Failures:  1,
+		},
+		{
+			Address:  "127.0.0.2:18333",
+			Failures: 7,
+			Score:    100,
+			BanUntil: now.Add(time.Hour),
+		},
+	}
+	if err := db.PeersInsert(ctx, peers); err != nil {
+		t.Fatal(err)
+	}
+	rpeers, err := db.Peers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rpeers, peers) {
+		t.Fatalf("expected %v got %v", spew.Sdump(peers),
+			spew.Sdump(rpeers))
+	}
+
+	// Overwrite and delete
+	peers[0].Successes++
+	if err := db.PeersInsert(ctx, peers[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PeersDelete(ctx, []string{peers[1].Address}); err != nil {
+		t.Fatal(err)
+	}
+	rpeers, err = db.Peers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rpeers, peers[:1]) {
+		t.Fatalf("expected %v got %v", spew.Sdump(peers[:1]),
+			spew.Sdump(rpeers))
+	}
+}
+
+func TestSpentOutputs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	cfg := level.NewConfig(t.TempDir())
+	db, err := level.New(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	script := []byte{0x51}
+	op := tbcd.NewOutpoint(chainhash.DoubleHashH([]byte("tx")), 1)
+	if err := db.BlockScriptUpdate(ctx, 1, map[tbcd.Outpoint][]byte{
+		op: script,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rscript, err := db.ScriptByOutpoint(ctx, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rscript, script) {
+		t.Fatalf("expected script %x got %x", script, rscript)
+	}
+	if err := db.BlockScriptUpdate(ctx, 1, map[tbcd.Outpoint][]byte{
+		op: nil,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ScriptByOutpoint(ctx, op); !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected %v got %v", database.ErrNotFound, err)
+	}
+
+	hash := chainhash.DoubleHashH([]byte("block"))
+	coinbase := chainhash.DoubleHashH([]byte("coinbase"))
+	txId := chainhash.DoubleHashH([]byte("tx"))
+	bu := &tbcd.BlockUndo{
+		Txs: []tbcd.TxUndo{
+			{
+				TxId:  coinbase,
+				Spent: []tbcd.SpentOutput{},
+				Created: []tbcd.CreatedOutput{
+					{
+						Index:      0,
+						ScriptHash: tbcd.NewScriptHashFromScript(script),
+					},
+				},
+			},
+			{
+				TxId: txId,
+				Spent: []tbcd.SpentOutput{
+					{
+						Outpoint:   op,
+						ScriptHash: tbcd.NewScriptHashFromScript(script),
+						Value:      5000,
+						PkScript:   script,
+					},
+					{
+						Outpoint:   tbcd.NewOutpoint(coinbase, 1),
+						ScriptHash: tbcd.NewScriptHashFromScript(nil),
+						Value:      1,
+						PkScript:   []byte{},
+					},
+					{
+						Outpoint:   tbcd.NewOutpoint(coinbase, 2),
+						ScriptHash: tbcd.NewScriptHashFromScript([]byte("unknown")),
+						Value:      7,
+					},
+				},
+				Created: []tbcd.CreatedOutput{},
+			},
+		},
+	}
+	if err := db.BlockUndoUpdate(ctx, 1, map[chainhash.Hash]*tbcd.BlockUndo{
+		hash: bu,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rbu, err := db.BlockUndoByHash(ctx, &hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rbu, bu) {
+		t.Fatalf("expected %v got %v", spew.Sdump(bu), spew.Sdump(rbu))
+	}
+	if !reflect.DeepEqual(rbu.SpentOutputs(), bu.Txs[1].Spent) {
+		t.Fatalf("unexpected spent outputs: %v",
+			spew.Sdump(rbu.SpentOutputs()))
+	}
+	if err := db.BlockUndoUpdate(ctx, -1, map[chainhash.Hash]*tbcd.BlockUndo{
+		hash: nil,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.BlockUndoByHash(ctx, &hash); !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected %v got %v", database.ErrNotFound, err)
+	}
+}
+
+func TestBlockHashByTxIdDuplicate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	cfg := level.NewConfig(t.TempDir())
+	db, err := level.New(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	genesis := &wire.BlockHeader{Bits: 0x207fffff}
+	if err := db.BlockHeaderGenesisInsert(ctx, genesis, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	b1 := wire.BlockHeader{PrevBlock: genesis.BlockHash(), Bits: 0x207fffff, Nonce: 1}
+	b2 := wire.BlockHeader{PrevBlock: b1.BlockHash(), Bits: 0x207fffff, Nonce: 2}
+	_, _, _, _, err = db.BlockHeadersInsert(ctx, &wire.MsgHeaders{
+		Headers: []*wire.BlockHeader{&b1, &b2},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert the same txid in both blocks, like the BIP30 duplicate
+	// coinbases.
+	txId := chainhash.DoubleHashH([]byte("coinbase"))
+	h1, h2 := b1.BlockHash(), b2.BlockHash()
+	if err := db.BlockTxUpdate(ctx, 1, map[tbcd.TxKey]*tbcd.TxValue{
+		tbcd.NewTxMapping(&txId, &h2): nil,
+		tbcd.NewTxMapping(&txId, &h1): nil,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := db.BlockHashByTxId(ctx, &txId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hash.IsEqual(&h2) {
+		t.Fatalf("expected block %v got %v", h2, hash)
+	}
+
+	for _, tt := range []struct {
+		hash chainhash.Hash
+		ok   bool
+	}{
+		{hash: h1, ok: true},
+		{hash: h2, ok: true},
+		{hash: genesis.BlockHash(), ok: false},
+	} {
+		ok, err := db.BlockInTxIndex(ctx, &tt.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.ok {
+			t.Fatalf("block %v in tx index: expected %v got %v",
+				tt.hash, tt.ok, ok)
+		}
+	}
+}
@@ -5,15 +5,22 @@
 package rawdb
 
 import (
+	"cmp"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 
+	"github.com/golang/snappy"
 	"github.com/juju/loggo"
+	"github.com/klauspost/compress/zstd"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 const (
@@ -23,13 +30,112 @@ const (
 	dataDir  = "data"
 
 	DefaultMaxFileSize = 256 * 1024 * 1024 // 256MB file max; will never be bigger.
+
+	compactSuffix = ".compact" // data file being rewritten by Compact
 )
 
 var (
-	log             = loggo.GetLogger("rawdb")
-	lastFilenameKey = []byte("lastfilename")
+	log              = loggo.GetLogger("rawdb")
+	lastFilenameKey  = []byte("lastfilename")
+	prunedKeyPrefix  = []byte("pruned")  // pruned data file number
+	compactKeyPrefix = []byte("compact") // data file number being compacted
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrPruned   = errors.New("pruned")
+	ErrChecksum = errors.New("checksum mismatch")
+)
+
+// Compression is the compression algorithm values are stored with.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+var compressions = map[Compression]string{
+	CompressionNone:   "none",
+	CompressionSnappy: "snappy",
+	CompressionZstd:   "zstd",
+}
+
+func (c Compression) String() string {
+	if s, ok := compressions[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown compression %d", c)
+}
+
+// ParseCompression returns the compression with the provided name. An empty
+// name is CompressionNone.
+func ParseCompression(name string) (Compression, error) {
+	if name == "" {
+		return CompressionNone, nil
+	}
+	for c, s := range compressions {
+		if s == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid compression: %v", name)
+}
+
+// Coordinates locate a value in the data files. Version 0 coordinates are
+// written by older releases and point to an uncompressed value without a
+// checksum. Version 1 coordinates add the compression of the stored value and
+// its CRC32C checksum.
+//
+//	v0: file number + offset + size                                    | [4 + 4 + 4]
+//	v1: file number + offset + size + version + compression + checksum | [4 + 4 + 4 + 1 + 1 + 4]
+const (
+	coordinatesV0Size = 12
+	coordinatesV1Size = 18
+
+	coordinatesV1 = 1
 )
 
+type coordinates struct {
+	number      uint32
+	offset      uint32
+	size        uint32 // stored size
+	version     uint8
+	compression Compression
+	checksum    uint32 // CRC32C of the stored value
+}
+
+func decodeCoordinates(c []byte) (*coordinates, error) {
+	switch {
+	case len(c) == coordinatesV0Size:
+	case len(c) == coordinatesV1Size && c[12] == coordinatesV1:
+	default:
+		return nil, errors.New("invalid coordinates")
+	}
+	co := &coordinates{
+		number: binary.BigEndian.Uint32(c[0:4]),
+		offset: binary.BigEndian.Uint32(c[4:8]),
+		size:   binary.BigEndian.Uint32(c[8:12]),
+	}
+	if len(c) == coordinatesV1Size {
+		co.version = c[12]
+		co.compression = Compression(c[13])
+		co.checksum = binary.BigEndian.Uint32(c[14:18])
+	}
+	return co, nil
+}
+
+func (co *coordinates) encode() []byte {
+	c := make([]byte, coordinatesV1Size)
+	binary.BigEndian.PutUint32(c[0:4], co.number)
+	binary.BigEndian.PutUint32(c[4:8], co.offset)
+	binary.BigEndian.PutUint32(c[8:12], co.size)
+	c[12] = coordinatesV1
+	c[13] = byte(co.compression)
+	binary.BigEndian.PutUint32(c[14:18], co.checksum)
+	return c
+}
+
 func init() {
 	if err := loggo.ConfigureLoggers(logLevel); err != nil {
 		panic(err)
@@ -37,12 +143,17 @@ func init() {
 }
 
 type RawDB struct {
-	mtx sync.RWMutex
+	mtx        sync.RWMutex
+	compactMtx sync.Mutex // serializes Compact
 
 	home string
 
 	maxSize int64
 
+	compression Compression
+	encoder     *zstd.Encoder
+	decoder     *zstd.Decoder
+
 	index *leveldb.DB
 }
 
@@ -72,10 +183,76 @@ func (r *RawDB) Open() error {
 	if err != nil {
 		return fmt.Errorf("mkdir: %w", err)
 	}
+	if err := r.compactRecover(); err != nil {
+		return fmt.Errorf("compact recover: %w", err)
+	}
+
+	// EncodeAll and DecodeAll may be called concurrently.
+	r.encoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		return fmt.Errorf("zstd writer: %w", err)
+	}
+	r.decoder, err = zstd.NewReader(nil)
+	if err != nil {
+		return fmt.Errorf("zstd reader: %w", err)
+	}
+
+	return nil
+}
+
+// SetCompression sets the compression of values that are inserted from now
+// on. Values that are already stored are read regardless of compression.
+func (r *RawDB) SetCompression(c Compression) error {
+	if _, ok := compressions[c]; !ok {
+		return fmt.Errorf("invalid compression: %v", c)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
 
+	r.compression = c
 	return nil
 }
 
+// encode returns value as it is stored with compression c. The value is
+// stored uncompressed when compression does not make it smaller.
+func (r *RawDB) encode(c Compression, value []byte) (Compression, []byte) {
+	var data []byte
+	switch c {
+	case CompressionSnappy:
+		data = snappy.Encode(nil, value)
+	case CompressionZstd:
+		data = r.encoder.EncodeAll(value, nil)
+	default:
+		return CompressionNone, value
+	}
+	if len(data) >= len(value) {
+		return CompressionNone, value
+	}
+	return c, data
+}
+
+// decode verifies the checksum of stored data and returns the decompressed
+// value.
+func (r *RawDB) decode(co *coordinates, data []byte) ([]byte, error) {
+	if co.version == 0 {
+		return data, nil
+	}
+	if crc32.Checksum(data, castagnoli) != co.checksum {
+		return nil, ErrChecksum
+	}
+	switch co.compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionSnappy:
+		return snappy.Decode(nil, data)
+	case CompressionZstd:
+		return r.decoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("invalid compression: %v", co.compression)
+	}
+}
+
 func (r *RawDB) Close() error {
 	log.Tracef("Close")
 	defer log.Tracef("Close exit")
@@ -83,6 +260,14 @@ func (r *RawDB) Close() error {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 
+	if r.encoder != nil {
+		if err := r.encoder.Close(); err != nil {
+			log.Errorf("zstd encoder close: %v", err)
+		}
+	}
+	if r.decoder != nil {
+		r.decoder.Close()
+	}
 	err := r.index.Close()
 	if err != nil {
 		return err
@@ -102,11 +287,6 @@ func (r *RawDB) Insert(key, value []byte) error {
 	log.Tracef("Insert")
 	defer log.Tracef("Insert exit")
 
-	if int64(len(value)) > r.maxSize {
-		return fmt.Errorf("length exceeds maximum length: %v > %v",
-			len(value), r.maxSize)
-	}
-
 	// Assert we do not have this key stored yet.
 	if ok, err := r.index.Has(key, nil); ok {
 		return errors.New("key already exists")
@@ -114,6 +294,17 @@ func (r *RawDB) Insert(key, value []byte) error {
 		return err
 	}
 
+	// Compress outside of the lock, the compression that was used is
+	// recorded in the coordinates.
+	r.mtx.RLock()
+	compression := r.compression
+	r.mtx.RUnlock()
+	compression, value = r.encode(compression, value)
+	if int64(len(value)) > r.maxSize {
+		return fmt.Errorf("length exceeds maximum length: %v > %v",
+			len(value), r.maxSize)
+	}
+
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
 
@@ -161,10 +352,13 @@ func (r *RawDB) Insert(key, value []byte) error {
 			continue
 		} else {
 			// Encoded coordinates.
-			c := make([]byte, 4+4+4)
-			binary.BigEndian.PutUint32(c[0:4], last)
-			binary.BigEndian.PutUint32(c[4:8], uint32(fi.Size()))
-			binary.BigEndian.PutUint32(c[8:12], uint32(len(value)))
+			c := (&coordinates{
+				number:      last,
+				offset:      uint32(fi.Size()),
+				size:        uint32(len(value)),
+				compression: compression,
+				checksum:    crc32.Checksum(value, castagnoli),
+			}).encode()
 
 			// Append value to latest file.
 			n, err := fh.Write(value)
@@ -186,24 +380,166 @@ func (r *RawDB) Insert(key, value []byte) error {
 	}
 }
 
+func (r *RawDB) dataFilename(number uint32) string {
+	return filepath.Join(r.home, dataDir, fmt.Sprintf("%010v", number))
+}
+
+func prunedKey(number uint32) []byte {
+	key := make([]byte, len(prunedKeyPrefix)+4)
+	copy(key, prunedKeyPrefix)
+	binary.BigEndian.PutUint32(key[len(prunedKeyPrefix):], number)
+	return key
+}
+
+func (r *RawDB) lastFilename() (uint32, error) {
+	lfe, err := r.index.Get(lastFilenameKey, nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(lfe), nil
+}
+
+// Location returns the number of the data file the value of the provided key
+// is stored in.
+func (r *RawDB) Location(key []byte) (uint32, error) {
+	log.Tracef("Location: %x", key)
+	defer log.Tracef("Location exit: %x", key)
+
+	c, err := r.index.Get(key, nil)
+	if err != nil {
+		return 0, err
+	}
+	co, err := decodeCoordinates(c)
+	if err != nil {
+		// Should not happen.
+		return 0, err
+	}
+	return co.number, nil
+}
+
+// DataFile describes a data file.
+type DataFile struct {
+	Number uint32
+	Size   int64 // Size on disk, 0 when pruned
+	Pruned bool
+}
+
+// DataFiles returns all data files in ascending order. The last entry is the
+// file that is currently being appended to.
+func (r *RawDB) DataFiles() ([]DataFile, error) {
+	log.Tracef("DataFiles")
+	defer log.Tracef("DataFiles exit")
+
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	last, err := r.lastFilename()
+	if err != nil {
+		return nil, err
+	}
+	dfs := make([]DataFile, 0, last+1)
+	for number := uint32(0); number <= last; number++ {
+		pruned, err := r.index.Has(prunedKey(number), nil)
+		if err != nil {
+			return nil, err
+		}
+		df := DataFile{Number: number, Pruned: pruned}
+		if !pruned {
+			fi, err := os.Stat(r.dataFilename(number))
+			switch {
+			case err == nil:
+				df.Size = fi.Size()
+			case errors.Is(err, os.ErrNotExist):
+				// File has not been created yet.
+			default:
+				return nil, err
+			}
+		}
+		dfs = append(dfs, df)
+	}
+	return dfs, nil
+}
+
+// Prune deletes the provided data file. The keys that point into the file are
+// retained and Get returns ErrPruned for them. The file that is currently
+// being appended to cannot be pruned.
+func (r *RawDB) Prune(number uint32) error {
+	log.Tracef("Prune: %v", number)
+	defer log.Tracef("Prune exit: %v", number)
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	last, err := r.lastFilename()
+	if err != nil {
+		return err
+	}
+	if number >= last {
+		return fmt.Errorf("cannot prune active file: %v", number)
+	}
+
+	// Mark pruned first so that a failed delete is retried on the next
+	// prune and never results in a missing file.
+	if err := r.index.Put(prunedKey(number), nil, nil); err != nil {
+		return err
+	}
+	err = os.Remove(r.dataFilename(number))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Walk calls f for every stored key with the number of the data file its value
+// is stored in.
+func (r *RawDB) Walk(f func(key []byte, number uint32) error) error {
+	log.Tracef("Walk")
+	defer log.Tracef("Walk exit")
+
+	it := r.index.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		co, err := decodeCoordinates(it.Value())
+		if err != nil {
+			// Not a key, e.g. lastfilename.
+			continue
+		}
+		if err := f(it.Key(), co.number); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// Get returns the value of the provided key. ErrChecksum is returned when the
+// stored value is corrupt.
 func (r *RawDB) Get(key []byte) ([]byte, error) {
 	log.Tracef("Get: %x", key)
 	defer log.Tracef("Get exit: %x", key)
 
+	// Compact moves values between files.
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
 	c, err := r.index.Get(key, nil)
 	if err != nil {
 		return nil, err
 	}
-	if len(c) != 12 {
+	co, err := decodeCoordinates(c)
+	if err != nil {
 		// Should not happen.
-		return nil, errors.New("invalid coordinates")
+		return nil, err
 	}
-	filename := filepath.Join(r.home, dataDir, fmt.Sprintf("%010v",
-		binary.BigEndian.Uint32(c[0:4])))
-	offset := binary.BigEndian.Uint32(c[4:8])
-	size := binary.BigEndian.Uint32(c[8:12])
-	f, err := os.OpenFile(filename, os.O_RDONLY, 0o600)
+	f, err := os.OpenFile(r.dataFilename(co.number), os.O_RDONLY, 0o600)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			if pruned, _ := r.index.Has(prunedKey(co.number), nil); pruned {
+				return nil, ErrPruned
+			}
+		}
 		return nil, err
 	}
 	defer func() {
@@ -213,14 +549,200 @@ func (r *RawDB) Get(key []byte) ([]byte, error) {
 		}
 	}()
 
-	data := make([]byte, size)
-	n, err := f.ReadAt(data, int64(offset))
+	data := make([]byte, co.size)
+	n, err := f.ReadAt(data, int64(co.offset))
 	if err != nil {
 		return nil, err
 	}
-	if n != int(size) {
+	if n != int(co.size) {
 		return nil, errors.New("invalid read size")
 	}
 
-	return data, nil
+	value, err := r.decode(co, data)
+	if err != nil {
+		return nil, fmt.Errorf("%x: %w", key, err)
+	}
+	return value, nil
+}
+
+func compactKey(number uint32) []byte {
+	key := make([]byte, len(compactKeyPrefix)+4)
+	copy(key, compactKeyPrefix)
+	binary.BigEndian.PutUint32(key[len(compactKeyPrefix):], number)
+	return key
+}
+
+// compactRecover finishes or discards compactions that were interrupted. A
+// compaction is finished when its coordinates were committed, which is marked
+// by the compact key.
+func (r *RawDB) compactRecover() error {
+	it := r.index.NewIterator(util.BytesPrefix(compactKeyPrefix), nil)
+	defer it.Release()
+	for it.Next() {
+		number := binary.BigEndian.Uint32(it.Key()[len(compactKeyPrefix):])
+		filename := r.dataFilename(number)
+		err := os.Rename(filename+compactSuffix, filename)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := r.index.Delete(it.Key(), nil); err != nil {
+			return err
+		}
+		log.Infof("Recovered compaction of data file %v", number)
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	// Remaining compacted files were never committed.
+	filenames, err := filepath.Glob(filepath.Join(r.home, dataDir,
+		"*"+compactSuffix))
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		if err := os.Remove(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the provided data file with the current compression and
+// checksums the values, values that were written by older releases are
+// upgraded. The file that is currently being appended to and pruned files
+// cannot be compacted.
+func (r *RawDB) Compact(number uint32) error {
+	log.Tracef("Compact: %v", number)
+	defer log.Tracef("Compact exit: %v", number)
+
+	r.compactMtx.Lock()
+	defer r.compactMtx.Unlock()
+
+	// Values are only ever appended to the last file so the values of the
+	// file being compacted cannot change until the new coordinates are
+	// committed.
+	r.mtx.RLock()
+	compression := r.compression
+	last, err := r.lastFilename()
+	if err != nil {
+		r.mtx.RUnlock()
+		return err
+	}
+	pruned, err := r.index.Has(prunedKey(number), nil)
+	r.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+	if number >= last {
+		return fmt.Errorf("cannot compact active file: %v", number)
+	}
+	if pruned {
+		return ErrPruned
+	}
+
+	type entry struct {
+		key []byte
+		co  *coordinates
+	}
+	var entries []entry
+	it := r.index.NewIterator(nil, nil)
+	for it.Next() {
+		co, err := decodeCoordinates(it.Value())
+		if err != nil || co.number != number {
+			continue
+		}
+		entries = append(entries, entry{
+			key: append([]byte{}, it.Key()...),
+			co:  co,
+		})
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return err
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return cmp.Compare(a.co.offset, b.co.offset)
+	})
+
+	filename := r.dataFilename(number)
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := src.Close(); err != nil {
+			log.Errorf("close %v: %v", filename, err)
+		}
+	}()
+	dst, err := os.OpenFile(filename+compactSuffix,
+		os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if err := dst.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			log.Errorf("close %v: %v", dst.Name(), err)
+		}
+		if !committed {
+			if err := os.Remove(dst.Name()); err != nil {
+				log.Errorf("remove %v: %v", dst.Name(), err)
+			}
+		}
+	}()
+
+	batch := new(leveldb.Batch)
+	var offset uint32
+	for _, e := range entries {
+		data := make([]byte, e.co.size)
+		if _, err := src.ReadAt(data, int64(e.co.offset)); err != nil {
+			return fmt.Errorf("read %x: %w", e.key, err)
+		}
+		value, err := r.decode(e.co, data)
+		if err != nil {
+			return fmt.Errorf("%x: %w", e.key, err)
+		}
+		c, data := r.encode(compression, value)
+		if _, err := dst.Write(data); err != nil {
+			return err
+		}
+		batch.Put(e.key, (&coordinates{
+			number:      number,
+			offset:      offset,
+			size:        uint32(len(data)),
+			compression: c,
+			checksum:    crc32.Checksum(data, castagnoli),
+		}).encode())
+		offset += uint32(len(data))
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	// The file may have been pruned in the mean time.
+	if pruned, err := r.index.Has(prunedKey(number), nil); err != nil {
+		return err
+	} else if pruned {
+		return ErrPruned
+	}
+
+	// Commit the coordinates together with the compact key, the compacted
+	// file is moved in place by compactRecover if we crash before the
+	// rename.
+	batch.Put(compactKey(number), nil)
+	if err := r.index.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		return err
+	}
+	committed = true
+	if err := os.Rename(dst.Name(), filename); err != nil {
+		return err
+	}
+	return r.index.Delete(compactKey(number), nil)
 }
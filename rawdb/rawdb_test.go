@@ -6,6 +6,8 @@ package rawdb
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"os"
 	"testing"
 )
@@ -99,3 +101,278 @@ func TestRawDB(t *testing.T) {
 		t.Fatal("overflow data not identical")
 	}
 }
+
+func TestRawDBPrune(t *testing.T) {
+	home := t.TempDir()
+	blockSize := int64(4096)
+	rdb, err := New(home, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rdb.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := rdb.Close()
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	// Fill three files.
+	data := make([]byte, blockSize)
+	keys := [][]byte{[]byte("zero"), []byte("one"), []byte("two")}
+	for k, key := range keys {
+		err = rdb.Insert(key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		number, err := rdb.Location(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if number != uint32(k) {
+			t.Fatalf("expected file %v, got %v", k, number)
+		}
+	}
+
+	// The active file cannot be pruned.
+	if err = rdb.Prune(2); err == nil {
+		t.Fatal("expected active file prune to fail")
+	}
+
+	if err = rdb.Prune(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rdb.Get(keys[0]); !errors.Is(err, ErrPruned) {
+		t.Fatalf("expected pruned, got %v", err)
+	}
+	if _, err = rdb.Get(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	dfs, err := rdb.DataFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dfs) != len(keys) {
+		t.Fatalf("expected %v files, got %v", len(keys), len(dfs))
+	}
+	for k, df := range dfs {
+		pruned := k == 0
+		if df.Pruned != pruned {
+			t.Fatalf("file %v: expected pruned %v", df.Number, pruned)
+		}
+		if pruned && df.Size != 0 || !pruned && df.Size != blockSize {
+			t.Fatalf("file %v: unexpected size %v", df.Number, df.Size)
+		}
+	}
+
+	// Walk still returns pruned keys.
+	walked := 0
+	err = rdb.Walk(func(key []byte, number uint32) error {
+		walked++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walked != len(keys) {
+		t.Fatalf("expected %v keys, got %v", len(keys), walked)
+	}
+}
+
+func TestRawDBCompression(t *testing.T) {
+	home := t.TempDir()
+	blockSize := int64(4096)
+	rdb, err := New(home, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rdb.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := rdb.Close()
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	// Values written by older releases have no checksum.
+	legacy := []byte("legacy")
+	if err := os.WriteFile(rdb.dataFilename(0), legacy, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := make([]byte, coordinatesV0Size)
+	binary.BigEndian.PutUint32(c[8:12], uint32(len(legacy)))
+	if err := rdb.index.Put(legacy, c, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("hello, world!"), 100)
+	for _, compression := range []Compression{
+		CompressionNone, CompressionSnappy, CompressionZstd,
+	} {
+		if err := rdb.SetCompression(compression); err != nil {
+			t.Fatal(err)
+		}
+		dfs, err := rdb.DataFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := []byte(compression.String())
+		if err := rdb.Insert(key, data); err != nil {
+			t.Fatal(err)
+		}
+		dfs2, err := rdb.DataFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := dfs2[0].Size - dfs[0].Size
+		if compression == CompressionNone && stored != int64(len(data)) ||
+			compression != CompressionNone && stored >= int64(len(data)) {
+			t.Fatalf("%v: unexpected stored size %v", compression, stored)
+		}
+	}
+	for _, key := range []string{"legacy", "none", "snappy", "zstd"} {
+		value, err := rdb.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("%v: %v", key, err)
+		}
+		if key == "legacy" && !bytes.Equal(value, legacy) ||
+			key != "legacy" && !bytes.Equal(value, data) {
+			t.Fatalf("%v: data not identical", key)
+		}
+	}
+
+	// Roll over and compact the first file with zstd.
+	if err := rdb.SetCompression(CompressionNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.Insert([]byte("overflow"), make([]byte, blockSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.SetCompression(CompressionZstd); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.Compact(1); err == nil {
+		t.Fatal("expected active file compact to fail")
+	}
+	dfs, err := rdb.DataFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.Compact(0); err != nil {
+		t.Fatal(err)
+	}
+	dfs2, err := rdb.DataFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dfs2[0].Size >= dfs[0].Size {
+		t.Fatalf("file not compacted: %v >= %v", dfs2[0].Size, dfs[0].Size)
+	}
+	for _, key := range []string{"legacy", "none", "snappy", "zstd"} {
+		value, err := rdb.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("%v: %v", key, err)
+		}
+		if key == "legacy" && !bytes.Equal(value, legacy) ||
+			key != "legacy" && !bytes.Equal(value, data) {
+			t.Fatalf("%v: data not identical", key)
+		}
+	}
+	c, err = rdb.index.Get(legacy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != coordinatesV1Size {
+		t.Fatalf("legacy coordinates not upgraded: %x", c)
+	}
+
+	// Corruption is detected.
+	f, err := os.OpenFile(rdb.dataFilename(0), os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := 0
+	for _, key := range []string{"legacy", "none", "snappy", "zstd"} {
+		if _, err := rdb.Get([]byte(key)); errors.Is(err, ErrChecksum) {
+			corrupt++
+		}
+	}
+	if corrupt != 1 {
+		t.Fatalf("expected 1 corrupt value, got %v", corrupt)
+	}
+	if err := rdb.Compact(0); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("expected %v, got %v", ErrChecksum, err)
+	}
+}
+
+func TestRawDBCompactRecover(t *testing.T) {
+	home := t.TempDir()
+	rdb, err := New(home, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A committed compaction is moved in place, an uncommitted one is
+	// discarded.
+	committed := rdb.dataFilename(0)
+	uncommitted := rdb.dataFilename(1)
+	for _, filename := range []string{committed, uncommitted} {
+		if err := os.WriteFile(filename, []byte("old"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		err := os.WriteFile(filename+compactSuffix, []byte("new"), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rdb.index.Put(compactKey(0), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := rdb.Close()
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	for filename, expected := range map[string]string{
+		committed:   "new",
+		uncommitted: "old",
+	} {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("%v: expected %v, got %s", filename, expected, data)
+		}
+		if _, err := os.Stat(filename + compactSuffix); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%v: compacted file not removed: %v", filename, err)
+		}
+	}
+	if ok, err := rdb.index.Has(compactKey(0), nil); err != nil || ok {
+		t.Fatalf("compact key not removed: %v %v", ok, err)
+	}
+}
@@ -16,7 +16,6 @@ import (
 	"math/big"
 	"net/http"
 	"slices"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -159,19 +158,15 @@ func NewMiner(cfg *Config) (*Miner, error) {
 	}
 	m.SetFee(cfg.StaticFee)
 
-	switch strings.ToLower(cfg.BTCChainName) {
-	case "mainnet":
-		m.btcChainParams = &btcchaincfg.MainNetParams
-	case "testnet", "testnet3":
-		m.btcChainParams = &btcchaincfg.TestNet3Params
-	default:
+	var err error
+	m.btcChainParams, err = bitcoin.NetworkParams(cfg.BTCChainName, "")
+	if err != nil {
 		return nil, fmt.Errorf("unknown BTC chain name %q", cfg.BTCChainName)
 	}
 
 	if cfg.BTCPrivateKey == "" {
 		return nil, errors.New("no BTC private key provided")
 	}
-	var err error
 	m.btcPrivateKey, m.btcPublicKey, m.btcAddress, err = bitcoin.KeysAndAddressFromHexString(cfg.BTCPrivateKey, m.btcChainParams)
 	if err != nil {
 		return nil, err
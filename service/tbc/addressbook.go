@@ -0,0 +1,94 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+// Modified address book entries are written to the database periodically and
+// on shutdown.
+const defaultAddressBookFlushInterval = time.Minute
+
+// addressBookLoad loads the persisted address book into the peer manager.
+func (s *Server) addressBookLoad(ctx context.Context) error {
+	log.Tracef("addressBookLoad")
+	defer log.Tracef("addressBookLoad exit")
+
+	peers, err := s.db.Peers(ctx)
+	if err != nil {
+		return fmt.Errorf("peers: %w", err)
+	}
+	s.pm.addressBookLoad(peers)
+	log.Infof("Address book loaded: %v peers", len(peers))
+
+	return nil
+}
+
+// addressBookFlush writes the modified address book entries to the database.
+func (s *Server) addressBookFlush(ctx context.Context) error {
+	log.Tracef("addressBookFlush")
+	defer log.Tracef("addressBookFlush exit")
+
+	return s.pm.addressBookFlush(func(peers []tbcd.Peer, evicted []string) error {
+		if err := s.db.PeersInsert(ctx, peers); err != nil {
+			return fmt.Errorf("peers insert: %w", err)
+		}
+		if err := s.db.PeersDelete(ctx, evicted); err != nil {
+			return fmt.Errorf("peers delete: %w", err)
+		}
+		return nil
+	})
+}
+
+// addressBookFlusher periodically writes the address book to the database.
+func (s *Server) addressBookFlusher(ctx context.Context) {
+	log.Tracef("addressBookFlusher")
+	defer log.Tracef("addressBookFlusher exit")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(defaultAddressBookFlushInterval):
+		}
+
+		if err := s.addressBookFlush(ctx); err != nil {
+			log.Errorf("address book flush: %v", err)
+		}
+	}
+}
+
+// Peers returns the address book.
+func (s *Server) Peers() []tbcd.Peer {
+	return s.pm.AddressBook()
+}
+
+// PeerBan bans the host of address for duration d and disconnects all its
+// peers, inbound included.
+func (s *Server) PeerBan(ctx context.Context, address string, d time.Duration) error {
+	if err := s.pm.Ban(ctx, address, d); err != nil {
+		return err
+	}
+
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	for _, p := range s.inbound {
+		if s.pm.Banned(p.String()) {
+			_ = p.Close() // Not interesting, the peer is reaped.
+		}
+	}
+
+	return nil
+}
+
+// PeerUnban lifts the ban of the host of address.
+func (s *Server) PeerUnban(address string) error {
+	return s.pm.Unban(address)
+}
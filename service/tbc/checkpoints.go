@@ -0,0 +1,175 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+var ErrCheckpointMismatch = errors.New("checkpoint mismatch")
+
+// checkpointsAdd returns a copy of checkpoints with the extra checkpoints
+// added. Extra checkpoints are encoded as height:hash and must not conflict
+// with existing ones.
+func checkpointsAdd(checkpoints map[chainhash.Hash]uint64, extra []string) (map[chainhash.Hash]uint64, error) {
+	c := maps.Clone(checkpoints)
+	if c == nil {
+		c = make(map[chainhash.Hash]uint64, len(extra))
+	}
+	heights := make(map[uint64]chainhash.Hash, len(c)+len(extra))
+	for hash, height := range c {
+		heights[height] = hash
+	}
+	for _, e := range extra {
+		heightS, hashS, ok := strings.Cut(e, ":")
+		if !ok {
+			return nil, fmt.Errorf("checkpoint %v: expected height:hash", e)
+		}
+		height, err := strconv.ParseUint(heightS, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint %v: height: %w", e, err)
+		}
+		hash, err := chainhash.NewHashFromStr(hashS)
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint %v: hash: %w", e, err)
+		}
+		if h, ok := heights[height]; ok && !h.IsEqual(hash) {
+			return nil, fmt.Errorf("checkpoint %v: conflicts with %v",
+				e, h)
+		}
+		if h, ok := c[*hash]; ok && h != height {
+			return nil, fmt.Errorf("checkpoint %v: conflicts with "+
+				"height %v", e, h)
+		}
+		c[*hash] = height
+		heights[height] = *hash
+	}
+	return c, nil
+}
+
+// checkpointsVerify returns ErrCheckpointMismatch if any of the contiguous
+// headers lands on a checkpoint height with a different hash or connects below
+// the highest known checkpoint without being its ancestor. Headers that do not
+// connect to a known header are left to the database to reject.
+func (s *Server) checkpointsVerify(ctx context.Context, headers []*wire.BlockHeader) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	parent, err := s.db.BlockHeaderByHash(ctx, &headers[0].PrevBlock)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("parent header: %w", err)
+	}
+	first := parent.Height + 1
+	last := parent.Height + uint64(len(headers))
+	for hash, height := range s.checkpoints {
+		if height < first || height > last {
+			continue
+		}
+		if h := headers[height-first].BlockHash(); !h.IsEqual(&hash) {
+			return fmt.Errorf("%w: %v at height %v, expected %v",
+				ErrCheckpointMismatch, h, height, hash)
+		}
+	}
+
+	// A fork that branches below the highest known checkpoint is rejected
+	// even when it never lands on a checkpoint height. The headers are
+	// contiguous so it is enough to compare the highest one below the
+	// checkpoint with the checkpoint ancestor at that height.
+	cp, err := s.checkpointHeaderBest(ctx)
+	if err != nil {
+		return err
+	}
+	if parent.Height >= cp.Height {
+		return nil
+	}
+	height := min(last, cp.Height)
+	bhs, err := s.db.BlockHeadersByHeight(ctx, height)
+	if err != nil {
+		return fmt.Errorf("block headers by height %v: %w", height, err)
+	}
+	index, err := s.findPathFromHash(ctx, &cp.Hash, bhs)
+	if err != nil {
+		return fmt.Errorf("checkpoint ancestor %v: %w", height, err)
+	}
+	if h := headers[height-first].BlockHash(); !h.IsEqual(&bhs[index].Hash) {
+		return fmt.Errorf("%w: %v at height %v forks below checkpoint %v",
+			ErrCheckpointMismatch, h, height, cp.Hash)
+	}
+	return nil
+}
+
+// checkpointHeaderBest returns the header of the highest checkpoint that is
+// in the database. Genesis is always a checkpoint.
+func (s *Server) checkpointHeaderBest(ctx context.Context) (*tbcd.BlockHeader, error) {
+	c := make([]HashHeight, 0, len(s.checkpoints))
+	for k, v := range s.checkpoints {
+		c = append(c, HashHeight{Height: v, Hash: k})
+	}
+	sort.Slice(c, func(i, j int) bool {
+		return c[i].Height > c[j].Height
+	})
+	for _, hh := range c {
+		bh, err := s.db.BlockHeaderByHash(ctx, &hh.Hash)
+		if err == nil {
+			return bh, nil
+		}
+		if !errors.Is(err, database.ErrNotFound) {
+			return nil, fmt.Errorf("checkpoint header: %w", err)
+		}
+	}
+	return s.db.BlockHeaderByHash(ctx, s.chainParams.GenesisHash)
+}
+
+// assumeValidHeight returns the height of the assume valid block when it is
+// on the same chain as endHash. The scripts of the assume valid block and its
+// ancestors are not validated.
+func (s *Server) assumeValidHeight(ctx context.Context, endHash *chainhash.Hash) (uint64, bool, error) {
+	if s.assumeValid == nil {
+		return 0, false, nil
+	}
+	av, err := s.db.BlockHeaderByHash(ctx, s.assumeValid)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			// Not seen yet.
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("assume valid header: %w", err)
+	}
+	eh, err := s.db.BlockHeaderByHash(ctx, endHash)
+	if err != nil {
+		return 0, false, fmt.Errorf("end header: %w", err)
+	}
+
+	// Walk the higher of the two back to the height of the lower one.
+	low, high := av, eh
+	if eh.Height < av.Height {
+		low, high = eh, av
+	}
+	for high.Height > low.Height {
+		high, err = s.db.BlockHeaderByHash(ctx, high.ParentHash())
+		if err != nil {
+			return 0, false, fmt.Errorf("assume valid ancestor: %w", err)
+		}
+	}
+	if !high.Hash.IsEqual(&low.Hash) {
+		return 0, false, nil
+	}
+	return av.Height, true, nil
+}
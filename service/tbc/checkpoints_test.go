@@ -0,0 +1,164 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestCheckpointsAdd(t *testing.T) {
+	h1 := chainhash.DoubleHashH([]byte("1"))
+	h2 := chainhash.DoubleHashH([]byte("2"))
+	builtin := map[chainhash.Hash]uint64{h1: 100}
+
+	c, err := checkpointsAdd(builtin, []string{fmt.Sprintf("200:%v", h2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 2 || c[h2] != 200 {
+		t.Fatalf("unexpected checkpoints: %v", c)
+	}
+	if len(builtin) != 1 {
+		t.Fatal("builtin checkpoints modified")
+	}
+
+	// Repeating a builtin checkpoint is fine.
+	if _, err := checkpointsAdd(builtin, []string{fmt.Sprintf("100:%v", h1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, extra := range []string{
+		h2.String(),                 // no height
+		fmt.Sprintf("x:%v", h2),     // invalid height
+		"200:xyz",                   // invalid hash
+		fmt.Sprintf("100:%v", h2),   // height conflict
+		fmt.Sprintf("300:%v", h1),   // hash conflict
+		fmt.Sprintf("-1:%v", h2),    // negative height
+		fmt.Sprintf("200:%v:1", h2), // trailing garbage
+		fmt.Sprintf("200 :%v", h2),  // whitespace
+	} {
+		if _, err := checkpointsAdd(builtin, []string{extra}); err == nil {
+			t.Fatalf("%v: expected error", extra)
+		}
+	}
+}
+
+// testHeaders returns n headers on top of prev, tag makes forks unique.
+func testHeaders(prev chainhash.Hash, n int, tag uint32) []*wire.BlockHeader {
+	headers := make([]*wire.BlockHeader, 0, n)
+	ts := chaincfg.RegressionNetParams.GenesisBlock.Header.Timestamp
+	for k := range n {
+		bh := wire.NewBlockHeader(1, &prev, &chainhash.Hash{},
+			chaincfg.RegressionNetParams.PowLimitBits, tag)
+		bh.Timestamp = ts.Add(time.Duration(k+1) * time.Minute)
+		headers = append(headers, bh)
+		prev = bh.BlockHash()
+	}
+	return headers
+}
+
+func testHeadersInsert(ctx context.Context, t *testing.T, s *Server, headers []*wire.BlockHeader) {
+	t.Helper()
+
+	msg := wire.NewMsgHeaders()
+	for _, bh := range headers {
+		if err := msg.AddBlockHeader(bh); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, _, _, err := s.db.BlockHeadersInsert(ctx, msg, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckpointsVerify(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	genesis := *chaincfg.RegressionNetParams.GenesisHash
+	main := testHeaders(genesis, 5, 0)
+	fork := testHeaders(main[1].BlockHash(), 3, 1) // heights 3, 4 and 5
+
+	cfg := NewDefaultConfig()
+	cfg.Network = networkLocalnet
+	cfg.LevelDBHome = t.TempDir()
+	cfg.FullValidation = true
+	cfg.AssumeValid = main[3].BlockHash().String() // height 4
+	cfg.Checkpoints = []string{fmt.Sprintf("3:%v", main[2].BlockHash())}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assume valid is not known yet.
+	if _, ok, err := s.assumeValidHeight(ctx, &genesis); err != nil || ok {
+		t.Fatalf("unexpected assume valid: %v %v", ok, err)
+	}
+
+	if err := s.checkpointsVerify(ctx, main); err != nil {
+		t.Fatal(err)
+	}
+	testHeadersInsert(ctx, t, s, main)
+
+	// The fork conflicts with the checkpoint at height 3.
+	if err := s.checkpointsVerify(ctx, fork); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Fatalf("expected %v, got %v", ErrCheckpointMismatch, err)
+	}
+	// Headers that do not connect are left to the database.
+	if err := s.checkpointsVerify(ctx, fork[1:]); err != nil {
+		t.Fatalf("unconnected headers: %v", err)
+	}
+	// A fork below the checkpoint that never lands on it.
+	below := testHeaders(main[0].BlockHash(), 1, 2) // height 2
+	if err := s.checkpointsVerify(ctx, below); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Fatalf("fork below checkpoint: expected %v, got %v",
+			ErrCheckpointMismatch, err)
+	}
+	// Known headers below the checkpoint are its ancestors.
+	if err := s.checkpointsVerify(ctx, main[1:2]); err != nil {
+		t.Fatalf("ancestors: %v", err)
+	}
+	testHeadersInsert(ctx, t, s, fork)
+
+	tests := []struct {
+		name string
+		end  chainhash.Hash
+		ok   bool
+	}{
+		{name: "descendant", end: main[4].BlockHash(), ok: true},
+		{name: "self", end: main[3].BlockHash(), ok: true},
+		{name: "ancestor", end: main[1].BlockHash(), ok: true},
+		{name: "fork", end: fork[2].BlockHash(), ok: false},
+		{name: "fork below", end: fork[0].BlockHash(), ok: false},
+	}
+	for _, tt := range tests {
+		height, ok, err := s.assumeValidHeight(ctx, &tt.end)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if ok != tt.ok || (ok && height != 4) {
+			t.Fatalf("%v: got %v %v", tt.name, height, ok)
+		}
+	}
+}
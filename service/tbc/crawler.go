@@ -5,6 +5,7 @@
 package tbc
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -15,8 +16,11 @@ import (
 
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/gcs/builder"
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/dustin/go-humanize"
 
@@ -33,10 +37,17 @@ func s2h(s string) chainhash.Hash {
 }
 
 var (
-	UtxoIndexHashKey = []byte("utxoindexhash") // last indexed utxo hash
-	TxIndexHashKey   = []byte("txindexhash")   // last indexed tx hash
+	UtxoIndexHashKey   = []byte("utxoindexhash")   // last indexed utxo hash
+	UtxoSnapshotKey    = []byte("utxosnapshot")    // imported utxo snapshot digest
+	TxIndexHashKey     = []byte("txindexhash")     // last indexed tx hash
+	FilterIndexHashKey = []byte("filterindexhash") // last indexed filter hash
+	InvalidBlocksKey   = []byte("invalidblocks")   // blocks that failed validation
+	UtxoUndoPrunedKey  = []byte("utxoundopruned")  // highest pruned undo height
+	IndexLowerBoundKey = []byte("indexlowerbound") // utxo snapshot block
 
 	ErrAlreadyIndexing = errors.New("already indexing")
+	ErrBlockInvalid    = errors.New("block invalid")
+	ErrPkScriptUnknown = errors.New("pk script unknown, rebuild utxo index")
 
 	testnet3Checkpoints = map[chainhash.Hash]uint64{
 		s2h("000000000000098faa89ab34c3ec0e6e037698e3e54c8d1bbb9dcfe0054a8e7a"): 3200000,
@@ -86,6 +97,12 @@ func (e NotLinearError) Is(target error) bool {
 
 var ErrNotLinear = NotLinearError("not linear")
 
+// genesisCheckpoints returns the checkpoints of networks without hard coded
+// checkpoints, only genesis is known.
+func genesisCheckpoints(params *chaincfg.Params) map[chainhash.Hash]uint64 {
+	return map[chainhash.Hash]uint64{*params.GenesisHash: 0}
+}
+
 func lastCheckpointHeight(height uint64, hhm map[chainhash.Hash]uint64) uint64 {
 	c := make([]HashHeight, 0, len(hhm))
 	for k, v := range hhm {
@@ -145,6 +162,17 @@ func (s *Server) TxIndexHash(ctx context.Context) (*HashHeight, error) {
 	return s.mdHashHeight(ctx, TxIndexHashKey)
 }
 
+// FilterIndexHash returns the last hash that has been filter indexed.
+func (s *Server) FilterIndexHash(ctx context.Context) (*HashHeight, error) {
+	return s.mdHashHeight(ctx, FilterIndexHashKey)
+}
+
+// IndexLowerBound returns the utxo snapshot block the indexes were started
+// from. Blocks at or below it are not indexed.
+func (s *Server) IndexLowerBound(ctx context.Context) (*HashHeight, error) {
+	return s.mdHashHeight(ctx, IndexLowerBoundKey)
+}
+
 func (s *Server) findCommonParent(ctx context.Context, bhX, bhY *tbcd.BlockHeader) (*tbcd.BlockHeader, error) {
 	// This function has one odd corner case. If bhX and bhY are both on a
 	// "long" chain without multiple blockheaders it will terminate on the
@@ -315,7 +343,7 @@ func logMemStats() {
 		mem.NumGC)
 }
 
-func processUtxos(txs []*btcutil.Tx, utxos map[tbcd.Outpoint]tbcd.CacheOutput) error {
+func processUtxos(txs []*btcutil.Tx, utxos map[tbcd.Outpoint]tbcd.CacheOutput, scripts map[tbcd.Outpoint][]byte) error {
 	for _, tx := range txs {
 		for _, txIn := range tx.MsgTx().TxIn {
 			if blockchain.IsCoinBase(tx) {
@@ -326,22 +354,143 @@ func processUtxos(txs []*btcutil.Tx, utxos map[tbcd.Outpoint]tbcd.CacheOutput) e
 				txIn.PreviousOutPoint.Index)
 			if utxo, ok := utxos[op]; ok && !utxo.IsDelete() {
 				delete(utxos, op)
+				delete(scripts, op)
 				continue
 			}
+			scripts[op] = nil // delete from disk
 		}
 		for outIndex, txOut := range tx.MsgTx().TxOut {
 			if txscript.IsUnspendable(txOut.PkScript) {
 				continue
 			}
-			utxos[tbcd.NewOutpoint(*tx.Hash(), uint32(outIndex))] = tbcd.NewCacheOutput(
+			op := tbcd.NewOutpoint(*tx.Hash(), uint32(outIndex))
+			utxos[op] = tbcd.NewCacheOutput(
 				tbcd.NewScriptHashFromScript(txOut.PkScript),
 				uint64(txOut.Value),
 				uint32(outIndex))
+			// Copy so that the block can be released, this also
+			// ensures that an empty pk script is not nil.
+			scripts[op] = append([]byte{}, txOut.PkScript...)
+		}
+	}
+	return nil
+}
+
+// blockUndo returns how the provided block changes the utxo index. The outputs
+// it spends are looked up in the block itself, in the utxo and script caches
+// and in the outputs that fixupCache retrieved from the database. It must
+// therefore be called after fixupCache and before processUtxos.
+func blockUndo(b *btcutil.Block, utxos map[tbcd.Outpoint]tbcd.CacheOutput, scripts map[tbcd.Outpoint][]byte, fetched map[tbcd.Outpoint]tbcd.SpentOutput) (*tbcd.BlockUndo, error) {
+	outs := make(map[tbcd.Outpoint]*wire.TxOut, len(b.Transactions()))
+	defer clear(outs)
+	bu := &tbcd.BlockUndo{
+		Txs: make([]tbcd.TxUndo, 0, len(b.Transactions())),
+	}
+	for _, tx := range b.Transactions() {
+		tu := tbcd.TxUndo{TxId: *tx.Hash()}
+		// Outputs may be spent by later transactions in the same block
+		// but never by earlier ones.
+		for _, txIn := range tx.MsgTx().TxIn {
+			if blockchain.IsCoinBase(tx) {
+				// Skip coinbase inputs
+				break
+			}
+			op := tbcd.NewOutpoint(txIn.PreviousOutPoint.Hash,
+				txIn.PreviousOutPoint.Index)
+			if txOut, ok := outs[op]; ok {
+				tu.Spent = append(tu.Spent, tbcd.SpentOutput{
+					Outpoint:   op,
+					ScriptHash: tbcd.NewScriptHashFromScript(txOut.PkScript),
+					Value:      uint64(txOut.Value),
+					PkScript:   append([]byte{}, txOut.PkScript...),
+				})
+				continue
+			}
+			if utxo, ok := utxos[op]; ok && !utxo.IsDelete() {
+				tu.Spent = append(tu.Spent, tbcd.SpentOutput{
+					Outpoint:   op,
+					ScriptHash: utxo.ScriptHash(),
+					Value:      utxo.Value(),
+					PkScript:   scripts[op],
+				})
+				continue
+			}
+			so, ok := fetched[op]
+			if !ok {
+				return nil, database.NotFoundError(fmt.Sprintf("spent output not found: %v", op))
+			}
+			so.Outpoint = op
+			tu.Spent = append(tu.Spent, so)
+		}
+		for outIndex, txOut := range tx.MsgTx().TxOut {
+			outs[tbcd.NewOutpoint(*tx.Hash(), uint32(outIndex))] = txOut
+			if txscript.IsUnspendable(txOut.PkScript) {
+				continue
+			}
+			tu.Created = append(tu.Created, tbcd.CreatedOutput{
+				Index:      uint32(outIndex),
+				ScriptHash: tbcd.NewScriptHashFromScript(txOut.PkScript),
+			})
+		}
+		bu.Txs = append(bu.Txs, tu)
+	}
+	return bu, nil
+}
+
+// processHistory records a history entry for every script hash that is touched
+// by the provided transactions. The script hashes of spent outputs are looked
+// up in the utxo cache, or in the outputs of the provided transactions when
+// they are spent within the same block. It must therefore be called after
+// fixupCache.
+func processHistory(height uint64, txs []*btcutil.Tx, utxos map[tbcd.Outpoint]tbcd.CacheOutput, history map[tbcd.HistoryKey]struct{}) error {
+	outs := make(map[tbcd.Outpoint]tbcd.ScriptHash, len(txs))
+	defer clear(outs)
+	for _, tx := range txs {
+		for outIndex, txOut := range tx.MsgTx().TxOut {
+			if txscript.IsUnspendable(txOut.PkScript) {
+				continue
+			}
+			sh := tbcd.NewScriptHashFromScript(txOut.PkScript)
+			outs[tbcd.NewOutpoint(*tx.Hash(), uint32(outIndex))] = sh
+			history[tbcd.NewHistoryKey(sh, height, tx.Hash())] = struct{}{}
+		}
+	}
+	for _, tx := range txs {
+		for _, txIn := range tx.MsgTx().TxIn {
+			if blockchain.IsCoinBase(tx) {
+				// Skip coinbase inputs
+				break
+			}
+			op := tbcd.NewOutpoint(txIn.PreviousOutPoint.Hash,
+				txIn.PreviousOutPoint.Index)
+			sh, ok := outs[op]
+			if !ok {
+				utxo, ok := utxos[op]
+				if !ok {
+					return fmt.Errorf("script hash not found: %v", op)
+				}
+				sh = utxo.ScriptHash()
+			}
+			history[tbcd.NewHistoryKey(sh, height, tx.Hash())] = struct{}{}
 		}
 	}
 	return nil
 }
 
+// undoHistory records a history entry for every script hash that was touched
+// by the block of the provided undo record. It is the unwind counterpart of
+// processHistory.
+func undoHistory(height uint64, bu *tbcd.BlockUndo, history map[tbcd.HistoryKey]struct{}) {
+	for _, tu := range bu.Txs {
+		for _, co := range tu.Created {
+			history[tbcd.NewHistoryKey(co.ScriptHash, height, &tu.TxId)] = struct{}{}
+		}
+		for _, so := range tu.Spent {
+			history[tbcd.NewHistoryKey(so.ScriptHash, height, &tu.TxId)] = struct{}{}
+		}
+	}
+}
+
 func (s *Server) scriptValue(ctx context.Context, op tbcd.Outpoint) ([]byte, int64, error) {
 	txId := op.TxIdHash()
 	txIndex := op.TxIndex()
@@ -370,47 +519,97 @@ func (s *Server) scriptValue(ctx context.Context, op tbcd.Outpoint) ([]byte, int
 	return nil, 0, fmt.Errorf("tx id not found: %v", op)
 }
 
-func (s *Server) unprocessUtxos(ctx context.Context, txs []*btcutil.Tx, utxos map[tbcd.Outpoint]tbcd.CacheOutput) error {
-	// Walk backwards through the txs
-	for idx := len(txs) - 1; idx >= 0; idx-- {
-		tx := txs[idx]
-		// TxIn get data from disk and insert into the cache as insert
+// legacyBlockUndo recreates the undo record of a block that was indexed by an
+// older release that did not record one. The spent outputs are restored from
+// the blocks that created them, which therefore must not have been pruned.
+func (s *Server) legacyBlockUndo(ctx context.Context, hash *chainhash.Hash) (*tbcd.BlockUndo, error) {
+	b, err := s.db.BlockByHash(ctx, hash)
+	if err != nil {
+		return nil, fmt.Errorf("block by hash %v: %w", hash, err)
+	}
+	bu := &tbcd.BlockUndo{
+		Txs: make([]tbcd.TxUndo, 0, len(b.Transactions())),
+	}
+	for _, tx := range b.Transactions() {
+		tu := tbcd.TxUndo{TxId: *tx.Hash()}
 		for _, txIn := range tx.MsgTx().TxIn {
 			if blockchain.IsCoinBase(tx) {
 				// Skip coinbase inputs
 				break
 			}
-
 			op := tbcd.NewOutpoint(txIn.PreviousOutPoint.Hash,
 				txIn.PreviousOutPoint.Index)
 			pkScript, value, err := s.scriptValue(ctx, op)
 			if err != nil {
-				return fmt.Errorf("script value: %w", err)
+				return nil, fmt.Errorf("script value: %w", err)
+			}
+			tu.Spent = append(tu.Spent, tbcd.SpentOutput{
+				Outpoint:   op,
+				ScriptHash: tbcd.NewScriptHashFromScript(pkScript),
+				Value:      uint64(value),
+				PkScript:   pkScript,
+			})
+		}
+		for outIndex, txOut := range tx.MsgTx().TxOut {
+			if txscript.IsUnspendable(txOut.PkScript) {
+				continue
 			}
+			tu.Created = append(tu.Created, tbcd.CreatedOutput{
+				Index:      uint32(outIndex),
+				ScriptHash: tbcd.NewScriptHashFromScript(txOut.PkScript),
+			})
+		}
+		bu.Txs = append(bu.Txs, tu)
+	}
+	return bu, nil
+}
+
+// blockUndoByHash returns the undo record of the provided block. Blocks that
+// were indexed by older releases have their undo record recreated.
+func (s *Server) blockUndoByHash(ctx context.Context, hash *chainhash.Hash) (*tbcd.BlockUndo, error) {
+	bu, err := s.db.BlockUndoByHash(ctx, hash)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return s.legacyBlockUndo(ctx, hash)
+		}
+		return nil, fmt.Errorf("block undo: %w", err)
+	}
+	return bu, nil
+}
+
+// unprocessUtxos reverses processUtxos using the undo record of a block alone.
+func unprocessUtxos(bu *tbcd.BlockUndo, utxos map[tbcd.Outpoint]tbcd.CacheOutput, scripts map[tbcd.Outpoint][]byte) error {
+	// Walk backwards through the txs
+	for idx := len(bu.Txs) - 1; idx >= 0; idx-- {
+		tu := &bu.Txs[idx]
+		// Spent outputs are inserted into the cache as inserts
+		for _, so := range tu.Spent {
+			op := so.Outpoint
 			// XXX this should not happen. We are keeping it for
 			// now to ensure it indeed does not happen. Remove in a
 			// couple of years.
 			if _, ok := utxos[op]; ok {
 				return fmt.Errorf("impossible collision: %v", op)
 			}
-			utxos[op] = tbcd.NewCacheOutput(tbcd.NewScriptHashFromScript(pkScript),
-				uint64(value), txIn.PreviousOutPoint.Index)
-		}
-
-		// TxOut if those are in the cache delete from cache; if they
-		// are not in the cache insert "delete from disk command" into
-		// cache.
-		for outIndex, txOut := range tx.MsgTx().TxOut {
-			if txscript.IsUnspendable(txOut.PkScript) {
-				continue
+			utxos[op] = tbcd.NewCacheOutput(so.ScriptHash, so.Value,
+				op.TxIndex())
+			if so.PkScript != nil {
+				scripts[op] = append([]byte{}, so.PkScript...)
 			}
+		}
 
-			op := tbcd.NewOutpoint(*tx.Hash(), uint32(outIndex))
+		// Created outputs, if those are in the cache delete from
+		// cache; if they are not in the cache insert "delete from disk
+		// command" into cache.
+		for _, co := range tu.Created {
+			op := tbcd.NewOutpoint(tu.TxId, co.Index)
 			if _, ok := utxos[op]; ok {
 				delete(utxos, op)
+				delete(scripts, op)
 			} else {
-				utxos[op] = tbcd.NewDeleteCacheOutput(tbcd.NewScriptHashFromScript(txOut.PkScript),
-					op.TxIndex())
+				utxos[op] = tbcd.NewDeleteCacheOutput(co.ScriptHash,
+					co.Index)
+				scripts[op] = nil // delete from disk
 			}
 		}
 	}
@@ -418,24 +617,53 @@ func (s *Server) unprocessUtxos(ctx context.Context, txs []*btcutil.Tx, utxos ma
 	return nil
 }
 
-func (s *Server) fetchOP(ctx context.Context, w *sync.WaitGroup, op tbcd.Outpoint, utxos map[tbcd.Outpoint]tbcd.CacheOutput) {
+func (s *Server) fetchOP(ctx context.Context, w *sync.WaitGroup, op tbcd.Outpoint, utxos map[tbcd.Outpoint]tbcd.CacheOutput, fetched map[tbcd.Outpoint]tbcd.SpentOutput, fetchErr *error) {
 	defer w.Done()
 
-	pkScript, err := s.db.ScriptHashByOutpoint(ctx, op)
+	utxo, err := s.db.UtxoByOutpoint(ctx, op)
 	if err != nil {
-		// This happens when a transaction is created and spent in the
-		// same block.
-		// XXX this is probably too loud but log for investigation and
-		// remove later.
-		log.Debugf("db missing pkscript: %v", op)
-		return
+		if errors.Is(err, database.ErrNotFound) {
+			// This happens when a transaction is created and
+			// spent in the same block or when the block spends an
+			// output that does not exist.
+			// XXX this is probably too loud but log for
+			// investigation and remove later.
+			log.Debugf("db missing pkscript: %v", op)
+			return
+		}
+		err = fmt.Errorf("utxo by outpoint %v: %w", op, err)
+	}
+	so := tbcd.SpentOutput{Outpoint: op}
+	if err == nil {
+		so.ScriptHash = utxo.ScriptHash()
+		so.Value = utxo.Value()
+		// Outputs that were indexed by older releases have no pk
+		// script recorded.
+		so.PkScript, err = s.db.ScriptByOutpoint(ctx, op)
+		if errors.Is(err, database.ErrNotFound) {
+			err = nil
+		} else if err != nil {
+			err = fmt.Errorf("script by outpoint %v: %w", op, err)
+		}
 	}
 	s.mtx.Lock()
-	utxos[op] = tbcd.NewDeleteCacheOutput(*pkScript, op.TxIndex())
-	s.mtx.Unlock()
+	defer s.mtx.Unlock()
+	if err != nil {
+		if *fetchErr == nil {
+			*fetchErr = err
+		}
+		return
+	}
+	utxos[op] = tbcd.NewDeleteCacheOutput(so.ScriptHash, op.TxIndex())
+	fetched[op] = so
 }
 
-func (s *Server) fixupCache(ctx context.Context, b *btcutil.Block, utxos map[tbcd.Outpoint]tbcd.CacheOutput) error {
+// fixupCache retrieves the outputs that are spent by the provided block and
+// that are not in the utxo cache from the database. They are inserted into the
+// utxo cache as delete commands and recorded in fetched. Outputs that do not
+// exist are omitted, other database errors are returned.
+func (s *Server) fixupCache(ctx context.Context, b *btcutil.Block, utxos map[tbcd.Outpoint]tbcd.CacheOutput, fetched map[tbcd.Outpoint]tbcd.SpentOutput) error {
+	var fetchErr error
 	w := new(sync.WaitGroup)
 	for _, tx := range b.Transactions() {
 		for _, txIn := range tx.MsgTx().TxIn {
@@ -455,19 +683,19 @@ func (s *Server) fixupCache(ctx context.Context, b *btcutil.Block, utxos map[tbc
 
 			// utxo not found, retrieve pkscript from database.
 			w.Add(1)
-			go s.fetchOP(ctx, w, op, utxos)
+			go s.fetchOP(ctx, w, op, utxos, fetched, &fetchErr)
 		}
 	}
 
 	w.Wait()
 
-	return nil
+	return fetchErr
 }
 
 // indexUtxosInBlocks indexes utxos from the last processed block until the
 // provided end hash, inclusive. It returns the number of blocks processed and
 // the last hash it has processedd.
-func (s *Server) indexUtxosInBlocks(ctx context.Context, endHash *chainhash.Hash, utxos map[tbcd.Outpoint]tbcd.CacheOutput) (int, *HashHeight, error) {
+func (s *Server) indexUtxosInBlocks(ctx context.Context, endHash *chainhash.Hash, utxos map[tbcd.Outpoint]tbcd.CacheOutput, scripts map[tbcd.Outpoint][]byte, undo map[chainhash.Hash]*tbcd.BlockUndo, history map[tbcd.HistoryKey]struct{}) (int, *HashHeight, error) {
 	log.Tracef("indexUtxoBlocks")
 	defer log.Tracef("indexUtxoBlocks exit")
 
@@ -487,9 +715,37 @@ func (s *Server) indexUtxosInBlocks(ctx context.Context, endHash *chainhash.Hash
 		}
 	}
 
+	// The start block has already been indexed unless we are starting at
+	// genesis.
+	indexed := err == nil
+
+	// Scripts of the assume valid block and its ancestors are not
+	// validated.
+	var (
+		assumeValidHeight uint64
+		assumeValid       bool
+	)
+	if s.cfg.FullValidation {
+		assumeValidHeight, assumeValid, err = s.assumeValidHeight(ctx,
+			endHash)
+		if err != nil {
+			return 0, last, err
+		}
+	}
+
+	// Outputs spent by a block that were retrieved from the database.
+	fetched := make(map[tbcd.Outpoint]tbcd.SpentOutput, 1024)
+	defer clear(fetched)
+
 	utxosPercentage := 95 // flush cache at >95% capacity
 	blocksProcessed := 0
 	hh := utxoHH
+	if indexed {
+		hh, err = s.nextIndexHash(ctx, hh, endHash)
+		if err != nil {
+			return 0, last, err
+		}
+	}
 	for {
 		log.Debugf("indexing utxos: %v", hh)
 
@@ -507,13 +763,42 @@ func (s *Server) indexUtxosInBlocks(ctx context.Context, endHash *chainhash.Hash
 
 		// fixupCache is executed in parallel meaning that the utxos
 		// map must be locked as it is being processed.
-		if err = s.fixupCache(ctx, b, utxos); err != nil {
+		if err = s.fixupCache(ctx, b, utxos, fetched); err != nil {
 			return 0, last, fmt.Errorf("parse block %v: %w", hh, err)
 		}
 		// At this point we can lockless since it is all single
 		// threaded again.
+		bu, err := blockUndo(b, utxos, scripts, fetched)
+		if s.cfg.FullValidation &&
+			!(assumeValid && bh.Height <= assumeValidHeight) {
+			if errors.Is(err, database.ErrNotFound) {
+				err = fmt.Errorf("%w: %w", ErrBlockInvalid, err)
+			} else if err == nil {
+				err = s.validateBlockScripts(ctx, b, bh, bu.SpentOutputs())
+			}
+			if errors.Is(err, ErrBlockInvalid) {
+				if merr := s.markBlockInvalid(ctx, &bh.Hash); merr != nil {
+					return 0, last, fmt.Errorf("mark invalid %v: %w", hh, merr)
+				}
+			}
+			if err != nil {
+				return 0, last, fmt.Errorf("validate %v: %w", hh, err)
+			}
+		}
+		if err != nil {
+			return 0, last, fmt.Errorf("block undo %v: %w", hh, err)
+		}
+		err = processHistory(bh.Height, b.Transactions(), utxos, history)
+		if err != nil {
+			return 0, last, fmt.Errorf("process history %v: %w", hh, err)
+		}
+		// Record how the block changed the utxo index so that
+		// it can be unwound without the block and without the
+		// blocks that created the outputs it spends.
+		undo[bh.Hash] = bu
+		clear(fetched)
 		// log.Infof("processing utxo at height %d", height)
-		err = processUtxos(b.Transactions(), utxos)
+		err = processUtxos(b.Transactions(), utxos, scripts)
 		if err != nil {
 			return 0, last, fmt.Errorf("process utxos %v: %w", hh, err)
 		}
@@ -521,7 +806,7 @@ func (s *Server) indexUtxosInBlocks(ctx context.Context, endHash *chainhash.Hash
 		blocksProcessed++
 
 		// Try not to overshoot the cache to prevent costly allocations
-		cp := len(utxos) * 100 / s.cfg.MaxCachedTxs
+		cp := max(len(utxos), len(scripts), len(history)) * 100 / s.cfg.MaxCachedTxs
 		if bh.Height%10000 == 0 || cp > utxosPercentage || blocksProcessed == 1 {
 			log.Infof("Utxo indexer: %v utxo cache %v%%", hh, cp)
 		}
@@ -540,33 +825,45 @@ func (s *Server) indexUtxosInBlocks(ctx context.Context, endHash *chainhash.Hash
 		}
 
 		// Move to next block
-		height := bh.Height + 1
-		bhs, err := s.db.BlockHeadersByHeight(ctx, height)
+		hh, err = s.nextIndexHash(ctx, hh, endHash)
 		if err != nil {
-			return 0, last, fmt.Errorf("block headers by height %v: %w",
-				height, err)
-		}
-		index, err := s.findPathFromHash(ctx, endHash, bhs)
-		if err != nil {
-			return 0, last, fmt.Errorf("could not determine canonical path %v: %w",
-				height, err)
-		}
-		// Verify it connects to parent
-		if !hash.IsEqual(bhs[index].ParentHash()) {
-			return 0, last, fmt.Errorf("%v does not connect to: %v",
-				bhs[index], hash)
+			return 0, last, err
 		}
-		hh.Hash = *bhs[index].BlockHash()
-		hh.Height = bhs[index].Height
 	}
 
 	return blocksProcessed, last, nil
 }
 
+// nextIndexHash returns the block after hh on the path to endHash. The
+// indexers continue after their index hash, that block has already been
+// indexed and need not be stored, e.g. the block of a utxo snapshot.
+func (s *Server) nextIndexHash(ctx context.Context, hh *HashHeight, endHash *chainhash.Hash) (*HashHeight, error) {
+	height := hh.Height + 1
+	bhs, err := s.db.BlockHeadersByHeight(ctx, height)
+	if err != nil {
+		return nil, fmt.Errorf("block headers by height %v: %w",
+			height, err)
+	}
+	index, err := s.findPathFromHash(ctx, endHash, bhs)
+	if err != nil {
+		return nil, fmt.Errorf("could not determine canonical path %v: %w",
+			height, err)
+	}
+	// Verify it connects to parent
+	if !hh.Hash.IsEqual(bhs[index].ParentHash()) {
+		return nil, fmt.Errorf("%v does not connect to: %v",
+			bhs[index], hh.Hash)
+	}
+	return &HashHeight{
+		Hash:   *bhs[index].BlockHash(),
+		Height: bhs[index].Height,
+	}, nil
+}
+
 // unindexUtxosInBlocks unindexes utxos from the last processed block until the
 // provided end hash, inclusive. It returns the number of blocks processed and
 // the last hash it has processedd.
-func (s *Server) unindexUtxosInBlocks(ctx context.Context, endHash *chainhash.Hash, utxos map[tbcd.Outpoint]tbcd.CacheOutput) (int, *HashHeight, error) {
+func (s *Server) unindexUtxosInBlocks(ctx context.Context, endHash *chainhash.Hash, utxos map[tbcd.Outpoint]tbcd.CacheOutput, scripts map[tbcd.Outpoint][]byte, undo map[chainhash.Hash]*tbcd.BlockUndo, history map[tbcd.HistoryKey]struct{}) (int, *HashHeight, error) {
 	log.Tracef("unindexUtxoBlocks")
 	defer log.Tracef("unindexUtxoBlocks exit")
 
@@ -604,28 +901,41 @@ func (s *Server) unindexUtxosInBlocks(ctx context.Context, endHash *chainhash.Ha
 			break
 		}
 
-		// Index block
-		b, err := s.db.BlockByHash(ctx, &bh.Hash)
+		// Unindex block, the block itself is not needed.
+		bu, err := s.blockUndoByHash(ctx, &bh.Hash)
 		if err != nil {
-			return 0, last, fmt.Errorf("block by hash %v: %w", bh, err)
+			return 0, last, fmt.Errorf("block undo %v: %w", hh, err)
 		}
-
-		err = s.unprocessUtxos(ctx, b.Transactions(), utxos)
+		err = unprocessUtxos(bu, utxos, scripts)
 		if err != nil {
 			return 0, last, fmt.Errorf("process utxos %v: %w", hh, err)
 		}
+		undoHistory(bh.Height, bu, history)
+		undo[bh.Hash] = nil // delete from disk
 
-		// Add tx's back to the mempool.
+		// Add tx's back to the mempool, skip coinbase. The fee is
+		// unknown since the spent outputs are being restored.
 		if s.cfg.MempoolEnabled {
 			// XXX this may not be the right spot.
-			txHashes, _ := b.MsgBlock().TxHashes()
-			_ = s.mempool.txsRemove(ctx, txHashes)
+			b, err := s.db.BlockByHash(ctx, &bh.Hash)
+			switch {
+			case err == nil:
+				for _, tx := range b.Transactions()[1:] {
+					mt := newMempoolTx(tx.MsgTx(), tx.MsgTx().SerializeSize())
+					_ = s.mempool.txsInsert(ctx, mt)
+				}
+			case errors.Is(err, database.ErrNotFound),
+				errors.Is(err, database.ErrBlockPruned):
+				log.Debugf("mempool readd %v: %v", hh, err)
+			default:
+				return 0, last, fmt.Errorf("block by hash %v: %w", bh, err)
+			}
 		}
 
 		blocksProcessed++
 
 		// Try not to overshoot the cache to prevent costly allocations
-		cp := len(utxos) * 100 / s.cfg.MaxCachedTxs
+		cp := max(len(utxos), len(scripts), len(history)) * 100 / s.cfg.MaxCachedTxs
 		if bh.Height%10000 == 0 || cp > utxosPercentage || blocksProcessed == 1 {
 			log.Infof("UTxo unindexer: %v utxo cache %v%%", hh, cp)
 		}
@@ -667,13 +977,19 @@ func (s *Server) UtxoIndexerUnwind(ctx context.Context, startBH, endBH *tbcd.Blo
 	// Allocate here so that we don't waste space when not indexing.
 	utxos := make(map[tbcd.Outpoint]tbcd.CacheOutput, s.cfg.MaxCachedTxs)
 	defer clear(utxos)
+	scripts := make(map[tbcd.Outpoint][]byte, s.cfg.MaxCachedTxs)
+	defer clear(scripts)
+	undo := make(map[chainhash.Hash]*tbcd.BlockUndo, 1024)
+	defer clear(undo)
+	history := make(map[tbcd.HistoryKey]struct{}, s.cfg.MaxCachedTxs)
+	defer clear(history)
 
 	log.Infof("Start unwinding UTxos at hash %v height %v", startBH, startBH.Height)
 	log.Infof("End unwinding UTxos at hash %v height %v", endBH, endBH.Height)
 	endHash := endBH.BlockHash()
 	for {
 		start := time.Now()
-		blocksProcessed, last, err := s.unindexUtxosInBlocks(ctx, endHash, utxos)
+		blocksProcessed, last, err := s.unindexUtxosInBlocks(ctx, endHash, utxos, scripts, undo, history)
 		if err != nil {
 			return fmt.Errorf("unindex utxos in blocks: %w", err)
 		}
@@ -685,11 +1001,27 @@ func (s *Server) UtxoIndexerUnwind(ctx context.Context, startBH, endBH *tbcd.Blo
 			blocksProcessed, time.Since(start), utxosCached,
 			s.cfg.MaxCachedTxs-utxosCached, utxosCached/blocksProcessed)
 
+		// Collect subscribed script hash activity before the history
+		// cache is flushed.
+		var notifications []tbcd.HistoryKey
+		if s.scriptHashesSubscribed() {
+			notifications = s.subscribedHistory(history)
+		}
+
 		// Flush to disk
 		start = time.Now()
 		if err = s.db.BlockUtxoUpdate(ctx, -1, utxos); err != nil {
 			return fmt.Errorf("block utxo update: %w", err)
 		}
+		if err = s.db.BlockScriptUpdate(ctx, -1, scripts); err != nil {
+			return fmt.Errorf("block script update: %w", err)
+		}
+		if err = s.db.BlockUndoUpdate(ctx, -1, undo); err != nil {
+			return fmt.Errorf("block undo update: %w", err)
+		}
+		if err = s.db.BlockHistoryUpdate(ctx, -1, history); err != nil {
+			return fmt.Errorf("block history update: %w", err)
+		}
 		// leveldb does all kinds of allocations, force GC to lower
 		// memory pressure.
 		logMemStats()
@@ -703,6 +1035,7 @@ func (s *Server) UtxoIndexerUnwind(ctx context.Context, startBH, endBH *tbcd.Blo
 		if err != nil {
 			return fmt.Errorf("metadata utxo hash: %w", err)
 		}
+		s.notifyScriptHashes(notifications, false, true)
 
 		if endHash.IsEqual(&last.Hash) {
 			break
@@ -727,13 +1060,19 @@ func (s *Server) UtxoIndexerWind(ctx context.Context, startBH, endBH *tbcd.Block
 	// Allocate here so that we don't waste space when not indexing.
 	utxos := make(map[tbcd.Outpoint]tbcd.CacheOutput, s.cfg.MaxCachedTxs)
 	defer clear(utxos)
+	scripts := make(map[tbcd.Outpoint][]byte, s.cfg.MaxCachedTxs)
+	defer clear(scripts)
+	undo := make(map[chainhash.Hash]*tbcd.BlockUndo, 1024)
+	defer clear(undo)
+	history := make(map[tbcd.HistoryKey]struct{}, s.cfg.MaxCachedTxs)
+	defer clear(history)
 
 	log.Infof("Start indexing UTxos at hash %v height %v", startBH, startBH.Height)
 	log.Infof("End indexing UTxos at hash %v height %v", endBH, endBH.Height)
 	endHash := endBH.BlockHash()
 	for {
 		start := time.Now()
-		blocksProcessed, last, err := s.indexUtxosInBlocks(ctx, endHash, utxos)
+		blocksProcessed, last, err := s.indexUtxosInBlocks(ctx, endHash, utxos, scripts, undo, history)
 		if err != nil {
 			return fmt.Errorf("index blocks: %w", err)
 		}
@@ -745,11 +1084,27 @@ func (s *Server) UtxoIndexerWind(ctx context.Context, startBH, endBH *tbcd.Block
 			blocksProcessed, time.Since(start), utxosCached,
 			s.cfg.MaxCachedTxs-utxosCached, utxosCached/blocksProcessed)
 
+		// Collect subscribed script hash activity before the history
+		// cache is flushed.
+		var notifications []tbcd.HistoryKey
+		if s.scriptHashesSubscribed() {
+			notifications = s.subscribedHistory(history)
+		}
+
 		// Flush to disk
 		start = time.Now()
 		if err = s.db.BlockUtxoUpdate(ctx, 1, utxos); err != nil {
 			return fmt.Errorf("block tx update: %w", err)
 		}
+		if err = s.db.BlockScriptUpdate(ctx, 1, scripts); err != nil {
+			return fmt.Errorf("block script update: %w", err)
+		}
+		if err = s.db.BlockUndoUpdate(ctx, 1, undo); err != nil {
+			return fmt.Errorf("block undo update: %w", err)
+		}
+		if err = s.db.BlockHistoryUpdate(ctx, 1, history); err != nil {
+			return fmt.Errorf("block history update: %w", err)
+		}
 
 		// leveldb does all kinds of allocations, force GC to lower
 		// memory pressure.
@@ -764,6 +1119,7 @@ func (s *Server) UtxoIndexerWind(ctx context.Context, startBH, endBH *tbcd.Block
 		if err != nil {
 			return fmt.Errorf("metadata utxo hash: %w", err)
 		}
+		s.notifyScriptHashes(notifications, false, false)
 		if endHash.IsEqual(&last.Hash) {
 			break
 		}
@@ -880,6 +1236,12 @@ func (s *Server) indexTxsInBlocks(ctx context.Context, endHash *chainhash.Hash,
 	txsPercentage := 95 // flush cache at >95% capacity
 	blocksProcessed := 0
 	hh := txHH
+	if err == nil {
+		hh, err = s.nextIndexHash(ctx, hh, endHash)
+		if err != nil {
+			return 0, last, err
+		}
+	}
 	for {
 		log.Debugf("indexing txs: %v", hh)
 
@@ -922,24 +1284,10 @@ func (s *Server) indexTxsInBlocks(ctx context.Context, endHash *chainhash.Hash,
 		}
 
 		// Move to next block
-		height := bh.Height + 1
-		bhs, err := s.db.BlockHeadersByHeight(ctx, height)
-		if err != nil {
-			return 0, last, fmt.Errorf("block headers by height %v: %w",
-				height, err)
-		}
-		index, err := s.findPathFromHash(ctx, endHash, bhs)
+		hh, err = s.nextIndexHash(ctx, hh, endHash)
 		if err != nil {
-			return 0, last, fmt.Errorf("could not determine canonical path %v: %w",
-				height, err)
-		}
-		// Verify it connects to parent
-		if !hash.IsEqual(bhs[index].ParentHash()) {
-			return 0, last, fmt.Errorf("%v does not connect to: %v",
-				bhs[index], hash)
+			return 0, last, err
 		}
-		hh.Hash = *bhs[index].BlockHash()
-		hh.Height = bhs[index].Height
 	}
 
 	return blocksProcessed, last, nil
@@ -998,15 +1346,6 @@ func (s *Server) unindexTxsInBlocks(ctx context.Context, endHash *chainhash.Hash
 			return 0, last, fmt.Errorf("process txs %v: %w", hh, err)
 		}
 
-		// This is probably not needed here since we alreayd dealt with
-		// it via the utxo unindexer but since it will be mostly a
-		// no-op just go ahead.
-		if s.cfg.MempoolEnabled {
-			// XXX this may not be the right spot.
-			txHashes, _ := b.MsgBlock().TxHashes()
-			_ = s.mempool.txsRemove(ctx, txHashes)
-		}
-
 		blocksProcessed++
 
 		// Try not to overshoot the cache to prevent costly allocations
@@ -1215,68 +1554,1013 @@ func (s *Server) TxIndexer(ctx context.Context, endHash *chainhash.Hash) error {
 	return fmt.Errorf("invalid direction: %v", direction)
 }
 
-func (s *Server) UtxoIndexIsLinear(ctx context.Context, endHash *chainhash.Hash) (int, error) {
-	log.Tracef("UtxoIndexIsLinear")
-	defer log.Tracef("UtxoIndexIsLinear exit")
+// prevOutScripts returns the pk scripts of all outputs that are spent by the
+// provided block. They are taken from the spent outputs that the utxo indexer
+// recorded for the block. Blocks that were indexed by older releases have no
+// pk scripts recorded, those are looked up via the tx index and thus the tx
+// index must be at or beyond the provided block.
+func (s *Server) prevOutScripts(ctx context.Context, b *btcutil.Block) ([][]byte, error) {
+	bu, err := s.db.BlockUndoByHash(ctx, b.Hash())
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return nil, fmt.Errorf("block undo: %w", err)
+	}
+	recorded := err == nil
+	var spent []tbcd.SpentOutput
+	if recorded {
+		spent = bu.SpentOutputs()
+	}
+
+	// Outputs may be spent within the same block so seed the lookup map
+	// with the block transactions.
+	var txs map[chainhash.Hash]*wire.MsgTx
+	defer clear(txs)
 
-	// Verify start point is not after the end point
-	utxoHH, err := s.UtxoIndexHash(ctx)
-	if err != nil {
-		if !errors.Is(err, database.ErrNotFound) {
-			return 0, fmt.Errorf("tx indexer: %w", err)
+	scripts := make([][]byte, 0, len(spent))
+	for _, tx := range b.Transactions() {
+		// Skip coinbase inputs
+		if blockchain.IsCoinBase(tx) {
+			continue
 		}
-		utxoHH = &HashHeight{
-			Hash:   *s.chainParams.GenesisHash,
-			Height: 0,
+
+		for _, txIn := range tx.MsgTx().TxIn {
+			k := len(scripts)
+			if recorded && k >= len(spent) {
+				return nil, fmt.Errorf("spent outputs missing: %v",
+					b.Hash())
+			}
+			if recorded && spent[k].PkScript != nil {
+				scripts = append(scripts, spent[k].PkScript)
+				continue
+			}
+
+			if txs == nil {
+				txs = make(map[chainhash.Hash]*wire.MsgTx,
+					len(b.Transactions()))
+				for _, tx := range b.Transactions() {
+					txs[*tx.Hash()] = tx.MsgTx()
+				}
+			}
+			pop := txIn.PreviousOutPoint
+			ptx, ok := txs[pop.Hash]
+			if !ok {
+				var err error
+				ptx, err = s.TxById(ctx, &pop.Hash)
+				if err != nil {
+					return nil, fmt.Errorf("prevout %v: %w", pop, err)
+				}
+				txs[pop.Hash] = ptx
+			}
+			if int(pop.Index) >= len(ptx.TxOut) {
+				return nil, fmt.Errorf("prevout %v: invalid index", pop)
+			}
+			scripts = append(scripts, ptx.TxOut[pop.Index].PkScript)
 		}
 	}
+	if recorded && len(scripts) != len(spent) {
+		return nil, fmt.Errorf("spent outputs mismatch: %v", b.Hash())
+	}
+	return scripts, nil
+}
 
-	return s.IndexIsLinear(ctx, &utxoHH.Hash, endHash)
+// activationHeights are consensus rule activation heights that are not
+// provided by chaincfg.
+type activationHeights struct {
+	csv    int32 // BIP68, BIP112 and BIP113
+	segwit int32 // BIP141, BIP143 and BIP147
 }
 
-func (s *Server) TxIndexIsLinear(ctx context.Context, endHash *chainhash.Hash) (int, error) {
-	log.Tracef("TxIndexIsLinear")
-	defer log.Tracef("TxIndexIsLinear exit")
+// activations is indexed by network, networks that are not listed activate
+// all rules at genesis.
+var activations = map[wire.BitcoinNet]activationHeights{
+	wire.MainNet:  {csv: 419328, segwit: 481824},
+	wire.TestNet3: {csv: 770112, segwit: 834624},
+}
 
-	// Verify start point is not after the end point
-	txHH, err := s.TxIndexHash(ctx)
+// scriptFlagExceptions are historical blocks that violate script rules that
+// are otherwise enforced since genesis.
+var scriptFlagExceptions = map[chainhash.Hash]txscript.ScriptFlags{
+	// mainnet BIP16 exception
+	s2h("00000000000002dc756eebf4f49723ed8d30cc28a5f108eb94b1ba88ac4f9c22"): 0,
+	// mainnet taproot exception
+	s2h("0000000000000000000f14c35b2d841e986ab5441de8c585d5ffe55ea1e395ad"): txscript.ScriptBip16 | txscript.ScriptVerifyWitness,
+	// testnet3 BIP16 exception
+	s2h("00000000dd30457c001f4095d208cc1296b0eed002427aa599874af7a432b105"): 0,
+}
+
+// scriptFlags returns the consensus script verification flags for the
+// provided block. Like bitcoind, P2SH, segwit and taproot are enforced since
+// genesis with the exception of a few historical blocks.
+func (s *Server) scriptFlags(bh *tbcd.BlockHeader) txscript.ScriptFlags {
+	flags, ok := scriptFlagExceptions[bh.Hash]
+	if !ok {
+		flags = txscript.ScriptBip16 | txscript.ScriptVerifyWitness |
+			txscript.ScriptVerifyTaproot
+	}
+
+	height := int32(bh.Height)
+	if height >= s.chainParams.BIP0066Height {
+		flags |= txscript.ScriptVerifyDERSignatures
+	}
+	if height >= s.chainParams.BIP0065Height {
+		flags |= txscript.ScriptVerifyCheckLockTimeVerify
+	}
+	a := activations[s.wireNet]
+	if height >= a.csv {
+		flags |= txscript.ScriptVerifyCheckSequenceVerify
+	}
+	if height >= a.segwit {
+		flags |= txscript.ScriptStrictMultiSig
+	}
+	return flags
+}
+
+// scriptInput is a transaction input that is pending script validation.
+type scriptInput struct {
+	tx        *btcutil.Tx
+	index     int
+	sigHashes *txscript.TxSigHashes
+}
+
+func (si scriptInput) validate(prevOuts txscript.PrevOutputFetcher, flags txscript.ScriptFlags) error {
+	txIn := si.tx.MsgTx().TxIn[si.index]
+	prevOut := prevOuts.FetchPrevOutput(txIn.PreviousOutPoint)
+	vm, err := txscript.NewEngine(prevOut.PkScript, si.tx.MsgTx(), si.index,
+		flags, nil, si.sigHashes, prevOut.Value, prevOuts)
 	if err != nil {
-		if !errors.Is(err, database.ErrNotFound) {
-			return 0, fmt.Errorf("tx indexer: %w", err)
+		return fmt.Errorf("%w: tx %v input %v: %w", ErrBlockInvalid,
+			si.tx.Hash(), si.index, err)
+	}
+	if err := vm.Execute(); err != nil {
+		return fmt.Errorf("%w: tx %v input %v: %w", ErrBlockInvalid,
+			si.tx.Hash(), si.index, err)
+	}
+	return nil
+}
+
+// validateBlockScripts executes all input scripts of the provided block
+// against the outputs they spend. The spent outputs are provided in input
+// order, see blockUndo. Outputs that were indexed by older releases have no pk
+// script recorded, an error that wraps ErrPkScriptUnknown is returned when one
+// of those is spent since the utxo index must be rebuilt in order to validate
+// the block. Scripts are executed in parallel. Returns an error that wraps
+// ErrBlockInvalid if the block fails validation.
+func (s *Server) validateBlockScripts(ctx context.Context, b *btcutil.Block, bh *tbcd.BlockHeader, spent []tbcd.SpentOutput) error {
+	log.Tracef("validateBlockScripts")
+	defer log.Tracef("validateBlockScripts exit")
+
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+	inputs := make([]scriptInput, 0, len(spent))
+	for _, tx := range b.Transactions() {
+		if blockchain.IsCoinBase(tx) {
+			continue
 		}
-		txHH = &HashHeight{
-			Hash:   *s.chainParams.GenesisHash,
-			Height: 0,
+		for _, txIn := range tx.MsgTx().TxIn {
+			k := len(inputs)
+			if k >= len(spent) {
+				return fmt.Errorf("spent outputs missing: %v", b.Hash())
+			}
+			pop := txIn.PreviousOutPoint
+			if spent[k].PkScript == nil {
+				return fmt.Errorf("prevout %v: %w", pop,
+					ErrPkScriptUnknown)
+			}
+			prevOuts.AddPrevOut(pop, wire.NewTxOut(int64(spent[k].Value),
+				spent[k].PkScript))
+			inputs = append(inputs, scriptInput{tx: tx})
+		}
+
+		// The signature hashes commit to all outputs spent by the tx.
+		sigHashes := txscript.NewTxSigHashes(tx.MsgTx(), prevOuts)
+		first := len(inputs) - len(tx.MsgTx().TxIn)
+		for k := range tx.MsgTx().TxIn {
+			inputs[first+k].index = k
+			inputs[first+k].sigHashes = sigHashes
 		}
 	}
+	if len(inputs) != len(spent) {
+		return fmt.Errorf("spent outputs mismatch: %v", b.Hash())
+	}
 
-	return s.IndexIsLinear(ctx, &txHH.Hash, endHash)
-}
+	// Verify signatures in parallel, the prevouts are read only from here
+	// on.
+	var (
+		mtx       sync.Mutex
+		scriptErr error
+	)
+	flags := s.scriptFlags(bh)
+	inputC := make(chan scriptInput)
+	w := new(sync.WaitGroup)
+	for range runtime.NumCPU() {
+		w.Add(1)
+		go func() {
+			defer w.Done()
+			for si := range inputC {
+				if err := si.validate(prevOuts, flags); err != nil {
+					mtx.Lock()
+					if scriptErr == nil {
+						scriptErr = err
+					}
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+	for _, si := range inputs {
+		mtx.Lock()
+		failed := scriptErr != nil
+		mtx.Unlock()
+		if failed {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			close(inputC)
+			w.Wait()
+			return ctx.Err()
+		case inputC <- si:
+		}
+	}
+	close(inputC)
+	w.Wait()
 
-func (s *Server) IndexIsLinear(ctx context.Context, startHash, endHash *chainhash.Hash) (int, error) {
-	log.Tracef("IndexIsLinear")
-	defer log.Tracef("IndexIsLinear exit")
+	return scriptErr
+}
 
-	// Verify exit condition hash
-	if startHash == nil || endHash == nil {
-		return 0, errors.New("must provide start and end hash")
-	}
-	endBH, err := s.db.BlockHeaderByHash(ctx, endHash)
+// invalidBlocks returns the blocks that failed validation.
+func (s *Server) invalidBlocks(ctx context.Context) (map[chainhash.Hash]struct{}, error) {
+	value, err := s.db.MetadataGet(ctx, InvalidBlocksKey)
 	if err != nil {
-		return 0, fmt.Errorf("blockheader hash: %w", err)
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(value)%chainhash.HashSize != 0 {
+		return nil, fmt.Errorf("invalid blocks length: %v", len(value))
+	}
+	ibs := make(map[chainhash.Hash]struct{}, len(value)/chainhash.HashSize)
+	for i := 0; i < len(value); i += chainhash.HashSize {
+		ibs[chainhash.Hash(value[i:i+chainhash.HashSize])] = struct{}{}
 	}
+	return ibs, nil
+}
 
-	// Make sure there is no gap between start and end or vice versa.
-	startBH, err := s.db.BlockHeaderByHash(ctx, startHash)
+// markBlockInvalid records that the provided block failed validation. The
+// indexers will not move beyond the parent of an invalid block.
+func (s *Server) markBlockInvalid(ctx context.Context, hash *chainhash.Hash) error {
+	log.Errorf("Block invalid: %v", hash)
+
+	ibs, err := s.invalidBlocks(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("blockheader hash: %w", err)
+		return fmt.Errorf("invalid blocks: %w", err)
 	}
-	// Short circuit if the block hash is the same.
-	if startBH.BlockHash().IsEqual(endBH.BlockHash()) {
-		return 0, nil
+	if _, ok := ibs[*hash]; ok {
+		return nil
+	}
+	if ibs == nil {
+		ibs = make(map[chainhash.Hash]struct{}, 1)
 	}
+	ibs[*hash] = struct{}{}
+	return s.invalidBlocksPut(ctx, ibs)
+}
 
-	direction := endBH.Difficulty.Cmp(&startBH.Difficulty)
+// invalidBlocksPut records the provided blocks as the blocks that failed
+// validation.
+func (s *Server) invalidBlocksPut(ctx context.Context, ibs map[chainhash.Hash]struct{}) error {
+	if len(ibs) == 0 {
+		return s.db.MetadataDel(ctx, InvalidBlocksKey)
+	}
+	value := make([]byte, 0, len(ibs)*chainhash.HashSize)
+	for ib := range ibs {
+		value = append(value, ib[:]...)
+	}
+	return s.db.MetadataPut(ctx, InvalidBlocksKey, value)
+}
+
+// InvalidBlocks returns the blocks that failed validation.
+func (s *Server) InvalidBlocks(ctx context.Context) ([]chainhash.Hash, error) {
+	log.Tracef("InvalidBlocks")
+	defer log.Tracef("InvalidBlocks exit")
+
+	ibs, err := s.invalidBlocks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocks: %w", err)
+	}
+	hashes := make([]chainhash.Hash, 0, len(ibs))
+	for ib := range ibs {
+		hashes = append(hashes, ib)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	return hashes, nil
+}
+
+// ReconsiderBlock removes the provided block from the blocks that failed
+// validation or all of them when hash is nil. The headers of invalid blocks
+// have been removed, they are retrieved again from peers and the blocks are
+// validated again when they become canonical. This must not be called while
+// tbcd is running.
+func (s *Server) ReconsiderBlock(ctx context.Context, hash *chainhash.Hash) error {
+	log.Tracef("ReconsiderBlock")
+	defer log.Tracef("ReconsiderBlock exit")
+
+	unlock, err := s.indexingLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	ibs, err := s.invalidBlocks(ctx)
+	if err != nil {
+		return fmt.Errorf("invalid blocks: %w", err)
+	}
+	if hash == nil {
+		clear(ibs)
+	} else {
+		if _, ok := ibs[*hash]; !ok {
+			return database.NotFoundError(fmt.Sprintf("invalid block "+
+				"not found: %v", hash))
+		}
+		delete(ibs, *hash)
+	}
+	return s.invalidBlocksPut(ctx, ibs)
+}
+
+// invalidHeadersVerify returns an error that wraps ErrBlockInvalid if any of
+// the provided headers is of a block that failed validation.
+func (s *Server) invalidHeadersVerify(ctx context.Context, headers []*wire.BlockHeader) error {
+	ibs, err := s.invalidBlocks(ctx)
+	if err != nil {
+		return fmt.Errorf("invalid blocks: %w", err)
+	}
+	if len(ibs) == 0 {
+		return nil
+	}
+	for _, bh := range headers {
+		hash := bh.BlockHash()
+		if _, ok := ibs[hash]; ok {
+			return fmt.Errorf("%w: %v", ErrBlockInvalid, hash)
+		}
+	}
+	return nil
+}
+
+// invalidChainsRemove moves the canonical tip off the blocks that failed
+// validation by removing their headers and the headers of all their
+// descendants. The indexers must not be beyond the parents of those blocks.
+func (s *Server) invalidChainsRemove(ctx context.Context) error {
+	ibs, err := s.invalidBlocks(ctx)
+	if err != nil {
+		return fmt.Errorf("invalid blocks: %w", err)
+	}
+	for ib := range ibs {
+		ibh, err := s.db.BlockHeaderByHash(ctx, &ib)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				// Already removed.
+				continue
+			}
+			return fmt.Errorf("invalid block header: %w", err)
+		}
+		if err := s.headersRemoveFrom(ctx, ibh); err != nil {
+			return fmt.Errorf("headers remove %v: %w", ibh, err)
+		}
+	}
+	return nil
+}
+
+// headersRemoveFrom removes the provided header and all its descendants. The
+// heaviest remaining header becomes the canonical tip if the canonical tip is
+// removed. BlockHeadersRemove removes linear chains that end in a tip thus the
+// headers are removed one branch at a time, leaves first.
+func (s *Server) headersRemoveFrom(ctx context.Context, root *tbcd.BlockHeader) error {
+	// Collect the descendants height by height.
+	remove := map[chainhash.Hash]*tbcd.BlockHeader{root.Hash: root}
+	children := make(map[chainhash.Hash]int)
+	for height := root.Height + 1; ; height++ {
+		bhs, err := s.db.BlockHeadersByHeight(ctx, height)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				break
+			}
+			return fmt.Errorf("block headers by height %v: %w",
+				height, err)
+		}
+		found := false
+		for k := range bhs {
+			if _, ok := remove[*bhs[k].ParentHash()]; !ok {
+				continue
+			}
+			remove[bhs[k].Hash] = &bhs[k]
+			children[*bhs[k].ParentHash()]++
+			found = true
+		}
+		if !found {
+			break
+		}
+	}
+
+	// Find the heaviest remaining header. Only headers at or above the
+	// removed ones are considered, forks below them are lighter than the
+	// parent of the removed headers in practice.
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return fmt.Errorf("block header best: %w", err)
+	}
+	tip := bhb
+	if _, ok := remove[bhb.Hash]; ok {
+		tip, err = s.db.BlockHeaderByHash(ctx, root.ParentHash())
+		if err != nil {
+			return fmt.Errorf("block header by hash: %w", err)
+		}
+		for height := root.Height; ; height++ {
+			bhs, err := s.db.BlockHeadersByHeight(ctx, height)
+			if err != nil {
+				if errors.Is(err, database.ErrNotFound) {
+					break
+				}
+				return fmt.Errorf("block headers by height %v: %w",
+					height, err)
+			}
+			for k := range bhs {
+				if _, ok := remove[bhs[k].Hash]; ok {
+					continue
+				}
+				if bhs[k].Difficulty.Cmp(&tip.Difficulty) > 0 {
+					tip = &bhs[k]
+				}
+			}
+		}
+	}
+	wtip, err := tip.Wire()
+	if err != nil {
+		return fmt.Errorf("tip: %w", err)
+	}
+
+	for len(remove) > 0 {
+		// Walk from a leaf down to where its branch forks off.
+		var branch []*tbcd.BlockHeader
+		for hash, bh := range remove {
+			if children[hash] == 0 {
+				branch = append(branch, bh)
+				break
+			}
+		}
+		for {
+			parent, ok := remove[*branch[0].ParentHash()]
+			if !ok || children[parent.Hash] > 1 {
+				break
+			}
+			branch = append([]*tbcd.BlockHeader{parent}, branch...)
+		}
+
+		msg := wire.NewMsgHeaders()
+		for _, bh := range branch {
+			wbh, err := bh.Wire()
+			if err != nil {
+				return fmt.Errorf("header %v: %w", bh, err)
+			}
+			if err := msg.AddBlockHeader(wbh); err != nil {
+				return fmt.Errorf("add header %v: %w", bh, err)
+			}
+		}
+		// The canonical tip is a leaf, it only changes when it is
+		// removed.
+		bhb, err := s.db.BlockHeaderBest(ctx)
+		if err != nil {
+			return fmt.Errorf("block header best: %w", err)
+		}
+		after := wtip
+		if !bhb.Hash.IsEqual(&branch[len(branch)-1].Hash) {
+			if after, err = bhb.Wire(); err != nil {
+				return fmt.Errorf("best: %w", err)
+			}
+		}
+		_, _, err = s.db.BlockHeadersRemove(ctx, msg, after, nil)
+		if err != nil {
+			return fmt.Errorf("block headers remove: %w", err)
+		}
+
+		for _, bh := range branch {
+			err := s.db.BlockMissingDelete(ctx, int64(bh.Height), &bh.Hash)
+			if err != nil {
+				return fmt.Errorf("block missing delete: %w", err)
+			}
+			delete(remove, bh.Hash)
+			delete(children, bh.Hash)
+		}
+		children[*branch[0].ParentHash()]--
+	}
+
+	log.Infof("Removed invalid block %v and its descendants, canonical "+
+		"tip: %v", root.HH(), tip.HH())
+
+	return nil
+}
+
+// validIndexTarget returns the block the indexers may move to on the way to
+// the provided block. This is the provided block itself unless it descends
+// from an invalid block, in which case it is the parent of the lowest invalid
+// block.
+func (s *Server) validIndexTarget(ctx context.Context, bh *tbcd.BlockHeader) (*tbcd.BlockHeader, error) {
+	ibs, err := s.invalidBlocks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocks: %w", err)
+	}
+	if len(ibs) == 0 {
+		return bh, nil
+	}
+
+	// Only walk back as far as the lowest invalid block.
+	lowest := bh.Height
+	for ib := range ibs {
+		ibh, err := s.db.BlockHeaderByHash(ctx, &ib)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block header: %w", err)
+		}
+		lowest = min(lowest, ibh.Height)
+	}
+
+	target := bh
+	for walk := bh; walk.Height >= lowest && walk.Height > 0; {
+		parent, err := s.db.BlockHeaderByHash(ctx, walk.ParentHash())
+		if err != nil {
+			return nil, fmt.Errorf("block header by hash: %w", err)
+		}
+		if _, ok := ibs[walk.Hash]; ok {
+			target = parent
+		}
+		walk = parent
+	}
+	return target, nil
+}
+
+// processFilter builds the BIP158 basic filter and the BIP157 filter header
+// for the provided block.
+func (s *Server) processFilter(ctx context.Context, b *btcutil.Block, prevHeader *chainhash.Hash) (*tbcd.BlockFilter, error) {
+	scripts, err := s.prevOutScripts(ctx, b)
+	if err != nil {
+		return nil, fmt.Errorf("prevout scripts: %w", err)
+	}
+	f, err := builder.BuildBasicFilter(b.MsgBlock(), scripts)
+	if err != nil {
+		return nil, fmt.Errorf("build filter: %w", err)
+	}
+	nb, err := f.NBytes()
+	if err != nil {
+		return nil, fmt.Errorf("filter bytes: %w", err)
+	}
+	header, err := builder.MakeHeaderForFilter(f, *prevHeader)
+	if err != nil {
+		return nil, fmt.Errorf("filter header: %w", err)
+	}
+	return &tbcd.BlockFilter{
+		BlockHash: *b.Hash(),
+		Header:    header,
+		Filter:    nb,
+	}, nil
+}
+
+// prevFilterHeader returns the filter header of the parent of the provided
+// block. The cache is consulted first since the parent may not have been
+// flushed yet. The genesis block commits to the zero hash.
+func (s *Server) prevFilterHeader(ctx context.Context, bh *tbcd.BlockHeader, filters map[chainhash.Hash]*tbcd.BlockFilter) (*chainhash.Hash, error) {
+	if bh.Hash.IsEqual(s.chainParams.GenesisHash) {
+		return &chainhash.Hash{}, nil
+	}
+	parent := bh.ParentHash()
+	if bf, ok := filters[*parent]; ok && bf != nil {
+		return &bf.Header, nil
+	}
+	bf, err := s.db.BlockFilterByHash(ctx, parent)
+	if err != nil {
+		return nil, fmt.Errorf("block filter by hash: %w", err)
+	}
+	return &bf.Header, nil
+}
+
+// indexFiltersInBlocks indexes filters from the last processed block until the
+// provided end hash, inclusive. It returns the number of blocks processed and
+// the last hash it has processedd.
+func (s *Server) indexFiltersInBlocks(ctx context.Context, endHash *chainhash.Hash, filters map[chainhash.Hash]*tbcd.BlockFilter) (int, *HashHeight, error) {
+	log.Tracef("indexFiltersInBlocks")
+	defer log.Tracef("indexFiltersInBlocks exit")
+
+	// indicates if we have processed endHash and thus have hit the exit
+	// condition.
+	var last *HashHeight
+
+	// Find start hash
+	filterHH, err := s.FilterIndexHash(ctx)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			return 0, last, fmt.Errorf("filter index hash: %w", err)
+		}
+		filterHH = &HashHeight{
+			Hash:   *s.chainParams.GenesisHash,
+			Height: 0,
+		}
+	}
+
+	filtersPercentage := 95 // flush cache at >95% capacity
+	blocksProcessed := 0
+	hh := filterHH
+	if err == nil {
+		hh, err = s.nextIndexHash(ctx, hh, endHash)
+		if err != nil {
+			return 0, last, err
+		}
+	}
+	for {
+		log.Debugf("indexing filters: %v", hh)
+
+		hash := hh.Hash
+		bh, err := s.db.BlockHeaderByHash(ctx, &hash)
+		if err != nil {
+			return 0, last, fmt.Errorf("block header %v: %w", hash, err)
+		}
+
+		// Index block
+		b, err := s.db.BlockByHash(ctx, &bh.Hash)
+		if err != nil {
+			return 0, last, fmt.Errorf("block by hash %v: %w", bh, err)
+		}
+
+		prevHeader, err := s.prevFilterHeader(ctx, bh, filters)
+		if err != nil {
+			return 0, last, fmt.Errorf("previous filter header %v: %w", hh, err)
+		}
+		bf, err := s.processFilter(ctx, b, prevHeader)
+		if err != nil {
+			return 0, last, fmt.Errorf("process filter %v: %w", hh, err)
+		}
+		filters[bh.Hash] = bf
+
+		blocksProcessed++
+
+		// Try not to overshoot the cache to prevent costly allocations
+		cp := len(filters) * 100 / s.cfg.MaxCachedFilters
+		if bh.Height%10000 == 0 || cp > filtersPercentage || blocksProcessed == 1 {
+			log.Infof("Filter indexer: %v filter cache %v%%", hh, cp)
+		}
+		if cp > filtersPercentage {
+			last = hh
+			// Flush
+			break
+		}
+
+		// Exit if we processed the provided end hash
+		if endHash.IsEqual(&hash) {
+			last = hh
+			break
+		}
+
+		// Move to next block
+		hh, err = s.nextIndexHash(ctx, hh, endHash)
+		if err != nil {
+			return 0, last, err
+		}
+	}
+
+	return blocksProcessed, last, nil
+}
+
+// unindexFiltersInBlocks unindexes filters from the last processed block until
+// the provided end hash, exclusive. It returns the number of blocks processed
+// and the last hash it has processedd.
+func (s *Server) unindexFiltersInBlocks(ctx context.Context, endHash *chainhash.Hash, filters map[chainhash.Hash]*tbcd.BlockFilter) (int, *HashHeight, error) {
+	log.Tracef("unindexFiltersInBlocks")
+	defer log.Tracef("unindexFiltersInBlocks exit")
+
+	// indicates if we have processed endHash and thus have hit the exit
+	// condition.
+	var last *HashHeight
+
+	// Find start hash
+	filterHH, err := s.FilterIndexHash(ctx)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			return 0, last, fmt.Errorf("filter index hash: %w", err)
+		}
+		filterHH = &HashHeight{
+			Hash:   *s.chainParams.GenesisHash,
+			Height: 0,
+		}
+	}
+
+	filtersPercentage := 95 // flush cache at >95% capacity
+	blocksProcessed := 0
+	hh := filterHH
+	for {
+		log.Debugf("unindexing filters: %v", hh)
+
+		hash := hh.Hash
+
+		// Exit if we processed the provided end hash
+		if endHash.IsEqual(&hash) {
+			last = hh
+			break
+		}
+
+		bh, err := s.db.BlockHeaderByHash(ctx, &hash)
+		if err != nil {
+			return 0, last, fmt.Errorf("block header %v: %w", hash, err)
+		}
+
+		// Filters are keyed by block hash, there is no need to
+		// recreate them in order to delete them.
+		filters[bh.Hash] = nil
+
+		blocksProcessed++
+
+		// Try not to overshoot the cache to prevent costly allocations
+		cp := len(filters) * 100 / s.cfg.MaxCachedFilters
+		if bh.Height%10000 == 0 || cp > filtersPercentage || blocksProcessed == 1 {
+			log.Infof("Filter unindexer: %v filter cache %v%%", hh, cp)
+		}
+		if cp > filtersPercentage {
+			last = hh
+			// Flush
+			break
+		}
+
+		// Move to previous block
+		height := bh.Height - 1
+		pbh, err := s.db.BlockHeaderByHash(ctx, bh.ParentHash())
+		if err != nil {
+			return 0, last, fmt.Errorf("block headers by height %v: %w",
+				height, err)
+		}
+		hh.Hash = *pbh.BlockHash()
+		hh.Height = pbh.Height
+	}
+
+	return blocksProcessed, last, nil
+}
+
+func (s *Server) FilterIndexerUnwind(ctx context.Context, startBH, endBH *tbcd.BlockHeader) error {
+	log.Tracef("FilterIndexerUnwind")
+	defer log.Tracef("FilterIndexerUnwind exit")
+
+	s.mtx.Lock()
+	if !s.indexing {
+		// XXX this prob should be an error but pusnish bad callers for now
+		s.mtx.Unlock()
+		panic("FilterIndexerUnwind indexing not true")
+	}
+	s.mtx.Unlock()
+
+	// Allocate here so that we don't waste space when not indexing.
+	filters := make(map[chainhash.Hash]*tbcd.BlockFilter, s.cfg.MaxCachedFilters)
+	defer clear(filters)
+
+	log.Infof("Start unwinding Filters at hash %v height %v", startBH, startBH.Height)
+	log.Infof("End unwinding Filters at hash %v height %v", endBH, endBH.Height)
+	endHash := endBH.BlockHash()
+	for {
+		start := time.Now()
+		blocksProcessed, last, err := s.unindexFiltersInBlocks(ctx, endHash, filters)
+		if err != nil {
+			return fmt.Errorf("unindex filters in blocks: %w", err)
+		}
+		if blocksProcessed == 0 {
+			return nil
+		}
+		filtersCached := len(filters)
+		log.Infof("Filter unwinder blocks processed %v in %v filters cached %v cache unused %v",
+			blocksProcessed, time.Since(start), filtersCached,
+			s.cfg.MaxCachedFilters-filtersCached)
+
+		// Flush to disk
+		start = time.Now()
+		if err = s.db.BlockFilterUpdate(ctx, -1, filters); err != nil {
+			return fmt.Errorf("block filter update: %w", err)
+		}
+
+		log.Infof("Flushing unwind filters complete %v took %v",
+			filtersCached, time.Since(start))
+
+		// Record height in metadata
+		err = s.db.MetadataPut(ctx, FilterIndexHashKey, last.Hash[:])
+		if err != nil {
+			return fmt.Errorf("metadata filter hash: %w", err)
+		}
+
+		if endHash.IsEqual(&last.Hash) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *Server) FilterIndexerWind(ctx context.Context, startBH, endBH *tbcd.BlockHeader) error {
+	log.Tracef("FilterIndexerWind")
+	defer log.Tracef("FilterIndexerWind exit")
+
+	s.mtx.Lock()
+	if !s.indexing {
+		// XXX this prob should be an error but pusnish bad callers for now
+		s.mtx.Unlock()
+		panic("FilterIndexerWind not true")
+	}
+	s.mtx.Unlock()
+
+	// Allocate here so that we don't waste space when not indexing.
+	filters := make(map[chainhash.Hash]*tbcd.BlockFilter, s.cfg.MaxCachedFilters)
+	defer clear(filters)
+
+	log.Infof("Start indexing Filters at hash %v height %v", startBH, startBH.Height)
+	log.Infof("End indexing Filters at hash %v height %v", endBH, endBH.Height)
+	endHash := endBH.BlockHash()
+	for {
+		start := time.Now()
+		blocksProcessed, last, err := s.indexFiltersInBlocks(ctx, endHash, filters)
+		if err != nil {
+			return fmt.Errorf("index blocks: %w", err)
+		}
+		if blocksProcessed == 0 {
+			return nil
+		}
+		filtersCached := len(filters)
+		log.Infof("Filter indexer blocks processed %v in %v filters cached %v cache unused %v",
+			blocksProcessed, time.Since(start), filtersCached,
+			s.cfg.MaxCachedFilters-filtersCached)
+
+		// Flush to disk
+		start = time.Now()
+		if err = s.db.BlockFilterUpdate(ctx, 1, filters); err != nil {
+			return fmt.Errorf("block filter update: %w", err)
+		}
+		// leveldb does all kinds of allocations, force GC to lower
+		// memory pressure.
+		logMemStats()
+		runtime.GC()
+
+		log.Infof("Flushing filters complete %v took %v",
+			filtersCached, time.Since(start))
+
+		// Record height in metadata
+		err = s.db.MetadataPut(ctx, FilterIndexHashKey, last.Hash[:])
+		if err != nil {
+			return fmt.Errorf("metadata filter hash: %w", err)
+		}
+
+		if endHash.IsEqual(&last.Hash) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// FilterIndexer moves the BIP158 filter index to the provided hash. The filter
+// indexer relies on the tx index to look up spent outputs and thus the tx
+// indexer must be run first when winding.
+func (s *Server) FilterIndexer(ctx context.Context, endHash *chainhash.Hash) error {
+	log.Tracef("FilterIndexer")
+	defer log.Tracef("FilterIndexer exit")
+
+	s.mtx.Lock()
+	if !s.indexing {
+		// XXX this prob should be an error but pusnish bad callers for now
+		s.mtx.Unlock()
+		panic("FilterIndexer not true")
+	}
+	s.mtx.Unlock()
+
+	// Verify exit condition hash
+	if endHash == nil {
+		return errors.New("must provide an end hash")
+	}
+	endBH, err := s.db.BlockHeaderByHash(ctx, endHash)
+	if err != nil {
+		return fmt.Errorf("blockheader hash: %w", err)
+	}
+
+	// Verify start point is not after the end point
+	filterHH, err := s.FilterIndexHash(ctx)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			return fmt.Errorf("filter indexer: %w", err)
+		}
+		filterHH = &HashHeight{
+			Hash:   *s.chainParams.GenesisHash,
+			Height: 0,
+		}
+	}
+
+	// Make sure there is no gap between start and end or vice versa.
+	startBH, err := s.db.BlockHeaderByHash(ctx, &filterHH.Hash)
+	if err != nil {
+		return fmt.Errorf("blockheader hash: %w", err)
+	}
+	direction, err := s.FilterIndexIsLinear(ctx, endHash)
+	if err != nil {
+		return fmt.Errorf("filter index is linear: %w", err)
+	}
+	switch direction {
+	case 1:
+		return s.FilterIndexerWind(ctx, startBH, endBH)
+	case -1:
+		return s.FilterIndexerUnwind(ctx, startBH, endBH)
+	case 0:
+		// Because we call FilterIndexIsLinear we know it's the same
+		// block. Filters are only created while winding so make sure
+		// the start block has one.
+		if _, err := s.db.BlockFilterByHash(ctx, &startBH.Hash); err != nil {
+			if !errors.Is(err, database.ErrNotFound) {
+				return fmt.Errorf("block filter by hash: %w", err)
+			}
+			return s.FilterIndexerWind(ctx, startBH, endBH)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("invalid direction: %v", direction)
+}
+
+func (s *Server) UtxoIndexIsLinear(ctx context.Context, endHash *chainhash.Hash) (int, error) {
+	log.Tracef("UtxoIndexIsLinear")
+	defer log.Tracef("UtxoIndexIsLinear exit")
+
+	// Verify start point is not after the end point
+	utxoHH, err := s.UtxoIndexHash(ctx)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			return 0, fmt.Errorf("tx indexer: %w", err)
+		}
+		utxoHH = &HashHeight{
+			Hash:   *s.chainParams.GenesisHash,
+			Height: 0,
+		}
+	}
+
+	return s.IndexIsLinear(ctx, &utxoHH.Hash, endHash)
+}
+
+func (s *Server) TxIndexIsLinear(ctx context.Context, endHash *chainhash.Hash) (int, error) {
+	log.Tracef("TxIndexIsLinear")
+	defer log.Tracef("TxIndexIsLinear exit")
+
+	// Verify start point is not after the end point
+	txHH, err := s.TxIndexHash(ctx)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			return 0, fmt.Errorf("tx indexer: %w", err)
+		}
+		txHH = &HashHeight{
+			Hash:   *s.chainParams.GenesisHash,
+			Height: 0,
+		}
+	}
+
+	return s.IndexIsLinear(ctx, &txHH.Hash, endHash)
+}
+
+func (s *Server) FilterIndexIsLinear(ctx context.Context, endHash *chainhash.Hash) (int, error) {
+	log.Tracef("FilterIndexIsLinear")
+	defer log.Tracef("FilterIndexIsLinear exit")
+
+	// Verify start point is not after the end point
+	filterHH, err := s.FilterIndexHash(ctx)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			return 0, fmt.Errorf("filter indexer: %w", err)
+		}
+		filterHH = &HashHeight{
+			Hash:   *s.chainParams.GenesisHash,
+			Height: 0,
+		}
+	}
+
+	return s.IndexIsLinear(ctx, &filterHH.Hash, endHash)
+}
+
+func (s *Server) IndexIsLinear(ctx context.Context, startHash, endHash *chainhash.Hash) (int, error) {
+	log.Tracef("IndexIsLinear")
+	defer log.Tracef("IndexIsLinear exit")
+
+	// Verify exit condition hash
+	if startHash == nil || endHash == nil {
+		return 0, errors.New("must provide start and end hash")
+	}
+	endBH, err := s.db.BlockHeaderByHash(ctx, endHash)
+	if err != nil {
+		return 0, fmt.Errorf("blockheader hash: %w", err)
+	}
+
+	// Make sure there is no gap between start and end or vice versa.
+	startBH, err := s.db.BlockHeaderByHash(ctx, startHash)
+	if err != nil {
+		return 0, fmt.Errorf("blockheader hash: %w", err)
+	}
+	// Short circuit if the block hash is the same.
+	if startBH.BlockHash().IsEqual(endBH.BlockHash()) {
+		return 0, nil
+	}
+
+	direction := endBH.Difficulty.Cmp(&startBH.Difficulty)
 	log.Debugf("startBH %v %v", startBH.Height, startBH)
 	log.Debugf("endBH %v %v", endBH.Height, endBH)
 	log.Debugf("direction %v", direction)
@@ -1347,6 +2631,17 @@ func (s *Server) SyncIndexersToHash(ctx context.Context, hash *chainhash.Hash) e
 
 	log.Debugf("Syncing indexes to: %v", hash)
 
+	// When winding the tx index goes first since the filter index looks
+	// up spent outputs through it when their pk scripts were not recorded.
+	// When unwinding the utxo index goes first since it restores spent
+	// outputs through the tx index for blocks indexed by older releases.
+	direction, err := s.UtxoIndexIsLinear(ctx, hash)
+	if err == nil && direction > 0 {
+		if err := s.TxIndexer(ctx, hash); err != nil {
+			return fmt.Errorf("tx indexer: %w", err)
+		}
+	}
+
 	// UTXOs
 	if err := s.UtxoIndexer(ctx, hash); err != nil {
 		return fmt.Errorf("utxo indexer: %w", err)
@@ -1356,6 +2651,13 @@ func (s *Server) SyncIndexersToHash(ctx context.Context, hash *chainhash.Hash) e
 	if err := s.TxIndexer(ctx, hash); err != nil {
 		return fmt.Errorf("tx indexer: %w", err)
 	}
+
+	// Filters index
+	if !s.pruning() {
+		if err := s.FilterIndexer(ctx, hash); err != nil {
+			return fmt.Errorf("filter indexer: %w", err)
+		}
+	}
 	log.Debugf("Done syncing to: %v", hash)
 
 	bh, err := s.db.BlockHeaderByHash(ctx, hash)
@@ -1363,6 +2665,7 @@ func (s *Server) SyncIndexersToHash(ctx context.Context, hash *chainhash.Hash) e
 		log.Errorf("block header by hash: %v", err)
 	} else {
 		log.Infof("Syncing complete at: %v", bh.HH())
+		s.notifyIndexedTip(ctx, bh)
 	}
 
 	return nil
@@ -1377,9 +2680,28 @@ func (s *Server) syncIndexersToBest(ctx context.Context) error {
 		return err
 	}
 
-	log.Debugf("Sync indexers to best: %v @ %v", bhb, bhb.Height)
+	// Bootstrap utxo index from snapshot.
+	if s.cfg.UtxoSnapshot != "" {
+		_, err := s.UtxoIndexHash(ctx)
+		if errors.Is(err, database.ErrNotFound) {
+			_, err = s.utxoSnapshotImport(ctx, s.cfg.UtxoSnapshot,
+				s.cfg.UtxoSnapshotDigest)
+		}
+		if err != nil {
+			return fmt.Errorf("utxo snapshot: %w", err)
+		}
+	}
+
+	// Do not index beyond blocks that failed validation.
+	target, err := s.validIndexTarget(ctx, bhb)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Sync indexers to best: %v @ %v target: %v @ %v",
+		bhb, bhb.Height, target, target.Height)
 
-	// Index Utxo
+	// Utxo index
 	utxoHH, err := s.UtxoIndexHash(ctx)
 	if err != nil {
 		if !errors.Is(err, database.ErrNotFound) {
@@ -1394,24 +2716,12 @@ func (s *Server) syncIndexersToBest(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	cp, err := s.findCanonicalParent(ctx, utxoBH)
+	utxoCP, err := s.findCanonicalParent(ctx, utxoBH)
 	if err != nil {
 		return err
 	}
-	if !cp.Hash.IsEqual(&utxoBH.Hash) {
-		log.Infof("Syncing utxo index to: %v from: %v via: %v",
-			bhb.HH(), utxoBH.HH(), cp.HH())
-		// utxoBH is NOT on canonical chain, unwind first
-		if err := s.UtxoIndexer(ctx, &cp.Hash); err != nil {
-			return fmt.Errorf("utxo indexer unwind: %w", err)
-		}
-	}
-	// Index utxo to best block
-	if err := s.UtxoIndexer(ctx, &bhb.Hash); err != nil {
-		return fmt.Errorf("utxo indexer: %w", err)
-	}
 
-	// Index Tx
+	// Tx index
 	txHH, err := s.TxIndexHash(ctx)
 	if err != nil {
 		if !errors.Is(err, database.ErrNotFound) {
@@ -1427,31 +2737,107 @@ func (s *Server) syncIndexersToBest(ctx context.Context) error {
 		return err
 	}
 	// We can short circuit looking up canonical parent if txBH == utxoBH.
-	ptxHash := &txBH.Hash
-	if !ptxHash.IsEqual(&utxoBH.Hash) {
-		cp, err = s.findCanonicalParent(ctx, txBH)
+	txCP := utxoCP
+	if !txBH.Hash.IsEqual(&utxoBH.Hash) {
+		txCP, err = s.findCanonicalParent(ctx, txBH)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Filter index
+	filterHH, err := s.FilterIndexHash(ctx)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			return fmt.Errorf("filter index hash: %w", err)
+		}
+		filterHH = &HashHeight{
+			Hash:   *s.chainParams.GenesisHash,
+			Height: 0,
+		}
+	}
+	filterBH, err := s.db.BlockHeaderByHash(ctx, &filterHH.Hash)
+	if err != nil {
+		return err
+	}
+	// We can short circuit looking up canonical parent if filterBH == txBH.
+	filterCP := txCP
+	if !filterBH.Hash.IsEqual(&txBH.Hash) {
+		filterCP, err = s.findCanonicalParent(ctx, filterBH)
 		if err != nil {
 			return err
 		}
 	}
-	if !cp.Hash.IsEqual(&txBH.Hash) {
+
+	// Unwind indexes that are NOT on the canonical chain first, in the
+	// reverse order of winding. The utxo index restores spent outputs from
+	// undo records, only blocks that were indexed by older releases
+	// restore them through the tx index and thus it is unwound first.
+	if !utxoCP.Hash.IsEqual(&utxoBH.Hash) {
+		log.Infof("Syncing utxo index to: %v from: %v via: %v",
+			target.HH(), utxoBH.HH(), utxoCP.HH())
+		if err := s.UtxoIndexer(ctx, &utxoCP.Hash); err != nil {
+			return fmt.Errorf("utxo indexer unwind: %w", err)
+		}
+	}
+	if !txCP.Hash.IsEqual(&txBH.Hash) {
 		log.Infof("Syncing tx index to: %v from: %v via: %v",
-			bhb.HH(), txBH.HH(), cp.HH())
-		// txBH is NOT on canonical chain, unwind first
-		if err := s.TxIndexer(ctx, &cp.Hash); err != nil {
+			target.HH(), txBH.HH(), txCP.HH())
+		if err := s.TxIndexer(ctx, &txCP.Hash); err != nil {
 			return fmt.Errorf("tx indexer unwind: %w", err)
 		}
 	}
-	// Transactions index
-	if err := s.TxIndexer(ctx, &bhb.Hash); err != nil {
+	if !s.pruning() && !filterCP.Hash.IsEqual(&filterBH.Hash) {
+		log.Infof("Syncing filter index to: %v from: %v via: %v",
+			target.HH(), filterBH.HH(), filterCP.HH())
+		if err := s.FilterIndexer(ctx, &filterCP.Hash); err != nil {
+			return fmt.Errorf("filter indexer unwind: %w", err)
+		}
+	}
+
+	// Wind the tx index first since the filter index looks up spent
+	// outputs through it when the utxo index has not recorded their pk
+	// scripts.
+	if err := s.TxIndexer(ctx, &target.Hash); err != nil {
 		return fmt.Errorf("tx indexer: %w", err)
 	}
+	if err := s.UtxoIndexer(ctx, &target.Hash); err != nil {
+		if errors.Is(err, ErrBlockInvalid) {
+			// The invalid block has been recorded, start over to
+			// move the indexes to its parent.
+			log.Errorf("utxo indexer: %v", err)
+			return s.syncIndexersToBest(ctx)
+		}
+		return fmt.Errorf("utxo indexer: %w", err)
+	}
+	// The filter index requires the blocks that created the spent
+	// outputs and is therefore disabled when pruning.
+	if !s.pruning() {
+		if err := s.FilterIndexer(ctx, &target.Hash); err != nil {
+			return fmt.Errorf("filter indexer: %w", err)
+		}
+	}
 
-	bh, err := s.db.BlockHeaderByHash(ctx, &bhb.Hash)
-	if err != nil {
-		log.Errorf("block header by hash: %v", err)
-	} else {
-		log.Infof("Syncing complete at: %v", bh.HH())
+	// Move the canonical tip off invalid blocks now that the indexers are
+	// no longer on them and start over to index the new canonical chain.
+	if !target.Hash.IsEqual(&bhb.Hash) {
+		if err := s.invalidChainsRemove(ctx); err != nil {
+			return fmt.Errorf("invalid chains remove: %w", err)
+		}
+		return s.syncIndexersToBest(ctx)
+	}
+
+	log.Infof("Syncing complete at: %v", target.HH())
+	s.notifyIndexedTip(ctx, target)
+
+	if s.cfg.MempoolEnabled {
+		if err := s.mempoolRevalidate(ctx); err != nil {
+			return fmt.Errorf("mempool revalidate: %w", err)
+		}
+	}
+
+	if err := s.pruneBlocks(ctx); err != nil {
+		return fmt.Errorf("prune blocks: %w", err)
 	}
 
 	return nil
@@ -5,11 +5,193 @@
 package tbc
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database"
 	"github.com/hemilabs/heminetwork/database/tbcd"
 )
 
+// utxoErrDB fails all utxo lookups with err.
+type utxoErrDB struct {
+	tbcd.Database
+	err error
+}
+
+func (db *utxoErrDB) UtxoByOutpoint(_ context.Context, _ tbcd.Outpoint) (*tbcd.CacheOutput, error) {
+	return nil, db.err
+}
+
+func TestFixupCacheErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg := NewDefaultConfig()
+	cfg.Network = networkLocalnet
+	cfg.LevelDBHome = t.TempDir()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+
+	genesis := *chaincfg.RegressionNetParams.GenesisHash
+	blocks := testBlocks(genesis, 0, 1, 0)
+	spend := wire.NewMsgTx(1)
+	spend.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0),
+		nil, nil))
+	spend.AddTxOut(wire.NewTxOut(1, testPkScript))
+	mb := blocks[0].MsgBlock()
+	mb.Transactions = append(mb.Transactions, spend)
+	b := btcutil.NewBlock(mb)
+
+	// Missing outputs are omitted, they make the block invalid.
+	db := s.db
+	defer func() { s.db = db }()
+	utxos := make(map[tbcd.Outpoint]tbcd.CacheOutput)
+	fetched := make(map[tbcd.Outpoint]tbcd.SpentOutput)
+	s.db = &utxoErrDB{Database: db, err: database.ErrNotFound}
+	if err := s.fixupCache(ctx, b, utxos, fetched); err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 0 || len(fetched) != 0 {
+		t.Fatalf("unexpected outputs: %v %v", utxos, fetched)
+	}
+
+	// Other errors must not make the block invalid.
+	s.db = &utxoErrDB{Database: db, err: errors.New("disk on fire")}
+	err = s.fixupCache(ctx, b, utxos, fetched)
+	if err == nil || errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+func TestInvalidChainsRemove(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// g - 1 - 2 - 3 - 4 - 5
+	//          \- 3f - 4f - 5f - 6f
+	//                 \- 5s
+	hashOf := func(bh *wire.BlockHeader) *chainhash.Hash {
+		hash := bh.BlockHash()
+		return &hash
+	}
+	genesis := *chaincfg.RegressionNetParams.GenesisHash
+	main := testHeaders(genesis, 5, 0)
+	fork := testHeaders(main[1].BlockHash(), 4, 1)
+	sub := testHeaders(fork[1].BlockHash(), 1, 2)
+
+	cfg := NewDefaultConfig()
+	cfg.Network = networkLocalnet
+	cfg.LevelDBHome = t.TempDir()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	testHeadersInsert(ctx, t, s, main)
+	testHeadersInsert(ctx, t, s, fork)
+	testHeadersInsert(ctx, t, s, sub)
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bhb.BlockHash().IsEqual(hashOf(fork[3])) {
+		t.Fatalf("expected fork tip, got %v", bhb)
+	}
+
+	// The canonical tip moves to the heaviest valid chain.
+	if err := s.markBlockInvalid(ctx, hashOf(fork[0])); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.invalidChainsRemove(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if bhb, err = s.db.BlockHeaderBest(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !bhb.BlockHash().IsEqual(hashOf(main[4])) {
+		t.Fatalf("expected main tip, got %v", bhb)
+	}
+	for _, bh := range append(fork, sub...) {
+		_, err := s.db.BlockHeaderByHash(ctx, hashOf(bh))
+		if !errors.Is(err, database.ErrNotFound) {
+			t.Fatalf("expected %v, got %v", database.ErrNotFound, err)
+		}
+	}
+	for height := uint64(3); height <= 5; height++ {
+		bhs, err := s.db.BlockHeadersByHeight(ctx, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bhs) != 1 {
+			t.Fatalf("height %v: expected 1 header, got %v", height,
+				len(bhs))
+		}
+	}
+	if err := s.invalidChainsRemove(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid headers are rejected until they are reconsidered.
+	if err := s.invalidHeadersVerify(ctx, main); err != nil {
+		t.Fatal(err)
+	}
+	err = s.invalidHeadersVerify(ctx, []*wire.BlockHeader{fork[0]})
+	if !errors.Is(err, ErrBlockInvalid) {
+		t.Fatalf("expected %v, got %v", ErrBlockInvalid, err)
+	}
+	ibs, err := s.InvalidBlocks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ibs) != 1 || !ibs[0].IsEqual(hashOf(fork[0])) {
+		t.Fatalf("unexpected invalid blocks: %v", ibs)
+	}
+	err = s.ReconsiderBlock(ctx, hashOf(main[0]))
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", database.ErrNotFound, err)
+	}
+	if err := s.ReconsiderBlock(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ibs, err = s.InvalidBlocks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(ibs) != 0 {
+		t.Fatalf("unexpected invalid blocks: %v", ibs)
+	}
+	err = s.invalidHeadersVerify(ctx, []*wire.BlockHeader{fork[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 // func TestIndex(t *testing.T) {
 //	t.Skip()
 //	logLevel := "INFO"
@@ -0,0 +1,550 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+// dbVerifyUtxoPage is the number of utxos that are read at a time when
+// recomputing a balance.
+const dbVerifyUtxoPage = 1000
+
+var ErrRebuildRequired = errors.New("rebuild required")
+
+// DBVerifyResult is the outcome of a database verification.
+type DBVerifyResult struct {
+	Best         HashHeight   // canonical tip
+	Headers      uint64       // canonical headers walked
+	Absent       []HashHeight // canonical blocks not in the block store
+	MissingStale []HashHeight // missing blocks entries that are stored
+
+	Indexes           []DBVerifyIndex // indexes that exist
+	ScriptHashes      int             // sampled script hashes
+	UtxoMismatches    int             // utxo index entries that do not add up
+	BalanceMismatches int             // balances that differ from the blocks
+
+	Problems []string
+}
+
+// DBVerifyIndex is the verification result of an index.
+type DBVerifyIndex struct {
+	Name       string
+	HashHeight HashHeight
+	Consistent HashHeight // last consistent HashHeight
+
+	// BeyondAbsent is set when the index covers an absent block. The
+	// absent block is required to unwind the index.
+	BeyondAbsent bool
+}
+
+// Index returns the named index, nil when it does not exist.
+func (r *DBVerifyResult) Index(name string) *DBVerifyIndex {
+	for k := range r.Indexes {
+		if r.Indexes[k].Name == name {
+			return &r.Indexes[k]
+		}
+	}
+	return nil
+}
+
+// Repairable returns true when the inconsistencies can be repaired by
+// unwinding the indexes.
+func (r *DBVerifyResult) Repairable() bool {
+	if r.UtxoMismatches != 0 || r.BalanceMismatches != 0 {
+		return false
+	}
+	for _, index := range r.Indexes {
+		if index.BeyondAbsent {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *DBVerifyResult) problemf(format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// canonicalChain is the canonical chain from the effective genesis to the tip.
+type canonicalChain struct {
+	low    uint64           // height of the effective genesis
+	hashes []chainhash.Hash // indexed by height
+}
+
+func (c *canonicalChain) contains(hh *HashHeight) bool {
+	return hh.Height >= c.low && hh.Height < uint64(len(c.hashes)) &&
+		c.hashes[hh.Height].IsEqual(&hh.Hash)
+}
+
+// canonicalParent walks back from hh until it reaches the canonical chain.
+func (s *Server) canonicalParent(ctx context.Context, c *canonicalChain, hh *HashHeight) (*HashHeight, error) {
+	for !c.contains(hh) {
+		if hh.Height <= c.low {
+			return nil, fmt.Errorf("%v does not connect to the "+
+				"canonical chain", hh)
+		}
+		bh, err := s.db.BlockHeaderByHash(ctx, &hh.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("block header %v: %w", hh, err)
+		}
+		hh = &HashHeight{Hash: *bh.ParentHash(), Height: bh.Height - 1}
+	}
+	return hh, nil
+}
+
+// DBVerify checks that the indexes are consistent with the canonical chain.
+// It walks the canonical headers and checks every block is stored or in the
+// missing blocks table, that the indexes are on the canonical chain and that
+// the balances of script hashes sampled from samples random blocks match the
+// utxo index. Balances are recomputed from the blocks of the transactions in
+// the script hash history. This must not be called while tbcd is running.
+func (s *Server) DBVerify(ctx context.Context, samples int) (*DBVerifyResult, error) {
+	log.Tracef("DBVerify")
+	defer log.Tracef("DBVerify exit")
+
+	r := &DBVerifyResult{}
+
+	// Walk the canonical chain.
+	bh, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("block header best: %w", err)
+	}
+	r.Best = HashHeight{
+		Hash:      bh.Hash,
+		Height:    bh.Height,
+		Timestamp: bh.Timestamp().Unix(),
+	}
+	c := &canonicalChain{hashes: make([]chainhash.Hash, bh.Height+1)}
+	for {
+		c.hashes[bh.Height] = bh.Hash
+		c.low = bh.Height
+		r.Headers++
+
+		ok, err := s.db.BlockExistsByHash(ctx, &bh.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("block exists %v: %w", bh.HH(), err)
+		}
+		if !ok {
+			r.Absent = append(r.Absent, HashHeight{
+				Hash:   bh.Hash,
+				Height: bh.Height,
+			})
+		}
+
+		if bh.Height == 0 {
+			break
+		}
+		bh, err = s.db.BlockHeaderByHash(ctx, bh.ParentHash())
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				break // effective genesis
+			}
+			return nil, fmt.Errorf("block header: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+	}
+	log.Infof("Verified %v canonical headers, %v blocks absent",
+		r.Headers, len(r.Absent))
+
+	// Blocks at or below the index lower bound are not downloaded.
+	var lowerBound uint64
+	lb, err := s.IndexLowerBound(ctx)
+	if err == nil {
+		lowerBound = lb.Height
+	} else if !errors.Is(err, database.ErrNotFound) {
+		return nil, fmt.Errorf("index lower bound: %w", err)
+	}
+
+	// Absent blocks must be in the missing blocks table or they are never
+	// downloaded. Stored blocks must not be.
+	missing, err := s.db.BlocksMissing(ctx, len(c.hashes))
+	if err != nil {
+		return nil, fmt.Errorf("blocks missing: %w", err)
+	}
+	inMissing := make(map[chainhash.Hash]struct{}, len(missing))
+	for _, bi := range missing {
+		inMissing[*bi.Hash] = struct{}{}
+		ok, err := s.db.BlockExistsByHash(ctx, bi.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("block exists %v: %w", bi.Hash, err)
+		}
+		if ok {
+			r.MissingStale = append(r.MissingStale, HashHeight{
+				Hash:   *bi.Hash,
+				Height: bi.Height,
+			})
+			r.problemf("missing block %v @ %v is stored",
+				bi.Hash, bi.Height)
+		}
+	}
+	var firstAbsent *HashHeight
+	for k := range r.Absent {
+		hh := &r.Absent[k]
+		if lb != nil && hh.Height <= lowerBound {
+			break // absent blocks are in descending order
+		}
+		if _, ok := inMissing[hh.Hash]; !ok {
+			r.problemf("absent block %v is not in the missing blocks "+
+				"table", hh)
+		}
+		firstAbsent = hh // absent blocks are in descending order
+	}
+
+	// Indexes must be on the canonical chain and may only index stored
+	// blocks.
+	_, err = s.db.MetadataGet(ctx, UtxoSnapshotKey)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return nil, fmt.Errorf("metadata utxo snapshot: %w", err)
+	}
+	snapshot := err == nil
+	indexes := []struct {
+		name string
+		hh   func(context.Context) (*HashHeight, error)
+	}{
+		{"utxo", s.UtxoIndexHash},
+		{"tx", s.TxIndexHash},
+		{"filter", s.FilterIndexHash},
+	}
+	for _, index := range indexes {
+		hh, err := index.hh(ctx)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				continue
+			}
+			return nil, fmt.Errorf("%v index hash: %w", index.name, err)
+		}
+
+		consistent, err := s.canonicalParent(ctx, c, hh)
+		if err != nil {
+			return nil, fmt.Errorf("%v index: %w", index.name, err)
+		}
+		if consistent != hh {
+			r.problemf("%v index %v is not canonical", index.name, hh)
+		}
+		var beyondAbsent bool
+		if firstAbsent != nil && consistent.Height >= firstAbsent.Height {
+			r.problemf("%v index %v is beyond absent block %v",
+				index.name, hh, firstAbsent)
+			h := max(firstAbsent.Height, c.low+1) - 1
+			consistent = &HashHeight{Hash: c.hashes[h], Height: h}
+			beyondAbsent = true
+		}
+		r.Indexes = append(r.Indexes, DBVerifyIndex{
+			Name:         index.name,
+			HashHeight:   *hh,
+			Consistent:   *consistent,
+			BeyondAbsent: beyondAbsent,
+		})
+	}
+
+	if r.Index("utxo") != nil && samples > 0 {
+		if err := s.dbVerifyUtxos(ctx, r, c, samples, snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// dbVerifyUtxos recomputes the balances of script hashes that are sampled from
+// random canonical blocks. Every utxo must point back to its script hash and
+// must have been created at or below the utxo index. The history of a utxo
+// index that was imported from a snapshot is incomplete and its balances are
+// therefore only checked against the utxos.
+func (s *Server) dbVerifyUtxos(ctx context.Context, r *DBVerifyResult, c *canonicalChain, samples int, snapshot bool) error {
+	utxoIndex := r.Index("utxo")
+	utxoHeight := utxoIndex.Consistent.Height
+	if utxoHeight < c.low {
+		return nil
+	}
+
+	// The creating transactions can only be checked when both indexes are
+	// canonical and the tx index covers the utxo index.
+	txIndex := r.Index("tx")
+	checkCreated := utxoIndex.HashHeight.Hash == utxoIndex.Consistent.Hash &&
+		txIndex != nil &&
+		txIndex.HashHeight.Hash == txIndex.Consistent.Hash &&
+		txIndex.HashHeight.Height >= utxoIndex.HashHeight.Height
+
+	// The blocks only add up to the balances of a canonical index that was
+	// built from the blocks.
+	checkBlocks := !snapshot &&
+		utxoIndex.HashHeight.Hash == utxoIndex.Consistent.Hash
+
+	shs := make(map[tbcd.ScriptHash]struct{}, samples)
+	for range samples {
+		height := c.low + rand.Uint64N(utxoHeight-c.low+1)
+		b, err := s.db.BlockByHash(ctx, &c.hashes[height])
+		if err != nil {
+			// Absent and pruned blocks cannot be sampled.
+			continue
+		}
+		txs := b.MsgBlock().Transactions
+		tx := txs[rand.IntN(len(txs))]
+		if len(tx.TxOut) == 0 {
+			continue
+		}
+		txOut := tx.TxOut[rand.IntN(len(tx.TxOut))]
+		shs[tbcd.NewScriptHashFromScript(txOut.PkScript)] = struct{}{}
+	}
+	r.ScriptHashes = len(shs)
+
+	for sh := range shs {
+		balance, err := s.db.BalanceByScriptHash(ctx, sh)
+		if err != nil {
+			return fmt.Errorf("balance %v: %w", sh, err)
+		}
+
+		var indexed uint64
+		for start := uint64(0); ; start += dbVerifyUtxoPage {
+			utxos, err := s.db.UtxosByScriptHash(ctx, sh, start,
+				dbVerifyUtxoPage)
+			if err != nil {
+				return fmt.Errorf("utxos %v: %w", sh, err)
+			}
+			for _, utxo := range utxos {
+				ok, err := s.dbVerifyUtxo(ctx, r, &utxoIndex.HashHeight,
+					checkCreated, snapshot, sh, utxo)
+				if err != nil {
+					return err
+				}
+				if ok {
+					indexed += utxo.Value()
+				} else {
+					r.UtxoMismatches++
+				}
+			}
+			if len(utxos) < dbVerifyUtxoPage {
+				break
+			}
+		}
+		if balance != indexed {
+			r.problemf("script hash %v balance %v, utxos %v",
+				sh, balance, indexed)
+			continue
+		}
+
+		if !checkBlocks {
+			continue
+		}
+		recomputed, ok, err := s.dbVerifyBalance(ctx, r, c, utxoHeight, sh)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if balance != recomputed {
+			r.problemf("script hash %v balance %v, recomputed %v",
+				sh, balance, recomputed)
+			r.BalanceMismatches++
+		}
+	}
+	return nil
+}
+
+// dbVerifyBalance recomputes the balance of a script hash at utxoHeight from
+// the blocks of the transactions in its history. It returns false when the
+// balance cannot be recomputed because a block is not available or, after
+// recording the problem, when the history does not match the blocks.
+func (s *Server) dbVerifyBalance(ctx context.Context, r *DBVerifyResult, c *canonicalChain, utxoHeight uint64, sh tbcd.ScriptHash) (uint64, bool, error) {
+	created := make(map[wire.OutPoint]uint64)
+	spent := make(map[wire.OutPoint]struct{})
+
+	// The history is ordered by height, keep the last block around.
+	var b *btcutil.Block
+	var cursor []byte
+	for {
+		txs, next, err := s.db.TxsByScriptHash(ctx, sh, cursor,
+			dbVerifyUtxoPage)
+		if err != nil {
+			return 0, false, fmt.Errorf("txs by script hash %v: %w",
+				sh, err)
+		}
+		for _, th := range txs {
+			if th.Height > utxoHeight {
+				next = nil // done
+				break
+			}
+			if th.Height < c.low {
+				return 0, false, nil
+			}
+			hash := &c.hashes[th.Height]
+			if b == nil || !b.Hash().IsEqual(hash) {
+				b, err = s.db.BlockByHash(ctx, hash)
+				if err != nil {
+					if errors.Is(err, database.ErrBlockNotFound) ||
+						errors.Is(err, database.ErrBlockPruned) {
+						return 0, false, nil
+					}
+					return 0, false, fmt.Errorf("block %v: %w",
+						hash, err)
+				}
+			}
+			var tx *btcutil.Tx
+			for _, t := range b.Transactions() {
+				if t.Hash().IsEqual(&th.TxId) {
+					tx = t
+					break
+				}
+			}
+			if tx == nil {
+				r.problemf("script hash %v history tx %v not in "+
+					"block %v @ %v", sh, th.TxId, hash, th.Height)
+				r.BalanceMismatches++
+				return 0, false, nil
+			}
+			for _, txIn := range tx.MsgTx().TxIn {
+				spent[txIn.PreviousOutPoint] = struct{}{}
+			}
+			for k, txOut := range tx.MsgTx().TxOut {
+				if txscript.IsUnspendable(txOut.PkScript) ||
+					tbcd.NewScriptHashFromScript(txOut.PkScript) != sh {
+					continue
+				}
+				op := wire.OutPoint{Hash: *tx.Hash(), Index: uint32(k)}
+				created[op] = uint64(txOut.Value)
+			}
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+
+	var balance uint64
+	for op, value := range created {
+		if _, ok := spent[op]; !ok {
+			balance += value
+		}
+	}
+	return balance, true, nil
+}
+
+// dbVerifyUtxo returns false, and records the problem, when the utxo is not
+// consistent with the rest of the database. When checkCreated is set the
+// utxo must have been created at or below the utxo index. Utxos that were
+// imported from a snapshot are not in the tx index.
+func (s *Server) dbVerifyUtxo(ctx context.Context, r *DBVerifyResult, utxoHH *HashHeight, checkCreated, snapshot bool, sh tbcd.ScriptHash, utxo tbcd.Utxo) (bool, error) {
+	op := tbcd.NewOutpoint(utxo.ScriptHash(), utxo.OutputIndex())
+	co, err := s.db.UtxoByOutpoint(ctx, op)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			r.problemf("utxo %v of %v has no outpoint", op, sh)
+			return false, nil
+		}
+		return false, fmt.Errorf("utxo by outpoint %v: %w", op, err)
+	}
+	if co.ScriptHash() != sh || co.Value() != utxo.Value() {
+		r.problemf("utxo %v of %v points to %v", op, sh, co)
+		return false, nil
+	}
+
+	if !checkCreated {
+		return true, nil
+	}
+	hash, err := s.db.BlockHashByTxId(ctx, op.TxIdHash())
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			if snapshot {
+				return true, nil
+			}
+			r.problemf("utxo %v of %v created by unknown tx", op, sh)
+			return false, nil
+		}
+		return false, fmt.Errorf("block hash by tx id %v: %w", op, err)
+	}
+	bh, err := s.db.BlockHeaderByHash(ctx, hash)
+	if err != nil {
+		return false, fmt.Errorf("block header %v: %w", hash, err)
+	}
+	if bh.Height > utxoHH.Height {
+		// The tx index returns the highest block of a duplicate tx,
+		// the utxo may have been created by an earlier one.
+		cbh, err := s.utxoBlockHeader(ctx, op.TxIdHash(), sh, utxoHH)
+		if err == nil {
+			bh = cbh
+		} else if !errors.Is(err, database.ErrNotFound) {
+			return false, err
+		}
+	}
+	if bh.Height > utxoHH.Height {
+		r.problemf("utxo %v of %v created in %v beyond utxo index %v",
+			op, sh, bh.HH(), utxoHH)
+		return false, nil
+	}
+	return true, nil
+}
+
+// DBRepair deletes stale missing blocks entries and unwinds the indexes to
+// their last consistent HashHeight found by DBVerify. Inconsistencies within
+// the utxo index cannot be unwound and require a rebuild. This must not be
+// called while tbcd is running.
+func (s *Server) DBRepair(ctx context.Context, r *DBVerifyResult) error {
+	log.Tracef("DBRepair")
+	defer log.Tracef("DBRepair exit")
+
+	// Unwinding requires the blocks that are being unwound.
+	for _, index := range r.Indexes {
+		if index.BeyondAbsent {
+			return fmt.Errorf("%w: %v index beyond absent block",
+				ErrRebuildRequired, index.Name)
+		}
+	}
+	if !r.Repairable() {
+		return fmt.Errorf("%w: %v utxo mismatches %v balance mismatches",
+			ErrRebuildRequired, r.UtxoMismatches, r.BalanceMismatches)
+	}
+
+	for _, hh := range r.MissingStale {
+		err := s.db.BlockMissingDelete(ctx, int64(hh.Height), &hh.Hash)
+		if err != nil {
+			return fmt.Errorf("block missing delete %v: %w", hh, err)
+		}
+	}
+
+	unlock, err := s.indexingLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The utxo index goes first since it restores spent outputs through
+	// the tx index.
+	indexers := map[string]func(context.Context, *chainhash.Hash) error{
+		"utxo":   s.UtxoIndexer,
+		"tx":     s.TxIndexer,
+		"filter": s.FilterIndexer,
+	}
+	for _, index := range r.Indexes {
+		if index.HashHeight.Hash.IsEqual(&index.Consistent.Hash) {
+			continue
+		}
+		log.Infof("Unwinding %v index %v to %v", index.Name,
+			index.HashHeight, index.Consistent)
+		err := indexers[index.Name](ctx, &index.Consistent.Hash)
+		if err != nil {
+			return fmt.Errorf("unwind %v index: %w", index.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+var testPkScript = []byte{txscript.OP_TRUE}
+
+// testBlocks returns n coinbase only blocks on top of prev, tag makes forks
+// unique.
+func testBlocks(prev chainhash.Hash, height uint64, n int, tag byte) []*btcutil.Block {
+	blocks := make([]*btcutil.Block, 0, n)
+	ts := chaincfg.RegressionNetParams.GenesisBlock.Header.Timestamp
+	for k := range n {
+		height++
+		tx := wire.NewMsgTx(1)
+		tx.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+			SignatureScript:  []byte{byte(height), tag},
+			Sequence:         wire.MaxTxInSequenceNum,
+		})
+		tx.AddTxOut(wire.NewTxOut(50*1e8, testPkScript))
+		merkle := tx.TxHash()
+		bh := wire.NewBlockHeader(1, &prev, &merkle,
+			chaincfg.RegressionNetParams.PowLimitBits, 0)
+		bh.Timestamp = ts.Add(time.Duration(k+1) * time.Minute)
+		b := btcutil.NewBlock(&wire.MsgBlock{
+			Header:       *bh,
+			Transactions: []*wire.MsgTx{tx},
+		})
+		blocks = append(blocks, b)
+		prev = *b.Hash()
+	}
+	return blocks
+}
+
+func testBlocksInsert(ctx context.Context, t *testing.T, s *Server, blocks []*btcutil.Block) {
+	t.Helper()
+
+	headers := make([]*wire.BlockHeader, 0, len(blocks))
+	for _, b := range blocks {
+		headers = append(headers, &b.MsgBlock().Header)
+	}
+	testHeadersInsert(ctx, t, s, headers)
+	for _, b := range blocks {
+		if _, err := s.db.BlockInsert(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDBVerify(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg := NewDefaultConfig()
+	cfg.Network = networkLocalnet
+	cfg.LevelDBHome = t.TempDir()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(problems int) *DBVerifyResult {
+		t.Helper()
+		r, err := s.DBVerify(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Problems) != problems {
+			t.Fatalf("expected %v problems, got %v", problems, r.Problems)
+		}
+		return r
+	}
+
+	// Index a chain of 5 blocks with 2 more headers on top.
+	main := testBlocks(*chaincfg.RegressionNetParams.GenesisHash, 0, 7, 0)
+	testBlocksInsert(ctx, t, s, main[:5])
+	msg := wire.NewMsgHeaders()
+	for _, b := range main[5:] {
+		if err := msg.AddBlockHeader(&b.MsgBlock().Header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, _, _, err := s.db.BlockHeadersInsert(ctx, msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := s.indexingLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TxIndexer(ctx, main[4].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UtxoIndexer(ctx, main[4].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	r := verify(0)
+	if r.Best.Height != 7 || r.Headers != 8 || len(r.Absent) != 2 {
+		t.Fatalf("unexpected result: %v %v %v", r.Best, r.Headers,
+			len(r.Absent))
+	}
+	if len(r.Indexes) != 2 || r.ScriptHashes == 0 {
+		t.Fatalf("unexpected indexes: %v %v", r.Indexes, r.ScriptHashes)
+	}
+
+	// An index beyond an absent block cannot be unwound.
+	if err := s.db.MetadataPut(ctx, TxIndexHashKey, main[5].Hash()[:]); err != nil {
+		t.Fatal(err)
+	}
+	r = verify(1)
+	if !r.Index("tx").BeyondAbsent || r.Repairable() {
+		t.Fatalf("unexpected tx index: %v", r.Index("tx"))
+	}
+	if err := s.DBRepair(ctx, r); !errors.Is(err, ErrRebuildRequired) {
+		t.Fatalf("expected %v, got %v", ErrRebuildRequired, err)
+	}
+	if err := s.db.MetadataPut(ctx, TxIndexHashKey, main[4].Hash()[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// A longer fork leaves the indexes on a non canonical chain, repair
+	// unwinds them to the fork point.
+	fork := testBlocks(*main[2].Hash(), 3, 5, 1)
+	testBlocksInsert(ctx, t, s, fork)
+	r = verify(2)
+	for _, index := range r.Indexes {
+		if !index.Consistent.Hash.IsEqual(main[2].Hash()) {
+			t.Fatalf("%v: unexpected consistent %v", index.Name,
+				index.Consistent)
+		}
+	}
+	if err := s.DBRepair(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	r = verify(0)
+	if h := r.Index("utxo").HashHeight; h.Height != 3 {
+		t.Fatalf("utxo index not unwound: %v", h)
+	}
+
+	// Balances are recomputed from the blocks, a utxo that is missing from
+	// both the utxos and the balance is found.
+	sh := tbcd.NewScriptHashFromScript(testPkScript)
+	op := tbcd.NewOutpoint(*main[1].Transactions()[0].Hash(), 0)
+	err = s.db.BlockUtxoUpdate(ctx, 1, map[tbcd.Outpoint]tbcd.CacheOutput{
+		op: tbcd.NewDeleteCacheOutput(sh, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = verify(1)
+	if r.BalanceMismatches != 1 || r.Repairable() {
+		t.Fatalf("unexpected balance mismatches: %v", r.BalanceMismatches)
+	}
+	err = s.db.BlockUtxoUpdate(ctx, 1, map[tbcd.Outpoint]tbcd.CacheOutput{
+		op: tbcd.NewCacheOutput(sh, 50*1e8, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify(0)
+
+	// Utxos that were flushed without the index hash cannot be unwound.
+	txId := chainhash.DoubleHashH([]byte("unknown"))
+	err = s.db.BlockUtxoUpdate(ctx, 1, map[tbcd.Outpoint]tbcd.CacheOutput{
+		tbcd.NewOutpoint(txId, 0): tbcd.NewCacheOutput(
+			tbcd.NewScriptHashFromScript(testPkScript), 1, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = verify(2) // unknown tx and balance
+	if r.UtxoMismatches != 1 || r.Repairable() {
+		t.Fatalf("unexpected utxo mismatches: %v", r.UtxoMismatches)
+	}
+	if err := s.DBRepair(ctx, r); !errors.Is(err, ErrRebuildRequired) {
+		t.Fatalf("expected %v, got %v", ErrRebuildRequired, err)
+	}
+}
+
+func TestDBVerifyDuplicateTx(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg := NewDefaultConfig()
+	cfg.Network = networkLocalnet
+	cfg.LevelDBHome = t.TempDir()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The third block repeats the coinbase of the first one, like the
+	// BIP30 duplicate coinbases.
+	blocks := testBlocks(*chaincfg.RegressionNetParams.GenesisHash, 0, 2, 0)
+	dup := blocks[0].MsgBlock().Transactions[0]
+	merkle := dup.TxHash()
+	bh := wire.NewBlockHeader(1, blocks[1].Hash(), &merkle,
+		chaincfg.RegressionNetParams.PowLimitBits, 0)
+	bh.Timestamp = blocks[1].MsgBlock().Header.Timestamp.Add(time.Minute)
+	blocks = append(blocks, btcutil.NewBlock(&wire.MsgBlock{
+		Header:       *bh,
+		Transactions: []*wire.MsgTx{dup},
+	}))
+	testBlocksInsert(ctx, t, s, blocks)
+
+	// The tx index covers the duplicate, the utxo index does not.
+	unlock, err := s.indexingLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TxIndexer(ctx, blocks[2].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UtxoIndexer(ctx, blocks[1].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	r, err := s.DBVerify(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || r.ScriptHashes == 0 {
+		t.Fatalf("unexpected result: %v %v", r.Problems, r.ScriptHashes)
+	}
+}
@@ -0,0 +1,435 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+// Blocks are downloaded headers first. Once the headers are known the missing
+// blocks are downloaded in height order by the block scheduler, which keeps a
+// window of the lowest missing blocks in flight and spreads it across the
+// connected peers.
+//
+// Every peer is allowed a number of outstanding blocks that grows by one for
+// every block it delivers and is halved when it stalls. Peers that have not
+// delivered a block yet are probed first, otherwise the next block goes to the
+// fastest peer with room. Blocks are assigned lowest height first so that the
+// blocks the indexers need next end up on the fastest peers.
+//
+// When the window is full and its lowest block has been outstanding for
+// longer than blockStallTimeout it is reassigned to another peer so that a
+// slow peer cannot hold up the window. A peer that delivers nothing for
+// defaultBlockPendingTimeout has all its blocks reassigned and is
+// disconnected.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database/tbcd"
+	"github.com/hemilabs/heminetwork/service/tbc/peer/rawpeer"
+)
+
+const (
+	minPeerBlocks = 2  // initial and minimum outstanding blocks per peer
+	maxPeerBlocks = 16 // maximum outstanding blocks per peer
+
+	blockStallTimeout     = 5 * time.Second // lowest block in a full window
+	blockDownloadInterval = time.Second     // timeout check interval
+
+	// Weight of a new sample in the peer throughput moving average.
+	blockRateWeight = 0.2
+)
+
+// blockRequest is a block in the download window.
+type blockRequest struct {
+	hash      chainhash.Hash
+	height    uint64
+	peer      string    // assigned peer, empty when unassigned
+	requested time.Time // when the block was requested from peer
+	avoid     string    // peer the block was taken away from
+}
+
+// blockPeer tracks the outstanding blocks and throughput of a peer.
+type blockPeer struct {
+	p         *rawpeer.RawPeer
+	inflight  int
+	capacity  int       // maximum outstanding blocks
+	rate      float64   // bytes per second, 0 until the first block
+	busySince time.Time // start of the current delivery interval
+}
+
+// blockScheduler assigns the blocks in the download window to peers.
+type blockScheduler struct {
+	mtx sync.Mutex
+
+	window  int
+	pending map[chainhash.Hash]*blockRequest
+	peers   map[string]*blockPeer
+}
+
+func blockSchedulerNew(window int) *blockScheduler {
+	return &blockScheduler{
+		window:  window,
+		pending: make(map[chainhash.Hash]*blockRequest, window),
+		peers:   make(map[string]*blockPeer),
+	}
+}
+
+// count returns the number of blocks in the download window.
+func (bs *blockScheduler) count() int {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	return len(bs.pending)
+}
+
+// peerAdd makes a peer available for block downloads.
+func (bs *blockScheduler) peerAdd(p *rawpeer.RawPeer) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	bs.peers[p.String()] = &blockPeer{p: p, capacity: minPeerBlocks}
+}
+
+// peerRemove removes a peer and unassigns its outstanding blocks. It returns
+// the number of unassigned blocks.
+func (bs *blockScheduler) peerRemove(p *rawpeer.RawPeer) int {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	addr := p.String()
+	delete(bs.peers, addr)
+	var n int
+	for _, r := range bs.pending {
+		if r.peer == addr {
+			r.peer = ""
+			n++
+		}
+	}
+	return n
+}
+
+// unassign returns a block to the unassigned blocks. Must be called with the
+// mutex held.
+func (bs *blockScheduler) unassign(r *blockRequest) {
+	if bp, ok := bs.peers[r.peer]; ok && bp.inflight > 0 {
+		bp.inflight--
+	}
+	r.avoid = r.peer
+	r.peer = ""
+}
+
+// add adds a block to the download window regardless of the window size. It
+// returns false if the block is already in the window.
+func (bs *blockScheduler) add(hash chainhash.Hash, height uint64) bool {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	if _, ok := bs.pending[hash]; ok {
+		return false
+	}
+	bs.pending[hash] = &blockRequest{hash: hash, height: height}
+	return true
+}
+
+// remove removes a block from the download window.
+func (bs *blockScheduler) remove(hash chainhash.Hash) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	if r, ok := bs.pending[hash]; ok {
+		bs.unassign(r)
+		delete(bs.pending, hash)
+	}
+}
+
+// pick returns the peer the next block should be requested from, or nil when
+// all peers are at capacity. Must be called with the mutex held.
+func (bs *blockScheduler) pick(avoid string) *blockPeer {
+	var best, fallback *blockPeer
+	for addr, bp := range bs.peers {
+		if bp.inflight >= bp.capacity {
+			continue
+		}
+		if addr == avoid {
+			fallback = bp
+			continue
+		}
+		switch {
+		case best == nil:
+			best = bp
+		case bp.rate == 0 && best.rate != 0:
+			// Probe peers that have not delivered yet.
+			best = bp
+		case (bp.rate == 0) != (best.rate == 0):
+		case bp.rate > best.rate,
+			bp.rate == best.rate && bp.inflight < best.inflight:
+			best = bp
+		}
+	}
+	if best == nil {
+		return fallback
+	}
+	return best
+}
+
+// schedule fills the download window with the missing blocks, which must be
+// ordered by height, and assigns the unassigned blocks to peers. It returns
+// the blocks to request per peer.
+func (bs *blockScheduler) schedule(missing []tbcd.BlockIdentifier, now time.Time) map[*rawpeer.RawPeer][]chainhash.Hash {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	for _, bi := range missing {
+		if len(bs.pending) >= bs.window {
+			break
+		}
+		if _, ok := bs.pending[*bi.Hash]; ok {
+			continue
+		}
+		bs.pending[*bi.Hash] = &blockRequest{
+			hash:   *bi.Hash,
+			height: bi.Height,
+		}
+	}
+
+	unassigned := make([]*blockRequest, 0, len(bs.pending))
+	for _, r := range bs.pending {
+		if r.peer == "" {
+			unassigned = append(unassigned, r)
+		}
+	}
+	slices.SortFunc(unassigned, func(a, b *blockRequest) int {
+		switch {
+		case a.height < b.height:
+			return -1
+		case a.height > b.height:
+			return 1
+		}
+		return 0
+	})
+
+	requests := make(map[*rawpeer.RawPeer][]chainhash.Hash)
+	for _, r := range unassigned {
+		bp := bs.pick(r.avoid)
+		if bp == nil {
+			break
+		}
+		if bp.inflight == 0 {
+			bp.busySince = now
+		}
+		bp.inflight++
+		r.peer = bp.p.String()
+		r.requested = now
+		requests[bp.p] = append(requests[bp.p], r.hash)
+	}
+	return requests
+}
+
+// received removes a block that was received from peer p from the download
+// window and updates the throughput of the peer. It returns false if the
+// block was not in the window.
+func (bs *blockScheduler) received(hash chainhash.Hash, p *rawpeer.RawPeer, size int, now time.Time) bool {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	r, ok := bs.pending[hash]
+	if !ok {
+		return false
+	}
+	delete(bs.pending, hash)
+
+	bp, ok := bs.peers[r.peer]
+	if !ok {
+		return true
+	}
+	if bp.inflight > 0 {
+		bp.inflight--
+	}
+	if r.peer != p.String() {
+		return true
+	}
+
+	elapsed := max(now.Sub(bp.busySince), time.Millisecond)
+	rate := float64(size) / elapsed.Seconds()
+	if bp.rate == 0 {
+		bp.rate = rate
+	} else {
+		bp.rate += blockRateWeight * (rate - bp.rate)
+	}
+	bp.capacity = min(bp.capacity+1, maxPeerBlocks)
+	bp.busySince = now
+	return true
+}
+
+// notFound unassigns the blocks peer p does not have so that they are
+// requested from another peer.
+func (bs *blockScheduler) notFound(p *rawpeer.RawPeer, hashes []chainhash.Hash) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	for _, hash := range hashes {
+		if r, ok := bs.pending[hash]; ok && r.peer == p.String() {
+			bs.unassign(r)
+		}
+	}
+}
+
+// expire unassigns the blocks of peers that have not delivered a block within
+// timeout and the lowest block of a full window when it has been outstanding
+// for longer than blockStallTimeout. It returns the peers that timed out and
+// their blocks.
+func (bs *blockScheduler) expire(now time.Time, timeout time.Duration) ([]*rawpeer.RawPeer, []chainhash.Hash) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	var (
+		peers  []*rawpeer.RawPeer
+		hashes []chainhash.Hash
+	)
+	for addr, bp := range bs.peers {
+		if bp.inflight == 0 || now.Sub(bp.busySince) < timeout {
+			continue
+		}
+		for _, r := range bs.pending {
+			if r.peer == addr {
+				bs.unassign(r)
+				hashes = append(hashes, r.hash)
+			}
+		}
+		bp.capacity = max(bp.capacity/2, minPeerBlocks)
+		peers = append(peers, bp.p)
+	}
+
+	if len(bs.pending) < bs.window {
+		return peers, hashes
+	}
+	var lowest *blockRequest
+	for _, r := range bs.pending {
+		if lowest == nil || r.height < lowest.height {
+			lowest = r
+		}
+	}
+	if lowest.peer != "" && now.Sub(lowest.requested) >= blockStallTimeout {
+		if bp, ok := bs.peers[lowest.peer]; ok {
+			bp.capacity = max(bp.capacity/2, minPeerBlocks)
+			log.Debugf("Block stalled: %v %v %v", bp.p, lowest.height,
+				lowest.hash)
+		}
+		bs.unassign(lowest)
+	}
+	return peers, hashes
+}
+
+// downloadBlocks requests blocks from a peer.
+func (s *Server) downloadBlocks(ctx context.Context, p *rawpeer.RawPeer, hashes []chainhash.Hash) error {
+	log.Tracef("downloadBlocks")
+	defer log.Tracef("downloadBlocks exit")
+
+	getData := wire.NewMsgGetDataSizeHint(uint(len(hashes)))
+	for k := range hashes {
+		getData.InvList = append(getData.InvList,
+			wire.NewInvVect(wire.InvTypeBlock, &hashes[k]))
+	}
+
+	// The write is not done under s.mtx, a slow peer would otherwise stall
+	// every other request.
+	err := p.Write(defaultCmdTimeout, getData)
+	if err != nil {
+		if !errors.Is(err, net.ErrClosed) &&
+			!errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Errorf("download blocks write: %v %v", p, err)
+		}
+	}
+	return err
+}
+
+// blockRequestsSend sends the scheduled block requests to the peers.
+func (s *Server) blockRequestsSend(ctx context.Context, requests map[*rawpeer.RawPeer][]chainhash.Hash) {
+	for p, hashes := range requests {
+		// Not an error. Checking and logging this will fill up logs
+		// with EOF, the peer is reaped and its blocks are reassigned.
+		//nolint:errcheck // Error is intentionally ignored.
+		go s.downloadBlocks(ctx, p, hashes)
+	}
+}
+
+// blockExpired removes a block that timed out from the blocks missing database
+// when it is not on the canonical chain or was inserted in the mean time.
+// It returns true if the block was removed.
+func (s *Server) blockExpired(ctx context.Context, hash *chainhash.Hash) (bool, error) {
+	log.Tracef("blockExpired")
+	defer log.Tracef("blockExpired exit")
+
+	if _, err := s.db.BlockByHash(ctx, hash); err == nil {
+		return true, nil
+	}
+
+	// Ensure block is on main chain, if it is not it is deleted from
+	// blocks missing database.
+	bhX, err := s.db.BlockHeaderByHash(ctx, hash)
+	if err != nil {
+		return false, err
+	}
+	canonical, err := s.isCanonical(ctx, bhX)
+	if err != nil {
+		return false, err
+	}
+	if canonical {
+		return false, nil
+	}
+
+	log.Infof("Deleting from blocks missing database: %v %v",
+		bhX.Height, bhX)
+	err = s.db.BlockMissingDelete(ctx, int64(bhX.Height), &bhX.Hash)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// blockDownloadExpire periodically reassigns the blocks of stalled peers and
+// disconnects peers that timed out.
+func (s *Server) blockDownloadExpire(ctx context.Context) {
+	log.Tracef("blockDownloadExpire")
+	defer log.Tracef("blockDownloadExpire exit")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(blockDownloadInterval):
+		}
+
+		peers, hashes := s.blocks.expire(time.Now(),
+			defaultBlockPendingTimeout)
+		for _, p := range peers {
+			log.Infof("Block download timeout: %v", p)
+			s.pm.Misbehaving(ctx, p.String(), misbehaviorStall,
+				"block download stalled")
+			p.Close() // kill peer, its blocks have been reassigned
+		}
+		for k := range hashes {
+			removed, err := s.blockExpired(ctx, &hashes[k])
+			if err != nil {
+				log.Errorf("block expired %v: %v", hashes[k], err)
+				continue
+			}
+			if removed {
+				s.blocks.remove(hashes[k])
+			}
+		}
+
+		if s.blocks.count() > 0 {
+			go s.syncBlocks(ctx)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database/tbcd"
+	"github.com/hemilabs/heminetwork/service/tbc/peer/rawpeer"
+)
+
+// testBlocksMissing returns count missing blocks starting at height.
+func testBlocksMissing(height uint64, count int) []tbcd.BlockIdentifier {
+	bis := make([]tbcd.BlockIdentifier, 0, count)
+	for k := range count {
+		h := height + uint64(k)
+		hash := chainhash.DoubleHashH([]byte(fmt.Sprintf("%v", h)))
+		bis = append(bis, tbcd.BlockIdentifier{Height: h, Hash: &hash})
+	}
+	return bis
+}
+
+func testRawPeer(t *testing.T, id int) *rawpeer.RawPeer {
+	p, err := rawpeer.New(wire.TestNet, id, fmt.Sprintf("127.0.0.1:%v", id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// testAssigned returns the number of blocks assigned to a peer.
+func testAssigned(bs *blockScheduler, p *rawpeer.RawPeer) int {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	var n int
+	for _, r := range bs.pending {
+		if r.peer == p.String() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBlockSchedulerSchedule(t *testing.T) {
+	now := time.Now()
+	bs := blockSchedulerNew(8)
+	missing := testBlocksMissing(100, 10)
+
+	// No peers, the window fills up but nothing is requested.
+	if requests := bs.schedule(missing, now); len(requests) != 0 {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+	if bs.count() != 8 {
+		t.Fatalf("window %v, want 8", bs.count())
+	}
+
+	// Both peers are probed with the lowest blocks.
+	p1, p2 := testRawPeer(t, 1), testRawPeer(t, 2)
+	bs.peerAdd(p1)
+	bs.peerAdd(p2)
+	requests := bs.schedule(missing, now)
+	if len(requests[p1]) != minPeerBlocks || len(requests[p2]) != minPeerBlocks {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+	requested := make(map[chainhash.Hash]*rawpeer.RawPeer)
+	for p, hashes := range requests {
+		for _, h := range hashes {
+			requested[h] = p
+		}
+	}
+	for _, bi := range missing[:2*minPeerBlocks] {
+		if _, ok := requested[*bi.Hash]; !ok {
+			t.Fatalf("block %v not requested", bi.Height)
+		}
+	}
+
+	// Peers at capacity are not handed more blocks.
+	if requests := bs.schedule(missing, now); len(requests) != 0 {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+
+	// p1 delivers fast, p2 slow. Delivery raises the capacity and the
+	// next blocks go to the fastest peer.
+	for _, bi := range missing[:2*minPeerBlocks] {
+		p := requested[*bi.Hash]
+		elapsed := time.Second
+		if p == p2 {
+			elapsed = 10 * time.Second
+		}
+		if !bs.received(*bi.Hash, p, 1000, now.Add(elapsed)) {
+			t.Fatalf("block %v not pending", bi.Height)
+		}
+	}
+	if bs.received(*missing[0].Hash, p1, 1000, now) {
+		t.Fatal("duplicate block pending")
+	}
+	missing = missing[2*minPeerBlocks:] // inserted blocks are not missing
+	requests = bs.schedule(missing, now.Add(10*time.Second))
+	if len(requests[p1]) != minPeerBlocks+2 {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+	if got := requests[p1][0]; got != *missing[0].Hash {
+		t.Fatalf("lowest block not requested first: %v", got)
+	}
+
+	// Removing a peer unassigns its blocks.
+	if n := bs.peerRemove(p1); n != minPeerBlocks+2 {
+		t.Fatalf("unassigned %v, want %v", n, minPeerBlocks+2)
+	}
+	// p2 already has two of its four blocks outstanding.
+	requests = bs.schedule(missing, now.Add(10*time.Second))
+	if len(requests[p2]) != 2 || testAssigned(bs, p2) != minPeerBlocks+2 {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+}
+
+func TestBlockSchedulerExpire(t *testing.T) {
+	now := time.Now()
+	bs := blockSchedulerNew(4)
+	missing := testBlocksMissing(1, 4)
+
+	p1, p2 := testRawPeer(t, 1), testRawPeer(t, 2)
+	bs.peerAdd(p1)
+	requests := bs.schedule(missing, now)
+	if len(requests[p1]) != minPeerBlocks {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+	bs.peerAdd(p2)
+	requests = bs.schedule(missing, now.Add(time.Second))
+	if len(requests[p2]) != minPeerBlocks {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+
+	// The lowest block of the full window stalls on p1 and is moved to
+	// another peer.
+	peers, hashes := bs.expire(now.Add(blockStallTimeout), time.Minute)
+	if len(peers) != 0 || len(hashes) != 0 {
+		t.Fatalf("unexpected expire: %v %v", peers, hashes)
+	}
+	if testAssigned(bs, p1) != minPeerBlocks-1 {
+		t.Fatalf("stalled block not unassigned")
+	}
+	bs.notFound(p2, []chainhash.Hash{*missing[minPeerBlocks].Hash})
+	requests = bs.schedule(nil, now.Add(blockStallTimeout))
+	if len(requests[p2]) != 1 || requests[p2][0] != *missing[0].Hash {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+	if len(requests[p1]) != 1 || requests[p1][0] != *missing[minPeerBlocks].Hash {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+
+	// p1 times out, its blocks are unassigned.
+	peers, hashes = bs.expire(now.Add(time.Minute), time.Minute)
+	if len(peers) != 1 || peers[0] != p1 || len(hashes) != minPeerBlocks {
+		t.Fatalf("unexpected expire: %v %v", peers, hashes)
+	}
+	if testAssigned(bs, p1) != 0 {
+		t.Fatal("timed out blocks not unassigned")
+	}
+
+	bs.remove(*missing[1].Hash)
+	if bs.count() != 3 {
+		t.Fatalf("window %v, want 3", bs.count())
+	}
+}
+
+func TestDownloadBlocksUnlocked(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	p, err := rawpeer.NewFromConn(c1, wire.TestNet, wire.AddrV2Version, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server lock is held by someone else, the request must still be
+	// written.
+	s := &Server{}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	hashes := []chainhash.Hash{*testBlocksMissing(100, 1)[0].Hash}
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.downloadBlocks(context.Background(), p, hashes)
+	}()
+
+	if err := c2.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	msg, _, err := wire.ReadMessage(c2, wire.AddrV2Version, wire.TestNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getData, ok := msg.(*wire.MsgGetData)
+	if !ok {
+		t.Fatalf("unexpected message: %T", msg)
+	}
+	if len(getData.InvList) != 1 || getData.InvList[0].Hash != hashes[0] {
+		t.Fatalf("unexpected getdata: %v", getData.InvList)
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,568 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+// The electrum server answers the subset of the Electrum protocol that
+// hemi/electrs.Client uses, from the tbcd indexes. Requests and responses are
+// newline delimited JSON-RPC over TCP. Errors are sent as plain strings, as
+// electrs does, since that is what the client expects.
+//
+// blockchain.headers.subscribe returns the current tip but no notifications
+// are sent afterwards; the client polls and does not expect them.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+	"github.com/hemilabs/heminetwork/version"
+)
+
+const (
+	electrumProtocolVersion = "1.4"
+
+	// Large enough for a hex encoded block sized transaction.
+	electrumMaxLineSize = 10 * 1024 * 1024
+
+	// Maximum number of utxos returned by listunspent.
+	electrumMaxUtxos = 1000
+
+	// Maximum number of requests in a batch.
+	electrumMaxBatch = 100
+
+	defaultElectrumMaxConnections = 128
+
+	// Clients ping every few minutes, disconnect clients that have been
+	// quiet for a lot longer than that.
+	defaultElectrumReadTimeout = 10 * time.Minute
+)
+
+type electrumRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type electrumResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Error   string          `json:"error,omitempty"`
+	Result  any             `json:"result"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type electrumHeader struct {
+	Height uint64 `json:"height"`
+	Hex    string `json:"hex"`
+}
+
+type electrumBalance struct {
+	Confirmed   uint64 `json:"confirmed"`
+	Unconfirmed int64  `json:"unconfirmed"`
+}
+
+type electrumUtxo struct {
+	TxHash string `json:"tx_hash"`
+	Height uint64 `json:"height"`
+	TxPos  uint32 `json:"tx_pos"`
+	Value  uint64 `json:"value"`
+}
+
+type electrumTxPosition struct {
+	TxHash string   `json:"tx_hash"`
+	Merkle []string `json:"merkle"`
+}
+
+// electrumTx is the verbose form of blockchain.transaction.get, a subset of
+// bitcoind getrawtransaction.
+type electrumTx struct {
+	TxId          string `json:"txid"`
+	Hash          string `json:"hash"`
+	Version       int32  `json:"version"`
+	Size          int    `json:"size"`
+	VSize         int64  `json:"vsize"`
+	Weight        int64  `json:"weight"`
+	LockTime      uint32 `json:"locktime"`
+	Hex           string `json:"hex"`
+	BlockHash     string `json:"blockhash,omitempty"`
+	Confirmations uint64 `json:"confirmations,omitempty"`
+	BlockTime     int64  `json:"blocktime,omitempty"`
+}
+
+// electrumError is an error that is returned to the client as is. All other
+// errors are logged and returned as an internal error.
+type electrumError string
+
+func (e electrumError) Error() string {
+	return string(e)
+}
+
+func electrumErrorf(format string, args ...any) electrumError {
+	return electrumError(fmt.Sprintf(format, args...))
+}
+
+// positionalParams decodes the positional request params into args. The first
+// required params must be present, missing optional params leave their arg
+// untouched and additional params are ignored.
+func positionalParams(raw json.RawMessage, required int, args ...any) error {
+	var params []json.RawMessage
+	if len(raw) != 0 && !bytes.Equal(raw, []byte("null")) {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return fmt.Errorf("invalid params: %w", err)
+		}
+	}
+	if len(params) < required {
+		return fmt.Errorf("expected %v params, got %v", required,
+			len(params))
+	}
+	for k := range min(len(params), len(args)) {
+		if err := json.Unmarshal(params[k], args[k]); err != nil {
+			return fmt.Errorf("invalid param %v: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func electrumParams(raw json.RawMessage, required int, args ...any) error {
+	if err := positionalParams(raw, required, args...); err != nil {
+		return electrumError(err.Error())
+	}
+	return nil
+}
+
+// electrumScriptHash decodes a script hash the way electrum encodes it, byte
+// reversed like a chainhash.
+func electrumScriptHash(s string) (tbcd.ScriptHash, error) {
+	h, err := chainhash.NewHashFromStr(s)
+	if err != nil {
+		return tbcd.ScriptHash{}, electrumErrorf("invalid script hash: %v", err)
+	}
+	sh, err := tbcd.NewScriptHashFromBytes(h[:])
+	if err != nil {
+		return tbcd.ScriptHash{}, electrumErrorf("invalid script hash: %v", err)
+	}
+	return sh, nil
+}
+
+// electrumListen accepts electrum connections until the context is canceled.
+func (s *Server) electrumListen(ctx context.Context) error {
+	log.Tracef("electrumListen")
+	defer log.Tracef("electrumListen exit")
+
+	lc := &net.ListenConfig{}
+	l, err := lc.Listen(ctx, "tcp", s.cfg.ElectrumListenAddress)
+	if err != nil {
+		return fmt.Errorf("electrum listen: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		if err := l.Close(); err != nil {
+			log.Debugf("electrum listener close: %v", err)
+		}
+	}()
+
+	log.Infof("Listening electrum: %v max connections %v", l.Addr(),
+		s.cfg.ElectrumMaxConnections)
+	conns := make(chan struct{}, s.cfg.ElectrumMaxConnections)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("electrum accept: %w", err)
+			}
+			log.Errorf("electrum accept: %v", err)
+			continue
+		}
+		select {
+		case conns <- struct{}{}:
+		default:
+			log.Debugf("electrum %v: connections full", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-conns }()
+			if err := s.handleElectrumConn(ctx, conn); err != nil {
+				log.Debugf("electrum %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *Server) handleElectrumConn(ctx context.Context, conn net.Conn) error {
+	log.Tracef("handleElectrumConn %v", conn.RemoteAddr())
+	defer log.Tracef("handleElectrumConn exit %v", conn.RemoteAddr())
+
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	log.Debugf("Electrum connected: %v", conn.RemoteAddr())
+	defer log.Debugf("Electrum disconnected: %v", conn.RemoteAddr())
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), electrumMaxLineSize)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(defaultElectrumReadTimeout)); err != nil {
+			return err
+		}
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+			return nil // EOF
+		}
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		reply, err := s.handleElectrumMessage(ctx, line)
+		if err != nil {
+			return err
+		}
+		if err := conn.SetWriteDeadline(time.Now().Add(defaultCmdTimeout)); err != nil {
+			return err
+		}
+		if _, err := conn.Write(append(reply, '\n')); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+}
+
+// handleElectrumMessage handles a single request or a batch of requests and
+// returns the encoded reply.
+func (s *Server) handleElectrumMessage(ctx context.Context, msg []byte) ([]byte, error) {
+	if msg[0] != '[' {
+		var req electrumRequest
+		if err := json.Unmarshal(msg, &req); err != nil {
+			return nil, fmt.Errorf("unmarshal request: %w", err)
+		}
+		return json.Marshal(s.handleElectrumRequest(ctx, &req))
+	}
+
+	var reqs []electrumRequest
+	if err := json.Unmarshal(msg, &reqs); err != nil {
+		return nil, fmt.Errorf("unmarshal batch: %w", err)
+	}
+	if len(reqs) > electrumMaxBatch {
+		return json.Marshal(&electrumResponse{
+			JSONRPC: "2.0",
+			Error: fmt.Sprintf("batch too large, max %v",
+				electrumMaxBatch),
+		})
+	}
+	replies := make([]*electrumResponse, 0, len(reqs))
+	for k := range reqs {
+		replies = append(replies, s.handleElectrumRequest(ctx, &reqs[k]))
+	}
+	return json.Marshal(replies)
+}
+
+func (s *Server) handleElectrumRequest(ctx context.Context, req *electrumRequest) *electrumResponse {
+	log.Tracef("handleElectrumRequest: %v", req.Method)
+	defer log.Tracef("handleElectrumRequest exit: %v", req.Method)
+
+	ctx, cancel := context.WithTimeout(ctx, s.requestTimeout)
+	defer cancel()
+
+	var (
+		result any
+		err    error
+	)
+	switch req.Method {
+	case "server.ping":
+	case "server.version":
+		result = []string{version.UserAgent(), electrumProtocolVersion}
+	case "blockchain.headers.subscribe":
+		result, err = s.electrumHeadersSubscribe(ctx)
+	case "blockchain.block.header":
+		result, err = s.electrumBlockHeader(ctx, req.Params)
+	case "blockchain.scripthash.get_balance":
+		result, err = s.electrumBalance(ctx, req.Params)
+	case "blockchain.scripthash.listunspent":
+		result, err = s.electrumListUnspent(ctx, req.Params)
+	case "blockchain.transaction.broadcast":
+		result, err = s.electrumBroadcast(ctx, req.Params)
+	case "blockchain.transaction.get":
+		result, err = s.electrumTransaction(ctx, req.Params)
+	case "blockchain.transaction.id_from_pos":
+		result, err = s.electrumIdFromPos(ctx, req.Params)
+	default:
+		err = electrumErrorf("unknown method %v", req.Method)
+	}
+
+	res := &electrumResponse{JSONRPC: "2.0", ID: req.ID}
+	if err != nil {
+		var ee electrumError
+		if !errors.As(err, &ee) {
+			log.Errorf("electrum %v: %v", req.Method, err)
+			ee = "internal error"
+		}
+		res.Error = string(ee)
+		return res
+	}
+	res.Result = result
+
+	s.cmdsProcessed.Inc()
+
+	return res
+}
+
+// electrumCanonicalHeader returns the canonical block header at height.
+func (s *Server) electrumCanonicalHeader(ctx context.Context, height uint64) (*tbcd.BlockHeader, error) {
+	bh, err := s.canonicalBlockHeaderByHeight(ctx, height)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, electrumErrorf("height %v out of range", height)
+		}
+		return nil, err
+	}
+	return bh, nil
+}
+
+func (s *Server) electrumHeadersSubscribe(ctx context.Context) (any, error) {
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("block header best: %w", err)
+	}
+	return &electrumHeader{
+		Height: bhb.Height,
+		Hex:    hex.EncodeToString(bhb.Header[:]),
+	}, nil
+}
+
+func (s *Server) electrumBlockHeader(ctx context.Context, params json.RawMessage) (any, error) {
+	var height uint64
+	if err := electrumParams(params, 1, &height); err != nil {
+		return nil, err
+	}
+	bh, err := s.electrumCanonicalHeader(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(bh.Header[:]), nil
+}
+
+// electrumBalance returns the confirmed balance of a script hash. Mempool txs
+// are not indexed by script hash thus the unconfirmed balance is always 0.
+func (s *Server) electrumBalance(ctx context.Context, params json.RawMessage) (any, error) {
+	var hash string
+	if err := electrumParams(params, 1, &hash); err != nil {
+		return nil, err
+	}
+	sh, err := electrumScriptHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := s.db.BalanceByScriptHash(ctx, sh)
+	if err != nil {
+		return nil, fmt.Errorf("balance %v: %w", sh, err)
+	}
+	return &electrumBalance{Confirmed: balance}, nil
+}
+
+// electrumListUnspent returns the confirmed utxos of a script hash. The height
+// of the utxos is looked up in the tx index.
+func (s *Server) electrumListUnspent(ctx context.Context, params json.RawMessage) (any, error) {
+	var hash string
+	if err := electrumParams(params, 1, &hash); err != nil {
+		return nil, err
+	}
+	sh, err := electrumScriptHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	utxos, err := s.db.UtxosByScriptHash(ctx, sh, 0, electrumMaxUtxos+1)
+	if err != nil {
+		return nil, fmt.Errorf("utxos %v: %w", sh, err)
+	}
+	if len(utxos) > electrumMaxUtxos {
+		return nil, electrumErrorf("too many utxos, max %v", electrumMaxUtxos)
+	}
+
+	heights := make(map[chainhash.Hash]uint64, len(utxos))
+	eus := make([]*electrumUtxo, 0, len(utxos))
+	for _, utxo := range utxos {
+		txId, err := chainhash.NewHash(utxo.ScriptHashSlice())
+		if err != nil {
+			return nil, fmt.Errorf("utxo tx id: %w", err)
+		}
+		height, ok := heights[*txId]
+		if !ok {
+			bh, err := s.txBlockHeader(ctx, txId)
+			if err != nil {
+				if errors.Is(err, database.ErrNotFound) {
+					return nil, electrumErrorf("tx %v not indexed",
+						txId)
+				}
+				return nil, err
+			}
+			height = bh.Height
+			heights[*txId] = height
+		}
+		eus = append(eus, &electrumUtxo{
+			TxHash: txId.String(),
+			Height: height,
+			TxPos:  utxo.OutputIndex(),
+			Value:  utxo.Value(),
+		})
+	}
+	return eus, nil
+}
+
+func (s *Server) electrumBroadcast(ctx context.Context, params json.RawMessage) (any, error) {
+	var rawTx string
+	if err := electrumParams(params, 1, &rawTx); err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(rawTx)
+	if err != nil {
+		return nil, electrumErrorf("invalid transaction: %v", err)
+	}
+	tx := &wire.MsgTx{}
+	if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, electrumErrorf("invalid transaction: %v", err)
+	}
+	txId, err := s.TxBroadcast(ctx, tx, false)
+	if err != nil {
+		if errors.Is(err, ErrTxAlreadyBroadcast) ||
+			errors.Is(err, ErrTxBroadcastNoPeers) {
+			return nil, electrumError(err.Error())
+		}
+		return nil, fmt.Errorf("broadcast %v: %w", tx.TxHash(), err)
+	}
+	return txId.String(), nil
+}
+
+// electrumTransaction returns a confirmed or mempool tx.
+func (s *Server) electrumTransaction(ctx context.Context, params json.RawMessage) (any, error) {
+	var (
+		hash    string
+		verbose bool
+	)
+	if err := electrumParams(params, 1, &hash, &verbose); err != nil {
+		return nil, err
+	}
+	txId, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		return nil, electrumErrorf("invalid tx id: %v", err)
+	}
+
+	tx, bh, err := s.txLookup(ctx, txId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, electrumErrorf("tx %v not found", txId)
+		}
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := tx.Serialize(&b); err != nil {
+		return nil, fmt.Errorf("serialize %v: %w", txId, err)
+	}
+	if !verbose {
+		return hex.EncodeToString(b.Bytes()), nil
+	}
+
+	weight := blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+	etx := &electrumTx{
+		TxId:     txId.String(),
+		Hash:     tx.WitnessHash().String(),
+		Version:  tx.Version,
+		Size:     b.Len(),
+		VSize:    (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor,
+		Weight:   weight,
+		LockTime: tx.LockTime,
+		Hex:      hex.EncodeToString(b.Bytes()),
+	}
+	if bh != nil {
+		bhb, err := s.db.BlockHeaderBest(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("block header best: %w", err)
+		}
+		wbh, err := bh.Wire()
+		if err != nil {
+			return nil, fmt.Errorf("wire header %v: %w", bh, err)
+		}
+		etx.BlockHash = bh.Hash.String()
+		etx.BlockTime = wbh.Timestamp.Unix()
+		if bhb.Height >= bh.Height {
+			etx.Confirmations = bhb.Height - bh.Height + 1
+		}
+	}
+	return etx, nil
+}
+
+// electrumIdFromPos returns the id of the tx at position pos in the canonical
+// block at height and, when requested, its merkle branch. The error strings
+// match electrs since the client parses them.
+func (s *Server) electrumIdFromPos(ctx context.Context, params json.RawMessage) (any, error) {
+	var (
+		height uint64
+		pos    int
+		merkle bool
+	)
+	if err := electrumParams(params, 2, &height, &pos, &merkle); err != nil {
+		return nil, err
+	}
+	bh, err := s.electrumCanonicalHeader(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.db.BlockByHash(ctx, &bh.Hash)
+	if err != nil {
+		if errors.Is(err, database.ErrBlockNotFound) ||
+			errors.Is(err, database.ErrBlockPruned) {
+			return nil, electrumErrorf("db error: DBError('block %v not on disk (height %v)')",
+				bh.Hash, height)
+		}
+		return nil, fmt.Errorf("block %v: %w", bh.Hash, err)
+	}
+	txs := b.Transactions()
+	if pos < 0 || pos >= len(txs) {
+		return nil, electrumErrorf("No tx in position %v for block at height %v",
+			pos, height)
+	}
+	txId := txs[pos].Hash()
+	if !merkle {
+		return txId.String(), nil
+	}
+
+	hashes := make([]chainhash.Hash, 0, len(txs))
+	for _, tx := range txs {
+		hashes = append(hashes, *tx.Hash())
+	}
+	branch := merkleBranch(hashes, pos)
+	etp := &electrumTxPosition{
+		TxHash: txId.String(),
+		Merkle: make([]string, 0, len(branch)),
+	}
+	for _, h := range branch {
+		etp.Merkle = append(etp.Merkle, h.String())
+	}
+	return etp, nil
+}
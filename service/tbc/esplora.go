@@ -0,0 +1,627 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+// The esplora server implements the commonly used endpoints of the Blockstream
+// Esplora REST API. Errors are returned as plain text with a 4xx or 5xx
+// status, as esplora does.
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+const (
+	// Maximum number of utxos returned for an address.
+	esploraMaxUtxos = 1000
+
+	// Large enough for a hex encoded block sized transaction.
+	esploraMaxBodySize = 10 * 1024 * 1024
+)
+
+type esploraStatus struct {
+	Confirmed   bool   `json:"confirmed"`
+	BlockHeight uint64 `json:"block_height,omitempty"`
+	BlockHash   string `json:"block_hash,omitempty"`
+	BlockTime   int64  `json:"block_time,omitempty"`
+}
+
+type esploraBlock struct {
+	Id                string  `json:"id"`
+	Height            uint64  `json:"height"`
+	Version           int32   `json:"version"`
+	Timestamp         int64   `json:"timestamp"`
+	TxCount           int     `json:"tx_count"`
+	Size              int     `json:"size"`
+	Weight            int     `json:"weight"`
+	MerkleRoot        string  `json:"merkle_root"`
+	PreviousBlockHash string  `json:"previousblockhash,omitempty"`
+	MedianTime        int64   `json:"mediantime"`
+	Nonce             uint32  `json:"nonce"`
+	Bits              uint32  `json:"bits"`
+	Difficulty        float64 `json:"difficulty"`
+}
+
+type esploraTxOut struct {
+	ScriptPubKey        string `json:"scriptpubkey"`
+	ScriptPubKeyAsm     string `json:"scriptpubkey_asm"`
+	ScriptPubKeyType    string `json:"scriptpubkey_type"`
+	ScriptPubKeyAddress string `json:"scriptpubkey_address,omitempty"`
+	Value               int64  `json:"value"`
+}
+
+type esploraTxIn struct {
+	TxId         string        `json:"txid"`
+	Vout         uint32        `json:"vout"`
+	PrevOut      *esploraTxOut `json:"prevout"`
+	ScriptSig    string        `json:"scriptsig"`
+	ScriptSigAsm string        `json:"scriptsig_asm"`
+	Witness      []string      `json:"witness,omitempty"`
+	IsCoinbase   bool          `json:"is_coinbase"`
+	Sequence     uint32        `json:"sequence"`
+}
+
+type esploraTx struct {
+	TxId     string          `json:"txid"`
+	Version  int32           `json:"version"`
+	LockTime uint32          `json:"locktime"`
+	Vin      []*esploraTxIn  `json:"vin"`
+	Vout     []*esploraTxOut `json:"vout"`
+	Size     int             `json:"size"`
+	Weight   int64           `json:"weight"`
+	Fee      int64           `json:"fee,omitempty"`
+	Status   *esploraStatus  `json:"status"`
+}
+
+type esploraUtxo struct {
+	TxId   string         `json:"txid"`
+	Vout   uint32         `json:"vout"`
+	Status *esploraStatus `json:"status"`
+	Value  uint64         `json:"value"`
+}
+
+// esploraError is an error that is returned to the client as is, with its
+// status code. All other errors are logged and returned as an internal error.
+type esploraError struct {
+	code int
+	msg  string
+}
+
+func (e esploraError) Error() string {
+	return e.msg
+}
+
+func esploraErrorf(code int, format string, args ...any) esploraError {
+	return esploraError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// esploraScriptType returns the esplora name of the script type.
+func esploraScriptType(pkScript []byte) string {
+	switch txscript.GetScriptClass(pkScript) {
+	case txscript.PubKeyHashTy:
+		return "p2pkh"
+	case txscript.ScriptHashTy:
+		return "p2sh"
+	case txscript.WitnessV0PubKeyHashTy:
+		return "v0_p2wpkh"
+	case txscript.WitnessV0ScriptHashTy:
+		return "v0_p2wsh"
+	case txscript.WitnessV1TaprootTy:
+		return "v1_p2tr"
+	case txscript.PubKeyTy:
+		return "p2pk"
+	case txscript.MultiSigTy:
+		return "multisig"
+	case txscript.NullDataTy:
+		return "op_return"
+	default:
+		return "unknown"
+	}
+}
+
+// difficulty returns the difficulty of bits relative to the proof of work
+// limit.
+func difficulty(bits uint32, powLimit *big.Int) float64 {
+	target := blockchain.CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+	d, _ := new(big.Rat).SetFrac(powLimit, target).Float64()
+	return d
+}
+
+// esploraListen serves the esplora API until the context is canceled.
+func (s *Server) esploraListen(ctx context.Context) error {
+	log.Tracef("esploraListen")
+	defer log.Tracef("esploraListen exit")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /blocks/tip/height", s.esploraHandler(s.handleEsploraTipHeight))
+	mux.HandleFunc("GET /blocks/tip/hash", s.esploraHandler(s.handleEsploraTipHash))
+	mux.HandleFunc("GET /block/{hash}", s.esploraHandler(s.handleEsploraBlock))
+	mux.HandleFunc("GET /block/{hash}/header", s.esploraHandler(s.handleEsploraBlockHeader))
+	mux.HandleFunc("GET /block/{hash}/raw", s.esploraHandler(s.handleEsploraBlockRaw))
+	mux.HandleFunc("GET /block-height/{height}", s.esploraHandler(s.handleEsploraBlockHeight))
+	mux.HandleFunc("GET /tx/{txid}", s.esploraHandler(s.handleEsploraTx))
+	mux.HandleFunc("GET /tx/{txid}/hex", s.esploraHandler(s.handleEsploraTxHex))
+	mux.HandleFunc("GET /tx/{txid}/status", s.esploraHandler(s.handleEsploraTxStatus))
+	mux.HandleFunc("GET /address/{address}/utxo", s.esploraHandler(s.handleEsploraAddressUtxo))
+	mux.HandleFunc("POST /tx", s.esploraHandler(s.handleEsploraTxBroadcast))
+
+	httpServer := &http.Server{
+		Addr:              s.cfg.EsploraListenAddress,
+		Handler:           mux,
+		BaseContext:       func(_ net.Listener) context.Context { return ctx },
+		ReadHeaderTimeout: defaultCmdTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(),
+			defaultCmdTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(sctx); err != nil {
+			log.Errorf("esplora server exit: %v", err)
+		}
+	}()
+
+	log.Infof("Listening esplora: %v", s.cfg.EsploraListenAddress)
+	err := httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return ctx.Err()
+	}
+	return fmt.Errorf("esplora listen: %w", err)
+}
+
+// esploraHandler wraps an esplora handler. The handler returns the response
+// body, a string is returned as text, a byte slice as binary and everything
+// else as JSON.
+func (s *Server) esploraHandler(handler func(ctx context.Context, r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Tracef("esplora: %v %v", r.Method, r.URL.Path)
+		defer log.Tracef("esplora exit: %v %v", r.Method, r.URL.Path)
+
+		ctx, cancel := context.WithTimeout(r.Context(), s.requestTimeout)
+		defer cancel()
+
+		res, err := handler(ctx, r)
+		if err != nil {
+			var ee esploraError
+			if !errors.As(err, &ee) {
+				log.Errorf("esplora %v %v: %v", r.Method, r.URL.Path, err)
+				ee = esploraErrorf(http.StatusInternalServerError,
+					"internal error")
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(ee.code)
+			_, _ = io.WriteString(w, ee.msg)
+			return
+		}
+
+		var body []byte
+		switch v := res.(type) {
+		case string:
+			w.Header().Set("Content-Type", "text/plain")
+			body = []byte(v)
+		case []byte:
+			w.Header().Set("Content-Type", "application/octet-stream")
+			body = v
+		default:
+			body, err = json.Marshal(v)
+			if err != nil {
+				log.Errorf("esplora %v %v: marshal: %v", r.Method,
+					r.URL.Path, err)
+				http.Error(w, "internal error",
+					http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if _, err := w.Write(body); err != nil {
+			log.Debugf("esplora %v %v: write: %v", r.Method, r.URL.Path,
+				err)
+			return
+		}
+
+		s.cmdsProcessed.Inc()
+	}
+}
+
+func esploraHash(r *http.Request, name string) (*chainhash.Hash, error) {
+	hash, err := chainhash.NewHashFromStr(r.PathValue(name))
+	if err != nil || len(r.PathValue(name)) != 2*chainhash.HashSize {
+		return nil, esploraErrorf(http.StatusBadRequest, "Invalid hex string")
+	}
+	return hash, nil
+}
+
+// esploraNotFound converts a not found error to an esplora error.
+func esploraNotFound(err error, msg string) error {
+	if errors.Is(err, database.ErrNotFound) ||
+		errors.Is(err, database.ErrBlockNotFound) ||
+		errors.Is(err, database.ErrBlockPruned) {
+		return esploraErrorf(http.StatusNotFound, "%v", msg)
+	}
+	return err
+}
+
+func (s *Server) handleEsploraTipHeight(ctx context.Context, _ *http.Request) (any, error) {
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("block header best: %w", err)
+	}
+	return strconv.FormatUint(bhb.Height, 10), nil
+}
+
+func (s *Server) handleEsploraTipHash(ctx context.Context, _ *http.Request) (any, error) {
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("block header best: %w", err)
+	}
+	return bhb.Hash.String(), nil
+}
+
+func (s *Server) handleEsploraBlock(ctx context.Context, r *http.Request) (any, error) {
+	hash, err := esploraHash(r, "hash")
+	if err != nil {
+		return nil, err
+	}
+	bh, err := s.db.BlockHeaderByHash(ctx, hash)
+	if err != nil {
+		return nil, esploraNotFound(err, "Block not found")
+	}
+	b, err := s.db.BlockByHash(ctx, hash)
+	if err != nil {
+		return nil, esploraNotFound(err, "Block not found")
+	}
+	mt, err := s.medianTime(ctx, bh)
+	if err != nil {
+		return nil, err
+	}
+
+	h := b.MsgBlock().Header
+	eb := &esploraBlock{
+		Id:         hash.String(),
+		Height:     bh.Height,
+		Version:    h.Version,
+		Timestamp:  h.Timestamp.Unix(),
+		TxCount:    len(b.Transactions()),
+		Size:       b.MsgBlock().SerializeSize(),
+		Weight:     int(blockchain.GetBlockWeight(b)),
+		MerkleRoot: h.MerkleRoot.String(),
+		MedianTime: mt,
+		Nonce:      h.Nonce,
+		Bits:       h.Bits,
+		Difficulty: difficulty(h.Bits, s.chainParams.PowLimit),
+	}
+	if bh.Height > 0 {
+		eb.PreviousBlockHash = h.PrevBlock.String()
+	}
+	return eb, nil
+}
+
+func (s *Server) handleEsploraBlockHeader(ctx context.Context, r *http.Request) (any, error) {
+	hash, err := esploraHash(r, "hash")
+	if err != nil {
+		return nil, err
+	}
+	bh, err := s.db.BlockHeaderByHash(ctx, hash)
+	if err != nil {
+		return nil, esploraNotFound(err, "Block not found")
+	}
+	return hex.EncodeToString(bh.Header[:]), nil
+}
+
+func (s *Server) handleEsploraBlockRaw(ctx context.Context, r *http.Request) (any, error) {
+	hash, err := esploraHash(r, "hash")
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.db.BlockByHash(ctx, hash)
+	if err != nil {
+		return nil, esploraNotFound(err, "Block not found")
+	}
+	raw, err := b.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("block bytes %v: %w", hash, err)
+	}
+	return raw, nil
+}
+
+func (s *Server) handleEsploraBlockHeight(ctx context.Context, r *http.Request) (any, error) {
+	height, err := strconv.ParseUint(r.PathValue("height"), 10, 64)
+	if err != nil {
+		return nil, esploraErrorf(http.StatusBadRequest, "Invalid height")
+	}
+	bh, err := s.canonicalBlockHeaderByHeight(ctx, height)
+	if err != nil {
+		return nil, esploraNotFound(err, "Block not found")
+	}
+	return bh.Hash.String(), nil
+}
+
+// esploraTxStatus returns the status of a tx mined in the block with header
+// bh, nil means the tx is not confirmed.
+func esploraTxStatus(bh *tbcd.BlockHeader) *esploraStatus {
+	if bh == nil {
+		return &esploraStatus{}
+	}
+	return &esploraStatus{
+		Confirmed:   true,
+		BlockHeight: bh.Height,
+		BlockHash:   bh.Hash.String(),
+		BlockTime:   bh.Timestamp().Unix(),
+	}
+}
+
+func (s *Server) esploraTxOut(txOut *wire.TxOut) *esploraTxOut {
+	eto := &esploraTxOut{
+		ScriptPubKey:     hex.EncodeToString(txOut.PkScript),
+		ScriptPubKeyType: esploraScriptType(txOut.PkScript),
+		Value:            txOut.Value,
+	}
+	eto.ScriptPubKeyAsm, _ = txscript.DisasmString(txOut.PkScript)
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(txOut.PkScript,
+		s.chainParams)
+	if err == nil && len(addrs) == 1 && eto.ScriptPubKeyType != "p2pk" {
+		eto.ScriptPubKeyAddress = addrs[0].EncodeAddress()
+	}
+	return eto
+}
+
+func (s *Server) handleEsploraTx(ctx context.Context, r *http.Request) (any, error) {
+	txId, err := esploraHash(r, "txid")
+	if err != nil {
+		return nil, err
+	}
+	tx, bh, err := s.txLookup(ctx, txId)
+	if err != nil {
+		return nil, esploraNotFound(err, "Transaction not found")
+	}
+
+	etx := &esploraTx{
+		TxId:     txId.String(),
+		Version:  tx.Version,
+		LockTime: tx.LockTime,
+		Vin:      make([]*esploraTxIn, 0, len(tx.TxIn)),
+		Vout:     make([]*esploraTxOut, 0, len(tx.TxOut)),
+		Size:     tx.SerializeSize(),
+		Weight:   blockchain.GetTransactionWeight(btcutil.NewTx(tx)),
+		Status:   esploraTxStatus(bh),
+	}
+
+	// The fee is only known when all previous outputs are found.
+	coinbase := blockchain.IsCoinBaseTx(tx)
+	feeKnown := !coinbase
+	var prevOuts []*tbcd.SpentOutput
+	if !coinbase {
+		prevOuts, err = s.esploraPrevOuts(ctx, tx, bh)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for k, txIn := range tx.TxIn {
+		eti := &esploraTxIn{
+			TxId:       txIn.PreviousOutPoint.Hash.String(),
+			Vout:       txIn.PreviousOutPoint.Index,
+			ScriptSig:  hex.EncodeToString(txIn.SignatureScript),
+			IsCoinbase: coinbase,
+			Sequence:   txIn.Sequence,
+		}
+		if !coinbase {
+			eti.ScriptSigAsm, _ = txscript.DisasmString(txIn.SignatureScript)
+		}
+		for _, w := range txIn.Witness {
+			eti.Witness = append(eti.Witness, hex.EncodeToString(w))
+		}
+		if !coinbase {
+			if so := prevOuts[k]; so != nil {
+				if so.PkScript != nil {
+					eti.PrevOut = s.esploraTxOut(wire.NewTxOut(
+						int64(so.Value), so.PkScript))
+				}
+				etx.Fee += int64(so.Value)
+			} else {
+				feeKnown = false
+			}
+		}
+		etx.Vin = append(etx.Vin, eti)
+	}
+	for _, txOut := range tx.TxOut {
+		etx.Vout = append(etx.Vout, s.esploraTxOut(txOut))
+		etx.Fee -= txOut.Value
+	}
+	if !feeKnown {
+		etx.Fee = 0
+	}
+
+	return etx, nil
+}
+
+// esploraPrevOuts returns the outputs that are spent by the inputs of the
+// provided tx, nil when unknown. The outputs spent by a tx that is mined in the
+// block with header bh are taken from the undo record of the block, those
+// spent by an unconfirmed tx from the utxo index or the mempool. The pk script
+// of an output is nil when it was not recorded.
+func (s *Server) esploraPrevOuts(ctx context.Context, tx *wire.MsgTx, bh *tbcd.BlockHeader) ([]*tbcd.SpentOutput, error) {
+	prevOuts := make([]*tbcd.SpentOutput, len(tx.TxIn))
+	if bh != nil {
+		bu, err := s.db.BlockUndoByHash(ctx, &bh.Hash)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				// Not indexed, indexed by an older release or
+				// pruned.
+				return prevOuts, nil
+			}
+			return nil, fmt.Errorf("block undo %v: %w", bh.Hash, err)
+		}
+		txId := tx.TxHash()
+		for k := range bu.Txs {
+			tu := &bu.Txs[k]
+			if !tu.TxId.IsEqual(&txId) {
+				continue
+			}
+			if len(tu.Spent) != len(tx.TxIn) {
+				return nil, fmt.Errorf("tx undo %v: spent outputs "+
+					"mismatch", txId)
+			}
+			for i := range tu.Spent {
+				prevOuts[i] = &tu.Spent[i]
+			}
+			break
+		}
+		return prevOuts, nil
+	}
+
+	for k, txIn := range tx.TxIn {
+		prev := txIn.PreviousOutPoint
+		if s.cfg.MempoolEnabled {
+			if txOut, ok := s.mempool.txOut(prev); ok {
+				prevOuts[k] = &tbcd.SpentOutput{
+					Value:    uint64(txOut.Value),
+					PkScript: txOut.PkScript,
+				}
+				continue
+			}
+		}
+		op := tbcd.NewOutpoint(prev.Hash, prev.Index)
+		utxo, err := s.db.UtxoByOutpoint(ctx, op)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				continue
+			}
+			return nil, fmt.Errorf("utxo %v: %w", prev, err)
+		}
+		so := &tbcd.SpentOutput{
+			Outpoint:   op,
+			ScriptHash: utxo.ScriptHash(),
+			Value:      utxo.Value(),
+		}
+		so.PkScript, err = s.db.ScriptByOutpoint(ctx, op)
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			return nil, fmt.Errorf("script %v: %w", prev, err)
+		}
+		prevOuts[k] = so
+	}
+	return prevOuts, nil
+}
+
+func (s *Server) handleEsploraTxHex(ctx context.Context, r *http.Request) (any, error) {
+	txId, err := esploraHash(r, "txid")
+	if err != nil {
+		return nil, err
+	}
+	tx, _, err := s.txLookup(ctx, txId)
+	if err != nil {
+		return nil, esploraNotFound(err, "Transaction not found")
+	}
+	b, err := tx2Bytes(tx)
+	if err != nil {
+		return nil, fmt.Errorf("serialize %v: %w", txId, err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Server) handleEsploraTxStatus(ctx context.Context, r *http.Request) (any, error) {
+	txId, err := esploraHash(r, "txid")
+	if err != nil {
+		return nil, err
+	}
+	_, bh, err := s.txLookup(ctx, txId)
+	if err != nil {
+		return nil, esploraNotFound(err, "Transaction not found")
+	}
+	return esploraTxStatus(bh), nil
+}
+
+func (s *Server) handleEsploraAddressUtxo(ctx context.Context, r *http.Request) (any, error) {
+	address := r.PathValue("address")
+	addr, err := btcutil.DecodeAddress(address, s.chainParams)
+	if err != nil || !addr.IsForNet(s.chainParams) {
+		return nil, esploraErrorf(http.StatusBadRequest, "Invalid Bitcoin address")
+	}
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return nil, esploraErrorf(http.StatusBadRequest, "Invalid Bitcoin address")
+	}
+	utxos, err := s.db.UtxosByScriptHash(ctx,
+		tbcd.NewScriptHashFromScript(script), 0, esploraMaxUtxos+1)
+	if err != nil {
+		return nil, fmt.Errorf("utxos %v: %w", address, err)
+	}
+	if len(utxos) > esploraMaxUtxos {
+		return nil, esploraErrorf(http.StatusBadRequest,
+			"Too many unspent transaction outputs, max %v", esploraMaxUtxos)
+	}
+
+	statuses := make(map[chainhash.Hash]*esploraStatus, len(utxos))
+	eus := make([]*esploraUtxo, 0, len(utxos))
+	for _, utxo := range utxos {
+		txId, err := chainhash.NewHash(utxo.ScriptHashSlice())
+		if err != nil {
+			return nil, fmt.Errorf("utxo tx id: %w", err)
+		}
+		status, ok := statuses[*txId]
+		if !ok {
+			bh, err := s.txBlockHeader(ctx, txId)
+			if err != nil {
+				return nil, err
+			}
+			status = esploraTxStatus(bh)
+			statuses[*txId] = status
+		}
+		eus = append(eus, &esploraUtxo{
+			TxId:   txId.String(),
+			Vout:   utxo.OutputIndex(),
+			Status: status,
+			Value:  utxo.Value(),
+		})
+	}
+	return eus, nil
+}
+
+func (s *Server) handleEsploraTxBroadcast(ctx context.Context, r *http.Request) (any, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, esploraMaxBodySize))
+	if err != nil {
+		return nil, esploraErrorf(http.StatusBadRequest, "read body: %v", err)
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, esploraErrorf(http.StatusBadRequest,
+			"sendrawtransaction RPC error: TX decode failed: %v", err)
+	}
+	tx := &wire.MsgTx{}
+	if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, esploraErrorf(http.StatusBadRequest,
+			"sendrawtransaction RPC error: TX decode failed: %v", err)
+	}
+	txId, err := s.TxBroadcast(ctx, tx, false)
+	if err != nil {
+		if errors.Is(err, ErrTxAlreadyBroadcast) ||
+			errors.Is(err, ErrTxBroadcastNoPeers) {
+			return nil, esploraErrorf(http.StatusBadRequest, "%v", err)
+		}
+		return nil, fmt.Errorf("broadcast %v: %w", tx.TxHash(), err)
+	}
+	return txId.String(), nil
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/bitcoin"
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+const (
+	// maxFutureBlockTime is how far a header timestamp may be ahead of
+	// the adjusted time.
+	maxFutureBlockTime = 2 * time.Hour
+
+	// maxTimewarp is how far, in seconds, the first header of a difficulty
+	// period may go back in time on networks that enforce BIP94.
+	maxTimewarp = 600
+
+	// Number of blocks the median time past is calculated over.
+	medianTimeBlocks = 11
+)
+
+var ErrInvalidHeader = errors.New("invalid header")
+
+// headerChain is the context required to validate headers that extend a
+// header in the database.
+type headerChain struct {
+	db     tbcd.Database
+	params *chaincfg.Params
+	bip94  bool      // testnet4 difficulty rules
+	now    time.Time // adjusted time
+
+	parent  *tbcd.BlockHeader   // database header the chain extends
+	headers []*wire.BlockHeader // validated headers on top of parent
+
+	tip        *wire.BlockHeader
+	height     uint64  // height of tip
+	timestamps []int64 // last medianTimeBlocks timestamps, oldest first
+	lastBits   uint32  // last bits without the minimum difficulty rule
+	lastBitsOk bool    // lastBits is known
+}
+
+func newHeaderChain(ctx context.Context, db tbcd.Database, params *chaincfg.Params, parent *tbcd.BlockHeader, now time.Time) (*headerChain, error) {
+	tip, err := parent.Wire()
+	if err != nil {
+		return nil, err
+	}
+	hc := &headerChain{
+		db:     db,
+		params: params,
+		bip94:  params.Net == bitcoin.TestNet4,
+		now:    now,
+		parent: parent,
+		tip:    tip,
+		height: parent.Height,
+	}
+
+	// Walk back far enough to find the median time past and, on networks
+	// with the minimum difficulty rule, the last regular bits. Headers
+	// that are not in the database are treated as the effective genesis.
+	interval := hc.retargetInterval()
+	findBits := params.ReduceMinDifficulty
+	timestamps := make([]int64, 0, medianTimeBlocks)
+	bh := parent
+	for {
+		wbh, err := bh.Wire()
+		if err != nil {
+			return nil, err
+		}
+		if len(timestamps) < medianTimeBlocks {
+			timestamps = append(timestamps, wbh.Timestamp.Unix())
+		}
+		if findBits && (bh.Height%interval == 0 ||
+			wbh.Bits != params.PowLimitBits) {
+			hc.lastBits = wbh.Bits
+			hc.lastBitsOk = true
+			findBits = false
+		}
+		if bh.Height == 0 ||
+			(len(timestamps) == medianTimeBlocks && !findBits) {
+			break
+		}
+		bh, err = db.BlockHeaderByHash(ctx, &wbh.PrevBlock)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				break // effective genesis
+			}
+			return nil, fmt.Errorf("block header %v: %w",
+				wbh.PrevBlock, err)
+		}
+	}
+	for i, j := 0, len(timestamps)-1; i < j; i, j = i+1, j-1 {
+		timestamps[i], timestamps[j] = timestamps[j], timestamps[i]
+	}
+	hc.timestamps = timestamps
+
+	return hc, nil
+}
+
+// retargetInterval returns the number of blocks between difficulty
+// adjustments.
+func (hc *headerChain) retargetInterval() uint64 {
+	return uint64(hc.params.TargetTimespan / hc.params.TargetTimePerBlock)
+}
+
+// ancestor returns the header at height on the chain that ends at the tip.
+// It returns nil if the header is not in the database.
+func (hc *headerChain) ancestor(ctx context.Context, height uint64) (*wire.BlockHeader, error) {
+	if height > hc.parent.Height {
+		return hc.headers[height-hc.parent.Height-1], nil
+	}
+	bh := hc.parent
+	for bh.Height > height {
+		var err error
+		bh, err = hc.db.BlockHeaderByHash(ctx, bh.ParentHash())
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("ancestor %v: %w", height, err)
+		}
+	}
+	return bh.Wire()
+}
+
+// nextBits returns the bits required for the header that extends the tip
+// with timestamp ts. It returns false when the required bits cannot be
+// determined because the database does not go back far enough.
+func (hc *headerChain) nextBits(ctx context.Context, ts time.Time) (uint32, bool, error) {
+	p := hc.params
+	if p.PoWNoRetargeting {
+		return hc.tip.Bits, true, nil
+	}
+
+	interval := hc.retargetInterval()
+	if (hc.height+1)%interval != 0 {
+		if !p.ReduceMinDifficulty {
+			return hc.tip.Bits, true, nil
+		}
+		// Testnet allows minimum difficulty blocks once no block has
+		// been found for a while, the block after that returns to the
+		// last regular difficulty.
+		if ts.After(hc.tip.Timestamp.Add(p.MinDiffReductionTime)) {
+			return p.PowLimitBits, true, nil
+		}
+		return hc.lastBits, hc.lastBitsOk, nil
+	}
+
+	first, err := hc.ancestor(ctx, hc.height+1-interval)
+	if err != nil {
+		return 0, false, err
+	}
+	if first == nil {
+		return 0, false, nil
+	}
+
+	// Limit the adjustment to the retarget adjustment factor.
+	timespan := int64(p.TargetTimespan / time.Second)
+	actual := hc.tip.Timestamp.Unix() - first.Timestamp.Unix()
+	actual = max(actual, timespan/p.RetargetAdjustmentFactor)
+	actual = min(actual, timespan*p.RetargetAdjustmentFactor)
+
+	// BIP94 retargets from the first block of the period so that a
+	// minimum difficulty block at the end of the period is ignored.
+	bits := hc.tip.Bits
+	if hc.bip94 {
+		bits = first.Bits
+	}
+	target := blockchain.CompactToBig(bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(timespan))
+	if target.Cmp(p.PowLimit) > 0 {
+		target.Set(p.PowLimit)
+	}
+	return blockchain.BigToCompact(target), true, nil
+}
+
+// medianTime returns the median time past of the tip.
+func (hc *headerChain) medianTime() int64 {
+	timestamps := slices.Clone(hc.timestamps)
+	slices.Sort(timestamps)
+	return timestamps[len(timestamps)/2]
+}
+
+// medianTime returns the median time past of the provided header as it is
+// determined during header validation.
+func (s *Server) medianTime(ctx context.Context, bh *tbcd.BlockHeader) (int64, error) {
+	hc, err := newHeaderChain(ctx, s.db, s.chainParams, bh, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("header chain %v: %w", bh, err)
+	}
+	return hc.medianTime(), nil
+}
+
+// verify validates the header that extends the tip and makes it the new tip.
+// Validation errors wrap ErrInvalidHeader.
+func (hc *headerChain) verify(ctx context.Context, bh *wire.BlockHeader) error {
+	p := hc.params
+	height := hc.height + 1
+	hash := bh.BlockHash()
+
+	// Proof of work.
+	target := blockchain.CompactToBig(bh.Bits)
+	if target.Sign() <= 0 || target.Cmp(p.PowLimit) > 0 {
+		return fmt.Errorf("%w: %v target out of range: %08x",
+			ErrInvalidHeader, hash, bh.Bits)
+	}
+	if blockchain.HashToBig(&hash).Cmp(target) > 0 {
+		return fmt.Errorf("%w: %v hash above target: %08x",
+			ErrInvalidHeader, hash, bh.Bits)
+	}
+
+	// Difficulty.
+	bits, ok, err := hc.nextBits(ctx, bh.Timestamp)
+	if err != nil {
+		return err
+	}
+	if ok && bh.Bits != bits {
+		return fmt.Errorf("%w: %v unexpected difficulty %08x, expected %08x",
+			ErrInvalidHeader, hash, bh.Bits, bits)
+	}
+
+	// Timestamps.
+	ts := bh.Timestamp.Unix()
+	if mt := hc.medianTime(); ts <= mt {
+		return fmt.Errorf("%w: %v timestamp %v not after median time %v",
+			ErrInvalidHeader, hash, bh.Timestamp, time.Unix(mt, 0))
+	}
+	if bh.Timestamp.After(hc.now.Add(maxFutureBlockTime)) {
+		return fmt.Errorf("%w: %v timestamp %v too far in the future",
+			ErrInvalidHeader, hash, bh.Timestamp)
+	}
+	if hc.bip94 && height%hc.retargetInterval() == 0 &&
+		ts < hc.tip.Timestamp.Unix()-maxTimewarp {
+		return fmt.Errorf("%w: %v timestamp %v timewarp",
+			ErrInvalidHeader, hash, bh.Timestamp)
+	}
+
+	// Versions obsoleted by BIP34, BIP66 and BIP65.
+	if (bh.Version < 2 && height >= uint64(p.BIP0034Height)) ||
+		(bh.Version < 3 && height >= uint64(p.BIP0066Height)) ||
+		(bh.Version < 4 && height >= uint64(p.BIP0065Height)) {
+		return fmt.Errorf("%w: %v obsolete version %v",
+			ErrInvalidHeader, hash, bh.Version)
+	}
+
+	hc.headers = append(hc.headers, bh)
+	hc.tip = bh
+	hc.height = height
+	hc.timestamps = append(hc.timestamps, ts)
+	if len(hc.timestamps) > medianTimeBlocks {
+		hc.timestamps = hc.timestamps[1:]
+	}
+	if height%hc.retargetInterval() == 0 || bh.Bits != p.PowLimitBits {
+		hc.lastBits = bh.Bits
+		hc.lastBitsOk = true
+	}
+
+	return nil
+}
+
+// headersVerify contextually validates contiguous headers before they are
+// inserted: proof of work, difficulty retargeting including the testnet
+// minimum difficulty rules, median time past and timestamps too far in the
+// future. Headers that do not connect to a known header are left to the
+// database to reject.
+func (s *Server) headersVerify(ctx context.Context, headers []*wire.BlockHeader) error {
+	// Localnet blocks are not mined.
+	if len(headers) == 0 || s.cfg.Network == networkLocalnet {
+		return nil
+	}
+	parent, err := s.db.BlockHeaderByHash(ctx, &headers[0].PrevBlock)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("parent header: %w", err)
+	}
+	hc, err := newHeaderChain(ctx, s.db, s.chainParams, parent,
+		s.timeSource.AdjustedTime())
+	if err != nil {
+		return fmt.Errorf("header chain: %w", err)
+	}
+	for _, bh := range headers {
+		if err := hc.verify(ctx, bh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
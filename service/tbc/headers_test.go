@@ -0,0 +1,163 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// testMine sets the nonce of bh so that its hash does (or does not) meet the
+// target.
+func testMine(bh *wire.BlockHeader, valid bool) *wire.BlockHeader {
+	target := blockchain.CompactToBig(bh.Bits)
+	for bh.Nonce = 0; ; bh.Nonce++ {
+		hash := bh.BlockHash()
+		if (blockchain.HashToBig(&hash).Cmp(target) <= 0) == valid {
+			return bh
+		}
+	}
+}
+
+func TestHeaderChain(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg := NewDefaultConfig()
+	cfg.Network = networkLocalnet
+	cfg.LevelDBHome = t.TempDir()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := s.db.BlockHeaderByHash(ctx,
+		chaincfg.RegressionNetParams.GenesisHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Testnet rules with a retarget every 10 blocks.
+	params := chaincfg.RegressionNetParams
+	params.PoWNoRetargeting = false
+	params.ReduceMinDifficulty = true
+	params.MinDiffReductionTime = 20 * time.Minute
+	params.TargetTimespan = 10 * params.TargetTimePerBlock
+	params.BIP0034Height = 1
+	params.BIP0065Height = 1
+	params.BIP0066Height = 1
+	minBits := params.PowLimitBits
+
+	now := time.Now()
+	newChain := func(bip94 bool) *headerChain {
+		hc, err := newHeaderChain(ctx, s.db, &params, genesis, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hc.bip94 = bip94
+		return hc
+	}
+	next := func(hc *headerChain, d time.Duration, bits uint32) *wire.BlockHeader {
+		prev := hc.tip.BlockHash()
+		bh := wire.NewBlockHeader(4, &prev, &prev, bits, 0)
+		bh.Timestamp = hc.tip.Timestamp.Add(d)
+		return testMine(bh, true)
+	}
+	reject := func(hc *headerChain, bh *wire.BlockHeader, reason string) {
+		t.Helper()
+		if err := hc.verify(ctx, bh); !errors.Is(err, ErrInvalidHeader) {
+			t.Fatalf("%v: expected %v, got %v", reason, ErrInvalidHeader, err)
+		}
+	}
+	accept := func(hc *headerChain, bh *wire.BlockHeader) {
+		t.Helper()
+		if err := hc.verify(ctx, bh); err != nil {
+			t.Fatalf("height %v: %v", hc.height+1, err)
+		}
+	}
+
+	hc := newChain(false)
+	for range 9 {
+		accept(hc, next(hc, time.Minute, minBits))
+	}
+
+	// Blocks were found too fast, the retarget at height 10 quadruples
+	// the difficulty.
+	const bits = 0x201fffff
+	reject(hc, next(hc, time.Minute, minBits), "missing retarget")
+	reject(hc, testMine(next(hc, time.Minute, bits), false),
+		"hash above target")
+	bh := next(hc, time.Minute, bits)
+	bh.Version = 1
+	reject(hc, testMine(bh, true), "obsolete version")
+	reject(hc, next(hc, -5*time.Minute, bits), "median time past")
+	bh = next(hc, 0, bits)
+	bh.Timestamp = now.Add(maxFutureBlockTime + time.Minute)
+	reject(hc, testMine(bh, true), "future timestamp")
+	accept(hc, next(hc, time.Minute, bits))
+	hc10 := hc.tip
+
+	// Minimum difficulty after 20 minutes, then back to the last regular
+	// difficulty.
+	reject(hc, next(hc, 10*time.Minute, minBits), "early min difficulty")
+	accept(hc, next(hc, 21*time.Minute, minBits))
+	reject(hc, next(hc, time.Minute, minBits), "min difficulty")
+	for range 6 {
+		accept(hc, next(hc, time.Minute, bits))
+	}
+	accept(hc, next(hc, 21*time.Minute, minBits)) // height 18
+	accept(hc, next(hc, 21*time.Minute, minBits)) // height 19
+
+	// Retarget at height 20, BIP94 uses the bits of the first block of the
+	// period rather than those of the minimum difficulty tip.
+	timespan := hc.tip.Timestamp.Unix() - hc10.Timestamp.Unix()
+	retarget := func(b uint32) uint32 {
+		target := blockchain.CompactToBig(b)
+		target.Mul(target, big.NewInt(timespan))
+		target.Div(target, big.NewInt(int64(params.TargetTimespan/time.Second)))
+		return blockchain.BigToCompact(target)
+	}
+	bip94 := newChain(true)
+	for _, bh := range hc.headers {
+		accept(bip94, bh)
+	}
+	accept(hc, next(hc, time.Minute, retarget(minBits)))
+	reject(bip94, next(bip94, time.Minute, retarget(minBits)), "bip94")
+	reject(bip94, next(bip94, -11*time.Minute, retarget(bits)),
+		"timewarp")
+	accept(bip94, next(bip94, time.Minute, retarget(bits)))
+
+	// A chain that starts in the database recovers the context.
+	testHeadersInsert(ctx, t, s, hc.headers[:15])
+	hash := hc.headers[14].BlockHash()
+	parent, err := s.db.BlockHeaderByHash(ctx, &hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc15, err := newHeaderChain(ctx, s.db, &params, parent, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bh := range hc.headers[15:] {
+		accept(hc15, bh)
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+	"github.com/hemilabs/heminetwork/service/tbc/peer/rawpeer"
+)
+
+const (
+	// Remote nodes ping every two minutes, disconnect inbound peers that
+	// have been quiet for a lot longer than that.
+	defaultInboundReadTimeout = 5 * time.Minute
+
+	// Services advertised to inbound peers.
+	inboundServices = wire.SFNodeNetwork | wire.SFNodeWitness |
+		rawpeer.SFNodeP2PV2
+)
+
+var ErrInboundFull = errors.New("inbound slots full")
+
+// inboundAdd reserves an inbound slot for the provided peer.
+func (s *Server) inboundAdd(p *rawpeer.RawPeer) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.inbound) >= s.cfg.PeersInbound {
+		return ErrInboundFull
+	}
+	if _, ok := s.inbound[p.String()]; ok {
+		return fmt.Errorf("inbound peer already connected: %v", p)
+	}
+	s.inbound[p.String()] = p
+	return nil
+}
+
+// inboundDelete releases the inbound slot of the provided peer.
+func (s *Server) inboundDelete(p *rawpeer.RawPeer) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.inbound, p.String())
+}
+
+// InboundPeers returns the number of connected inbound peers.
+func (s *Server) InboundPeers() int {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return len(s.inbound)
+}
+
+// p2pListen accepts inbound bitcoin p2p connections until the context is
+// canceled.
+func (s *Server) p2pListen(ctx context.Context) error {
+	log.Tracef("p2pListen")
+	defer log.Tracef("p2pListen exit")
+
+	lc := &net.ListenConfig{}
+	l, err := lc.Listen(ctx, "tcp", s.cfg.P2PListenAddress)
+	if err != nil {
+		return fmt.Errorf("p2p listen: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		if err := l.Close(); err != nil {
+			log.Debugf("p2p listener close: %v", err)
+		}
+	}()
+
+	log.Infof("Listening p2p: %v inbound slots %v", l.Addr(),
+		s.cfg.PeersInbound)
+	for id := 0; ; id++ {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("p2p accept: %w", err)
+			}
+			log.Errorf("p2p accept: %v", err)
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.handleInboundPeer(ctx, conn, id); err != nil {
+				log.Debugf("inbound %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *Server) handleInboundPeer(ctx context.Context, conn net.Conn, id int) error {
+	log.Tracef("handleInboundPeer %v", conn.RemoteAddr())
+	defer log.Tracef("handleInboundPeer exit %v", conn.RemoteAddr())
+
+	p, err := rawpeer.NewFromConn(conn, s.wireNet, wire.AddrV2Version, id)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("new peer: %w", err)
+	}
+	if s.pm.Banned(p.String()) {
+		conn.Close()
+		return fmt.Errorf("%w: %v", ErrPeerBanned, p)
+	}
+	if err := s.inboundAdd(p); err != nil {
+		conn.Close()
+		return err
+	}
+
+	var readError error
+	defer func() {
+		s.inboundDelete(p)
+		_ = p.Close() // Not an interesting error since it races.
+
+		re := ""
+		if readError != nil {
+			re = fmt.Sprintf(" error: %v", readError)
+		}
+		log.Infof("Inbound disconnected: %v%v", p, re)
+	}()
+
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		readError = err
+		return fmt.Errorf("block header best: %w", err)
+	}
+	services := inboundServices
+	if s.pruning() {
+		// Only recent blocks can be served.
+		services = wire.SFNodeNetworkLimited | wire.SFNodeWitness |
+			rawpeer.SFNodeP2PV2
+	}
+	err = p.Accept(ctx, services, int32(bhb.Height))
+	if err != nil {
+		readError = err
+		return err
+	}
+	remoteVersion, err := p.RemoteVersion()
+	if err != nil {
+		readError = err
+		return fmt.Errorf("peer remote version: %w", err)
+	}
+	log.Infof("Inbound connected: %v version %v agent %v", p,
+		remoteVersion.ProtocolVersion, remoteVersion.UserAgent)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		msg, raw, err := p.Read(defaultInboundReadTimeout)
+		if errors.Is(err, wire.ErrUnknownMessage) {
+			// skip unknown message
+			continue
+		} else if err != nil {
+			readError = err
+			return err
+		}
+
+		if err := s.handleInboundGeneric(ctx, p, msg, raw); err != nil {
+			readError = err
+			return err
+		}
+	}
+}
+
+// handleInboundGeneric handles the messages of inbound peers. Inbound peers
+// are only served, they do not drive our chain.
+func (s *Server) handleInboundGeneric(ctx context.Context, p *rawpeer.RawPeer, msg wire.Message, raw []byte) error {
+	switch m := msg.(type) {
+	case *wire.MsgGetHeaders:
+		if err := s.handleGetHeaders(ctx, p, m); err != nil {
+			return fmt.Errorf("handle inbound get headers: %w", err)
+		}
+
+	case *wire.MsgGetData:
+		if err := s.handleGetData(ctx, p, m, raw); err != nil {
+			return fmt.Errorf("handle inbound get data: %w", err)
+		}
+
+	case *wire.MsgPing:
+		if err := s.handlePing(ctx, p, m); err != nil {
+			return fmt.Errorf("handle inbound ping: %w", err)
+		}
+
+	default:
+		log.Tracef("unhandled inbound message type %v: %T\n", p, msg)
+	}
+	return nil
+}
+
+func (s *Server) handleGetHeaders(ctx context.Context, p *rawpeer.RawPeer, msg *wire.MsgGetHeaders) error {
+	log.Tracef("handleGetHeaders %v", p)
+	defer log.Tracef("handleGetHeaders exit %v", p)
+
+	bhs, err := s.headersAfterLocator(ctx, msg.BlockLocatorHashes,
+		&msg.HashStop, wire.MaxBlockHeadersPerMsg)
+	if err != nil {
+		return fmt.Errorf("headers after locator: %w", err)
+	}
+	headers := wire.NewMsgHeaders()
+	for _, bh := range bhs {
+		wbh, err := bh.Wire()
+		if err != nil {
+			return fmt.Errorf("wire header %v: %w", bh, err)
+		}
+		if err := headers.AddBlockHeader(wbh); err != nil {
+			return fmt.Errorf("add header %v: %w", bh, err)
+		}
+	}
+	if err := p.Write(defaultCmdTimeout, headers); err != nil {
+		return fmt.Errorf("write headers: %w", err)
+	}
+	return nil
+}
+
+// headersAfterLocator returns up to count canonical block headers that follow
+// the first canonical locator hash. When no locator hash is known headers
+// are returned starting after genesis. The returned headers end at stop,
+// inclusive, if it is encountered. Like bitcoind, an empty locator returns
+// only the stop header, if it is known.
+func (s *Server) headersAfterLocator(ctx context.Context, locator []*chainhash.Hash, stop *chainhash.Hash, count int) ([]tbcd.BlockHeader, error) {
+	if len(locator) == 0 {
+		bh, err := s.db.BlockHeaderByHash(ctx, stop)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("block header %v: %w", stop, err)
+		}
+		return []tbcd.BlockHeader{*bh}, nil
+	}
+
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("block header best: %w", err)
+	}
+
+	// Find fork point.
+	var start *tbcd.BlockHeader
+	for _, hash := range locator {
+		bh, err := s.db.BlockHeaderByHash(ctx, hash)
+		if err != nil || bh.Height > bhb.Height {
+			continue
+		}
+		// Every height up to best has a canonical header thus a lone
+		// header at a height is canonical. Avoid walking the chain in
+		// that case since locators tend to point far back.
+		bhs, err := s.db.BlockHeadersByHeight(ctx, bh.Height)
+		if err != nil {
+			return nil, fmt.Errorf("block headers by height %v: %w",
+				bh.Height, err)
+		}
+		canonical := len(bhs) == 1
+		if !canonical {
+			canonical, err = s.isCanonical(ctx, bh)
+			if err != nil {
+				return nil, fmt.Errorf("is canonical: %w", err)
+			}
+		}
+		if canonical {
+			start = bh
+			break
+		}
+	}
+	if start == nil {
+		start, err = s.db.BlockHeaderByHash(ctx, s.chainParams.GenesisHash)
+		if err != nil {
+			return nil, fmt.Errorf("genesis: %w", err)
+		}
+	}
+
+	// Walk canonical chain forward.
+	bhs := make([]tbcd.BlockHeader, 0, min(count,
+		int(bhb.Height-start.Height)))
+	parent := start
+	for len(bhs) < count && parent.Height < bhb.Height {
+		candidates, err := s.db.BlockHeadersByHeight(ctx, parent.Height+1)
+		if err != nil {
+			return nil, fmt.Errorf("block headers by height %v: %w",
+				parent.Height+1, err)
+		}
+		children := candidates[:0]
+		for _, bh := range candidates {
+			if bh.ParentHash().IsEqual(&parent.Hash) {
+				children = append(children, bh)
+			}
+		}
+		index, err := s.findPathFromHash(ctx, &bhb.Hash, children)
+		if err != nil {
+			return nil, fmt.Errorf("find path %v: %w", parent.Height+1, err)
+		}
+		child := children[index]
+		bhs = append(bhs, child)
+		parent = &child
+		if parent.Hash.IsEqual(stop) {
+			break
+		}
+	}
+
+	return bhs, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestHeadersAfterLocator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg := NewDefaultConfig()
+	cfg.Network = networkLocalnet
+	cfg.LevelDBHome = t.TempDir()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := testBlocks(*chaincfg.RegressionNetParams.GenesisHash, 0, 5, 0)
+	headers := make([]*wire.BlockHeader, 0, len(blocks))
+	for _, b := range blocks {
+		headers = append(headers, &b.MsgBlock().Header)
+	}
+	testHeadersInsert(ctx, t, s, headers)
+	unknown := chainhash.DoubleHashH([]byte("unknown"))
+
+	tests := []struct {
+		name    string
+		locator []*chainhash.Hash
+		stop    *chainhash.Hash
+		want    []*chainhash.Hash
+	}{
+		{
+			name:    "locator",
+			locator: []*chainhash.Hash{blocks[1].Hash()},
+			stop:    &chainhash.Hash{},
+			want: []*chainhash.Hash{
+				blocks[2].Hash(), blocks[3].Hash(), blocks[4].Hash(),
+			},
+		},
+		{
+			name:    "locator with stop",
+			locator: []*chainhash.Hash{&unknown, blocks[0].Hash()},
+			stop:    blocks[2].Hash(),
+			want:    []*chainhash.Hash{blocks[1].Hash(), blocks[2].Hash()},
+		},
+		{
+			name:    "unknown locator",
+			locator: []*chainhash.Hash{&unknown},
+			stop:    blocks[0].Hash(),
+			want:    []*chainhash.Hash{blocks[0].Hash()},
+		},
+		{
+			name: "empty locator",
+			stop: blocks[3].Hash(),
+			want: []*chainhash.Hash{blocks[3].Hash()},
+		},
+		{
+			name: "empty locator unknown stop",
+			stop: &unknown,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bhs, err := s.headersAfterLocator(ctx, tt.locator, tt.stop,
+				wire.MaxBlockHeadersPerMsg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bhs) != len(tt.want) {
+				t.Fatalf("expected %v headers, got %v", len(tt.want),
+					len(bhs))
+			}
+			for k, bh := range bhs {
+				if !bh.Hash.IsEqual(tt.want[k]) {
+					t.Fatalf("header %v: expected %v, got %v", k,
+						tt.want[k], bh.Hash)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,863 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+// The JSON-RPC server implements a subset of the bitcoind JSON-RPC API over
+// HTTP with basic auth. Only positional params are supported. As bitcoind, a
+// failed request is answered with a 500, or 404 for an unknown method, and a
+// JSON-RPC error object; batches are always answered with a 200.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+// bitcoind JSON-RPC error codes.
+const (
+	rpcMiscError           = -1
+	rpcTypeError           = -3
+	rpcInvalidAddressOrKey = -5
+	rpcInvalidParameter    = -8
+	rpcClientNotConnected  = -9
+	rpcDeserializationErr  = -22
+	rpcVerifyRejected      = -26
+	rpcInvalidRequest      = -32600
+	rpcMethodNotFound      = -32601
+	rpcInternalError       = -32603
+	rpcParseError          = -32700
+)
+
+const (
+	// Large enough for a hex encoded block sized transaction.
+	rpcMaxBodySize = 10 * 1024 * 1024
+
+	// Maximum number of requests in a batch.
+	rpcMaxBatchSize = 1000
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	Result any             `json:"result"`
+	Error  *rpcError       `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// rpcError is a JSON-RPC error that is returned to the client as is. All other
+// errors are logged and returned as an internal error.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func rpcErrorf(code int, format string, args ...any) *rpcError {
+	return &rpcError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func rpcParams(raw json.RawMessage, required int, args ...any) error {
+	if err := positionalParams(raw, required, args...); err != nil {
+		return rpcErrorf(rpcTypeError, "%v", err)
+	}
+	return nil
+}
+
+// rpcVerbosity is a verbosity param, it may be provided as a boolean or an
+// integer.
+type rpcVerbosity int
+
+func (v *rpcVerbosity) UnmarshalJSON(b []byte) error {
+	var verbose bool
+	if err := json.Unmarshal(b, &verbose); err == nil {
+		*v = 0
+		if verbose {
+			*v = 1
+		}
+		return nil
+	}
+	var i int
+	if err := json.Unmarshal(b, &i); err != nil {
+		return errors.New("verbosity must be a boolean or an integer")
+	}
+	*v = rpcVerbosity(i)
+	return nil
+}
+
+type rpcScriptSig struct {
+	Asm string `json:"asm"`
+	Hex string `json:"hex"`
+}
+
+type rpcScriptPubKey struct {
+	Asm     string `json:"asm"`
+	Hex     string `json:"hex"`
+	Type    string `json:"type"`
+	Address string `json:"address,omitempty"`
+}
+
+type rpcVin struct {
+	Coinbase    string        `json:"coinbase,omitempty"`
+	TxId        string        `json:"txid,omitempty"`
+	Vout        *uint32       `json:"vout,omitempty"`
+	ScriptSig   *rpcScriptSig `json:"scriptSig,omitempty"`
+	TxInWitness []string      `json:"txinwitness,omitempty"`
+	Sequence    uint32        `json:"sequence"`
+}
+
+type rpcVout struct {
+	Value        float64          `json:"value"`
+	N            uint32           `json:"n"`
+	ScriptPubKey *rpcScriptPubKey `json:"scriptPubKey"`
+}
+
+// rpcTx is the verbose form of getrawtransaction.
+type rpcTx struct {
+	TxId          string     `json:"txid"`
+	Hash          string     `json:"hash"`
+	Version       int32      `json:"version"`
+	Size          int        `json:"size"`
+	VSize         int64      `json:"vsize"`
+	Weight        int64      `json:"weight"`
+	LockTime      uint32     `json:"locktime"`
+	Vin           []*rpcVin  `json:"vin"`
+	Vout          []*rpcVout `json:"vout"`
+	Hex           string     `json:"hex"`
+	BlockHash     string     `json:"blockhash,omitempty"`
+	Confirmations uint64     `json:"confirmations,omitempty"`
+	Time          int64      `json:"time,omitempty"`
+	BlockTime     int64      `json:"blocktime,omitempty"`
+}
+
+// rpcBlockHeader is the verbose form of getblockheader.
+type rpcBlockHeader struct {
+	Hash              string  `json:"hash"`
+	Confirmations     int64   `json:"confirmations"`
+	Height            uint64  `json:"height"`
+	Version           int32   `json:"version"`
+	VersionHex        string  `json:"versionHex"`
+	MerkleRoot        string  `json:"merkleroot"`
+	Time              int64   `json:"time"`
+	MedianTime        int64   `json:"mediantime"`
+	Nonce             uint32  `json:"nonce"`
+	Bits              string  `json:"bits"`
+	Difficulty        float64 `json:"difficulty"`
+	ChainWork         string  `json:"chainwork"`
+	NTx               int     `json:"nTx,omitempty"`
+	PreviousBlockHash string  `json:"previousblockhash,omitempty"`
+	NextBlockHash     string  `json:"nextblockhash,omitempty"`
+}
+
+// rpcBlock is the verbose form of getblock.
+type rpcBlock struct {
+	rpcBlockHeader
+	StrippedSize int      `json:"strippedsize"`
+	Size         int      `json:"size"`
+	Weight       int64    `json:"weight"`
+	Tx           []string `json:"tx"`
+}
+
+type rpcTxOut struct {
+	BestBlock     string           `json:"bestblock"`
+	Confirmations uint64           `json:"confirmations"`
+	Value         float64          `json:"value"`
+	ScriptPubKey  *rpcScriptPubKey `json:"scriptPubKey"`
+	Coinbase      bool             `json:"coinbase"`
+}
+
+type rpcMempoolInfo struct {
+	Loaded           bool    `json:"loaded"`
+	Size             int     `json:"size"`
+	Bytes            int     `json:"bytes"`
+	Usage            int     `json:"usage"`
+	MaxMempool       int     `json:"maxmempool"`
+	MempoolMinFee    float64 `json:"mempoolminfee"`
+	MinRelayTxFee    float64 `json:"minrelaytxfee"`
+	UnbroadcastCount int     `json:"unbroadcastcount"`
+}
+
+// rpcScriptType returns the bitcoind name of the script type.
+func rpcScriptType(pkScript []byte) string {
+	switch txscript.GetScriptClass(pkScript) {
+	case txscript.PubKeyHashTy:
+		return "pubkeyhash"
+	case txscript.ScriptHashTy:
+		return "scripthash"
+	case txscript.WitnessV0PubKeyHashTy:
+		return "witness_v0_keyhash"
+	case txscript.WitnessV0ScriptHashTy:
+		return "witness_v0_scripthash"
+	case txscript.WitnessV1TaprootTy:
+		return "witness_v1_taproot"
+	case txscript.PubKeyTy:
+		return "pubkey"
+	case txscript.MultiSigTy:
+		return "multisig"
+	case txscript.NullDataTy:
+		return "nulldata"
+	default:
+		return "nonstandard"
+	}
+}
+
+func (s *Server) rpcScriptPubKey(pkScript []byte) *rpcScriptPubKey {
+	spk := &rpcScriptPubKey{
+		Hex:  hex.EncodeToString(pkScript),
+		Type: rpcScriptType(pkScript),
+	}
+	spk.Asm, _ = txscript.DisasmString(pkScript)
+	_, addrs, _, err := txscript.ExtractPkScriptAddrs(pkScript, s.chainParams)
+	if err == nil && len(addrs) == 1 && spk.Type != "pubkey" {
+		spk.Address = addrs[0].EncodeAddress()
+	}
+	return spk
+}
+
+// rpcTxVerbose returns the verbose form of a tx, bh is the header of the block
+// the tx was mined in and nil for mempool txs.
+func (s *Server) rpcTxVerbose(ctx context.Context, tx *wire.MsgTx, bh *tbcd.BlockHeader) (*rpcTx, error) {
+	var b bytes.Buffer
+	if err := tx.Serialize(&b); err != nil {
+		return nil, fmt.Errorf("serialize %v: %w", tx.TxHash(), err)
+	}
+	weight := blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+	rtx := &rpcTx{
+		TxId:     tx.TxHash().String(),
+		Hash:     tx.WitnessHash().String(),
+		Version:  tx.Version,
+		Size:     b.Len(),
+		VSize:    (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor,
+		Weight:   weight,
+		LockTime: tx.LockTime,
+		Vin:      make([]*rpcVin, 0, len(tx.TxIn)),
+		Vout:     make([]*rpcVout, 0, len(tx.TxOut)),
+		Hex:      hex.EncodeToString(b.Bytes()),
+	}
+
+	coinbase := blockchain.IsCoinBaseTx(tx)
+	for _, txIn := range tx.TxIn {
+		vin := &rpcVin{Sequence: txIn.Sequence}
+		if coinbase {
+			vin.Coinbase = hex.EncodeToString(txIn.SignatureScript)
+		} else {
+			vout := txIn.PreviousOutPoint.Index
+			vin.TxId = txIn.PreviousOutPoint.Hash.String()
+			vin.Vout = &vout
+			vin.ScriptSig = &rpcScriptSig{
+				Hex: hex.EncodeToString(txIn.SignatureScript),
+			}
+			vin.ScriptSig.Asm, _ = txscript.DisasmString(txIn.SignatureScript)
+		}
+		for _, w := range txIn.Witness {
+			vin.TxInWitness = append(vin.TxInWitness, hex.EncodeToString(w))
+		}
+		rtx.Vin = append(rtx.Vin, vin)
+	}
+	for k, txOut := range tx.TxOut {
+		rtx.Vout = append(rtx.Vout, &rpcVout{
+			Value:        btcutil.Amount(txOut.Value).ToBTC(),
+			N:            uint32(k),
+			ScriptPubKey: s.rpcScriptPubKey(txOut.PkScript),
+		})
+	}
+
+	if bh != nil {
+		bhb, err := s.db.BlockHeaderBest(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("block header best: %w", err)
+		}
+		// Txs in blocks that were reorged out have no confirmations.
+		canonical, err := s.isCanonical(ctx, bh)
+		if err != nil {
+			return nil, fmt.Errorf("is canonical: %w", err)
+		}
+		rtx.BlockHash = bh.Hash.String()
+		rtx.Time = bh.Timestamp().Unix()
+		rtx.BlockTime = rtx.Time
+		if canonical {
+			rtx.Confirmations = bhb.Height - bh.Height + 1
+		}
+	}
+	return rtx, nil
+}
+
+// jsonrpcListen serves the JSON-RPC API until the context is canceled.
+func (s *Server) jsonrpcListen(ctx context.Context) error {
+	log.Tracef("jsonrpcListen")
+	defer log.Tracef("jsonrpcListen exit")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /", s.handleJSONRPC)
+
+	httpServer := &http.Server{
+		Addr:              s.cfg.JSONRPCListenAddress,
+		Handler:           mux,
+		BaseContext:       func(_ net.Listener) context.Context { return ctx },
+		ReadHeaderTimeout: defaultCmdTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(),
+			defaultCmdTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(sctx); err != nil {
+			log.Errorf("json-rpc server exit: %v", err)
+		}
+	}()
+
+	log.Infof("Listening json-rpc: %v", s.cfg.JSONRPCListenAddress)
+	err := httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return ctx.Err()
+	}
+	return fmt.Errorf("json-rpc listen: %w", err)
+}
+
+// jsonrpcAuthorized returns true if the request carries the configured
+// credentials.
+func (s *Server) jsonrpcAuthorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Compare digests to not leak the length of the credentials.
+	uh, wuh := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(s.cfg.JSONRPCUser))
+	ph, wph := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(s.cfg.JSONRPCPassword))
+	return subtle.ConstantTimeCompare(uh[:], wuh[:])&
+		subtle.ConstantTimeCompare(ph[:], wph[:]) == 1
+}
+
+func (s *Server) handleJSONRPC(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("handleJSONRPC: %v", r.RemoteAddr)
+	defer log.Tracef("handleJSONRPC exit: %v", r.RemoteAddr)
+
+	if !s.jsonrpcAuthorized(r) {
+		log.Debugf("json-rpc unauthorized: %v", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	write := func(status int, v any) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			log.Errorf("json-rpc marshal: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			log.Debugf("json-rpc write %v: %v", r.RemoteAddr, err)
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, rpcMaxBodySize))
+	if err != nil {
+		log.Debugf("json-rpc read %v: %v", r.RemoteAddr, err)
+		return
+	}
+	body = bytes.TrimSpace(body)
+
+	if len(body) > 0 && body[0] == '[' {
+		var reqs []rpcRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			write(http.StatusInternalServerError, &rpcResponse{
+				Error: rpcErrorf(rpcParseError, "Parse error"),
+			})
+			return
+		}
+		if len(reqs) > rpcMaxBatchSize {
+			write(http.StatusInternalServerError, &rpcResponse{
+				Error: rpcErrorf(rpcInvalidRequest,
+					"too many requests, max %v", rpcMaxBatchSize),
+			})
+			return
+		}
+		replies := make([]*rpcResponse, 0, len(reqs))
+		for k := range reqs {
+			replies = append(replies, s.handleJSONRPCRequest(r.Context(),
+				&reqs[k]))
+		}
+		write(http.StatusOK, replies)
+		return
+	}
+
+	var req rpcRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		write(http.StatusInternalServerError, &rpcResponse{
+			Error: rpcErrorf(rpcParseError, "Parse error"),
+		})
+		return
+	}
+	res := s.handleJSONRPCRequest(r.Context(), &req)
+	status := http.StatusOK
+	if res.Error != nil {
+		status = http.StatusInternalServerError
+		if res.Error.Code == rpcMethodNotFound {
+			status = http.StatusNotFound
+		}
+	}
+	write(status, res)
+}
+
+func (s *Server) handleJSONRPCRequest(ctx context.Context, req *rpcRequest) *rpcResponse {
+	log.Tracef("handleJSONRPCRequest: %v", req.Method)
+	defer log.Tracef("handleJSONRPCRequest exit: %v", req.Method)
+
+	ctx, cancel := context.WithTimeout(ctx, s.requestTimeout)
+	defer cancel()
+
+	var (
+		result any
+		err    error
+	)
+	switch req.Method {
+	case "getblockcount":
+		result, err = s.rpcGetBlockCount(ctx)
+	case "getbestblockhash":
+		result, err = s.rpcGetBestBlockHash(ctx)
+	case "getblockhash":
+		result, err = s.rpcGetBlockHash(ctx, req.Params)
+	case "getblockheader":
+		result, err = s.rpcGetBlockHeader(ctx, req.Params)
+	case "getblock":
+		result, err = s.rpcGetBlock(ctx, req.Params)
+	case "getrawtransaction":
+		result, err = s.rpcGetRawTransaction(ctx, req.Params)
+	case "sendrawtransaction":
+		result, err = s.rpcSendRawTransaction(ctx, req.Params)
+	case "gettxout":
+		result, err = s.rpcGetTxOut(ctx, req.Params)
+	case "getmempoolinfo":
+		result, err = s.rpcGetMempoolInfo(ctx)
+	default:
+		err = rpcErrorf(rpcMethodNotFound, "Method not found")
+	}
+
+	res := &rpcResponse{ID: req.ID}
+	if err != nil {
+		var re *rpcError
+		if !errors.As(err, &re) {
+			log.Errorf("json-rpc %v: %v", req.Method, err)
+			re = rpcErrorf(rpcInternalError, "internal error")
+		}
+		res.Error = re
+		return res
+	}
+	res.Result = result
+
+	s.cmdsProcessed.Inc()
+
+	return res
+}
+
+func rpcHash(s string) (*chainhash.Hash, error) {
+	if len(s) != 2*chainhash.HashSize {
+		return nil, rpcErrorf(rpcInvalidParameter,
+			"must be of length %v (not %v)", 2*chainhash.HashSize, len(s))
+	}
+	hash, err := chainhash.NewHashFromStr(s)
+	if err != nil {
+		return nil, rpcErrorf(rpcInvalidParameter, "must be hexadecimal string")
+	}
+	return hash, nil
+}
+
+func (s *Server) rpcGetBlockCount(ctx context.Context) (any, error) {
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("block header best: %w", err)
+	}
+	return bhb.Height, nil
+}
+
+func (s *Server) rpcGetBestBlockHash(ctx context.Context) (any, error) {
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("block header best: %w", err)
+	}
+	return bhb.Hash.String(), nil
+}
+
+func (s *Server) rpcGetBlockHash(ctx context.Context, params json.RawMessage) (any, error) {
+	var height uint64
+	if err := rpcParams(params, 1, &height); err != nil {
+		return nil, err
+	}
+	bh, err := s.canonicalBlockHeaderByHeight(ctx, height)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, rpcErrorf(rpcInvalidParameter,
+				"Block height out of range")
+		}
+		return nil, err
+	}
+	return bh.Hash.String(), nil
+}
+
+// rpcBlockHeaderVerbose returns the verbose form of a block header. The number
+// of txs is only set when the block is provided.
+func (s *Server) rpcBlockHeaderVerbose(ctx context.Context, bh *tbcd.BlockHeader, b *btcutil.Block) (*rpcBlockHeader, error) {
+	wbh, err := bh.Wire()
+	if err != nil {
+		return nil, fmt.Errorf("wire header %v: %w", bh, err)
+	}
+	mt, err := s.medianTime(ctx, bh)
+	if err != nil {
+		return nil, err
+	}
+	rbh := &rpcBlockHeader{
+		Hash:          bh.Hash.String(),
+		Confirmations: -1,
+		Height:        bh.Height,
+		Version:       wbh.Version,
+		VersionHex:    fmt.Sprintf("%08x", uint32(wbh.Version)),
+		MerkleRoot:    wbh.MerkleRoot.String(),
+		Time:          wbh.Timestamp.Unix(),
+		MedianTime:    mt,
+		Nonce:         wbh.Nonce,
+		Bits:          fmt.Sprintf("%08x", wbh.Bits),
+		Difficulty:    difficulty(wbh.Bits, s.chainParams.PowLimit),
+		ChainWork:     fmt.Sprintf("%064x", &bh.Difficulty),
+	}
+	if b != nil {
+		rbh.NTx = len(b.Transactions())
+	}
+	if bh.Height > 0 {
+		rbh.PreviousBlockHash = wbh.PrevBlock.String()
+	}
+
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("block header best: %w", err)
+	}
+	canonical, err := s.isCanonical(ctx, bh)
+	if err != nil {
+		return nil, fmt.Errorf("is canonical: %w", err)
+	}
+	if canonical {
+		rbh.Confirmations = int64(bhb.Height-bh.Height) + 1
+		if bh.Height < bhb.Height {
+			next, err := s.canonicalBlockHeaderByHeight(ctx, bh.Height+1)
+			if err != nil {
+				return nil, err
+			}
+			rbh.NextBlockHash = next.Hash.String()
+		}
+	}
+	return rbh, nil
+}
+
+func (s *Server) rpcGetBlockHeader(ctx context.Context, params json.RawMessage) (any, error) {
+	var (
+		hash    string
+		verbose = rpcVerbosity(1)
+	)
+	if err := rpcParams(params, 1, &hash, &verbose); err != nil {
+		return nil, err
+	}
+	h, err := rpcHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	bh, err := s.db.BlockHeaderByHash(ctx, h)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, rpcErrorf(rpcInvalidAddressOrKey, "Block not found")
+		}
+		return nil, fmt.Errorf("block header %v: %w", h, err)
+	}
+	if verbose == 0 {
+		return hex.EncodeToString(bh.Header[:]), nil
+	}
+	b, err := s.db.BlockByHash(ctx, h)
+	if err != nil {
+		b = nil // Header only
+	}
+	return s.rpcBlockHeaderVerbose(ctx, bh, b)
+}
+
+func (s *Server) rpcGetBlock(ctx context.Context, params json.RawMessage) (any, error) {
+	var (
+		hash      string
+		verbosity = rpcVerbosity(1)
+	)
+	if err := rpcParams(params, 1, &hash, &verbosity); err != nil {
+		return nil, err
+	}
+	if verbosity != 0 && verbosity != 1 {
+		return nil, rpcErrorf(rpcInvalidParameter,
+			"verbosity %v not supported", verbosity)
+	}
+	h, err := rpcHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	bh, err := s.db.BlockHeaderByHash(ctx, h)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, rpcErrorf(rpcInvalidAddressOrKey, "Block not found")
+		}
+		return nil, fmt.Errorf("block header %v: %w", h, err)
+	}
+	b, err := s.db.BlockByHash(ctx, h)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrBlockPruned):
+			return nil, rpcErrorf(rpcMiscError, "Block not available (pruned data)")
+		case errors.Is(err, database.ErrBlockNotFound):
+			return nil, rpcErrorf(rpcMiscError, "Block not found on disk")
+		}
+		return nil, fmt.Errorf("block %v: %w", h, err)
+	}
+	if verbosity == 0 {
+		raw, err := b.Bytes()
+		if err != nil {
+			return nil, fmt.Errorf("block bytes %v: %w", h, err)
+		}
+		return hex.EncodeToString(raw), nil
+	}
+
+	rbh, err := s.rpcBlockHeaderVerbose(ctx, bh, b)
+	if err != nil {
+		return nil, err
+	}
+	rb := &rpcBlock{
+		rpcBlockHeader: *rbh,
+		StrippedSize:   b.MsgBlock().SerializeSizeStripped(),
+		Size:           b.MsgBlock().SerializeSize(),
+		Weight:         blockchain.GetBlockWeight(b),
+		Tx:             make([]string, 0, len(b.Transactions())),
+	}
+	for _, tx := range b.Transactions() {
+		rb.Tx = append(rb.Tx, tx.Hash().String())
+	}
+	return rb, nil
+}
+
+func (s *Server) rpcGetRawTransaction(ctx context.Context, params json.RawMessage) (any, error) {
+	var (
+		hash      string
+		verbose   rpcVerbosity
+		blockHash string
+	)
+	if err := rpcParams(params, 1, &hash, &verbose, &blockHash); err != nil {
+		return nil, err
+	}
+	txId, err := rpcHash(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		tx *wire.MsgTx
+		bh *tbcd.BlockHeader
+	)
+	if blockHash == "" {
+		tx, bh, err = s.txLookup(ctx, txId)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				return nil, rpcErrorf(rpcInvalidAddressOrKey,
+					"No such mempool or blockchain transaction")
+			}
+			return nil, err
+		}
+	} else {
+		h, err := rpcHash(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		bh, err = s.db.BlockHeaderByHash(ctx, h)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				return nil, rpcErrorf(rpcInvalidAddressOrKey,
+					"Block hash not found")
+			}
+			return nil, fmt.Errorf("block header %v: %w", h, err)
+		}
+		b, err := s.db.BlockByHash(ctx, h)
+		if err != nil {
+			if errors.Is(err, database.ErrBlockNotFound) ||
+				errors.Is(err, database.ErrBlockPruned) {
+				return nil, rpcErrorf(rpcMiscError,
+					"Block not available")
+			}
+			return nil, fmt.Errorf("block %v: %w", h, err)
+		}
+		for _, btx := range b.Transactions() {
+			if btx.Hash().IsEqual(txId) {
+				tx = btx.MsgTx()
+				break
+			}
+		}
+		if tx == nil {
+			return nil, rpcErrorf(rpcInvalidAddressOrKey,
+				"No such transaction found in the provided block")
+		}
+	}
+
+	if verbose == 0 {
+		b, err := tx2Bytes(tx)
+		if err != nil {
+			return nil, fmt.Errorf("serialize %v: %w", txId, err)
+		}
+		return hex.EncodeToString(b), nil
+	}
+	return s.rpcTxVerbose(ctx, tx, bh)
+}
+
+func (s *Server) rpcSendRawTransaction(ctx context.Context, params json.RawMessage) (any, error) {
+	var rawTx string
+	if err := rpcParams(params, 1, &rawTx); err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(rawTx)
+	if err != nil {
+		return nil, rpcErrorf(rpcDeserializationErr, "TX decode failed")
+	}
+	tx := &wire.MsgTx{}
+	if err := tx.Deserialize(bytes.NewReader(b)); err != nil {
+		return nil, rpcErrorf(rpcDeserializationErr, "TX decode failed")
+	}
+	txId, err := s.TxBroadcast(ctx, tx, false)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrTxAlreadyBroadcast):
+			return nil, rpcErrorf(rpcVerifyRejected, "%v", err)
+		case errors.Is(err, ErrTxBroadcastNoPeers):
+			return nil, rpcErrorf(rpcClientNotConnected, "%v", err)
+		}
+		return nil, fmt.Errorf("broadcast %v: %w", tx.TxHash(), err)
+	}
+	return txId.String(), nil
+}
+
+// rpcGetTxOut returns an unspent output per the utxo index or, when
+// include_mempool is set, the mempool. Outputs that are spent return null.
+func (s *Server) rpcGetTxOut(ctx context.Context, params json.RawMessage) (any, error) {
+	var (
+		hash           string
+		n              uint32
+		includeMempool = true
+	)
+	if err := rpcParams(params, 2, &hash, &n, &includeMempool); err != nil {
+		return nil, err
+	}
+	txId, err := rpcHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	op := wire.OutPoint{Hash: *txId, Index: n}
+
+	utxoHH, err := s.UtxoIndexHash(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("utxo index hash: %w", err)
+	}
+	if includeMempool && s.cfg.MempoolEnabled {
+		_, _, err := s.mempool.spentBy(op)
+		if err == nil {
+			return nil, nil
+		}
+		if !errors.Is(err, database.ErrNotFound) {
+			return nil, fmt.Errorf("mempool: %w", err)
+		}
+		if tx, ok := s.mempool.txById(*txId); ok {
+			if int(n) >= len(tx.TxOut) {
+				return nil, nil
+			}
+			return &rpcTxOut{
+				BestBlock:    utxoHH.Hash.String(),
+				Value:        btcutil.Amount(tx.TxOut[n].Value).ToBTC(),
+				ScriptPubKey: s.rpcScriptPubKey(tx.TxOut[n].PkScript),
+			}, nil
+		}
+	}
+
+	utxo, err := s.db.UtxoByOutpoint(ctx, tbcd.NewOutpoint(*txId, n))
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("utxo %v: %w", op, err)
+	}
+	pkScript, err := s.db.ScriptByOutpoint(ctx, tbcd.NewOutpoint(*txId, n))
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, fmt.Errorf("utxo %v: %w", op, ErrPkScriptUnknown)
+		}
+		return nil, fmt.Errorf("script %v: %w", op, err)
+	}
+	bh, err := s.utxoBlockHeader(ctx, txId, utxo.ScriptHash(), utxoHH)
+	if err != nil {
+		return nil, fmt.Errorf("utxo %v: %w", op, err)
+	}
+	rto := &rpcTxOut{
+		BestBlock:     utxoHH.Hash.String(),
+		Confirmations: utxoHH.Height - bh.Height + 1,
+		Value:         btcutil.Amount(utxo.Value()).ToBTC(),
+		ScriptPubKey:  s.rpcScriptPubKey(pkScript),
+	}
+
+	// The coinbase is the first tx of the undo record. The undo record is
+	// pruned with its block, older outputs are reported as not coinbase.
+	bu, err := s.blockUndoByHash(ctx, &bh.Hash)
+	switch {
+	case err == nil:
+		rto.Coinbase = len(bu.Txs) > 0 && bu.Txs[0].TxId.IsEqual(txId)
+	case errors.Is(err, database.ErrNotFound),
+		errors.Is(err, database.ErrBlockPruned):
+	default:
+		return nil, fmt.Errorf("block undo %v: %w", bh.Hash, err)
+	}
+	return rto, nil
+}
+
+func (s *Server) rpcGetMempoolInfo(ctx context.Context) (any, error) {
+	minFee := btcutil.Amount(minFeeRate * 1000).ToBTC() // per kvB
+	rmi := &rpcMempoolInfo{
+		MaxMempool:    s.cfg.MempoolMaxSize,
+		MempoolMinFee: minFee,
+		MinRelayTxFee: minFee,
+	}
+	mi, err := s.MempoolInfo(ctx)
+	if err != nil {
+		if errors.Is(err, ErrMempoolDisabled) {
+			return rmi, nil
+		}
+		return nil, err
+	}
+	rmi.Loaded = true
+	rmi.Size = mi.Count
+	rmi.Bytes = mi.Size
+	rmi.Usage = mi.Size
+	rmi.MaxMempool = mi.MaxSize
+	return rmi, nil
+}
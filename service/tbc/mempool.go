@@ -5,21 +5,329 @@
 package tbc
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/davecgh/go-spew/spew"
+
+	"github.com/hemilabs/heminetwork/database"
+)
+
+const (
+	// Virtual size of a full block.
+	maxBlockVSize = blockchain.MaxBlockWeight / blockchain.WitnessScaleFactor
+
+	// Minimum relay fee rate in sat/vB.
+	minFeeRate = 1
+
+	// Maximum number of txs a BIP125 replacement may evict.
+	maxReplacements = 100
+
+	// Announced txs that are not downloaded within this time are dropped.
+	mempoolInvTimeout = 10 * time.Minute
+)
+
+var (
+	// feeRateBuckets are the lower bounds, in sat/vB, of the fee rate
+	// histogram buckets.
+	feeRateBuckets = []float64{
+		1, 2, 3, 4, 5, 6, 8, 10, 12, 15, 20, 25, 30, 40, 50, 60, 70, 80,
+		90, 100, 125, 150, 175, 200, 250, 300, 350, 400, 500, 600, 700,
+		800, 900, 1000, 1200, 1400, 1700, 2000,
+	}
+
+	// feeEstimateTargets are the confirmation targets, in blocks, fees
+	// are estimated for.
+	feeEstimateTargets = []uint{1, 2, 3, 6, 12, 24, 144}
+
+	ErrMempoolDisabled = errors.New("mempool disabled")
+	ErrMempoolFull     = errors.New("mempool full")
+	ErrTxConflict      = errors.New("tx conflict")
 )
 
+// FeeEstimate is the recommended fee rate to be included within the number of
+// blocks.
+type FeeEstimate struct {
+	Blocks       uint
+	SatsPerVByte float64
+}
+
+// MempoolInfo contains the mempool statistics.
+type MempoolInfo struct {
+	Count     int // downloaded txs
+	Pending   int // announced txs that have not been downloaded
+	Size      int
+	MaxSize   int
+	Histogram []FeeRateBucket
+}
+
+// FeeRateBucket is the total virtual size of the mempool txs with a fee rate
+// of at least SatsPerVByte and below the next bucket.
+type FeeRateBucket struct {
+	SatsPerVByte float64
+	VSize        int64
+}
+
+// MempoolTx describes a mempool transaction. Fee is -1 when it is unknown.
+type MempoolTx struct {
+	TxId  chainhash.Hash
+	Size  int
+	VSize int64
+	Fee   int64
+	Added time.Time
+}
+
+// FeeRate returns the fee rate in sat/vB, or -1 when the fee is unknown.
+func (mt MempoolTx) FeeRate() float64 {
+	if mt.Fee < 0 || mt.VSize == 0 {
+		return -1
+	}
+	return float64(mt.Fee) / float64(mt.VSize)
+}
+
+// mempoolTx is a mempool transaction. The tx is nil when it has only been
+// announced.
+type mempoolTx struct {
+	tx    *wire.MsgTx
+	size  int       // serialized size
+	vsize int64     // virtual size
+	fee   int64     // fee in satoshis, -1 when unknown
+	added time.Time // time the tx was inserted or announced
+}
+
+func newMempoolTx(tx *wire.MsgTx, size int) *mempoolTx {
+	weight := blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+	return &mempoolTx{
+		tx:    tx,
+		size:  size,
+		vsize: (weight + blockchain.WitnessScaleFactor - 1) / blockchain.WitnessScaleFactor,
+		fee:   -1,
+		added: time.Now(),
+	}
+}
+
+// feeRate returns the fee rate in sat/vB and false when the fee is unknown.
+func (mt *mempoolTx) feeRate() (float64, bool) {
+	if mt.fee < 0 || mt.vsize == 0 {
+		return 0, false
+	}
+	return float64(mt.fee) / float64(mt.vsize), true
+}
+
+// feeRateBucket returns the histogram bucket of the provided fee rate. Fee
+// rates below the lowest bucket are accounted in the lowest bucket.
+func feeRateBucket(feeRate float64) int {
+	i := sort.Search(len(feeRateBuckets), func(i int) bool {
+		return feeRateBuckets[i] > feeRate
+	})
+	return max(i-1, 0)
+}
+
 type mempool struct {
 	mtx sync.RWMutex
 
-	txs  map[chainhash.Hash][]byte // when nil, tx has not been downloaded
-	size int                       // total memory used by mempool
+	txs   map[chainhash.Hash]*mempoolTx    // tx is nil when not downloaded
+	spent map[wire.OutPoint]chainhash.Hash // outpoints spent by mempool txs
+	size  int                              // total memory used by mempool
+
+	maxSize int           // lowest fee rate txs are evicted beyond this size
+	expiry  time.Duration // txs are expired after being this long in mempool
+
+	histogram []int64 // vsize of txs with a known fee per fee rate bucket
+}
+
+// histogramUpdate adds or, when direction is -1, removes the provided tx from
+// the fee rate histogram. Must be called with the lock held.
+func (m *mempool) histogramUpdate(mt *mempoolTx, direction int64) {
+	if feeRate, ok := mt.feeRate(); ok {
+		m.histogram[feeRateBucket(feeRate)] += direction * mt.vsize
+	}
+}
+
+// txAdd adds a downloaded tx. Must be called with the lock held.
+func (m *mempool) txAdd(txId chainhash.Hash, mt *mempoolTx) {
+	m.txs[txId] = mt
+	m.size += mt.size
+	m.histogramUpdate(mt, 1)
+	for _, txIn := range mt.tx.TxIn {
+		m.spent[txIn.PreviousOutPoint] = txId
+	}
+}
+
+// txDelete deletes a tx. Must be called with the lock held.
+func (m *mempool) txDelete(txId chainhash.Hash) {
+	mt, ok := m.txs[txId]
+	if !ok {
+		return
+	}
+	delete(m.txs, txId)
+	if mt.tx == nil {
+		return
+	}
+	m.size -= mt.size
+	m.histogramUpdate(mt, -1)
+	for _, txIn := range mt.tx.TxIn {
+		if m.spent[txIn.PreviousOutPoint] == txId {
+			delete(m.spent, txIn.PreviousOutPoint)
+		}
+	}
+}
+
+// descendants returns the tx and all mempool txs that spend its outputs,
+// directly or indirectly. Must be called with the lock held.
+func (m *mempool) descendants(txId chainhash.Hash) []chainhash.Hash {
+	seen := map[chainhash.Hash]struct{}{txId: {}}
+	d := []chainhash.Hash{txId}
+	for i := 0; i < len(d); i++ {
+		mt := m.txs[d[i]]
+		if mt == nil || mt.tx == nil {
+			continue
+		}
+		for k := range mt.tx.TxOut {
+			child, ok := m.spent[wire.OutPoint{Hash: d[i], Index: uint32(k)}]
+			if !ok {
+				continue
+			}
+			if _, ok := seen[child]; ok {
+				continue
+			}
+			seen[child] = struct{}{}
+			d = append(d, child)
+		}
+	}
+	return d
+}
+
+// txDeleteWithDescendants deletes a tx and its descendants. Must be called
+// with the lock held.
+func (m *mempool) txDeleteWithDescendants(txId chainhash.Hash) int {
+	d := m.descendants(txId)
+	for _, h := range d {
+		m.txDelete(h)
+	}
+	return len(d)
+}
+
+// signalsReplacement returns true if the tx opts in to replacement as per
+// BIP125.
+func signalsReplacement(tx *wire.MsgTx) bool {
+	for _, txIn := range tx.TxIn {
+		if txIn.Sequence <= wire.MaxTxInSequenceNum-2 {
+			return true
+		}
+	}
+	return false
+}
+
+// replacement verifies that mt may replace the conflicting txs and returns
+// the txs that must be evicted. It implements the BIP125 rules except for
+// inherited signaling and the unconfirmed inputs rule. Must be called with
+// the lock held.
+func (m *mempool) replacement(mt *mempoolTx, conflicts map[chainhash.Hash]struct{}) ([]chainhash.Hash, error) {
+	feeRate, ok := mt.feeRate()
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown fee", ErrTxConflict)
+	}
+
+	var evict []chainhash.Hash
+	seen := make(map[chainhash.Hash]struct{})
+	for txId := range conflicts {
+		c := m.txs[txId]
+		if !signalsReplacement(c.tx) {
+			return nil, fmt.Errorf("%w: %v not replaceable",
+				ErrTxConflict, txId)
+		}
+		cFeeRate, ok := c.feeRate()
+		if !ok {
+			return nil, fmt.Errorf("%w: %v unknown fee", ErrTxConflict,
+				txId)
+		}
+		if feeRate <= cFeeRate {
+			return nil, fmt.Errorf("%w: fee rate %.2f <= %.2f of %v",
+				ErrTxConflict, feeRate, cFeeRate, txId)
+		}
+		for _, d := range m.descendants(txId) {
+			if _, ok := seen[d]; ok {
+				continue
+			}
+			seen[d] = struct{}{}
+			evict = append(evict, d)
+		}
+	}
+	if len(evict) > maxReplacements {
+		return nil, fmt.Errorf("%w: too many replacements %v",
+			ErrTxConflict, len(evict))
+	}
+
+	// The replacement must pay for the evicted txs and its own
+	// bandwidth.
+	var fees int64
+	for _, txId := range evict {
+		e := m.txs[txId]
+		if e.fee < 0 {
+			return nil, fmt.Errorf("%w: %v unknown fee", ErrTxConflict,
+				txId)
+		}
+		fees += e.fee
+	}
+	if mt.fee < fees+minFeeRate*mt.vsize {
+		return nil, fmt.Errorf("%w: fee %v insufficient, need %v",
+			ErrTxConflict, mt.fee, fees+minFeeRate*mt.vsize)
+	}
+
+	return evict, nil
+}
+
+// trim evicts the lowest fee rate txs, and their descendants, until the
+// mempool is below its maximum size. Txs with an unknown fee are evicted
+// first. Some headroom is created to not have to trim on every insert. Must
+// be called with the lock held.
+func (m *mempool) trim() int {
+	if m.maxSize <= 0 || m.size <= m.maxSize {
+		return 0
+	}
+
+	type entry struct {
+		txId    chainhash.Hash
+		feeRate float64
+	}
+	entries := make([]entry, 0, len(m.txs))
+	for txId, mt := range m.txs {
+		if mt.tx == nil {
+			continue
+		}
+		feeRate, ok := mt.feeRate()
+		if !ok {
+			feeRate = -1
+		}
+		entries = append(entries, entry{txId: txId, feeRate: feeRate})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].feeRate < entries[j].feeRate
+	})
+
+	target := m.maxSize - m.maxSize/20
+	evicted := 0
+	for _, e := range entries {
+		if m.size <= target {
+			break
+		}
+		if _, ok := m.txs[e.txId]; !ok {
+			// Already evicted as a descendant.
+			continue
+		}
+		evicted += m.txDeleteWithDescendants(e.txId)
+	}
+	return evicted
 }
 
 func (m *mempool) getDataConstruct(ctx context.Context) (*wire.MsgGetData, error) {
@@ -32,7 +340,7 @@ func (m *mempool) getDataConstruct(ctx context.Context) (*wire.MsgGetData, error
 	defer m.mtx.RUnlock()
 
 	for k, v := range m.txs {
-		if v != nil {
+		if v.tx != nil {
 			continue
 		}
 		if err := getData.AddInvVect(&wire.InvVect{
@@ -46,21 +354,101 @@ func (m *mempool) getDataConstruct(ctx context.Context) (*wire.MsgGetData, error
 	return getData, nil
 }
 
-func (m *mempool) txsInsert(ctx context.Context, msg *wire.MsgTx, raw []byte) error {
+// txsInsert inserts a downloaded tx. A tx that conflicts with mempool txs
+// replaces them when it follows the BIP125 rules, otherwise ErrTxConflict is
+// returned. When the mempool is full the lowest fee rate txs are evicted and
+// ErrMempoolFull is returned if that includes the provided tx.
+func (m *mempool) txsInsert(ctx context.Context, mt *mempoolTx) error {
 	log.Tracef("txsInsert")
 	defer log.Tracef("txsInsert exit")
 
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	if tx := m.txs[msg.TxHash()]; tx == nil {
-		m.txs[msg.TxHash()] = raw
-		m.size += len(raw)
+	txId := mt.tx.TxHash()
+	if tx, ok := m.txs[txId]; ok && tx.tx != nil {
+		return nil
+	}
+
+	conflicts := make(map[chainhash.Hash]struct{})
+	for _, txIn := range mt.tx.TxIn {
+		if c, ok := m.spent[txIn.PreviousOutPoint]; ok {
+			conflicts[c] = struct{}{}
+		}
+	}
+	if len(conflicts) > 0 {
+		evict, err := m.replacement(mt, conflicts)
+		if err != nil {
+			return err
+		}
+		for _, h := range evict {
+			m.txDelete(h)
+		}
+		log.Debugf("mempool tx %v replaced %v txs", txId, len(evict))
+	}
+
+	m.txDelete(txId) // placeholder
+	m.txAdd(txId, mt)
+
+	if evicted := m.trim(); evicted > 0 {
+		log.Debugf("mempool evicted %v txs", evicted)
+		if _, ok := m.txs[txId]; !ok {
+			return ErrMempoolFull
+		}
 	}
 
 	return nil
 }
 
+// txOut returns the output of a mempool tx, it is used to look up inputs that
+// spend unconfirmed outputs.
+func (m *mempool) txOut(op wire.OutPoint) (*wire.TxOut, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	mt := m.txs[op.Hash]
+	if mt == nil || mt.tx == nil || int(op.Index) >= len(mt.tx.TxOut) {
+		return nil, false
+	}
+	return mt.tx.TxOut[op.Index], true
+}
+
+// spentBy returns the mempool tx that spends the outpoint and the index of the
+// spending input. It returns database.ErrNotFound when the outpoint is not
+// spent in the mempool.
+func (m *mempool) spentBy(op wire.OutPoint) (chainhash.Hash, uint32, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	txId, ok := m.spent[op]
+	if !ok {
+		return chainhash.Hash{}, 0, database.ErrNotFound
+	}
+	mt := m.txs[txId]
+	if mt == nil || mt.tx == nil {
+		return chainhash.Hash{}, 0, fmt.Errorf("spending tx not found: %v", txId)
+	}
+	for k, txIn := range mt.tx.TxIn {
+		if txIn.PreviousOutPoint == op {
+			return txId, uint32(k), nil
+		}
+	}
+	return chainhash.Hash{}, 0, fmt.Errorf("spent outpoint %v not in tx %v",
+		op, txId)
+}
+
+// txById returns a downloaded mempool tx.
+func (m *mempool) txById(txId chainhash.Hash) (*wire.MsgTx, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	mt := m.txs[txId]
+	if mt == nil || mt.tx == nil {
+		return nil, false
+	}
+	return mt.tx, true
+}
+
 func (m *mempool) invTxsInsert(ctx context.Context, inv *wire.MsgInv) error {
 	log.Tracef("invTxsInsert")
 	defer log.Tracef("invTxsInsert exit")
@@ -77,7 +465,7 @@ func (m *mempool) invTxsInsert(ctx context.Context, inv *wire.MsgInv) error {
 		switch v.Type {
 		case wire.InvTypeTx:
 			if _, ok := m.txs[v.Hash]; !ok {
-				m.txs[v.Hash] = nil
+				m.txs[v.Hash] = &mempoolTx{added: time.Now()}
 			}
 		}
 	}
@@ -89,30 +477,54 @@ func (m *mempool) invTxsInsert(ctx context.Context, inv *wire.MsgInv) error {
 	return nil
 }
 
-func (m *mempool) txsRemove(ctx context.Context, txs []chainhash.Hash) error {
-	log.Tracef("txsRemove")
-	defer log.Tracef("txsRemove exit")
-
-	if len(txs) == 0 {
-		return errors.New("no transactions provided")
-	}
+// blockRemove removes the txs that were mined in the provided block and the
+// mempool txs, and their descendants, that conflict with them.
+func (m *mempool) blockRemove(ctx context.Context, block *wire.MsgBlock) int {
+	log.Tracef("blockRemove")
+	defer log.Tracef("blockRemove exit")
 
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
 	l := len(m.txs)
-	for k := range txs {
-		if tx, ok := m.txs[txs[k]]; ok {
-			m.size -= len(tx)
-			delete(m.txs, txs[k])
+	for _, tx := range block.Transactions {
+		m.txDelete(tx.TxHash())
+	}
+	for _, tx := range block.Transactions {
+		for _, txIn := range tx.TxIn {
+			if c, ok := m.spent[txIn.PreviousOutPoint]; ok {
+				m.txDeleteWithDescendants(c)
+			}
 		}
 	}
+	return l - len(m.txs)
+}
 
-	// if the map length does not change, nothing was deleted.
-	if len(m.txs) != l {
-		return errors.New("remove txs: nothing removed")
+// expire removes txs, and their descendants, that have been in the mempool
+// for too long. Announced txs that were never downloaded are removed after
+// mempoolInvTimeout.
+func (m *mempool) expire(ctx context.Context, now time.Time) int {
+	log.Tracef("expire")
+	defer log.Tracef("expire exit")
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	l := len(m.txs)
+	for txId, mt := range m.txs {
+		if _, ok := m.txs[txId]; !ok {
+			// Already expired as a descendant.
+			continue
+		}
+		age := now.Sub(mt.added)
+		switch {
+		case mt.tx == nil && age > mempoolInvTimeout:
+			m.txDelete(txId)
+		case mt.tx != nil && m.expiry > 0 && age > m.expiry:
+			m.txDeleteWithDescendants(txId)
+		}
 	}
-	return nil
+	return l - len(m.txs)
 }
 
 func (m *mempool) stats(ctx context.Context) (int, int) {
@@ -123,6 +535,94 @@ func (m *mempool) stats(ctx context.Context) (int, int) {
 	return len(m.txs), m.size + (len(m.txs) * chainhash.HashSize)
 }
 
+// info returns the mempool statistics and fee rate histogram.
+func (m *mempool) info(ctx context.Context) *MempoolInfo {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	mi := &MempoolInfo{
+		Size:      m.size,
+		MaxSize:   m.maxSize,
+		Histogram: make([]FeeRateBucket, 0, len(m.histogram)),
+	}
+	for _, mt := range m.txs {
+		if mt.tx == nil {
+			mi.Pending++
+			continue
+		}
+		mi.Count++
+	}
+	for k, vsize := range m.histogram {
+		mi.Histogram = append(mi.Histogram, FeeRateBucket{
+			SatsPerVByte: feeRateBuckets[k],
+			VSize:        vsize,
+		})
+	}
+	return mi
+}
+
+// txsByFeeRate returns up to count downloaded txs, starting at start, ordered
+// by descending fee rate. Txs with an unknown fee are returned last.
+func (m *mempool) txsByFeeRate(ctx context.Context, start, count int) []MempoolTx {
+	m.mtx.RLock()
+	mts := make([]MempoolTx, 0, len(m.txs))
+	for txId, mt := range m.txs {
+		if mt.tx == nil {
+			continue
+		}
+		mts = append(mts, MempoolTx{
+			TxId:  txId,
+			Size:  mt.size,
+			VSize: mt.vsize,
+			Fee:   mt.fee,
+			Added: mt.added,
+		})
+	}
+	m.mtx.RUnlock()
+
+	sort.Slice(mts, func(i, j int) bool {
+		ri, rj := mts[i].FeeRate(), mts[j].FeeRate()
+		if ri != rj {
+			return ri > rj
+		}
+		return bytes.Compare(mts[i].TxId[:], mts[j].TxId[:]) < 0
+	})
+	if start >= len(mts) {
+		return nil
+	}
+	return mts[start:min(start+count, len(mts))]
+}
+
+// feeEstimate returns the fee rate required to be included within each of the
+// provided number of blocks. The mempool is assumed to be mined in fee rate
+// order thus a tx must outbid the txs that fill the blocks before it.
+func (m *mempool) feeEstimate(ctx context.Context, targets []uint) []FeeEstimate {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	fes := make([]FeeEstimate, 0, len(targets))
+	for _, blocks := range targets {
+		fe := FeeEstimate{Blocks: blocks, SatsPerVByte: minFeeRate}
+		threshold := int64(blocks) * maxBlockVSize
+		var vsize int64
+		for i := len(m.histogram) - 1; i >= 0; i-- {
+			vsize += m.histogram[i]
+			if vsize < threshold {
+				continue
+			}
+			// Bucket i does not fit in the target, outbid it.
+			if i == len(m.histogram)-1 {
+				fe.SatsPerVByte = feeRateBuckets[i]
+			} else {
+				fe.SatsPerVByte = feeRateBuckets[i+1]
+			}
+			break
+		}
+		fes = append(fes, fe)
+	}
+	return fes
+}
+
 func (m *mempool) Dump(ctx context.Context) string {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
@@ -130,8 +630,12 @@ func (m *mempool) Dump(ctx context.Context) string {
 	return spew.Sdump(m.txs)
 }
 
-func mempoolNew() (*mempool, error) {
+func mempoolNew(maxSize int, expiry time.Duration) (*mempool, error) {
 	return &mempool{
-		txs: make(map[chainhash.Hash][]byte, wire.MaxInvPerMsg),
+		txs:       make(map[chainhash.Hash]*mempoolTx, wire.MaxInvPerMsg),
+		spent:     make(map[wire.OutPoint]chainhash.Hash, wire.MaxInvPerMsg),
+		maxSize:   maxSize,
+		expiry:    expiry,
+		histogram: make([]int64, len(feeRateBuckets)),
 	}, nil
 }
@@ -0,0 +1,297 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestFeeRateBucket(t *testing.T) {
+	testTable := []struct {
+		feeRate float64
+		want    float64
+	}{
+		{feeRate: 0, want: 1},
+		{feeRate: 0.5, want: 1},
+		{feeRate: 1, want: 1},
+		{feeRate: 5.5, want: 5},
+		{feeRate: 7, want: 6},
+		{feeRate: 2000, want: 2000},
+		{feeRate: 1e6, want: 2000},
+	}
+	for _, tti := range testTable {
+		got := feeRateBuckets[feeRateBucket(tti.feeRate)]
+		if got != tti.want {
+			t.Errorf("fee rate %v: got %v, want %v", tti.feeRate, got,
+				tti.want)
+		}
+	}
+}
+
+// testMempoolTx returns a mempool tx that spends the provided outpoints.
+func testMempoolTx(lockTime uint32, sequence uint32, vsize, fee int64, ops ...wire.OutPoint) *mempoolTx {
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.LockTime = lockTime
+	for k := range ops {
+		tx.AddTxIn(wire.NewTxIn(&ops[k], nil, nil))
+		tx.TxIn[k].Sequence = sequence
+	}
+	tx.AddTxOut(wire.NewTxOut(1000, nil))
+	mt := newMempoolTx(tx, 100)
+	mt.vsize = vsize
+	mt.fee = fee
+	return mt
+}
+
+func TestFeeEstimate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := mempoolNew(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	estimates := func(want ...float64) {
+		t.Helper()
+		fes := m.feeEstimate(ctx, []uint{1, 2, 3})
+		got := make([]float64, 0, len(fes))
+		for _, fe := range fes {
+			got = append(got, fe.SatsPerVByte)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+	insert := func(lockTime uint32, vsize, fee int64) *wire.MsgTx {
+		t.Helper()
+		mt := testMempoolTx(lockTime, wire.MaxTxInSequenceNum, vsize, fee)
+		if err := m.txsInsert(ctx, mt); err != nil {
+			t.Fatal(err)
+		}
+		return mt.tx
+	}
+
+	// Empty mempool, everything fits.
+	estimates(minFeeRate, minFeeRate, minFeeRate)
+
+	a := insert(1, 600_000, 50*600_000)
+	insert(2, 600_000, 20*600_000)
+	insert(3, 1_200_000, 5*1_200_000)
+	insert(4, 10_000_000, -1) // unknown fee is ignored
+
+	// 1 block is filled in the 20 bucket, 2 blocks in the 5 bucket.
+	estimates(25, 6, minFeeRate)
+
+	// Duplicate inserts are ignored.
+	insert(1, 600_000, 50*600_000)
+	estimates(25, 6, minFeeRate)
+
+	m.blockRemove(ctx, &wire.MsgBlock{Transactions: []*wire.MsgTx{a}})
+	estimates(6, minFeeRate, minFeeRate)
+}
+
+func TestMempoolReplacement(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := mempoolNew(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := wire.OutPoint{Index: 1}
+	final := testMempoolTx(1, wire.MaxTxInSequenceNum, 100, 1000, op)
+	if err := m.txsInsert(ctx, final); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not signaling replacement.
+	err = m.txsInsert(ctx, testMempoolTx(2, wire.MaxTxInSequenceNum, 100,
+		10000, op))
+	if !errors.Is(err, ErrTxConflict) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	m.blockRemove(ctx, &wire.MsgBlock{Transactions: []*wire.MsgTx{final.tx}})
+
+	rbf := testMempoolTx(3, 0, 100, 1000, op)
+	if err := m.txsInsert(ctx, rbf); err != nil {
+		t.Fatal(err)
+	}
+	child := testMempoolTx(4, 0, 100, 1000,
+		wire.OutPoint{Hash: rbf.tx.TxHash(), Index: 0})
+	if err := m.txsInsert(ctx, child); err != nil {
+		t.Fatal(err)
+	}
+
+	testTable := []struct {
+		name string
+		fee  int64
+		err  error
+	}{
+		{name: "lower fee rate", fee: 900, err: ErrTxConflict},
+		{name: "does not pay for descendants", fee: 2000, err: ErrTxConflict},
+		{name: "does not pay for bandwidth", fee: 2099, err: ErrTxConflict},
+		{name: "replaced", fee: 2100},
+	}
+	for k, tti := range testTable {
+		replacement := testMempoolTx(uint32(10+k), 0, 100, tti.fee, op)
+		err := m.txsInsert(ctx, replacement)
+		if !errors.Is(err, tti.err) {
+			t.Fatalf("%v: got %v, want %v", tti.name, err, tti.err)
+		}
+	}
+
+	mi := m.info(ctx)
+	if mi.Count != 1 {
+		t.Fatalf("expected 1 tx, got %v", mi.Count)
+	}
+	for _, txId := range []chainhash.Hash{rbf.tx.TxHash(), child.tx.TxHash()} {
+		if _, ok := m.txs[txId]; ok {
+			t.Fatalf("%v not replaced", txId)
+		}
+	}
+}
+
+func TestMempoolTrim(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Room for 3 txs of 100 bytes.
+	m, err := mempoolNew(350, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	low := testMempoolTx(1, wire.MaxTxInSequenceNum, 100, 100,
+		wire.OutPoint{Index: 1})
+	unknown := testMempoolTx(2, wire.MaxTxInSequenceNum, 100, -1,
+		wire.OutPoint{Index: 2})
+	high := testMempoolTx(3, wire.MaxTxInSequenceNum, 100, 1000,
+		wire.OutPoint{Index: 3})
+	for _, mt := range []*mempoolTx{low, unknown, high} {
+		if err := m.txsInsert(ctx, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Unknown fee is evicted first.
+	mid := testMempoolTx(4, wire.MaxTxInSequenceNum, 100, 500,
+		wire.OutPoint{Index: 4})
+	if err := m.txsInsert(ctx, mid); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.txs[unknown.tx.TxHash()]; ok {
+		t.Fatal("unknown fee tx not evicted")
+	}
+
+	// Lowest fee rate is evicted next, including the new tx.
+	lowest := testMempoolTx(5, wire.MaxTxInSequenceNum, 100, 50,
+		wire.OutPoint{Index: 5})
+	if err := m.txsInsert(ctx, lowest); !errors.Is(err, ErrMempoolFull) {
+		t.Fatalf("expected mempool full, got %v", err)
+	}
+
+	mts := m.txsByFeeRate(ctx, 0, 10)
+	var got []chainhash.Hash
+	for _, mt := range mts {
+		got = append(got, mt.TxId)
+	}
+	want := []chainhash.Hash{high.tx.TxHash(), mid.tx.TxHash(), low.tx.TxHash()}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestMempoolExpire(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := mempoolNew(0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := testMempoolTx(1, wire.MaxTxInSequenceNum, 100, 100,
+		wire.OutPoint{Index: 1})
+	if err := m.txsInsert(ctx, parent); err != nil {
+		t.Fatal(err)
+	}
+	child := testMempoolTx(2, wire.MaxTxInSequenceNum, 100, 100,
+		wire.OutPoint{Hash: parent.tx.TxHash(), Index: 0})
+	child.added = parent.added.Add(time.Hour)
+	if err := m.txsInsert(ctx, child); err != nil {
+		t.Fatal(err)
+	}
+	inv := wire.NewMsgInv()
+	if err := inv.AddInvVect(wire.NewInvVect(wire.InvTypeTx,
+		&chainhash.Hash{0xaa})); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.invTxsInsert(ctx, inv)
+
+	if n := m.expire(ctx, parent.added.Add(mempoolInvTimeout/2)); n != 0 {
+		t.Fatalf("expected no expiry, got %v", n)
+	}
+
+	// The placeholder times out.
+	if n := m.expire(ctx, time.Now().Add(2*mempoolInvTimeout)); n != 1 {
+		t.Fatalf("expected placeholder expiry, got %v", n)
+	}
+
+	// The child expires with its parent.
+	if n := m.expire(ctx, parent.added.Add(2*time.Hour)); n != 2 {
+		t.Fatalf("expected 2 expired txs, got %v", n)
+	}
+	if len(m.txs) != 0 || len(m.spent) != 0 || m.size != 0 {
+		t.Fatalf("mempool not empty: %v txs %v spent %v size",
+			len(m.txs), len(m.spent), m.size)
+	}
+}
+
+func TestMempoolBlockRemove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := mempoolNew(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := wire.OutPoint{Index: 1}
+	conflict := testMempoolTx(1, 0, 100, 100, op)
+	if err := m.txsInsert(ctx, conflict); err != nil {
+		t.Fatal(err)
+	}
+	child := testMempoolTx(2, 0, 100, 100,
+		wire.OutPoint{Hash: conflict.tx.TxHash(), Index: 0})
+	if err := m.txsInsert(ctx, child); err != nil {
+		t.Fatal(err)
+	}
+	other := testMempoolTx(3, 0, 100, 100, wire.OutPoint{Index: 2})
+	if err := m.txsInsert(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+
+	// A block that mines other and a tx that double spends conflict.
+	mined := testMempoolTx(4, 0, 100, 100, op)
+	block := &wire.MsgBlock{
+		Transactions: []*wire.MsgTx{other.tx, mined.tx},
+	}
+	if n := m.blockRemove(ctx, block); n != 3 {
+		t.Fatalf("expected 3 removed txs, got %v", n)
+	}
+	if len(m.txs) != 0 || len(m.spent) != 0 || m.size != 0 {
+		t.Fatalf("mempool not empty: %v txs %v spent %v size",
+			len(m.txs), len(m.spent), m.size)
+	}
+}
@@ -0,0 +1,358 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+// The mempool is saved on shutdown, and periodically, so that it does not have
+// to be rebuilt from peers after a restart. The file is laid out as follows,
+// integers are big endian:
+//
+//	magic   [8]byte  "tbcmpool"
+//	version uint32
+//	network uint32   wire.BitcoinNet
+//	count   uint64   number of records
+//	records count * (added int64 unix time, fee int64, tx wire encoded)
+//	digest  [32]byte sha256 of all preceding bytes
+//
+// Announced txs that were not downloaded are not saved.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mitchellh/go-homedir"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+const (
+	mempoolFileName       = "mempool.dat"
+	mempoolFileVersion    = 1
+	mempoolFileHeaderSize = 8 + 4 + 4 + 8
+	mempoolFileRecordSize = 8 + 8 // excluding tx
+
+	defaultMempoolSaveInterval = 30 * time.Minute
+)
+
+var (
+	mempoolFileMagic = [8]byte{'t', 'b', 'c', 'm', 'p', 'o', 'o', 'l'}
+
+	ErrMempoolFileInvalid = errors.New("invalid mempool file")
+)
+
+// write writes the downloaded mempool txs to w and returns the number of txs
+// written.
+func (m *mempool) write(ctx context.Context, w io.Writer, net wire.BitcoinNet) (int, error) {
+	log.Tracef("write")
+	defer log.Tracef("write exit")
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	var count int
+	for _, mt := range m.txs {
+		if mt.tx != nil {
+			count++
+		}
+	}
+
+	h := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	hdr := make([]byte, mempoolFileHeaderSize)
+	copy(hdr[0:8], mempoolFileMagic[:])
+	binary.BigEndian.PutUint32(hdr[8:12], mempoolFileVersion)
+	binary.BigEndian.PutUint32(hdr[12:16], uint32(net))
+	binary.BigEndian.PutUint64(hdr[16:24], uint64(count))
+	if _, err := bw.Write(hdr); err != nil {
+		return 0, err
+	}
+
+	r := make([]byte, mempoolFileRecordSize)
+	for txId, mt := range m.txs {
+		if mt.tx == nil {
+			continue
+		}
+		binary.BigEndian.PutUint64(r[0:8], uint64(mt.added.Unix()))
+		binary.BigEndian.PutUint64(r[8:16], uint64(mt.fee))
+		if _, err := bw.Write(r); err != nil {
+			return 0, err
+		}
+		if err := mt.tx.Serialize(bw); err != nil {
+			return 0, fmt.Errorf("serialize %v: %w", txId, err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(h.Sum(nil)); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// readMempoolFile reads the txs written by write.
+func readMempoolFile(r io.Reader, net wire.BitcoinNet) ([]*mempoolTx, error) {
+	h := sha256.New()
+	br := bufio.NewReader(r)
+	tr := io.TeeReader(br, h)
+
+	hdr := make([]byte, mempoolFileHeaderSize)
+	if _, err := io.ReadFull(tr, hdr); err != nil {
+		return nil, fmt.Errorf("%w: header: %w", ErrMempoolFileInvalid, err)
+	}
+	if !bytes.Equal(hdr[0:8], mempoolFileMagic[:]) {
+		return nil, fmt.Errorf("%w: magic %x", ErrMempoolFileInvalid, hdr[0:8])
+	}
+	if v := binary.BigEndian.Uint32(hdr[8:12]); v != mempoolFileVersion {
+		return nil, fmt.Errorf("%w: version %v", ErrMempoolFileInvalid, v)
+	}
+	if n := wire.BitcoinNet(binary.BigEndian.Uint32(hdr[12:16])); n != net {
+		return nil, fmt.Errorf("%w: network %v", ErrMempoolFileInvalid, n)
+	}
+	count := binary.BigEndian.Uint64(hdr[16:24])
+
+	mts := make([]*mempoolTx, 0, min(count, wire.MaxInvPerMsg))
+	rec := make([]byte, mempoolFileRecordSize)
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(tr, rec); err != nil {
+			return nil, fmt.Errorf("%w: record %v: %w",
+				ErrMempoolFileInvalid, i, err)
+		}
+		tx := &wire.MsgTx{}
+		if err := tx.Deserialize(tr); err != nil {
+			return nil, fmt.Errorf("%w: tx %v: %w",
+				ErrMempoolFileInvalid, i, err)
+		}
+		mt := newMempoolTx(tx, tx.SerializeSize())
+		mt.added = time.Unix(int64(binary.BigEndian.Uint64(rec[0:8])), 0)
+		mt.fee = int64(binary.BigEndian.Uint64(rec[8:16]))
+		mts = append(mts, mt)
+	}
+
+	digest := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(br, digest); err != nil {
+		return nil, fmt.Errorf("%w: digest: %w", ErrMempoolFileInvalid, err)
+	}
+	if !bytes.Equal(digest, h.Sum(nil)) {
+		return nil, fmt.Errorf("%w: digest mismatch", ErrMempoolFileInvalid)
+	}
+
+	return mts, nil
+}
+
+// confirmedInputs returns the inputs of the downloaded txs that do not spend
+// mempool txs.
+func (m *mempool) confirmedInputs(ctx context.Context) map[chainhash.Hash][]wire.OutPoint {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	inputs := make(map[chainhash.Hash][]wire.OutPoint, len(m.txs))
+	for txId, mt := range m.txs {
+		if mt.tx == nil {
+			continue
+		}
+		for _, txIn := range mt.tx.TxIn {
+			if _, ok := m.txs[txIn.PreviousOutPoint.Hash]; ok {
+				continue
+			}
+			inputs[txId] = append(inputs[txId], txIn.PreviousOutPoint)
+		}
+	}
+	return inputs
+}
+
+// txsRemove removes the provided mined txs and the provided conflicting txs.
+// The descendants of mined txs remain valid, only the descendants of
+// conflicting txs are removed.
+func (m *mempool) txsRemove(ctx context.Context, mined, conflicts []chainhash.Hash) int {
+	log.Tracef("txsRemove")
+	defer log.Tracef("txsRemove exit")
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	l := len(m.txs)
+	for _, txId := range mined {
+		m.txDelete(txId)
+	}
+	for _, txId := range conflicts {
+		m.txDeleteWithDescendants(txId)
+	}
+	return l - len(m.txs)
+}
+
+func (s *Server) mempoolFilename() (string, error) {
+	home, err := homedir.Expand(s.cfg.LevelDBHome)
+	if err != nil {
+		return "", fmt.Errorf("expand home: %w", err)
+	}
+	return filepath.Join(home, s.cfg.Network, mempoolFileName), nil
+}
+
+// mempoolSave writes the mempool to disk.
+func (s *Server) mempoolSave(ctx context.Context) error {
+	log.Tracef("mempoolSave")
+	defer log.Tracef("mempoolSave exit")
+
+	filename, err := s.mempoolFilename()
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := s.mempool.write(ctx, f, s.wireNet)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write %v: %w", tmp, err)
+	}
+	// Make sure the contents are on disk before the rename replaces the
+	// previous file.
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("sync %v: %w", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	log.Debugf("Saved %v mempool txs to %v", n, filename)
+
+	return nil
+}
+
+// mempoolLoad reads the mempool from disk. Expired txs are dropped right away
+// and the remaining txs are revalidated once the indexers have caught up.
+func (s *Server) mempoolLoad(ctx context.Context) error {
+	log.Tracef("mempoolLoad")
+	defer log.Tracef("mempoolLoad exit")
+
+	filename, err := s.mempoolFilename()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	mts, err := readMempoolFile(f, s.wireNet)
+	if err != nil {
+		return fmt.Errorf("read %v: %w", filename, err)
+	}
+	var loaded int
+	for _, mt := range mts {
+		if err := s.mempool.txsInsert(ctx, mt); err != nil {
+			log.Debugf("mempool load %v: %v", mt.tx.TxHash(), err)
+			continue
+		}
+		loaded++
+	}
+	expired := s.mempool.expire(ctx, time.Now())
+
+	s.mtx.Lock()
+	s.mempoolStale = true
+	s.mtx.Unlock()
+
+	log.Infof("Loaded %v mempool txs, %v expired", loaded, expired)
+
+	return nil
+}
+
+// mempoolRevalidate removes the loaded mempool txs that were confirmed in
+// blocks indexed since the mempool was saved, and the txs, and their
+// descendants, that were double spent. It must be called with the indexers at
+// the tip and only does work once after the mempool was loaded.
+func (s *Server) mempoolRevalidate(ctx context.Context) error {
+	log.Tracef("mempoolRevalidate")
+	defer log.Tracef("mempoolRevalidate exit")
+
+	s.mtx.Lock()
+	stale := s.mempoolStale
+	s.mempoolStale = false
+	s.mtx.Unlock()
+	if !stale {
+		return nil
+	}
+
+	var mined, conflicts []chainhash.Hash
+	for txId, ops := range s.mempool.confirmedInputs(ctx) {
+		for _, op := range ops {
+			_, err := s.db.UtxoByOutpoint(ctx,
+				tbcd.NewOutpoint(op.Hash, op.Index))
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, database.ErrNotFound) {
+				return fmt.Errorf("utxo %v: %w", op, err)
+			}
+
+			// The input is spent, either by the tx itself or by a
+			// conflicting tx.
+			_, err = s.db.BlockHashByTxId(ctx, &txId)
+			switch {
+			case err == nil:
+				mined = append(mined, txId)
+			case errors.Is(err, database.ErrNotFound):
+				conflicts = append(conflicts, txId)
+			default:
+				return fmt.Errorf("block hash by tx id %v: %w",
+					txId, err)
+			}
+			break
+		}
+	}
+	removed := s.mempool.txsRemove(ctx, mined, conflicts)
+	log.Infof("Mempool revalidated, removed %v confirmed or conflicting txs",
+		removed)
+
+	return nil
+}
+
+// mempoolPersist periodically saves the mempool and saves it one last time
+// when the context is canceled.
+func (s *Server) mempoolPersist(ctx context.Context) {
+	log.Tracef("mempoolPersist")
+	defer log.Tracef("mempoolPersist exit")
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.mempoolSave(context.Background()); err != nil {
+				log.Errorf("mempool save: %v", err)
+			}
+			return
+		case <-time.After(defaultMempoolSaveInterval):
+		}
+
+		if err := s.mempoolSave(ctx); err != nil {
+			log.Errorf("mempool save: %v", err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestMempoolFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := mempoolNew(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := testMempoolTx(1, wire.MaxTxInSequenceNum, 100, 1000,
+		wire.OutPoint{Index: 1})
+	child := testMempoolTx(2, wire.MaxTxInSequenceNum, 100, -1,
+		wire.OutPoint{Hash: parent.tx.TxHash(), Index: 0})
+	for _, mt := range []*mempoolTx{parent, child} {
+		mt.added = time.Unix(1700000000, 0)
+		if err := m.txsInsert(ctx, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inv := wire.NewMsgInv()
+	if err := inv.AddInvVect(wire.NewInvVect(wire.InvTypeTx,
+		&chainhash.Hash{0xaa})); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.invTxsInsert(ctx, inv)
+
+	var b bytes.Buffer
+	n, err := m.write(ctx, &b, wire.TestNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 txs written, got %v", n)
+	}
+
+	mts, err := readMempoolFile(bytes.NewReader(b.Bytes()), wire.TestNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mts) != 2 {
+		t.Fatalf("expected 2 txs read, got %v", len(mts))
+	}
+	for _, mt := range mts {
+		txId := mt.tx.TxHash()
+		want := m.txs[txId]
+		if want == nil {
+			t.Fatalf("unexpected tx %v", txId)
+		}
+		// Sizes are recomputed, the test txs have made up sizes.
+		if mt.fee != want.fee || mt.size != mt.tx.SerializeSize() ||
+			!mt.added.Equal(want.added) {
+			t.Fatalf("tx %v mismatch: got %+v, want %+v", txId, mt, want)
+		}
+	}
+
+	// Wrong network.
+	_, err = readMempoolFile(bytes.NewReader(b.Bytes()), wire.MainNet)
+	if !errors.Is(err, ErrMempoolFileInvalid) {
+		t.Fatalf("expected invalid network, got %v", err)
+	}
+
+	// Corrupt record.
+	corrupt := bytes.Clone(b.Bytes())
+	corrupt[mempoolFileHeaderSize] ^= 0xff
+	_, err = readMempoolFile(bytes.NewReader(corrupt), wire.TestNet)
+	if !errors.Is(err, ErrMempoolFileInvalid) {
+		t.Fatalf("expected digest mismatch, got %v", err)
+	}
+
+	// Truncated.
+	_, err = readMempoolFile(bytes.NewReader(b.Bytes()[:b.Len()-1]),
+		wire.TestNet)
+	if !errors.Is(err, ErrMempoolFileInvalid) {
+		t.Fatalf("expected truncated file, got %v", err)
+	}
+}
+
+func TestMempoolTxsRemove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := mempoolNew(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := testMempoolTx(1, wire.MaxTxInSequenceNum, 100, 1000,
+		wire.OutPoint{Index: 1})
+	child := testMempoolTx(2, wire.MaxTxInSequenceNum, 100, 1000,
+		wire.OutPoint{Hash: parent.tx.TxHash(), Index: 0},
+		wire.OutPoint{Index: 2})
+	for _, mt := range []*mempoolTx{parent, child} {
+		if err := m.txsInsert(ctx, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Inputs that spend mempool txs are not confirmed inputs.
+	inputs := m.confirmedInputs(ctx)
+	if len(inputs[parent.tx.TxHash()]) != 1 ||
+		len(inputs[child.tx.TxHash()]) != 1 ||
+		inputs[child.tx.TxHash()][0].Index != 2 {
+		t.Fatalf("unexpected confirmed inputs: %v", inputs)
+	}
+
+	// Descendants of mined txs remain.
+	if n := m.txsRemove(ctx, []chainhash.Hash{parent.tx.TxHash()}, nil); n != 1 {
+		t.Fatalf("expected 1 removed tx, got %v", n)
+	}
+	if _, ok := m.txs[child.tx.TxHash()]; !ok {
+		t.Fatal("child of mined tx removed")
+	}
+	if err := m.txsInsert(ctx, parent); err != nil {
+		t.Fatal(err)
+	}
+
+	// Descendants of conflicting txs are removed with their parent.
+	if n := m.txsRemove(ctx, nil, []chainhash.Hash{parent.tx.TxHash()}); n != 2 {
+		t.Fatalf("expected 2 removed txs, got %v", n)
+	}
+	if len(m.txs) != 0 || len(m.spent) != 0 || m.size != 0 {
+		t.Fatalf("mempool not empty: %v txs %v spent %v size",
+			len(m.txs), len(m.spent), m.size)
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/api"
+	"github.com/hemilabs/heminetwork/api/protocol"
+	"github.com/hemilabs/heminetwork/api/tbcapi"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+type notificationId string
+
+const (
+	notifyBlocks notificationId = tbcapi.TopicBlocks
+	notifyReorgs notificationId = tbcapi.TopicReorgs
+
+	maxScriptHashSubscriptions = 1000 // per connection
+	notificationQueueSize      = 1024 // per connection
+)
+
+// subscriptions parses the topics and script hashes of a subscribe or
+// unsubscribe request.
+func subscriptions(topics []string, scriptHashes []api.ByteSlice) ([]notificationId, []tbcd.ScriptHash, error) {
+	ids := make([]notificationId, 0, len(topics))
+	for _, topic := range topics {
+		switch id := notificationId(topic); id {
+		case notifyBlocks, notifyReorgs:
+			ids = append(ids, id)
+		default:
+			return nil, nil, fmt.Errorf("invalid topic: %v", topic)
+		}
+	}
+	shs := make([]tbcd.ScriptHash, 0, len(scriptHashes))
+	for _, b := range scriptHashes {
+		sh, err := tbcd.NewScriptHashFromBytes(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid script hash: %w", err)
+		}
+		shs = append(shs, sh)
+	}
+	return ids, shs, nil
+}
+
+func (s *Server) handleSubscribeRequest(ctx context.Context, ws *tbcWs, req *tbcapi.SubscribeRequest) (any, error) {
+	log.Tracef("handleSubscribeRequest")
+	defer log.Tracef("handleSubscribeRequest exit")
+
+	ids, shs, err := subscriptions(req.Topics, req.ScriptHashes)
+	if err != nil {
+		return &tbcapi.SubscribeResponse{
+			Error: protocol.RequestErrorf("%v", err),
+		}, nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	count := len(ws.scriptHashes)
+	for _, sh := range shs {
+		if _, ok := ws.scriptHashes[sh]; !ok {
+			count++
+		}
+	}
+	if count > maxScriptHashSubscriptions {
+		return &tbcapi.SubscribeResponse{
+			Error: protocol.RequestErrorf("too many script hashes, max %v",
+				maxScriptHashSubscriptions),
+		}, nil
+	}
+
+	for _, id := range ids {
+		ws.notify[id] = struct{}{}
+	}
+	for _, sh := range shs {
+		ws.scriptHashes[sh] = struct{}{}
+	}
+
+	return &tbcapi.SubscribeResponse{}, nil
+}
+
+func (s *Server) handleUnsubscribeRequest(ctx context.Context, ws *tbcWs, req *tbcapi.UnsubscribeRequest) (any, error) {
+	log.Tracef("handleUnsubscribeRequest")
+	defer log.Tracef("handleUnsubscribeRequest exit")
+
+	ids, shs, err := subscriptions(req.Topics, req.ScriptHashes)
+	if err != nil {
+		return &tbcapi.UnsubscribeResponse{
+			Error: protocol.RequestErrorf("%v", err),
+		}, nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, id := range ids {
+		delete(ws.notify, id)
+	}
+	for _, sh := range shs {
+		delete(ws.scriptHashes, sh)
+	}
+
+	return &tbcapi.UnsubscribeResponse{}, nil
+}
+
+// handleWebsocketNotifications writes the queued notifications of a
+// connection in order.
+func (s *Server) handleWebsocketNotifications(ctx context.Context, ws *tbcWs) {
+	log.Tracef("handleWebsocketNotifications: %v", ws.addr)
+	defer log.Tracef("handleWebsocketNotifications exit: %v", ws.addr)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-ws.notifications:
+			if err := tbcapi.Write(ctx, ws.conn, "", n); err != nil {
+				log.Debugf("write notification %v: %v", ws.addr, err)
+				return
+			}
+		}
+	}
+}
+
+// queueNotifications queues notifications for a connection. Notifications
+// are dropped when the connection does not keep up. Must be called with the
+// server mutex held.
+func queueNotifications(ws *tbcWs, notifications ...any) {
+	for _, n := range notifications {
+		select {
+		case ws.notifications <- n:
+		default:
+			log.Errorf("notification queue full, dropping %T for %v",
+				n, ws.addr)
+			return
+		}
+	}
+}
+
+// notifying returns true if any connection is subscribed to the topic.
+func (s *Server) notifying(id notificationId) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, ws := range s.sessions {
+		if _, ok := ws.notify[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// forkPoint returns the most recent block header that is part of both chains.
+func (s *Server) forkPoint(ctx context.Context, x, y *tbcd.BlockHeader) (*tbcd.BlockHeader, error) {
+	var err error
+	for !x.Hash.IsEqual(&y.Hash) {
+		if x.Height >= y.Height {
+			x, err = s.db.BlockHeaderByHash(ctx, x.ParentHash())
+		} else {
+			y, err = s.db.BlockHeaderByHash(ctx, y.ParentHash())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// notifyIndexedTip notifies the tip the indexers were synced to, if it changed,
+// so that the indexes are up to date by the time clients are notified.
+func (s *Server) notifyIndexedTip(ctx context.Context, tip *tbcd.BlockHeader) {
+	s.mtx.Lock()
+	oldTip := s.notifiedTip
+	s.notifiedTip = tip
+	s.mtx.Unlock()
+
+	if oldTip != nil && oldTip.Hash.IsEqual(&tip.Hash) {
+		return
+	}
+	s.notifyTip(ctx, oldTip, tip)
+}
+
+// notifyTip sends a block notification for the new tip and, when the tip
+// moved from oldTip to a fork, a reorg notification first. oldTip is nil when
+// there is no previous tip.
+func (s *Server) notifyTip(ctx context.Context, oldTip, newTip *tbcd.BlockHeader) {
+	log.Tracef("notifyTip")
+	defer log.Tracef("notifyTip exit")
+
+	var rn *tbcapi.ReorgNotification
+	if oldTip != nil && s.notifying(notifyReorgs) {
+		fork, err := s.forkPoint(ctx, oldTip, newTip)
+		if err != nil {
+			log.Errorf("notify reorg %v: %v", newTip, err)
+		} else if !fork.Hash.IsEqual(&oldTip.Hash) {
+			rn = &tbcapi.ReorgNotification{
+				OldTip:    tbcapi.HashHeight{Hash: oldTip.Hash, Height: oldTip.Height},
+				NewTip:    tbcapi.HashHeight{Hash: newTip.Hash, Height: newTip.Height},
+				ForkPoint: tbcapi.HashHeight{Hash: fork.Hash, Height: fork.Height},
+			}
+		}
+	}
+
+	bh, err := newTip.Wire()
+	if err != nil {
+		log.Errorf("notify block %v: %v", newTip, err)
+		return
+	}
+	bn := &tbcapi.BlockNotification{
+		Hash:        newTip.Hash,
+		Height:      newTip.Height,
+		BlockHeader: wireBlockHeaderToTBC(bh),
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, ws := range s.sessions {
+		if _, ok := ws.notify[notifyReorgs]; ok && rn != nil {
+			queueNotifications(ws, rn)
+		}
+		if _, ok := ws.notify[notifyBlocks]; ok {
+			queueNotifications(ws, bn)
+		}
+	}
+}
+
+// scriptHashesSubscribed returns true if any connection is subscribed to a
+// script hash.
+func (s *Server) scriptHashesSubscribed() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, ws := range s.sessions {
+		if len(ws.scriptHashes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribedHistory returns the history entries of subscribed script hashes.
+func (s *Server) subscribedHistory(history map[tbcd.HistoryKey]struct{}) []tbcd.HistoryKey {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	shs := make(map[tbcd.ScriptHash]struct{})
+	for _, ws := range s.sessions {
+		for sh := range ws.scriptHashes {
+			shs[sh] = struct{}{}
+		}
+	}
+	if len(shs) == 0 {
+		return nil
+	}
+
+	var hks []tbcd.HistoryKey
+	for hk := range history {
+		if _, ok := shs[hk.ScriptHash()]; ok {
+			hks = append(hks, hk)
+		}
+	}
+	return hks
+}
+
+// notifyScriptHashes sends a script hash notification for every history entry
+// to the connections subscribed to its script hash. unwound is set when the
+// history entries were removed from the index.
+func (s *Server) notifyScriptHashes(hks []tbcd.HistoryKey, mempool, unwound bool) {
+	log.Tracef("notifyScriptHashes")
+	defer log.Tracef("notifyScriptHashes exit")
+
+	if len(hks) == 0 {
+		return
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, ws := range s.sessions {
+		if len(ws.scriptHashes) == 0 {
+			continue
+		}
+		var notifications []any
+		for _, hk := range hks {
+			sh := hk.ScriptHash()
+			if _, ok := ws.scriptHashes[sh]; !ok {
+				continue
+			}
+			notifications = append(notifications,
+				&tbcapi.ScriptHashNotification{
+					ScriptHash: sh[:],
+					TxId:       hk.TxId(),
+					Height:     hk.Height(),
+					Mempool:    mempool,
+					Unwound:    unwound,
+				})
+		}
+		queueNotifications(ws, notifications...)
+	}
+}
+
+// mempoolHistory returns the script hashes touched by a mempool tx as history
+// entries at height 0. Inputs are looked up in the mempool and the utxo index
+// and skipped when not found.
+func (s *Server) mempoolHistory(ctx context.Context, tx *wire.MsgTx) map[tbcd.HistoryKey]struct{} {
+	txId := tx.TxHash()
+	history := make(map[tbcd.HistoryKey]struct{}, len(tx.TxIn)+len(tx.TxOut))
+	add := func(pkScript []byte) {
+		sh := tbcd.NewScriptHashFromScript(pkScript)
+		history[tbcd.NewHistoryKey(sh, 0, &txId)] = struct{}{}
+	}
+	for _, txOut := range tx.TxOut {
+		if txscript.IsUnspendable(txOut.PkScript) {
+			continue
+		}
+		add(txOut.PkScript)
+	}
+	for _, txIn := range tx.TxIn {
+		prev := txIn.PreviousOutPoint
+		if txOut, ok := s.mempool.txOut(prev); ok {
+			add(txOut.PkScript)
+			continue
+		}
+		co, err := s.db.UtxoByOutpoint(ctx,
+			tbcd.NewOutpoint(prev.Hash, prev.Index))
+		if err != nil {
+			continue
+		}
+		sh := co.ScriptHash()
+		history[tbcd.NewHistoryKey(sh, 0, &txId)] = struct{}{}
+	}
+	return history
+}
+
+// notifyMempoolTx notifies the connections subscribed to the script hashes the
+// tx touches.
+func (s *Server) notifyMempoolTx(ctx context.Context, tx *wire.MsgTx) {
+	if !s.scriptHashesSubscribed() {
+		return
+	}
+	s.notifyScriptHashes(s.subscribedHistory(s.mempoolHistory(ctx, tx)),
+		true, false)
+}
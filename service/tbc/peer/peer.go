@@ -18,6 +18,7 @@ import (
 	"github.com/btcsuite/btcd/wire"
 	"github.com/juju/loggo"
 
+	"github.com/hemilabs/heminetwork/bitcoin"
 	"github.com/hemilabs/heminetwork/service/tbc/peer/rawpeer"
 )
 
@@ -782,6 +783,10 @@ func New(network wire.BitcoinNet, id int, address string) (*Peer, error) {
 		cp.chainParams = &chaincfg.MainNetParams
 	case wire.TestNet3:
 		cp.chainParams = &chaincfg.TestNet3Params
+	case bitcoin.TestNet4:
+		cp.chainParams = &bitcoin.TestNet4Params
+	case chaincfg.SigNetParams.Net:
+		cp.chainParams = &chaincfg.SigNetParams
 	case wire.TestNet:
 		cp.chainParams = &chaincfg.RegressionNetParams
 	default:
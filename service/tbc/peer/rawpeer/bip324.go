@@ -0,0 +1,675 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package rawpeer
+
+// BIP324 version 2 encrypted p2p transport, see
+// https://github.com/bitcoin/bips/blob/master/bip-0324.mediawiki
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// SFNodeP2PV2 is the service flag advertised by nodes that accept the
+	// BIP324 transport.
+	SFNodeP2PV2 wire.ServiceFlag = 1 << 11
+
+	v2EllSwiftLen          = 64
+	v2GarbageTerminatorLen = 16
+	v2MaxGarbageLen        = 4095
+	v2LengthLen            = 3
+	v2HeaderLen            = 1
+	v2TagLen               = chacha20poly1305.Overhead
+	v2RekeyInterval        = 224
+	v2IgnoreBit            = 0x80
+	v2CommandLen           = wire.CommandSize
+
+	// v2MaxContentsLen is the largest packet we accept, the largest
+	// message with a long command encoding.
+	v2MaxContentsLen = 1 + v2CommandLen + wire.MaxMessagePayload
+)
+
+// ErrV2Rejected is returned when the remote does not answer the v2 key
+// exchange, which is what v1 only nodes do.
+var ErrV2Rejected = errors.New("v2 transport rejected")
+
+// v2ShortIDs maps the BIP324 one byte message type ids to commands.
+var v2ShortIDs = [...]string{
+	1:  wire.CmdAddr,
+	2:  wire.CmdBlock,
+	3:  "blocktxn",
+	4:  "cmpctblock",
+	5:  wire.CmdFeeFilter,
+	6:  wire.CmdFilterAdd,
+	7:  wire.CmdFilterClear,
+	8:  wire.CmdFilterLoad,
+	9:  wire.CmdGetBlocks,
+	10: "getblocktxn",
+	11: wire.CmdGetData,
+	12: wire.CmdGetHeaders,
+	13: wire.CmdHeaders,
+	14: wire.CmdInv,
+	15: wire.CmdMemPool,
+	16: wire.CmdMerkleBlock,
+	17: wire.CmdNotFound,
+	18: wire.CmdPing,
+	19: wire.CmdPong,
+	20: "sendcmpct",
+	21: wire.CmdTx,
+	22: wire.CmdGetCFilters,
+	23: wire.CmdCFilter,
+	24: wire.CmdGetCFHeaders,
+	25: wire.CmdCFHeaders,
+	26: wire.CmdGetCFCheckpt,
+	27: wire.CmdCFCheckpt,
+	28: wire.CmdAddrV2,
+}
+
+var v2ShortIDsByCommand = func() map[string]byte {
+	m := make(map[string]byte, len(v2ShortIDs))
+	for id, cmd := range v2ShortIDs {
+		if cmd != "" {
+			m[cmd] = byte(id)
+		}
+	}
+	return m
+}()
+
+// v1Prefix returns the first bytes a v1 peer sends, the header of a version
+// message up to the payload length. It is used by responders to tell v1 and
+// v2 initiators apart.
+func v1Prefix(btcnet wire.BitcoinNet) []byte {
+	prefix := binary.LittleEndian.AppendUint32(nil, uint32(btcnet))
+	var cmd [v2CommandLen]byte
+	copy(cmd[:], wire.CmdVersion)
+	return append(prefix, cmd[:]...)
+}
+
+// secp256k1 field arithmetic for ElligatorSwift. Only public data is encoded
+// and decoded so there is no need for constant time operations.
+var (
+	fieldP        = btcec.S256().P
+	fieldSqrtExp  = new(big.Int).Rsh(new(big.Int).Add(fieldP, big.NewInt(1)), 2)
+	fieldMinus3Sq = fieldSqrt(fieldMod(big.NewInt(-3)))
+	fieldSeven    = big.NewInt(7)
+)
+
+func fieldMod(a *big.Int) *big.Int {
+	return a.Mod(a, fieldP)
+}
+
+func fieldAdd(a, b *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Add(a, b))
+}
+
+func fieldSub(a, b *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Sub(a, b))
+}
+
+func fieldMul(a, b *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Mul(a, b))
+}
+
+func fieldDiv(a, b *big.Int) *big.Int {
+	return fieldMul(a, new(big.Int).ModInverse(b, fieldP))
+}
+
+func fieldNeg(a *big.Int) *big.Int {
+	return fieldMod(new(big.Int).Neg(a))
+}
+
+// fieldSqrt returns the square root of a or nil if a is not a square.
+func fieldSqrt(a *big.Int) *big.Int {
+	r := new(big.Int).Exp(a, fieldSqrtExp, fieldP)
+	if fieldMul(r, r).Cmp(a) != 0 {
+		return nil
+	}
+	return r
+}
+
+// fieldCurve returns x^3 + 7.
+func fieldCurve(x *big.Int) *big.Int {
+	return fieldAdd(fieldMul(fieldMul(x, x), x), fieldSeven)
+}
+
+func fieldValidX(x *big.Int) bool {
+	return fieldSqrt(fieldCurve(x)) != nil
+}
+
+// xSwiftEC decodes the field elements (u, t) to an x coordinate on the curve.
+func xSwiftEC(u, t *big.Int) *big.Int {
+	u, t = fieldMod(new(big.Int).Set(u)), fieldMod(new(big.Int).Set(t))
+	if u.Sign() == 0 {
+		u.SetInt64(1)
+	}
+	if t.Sign() == 0 {
+		t.SetInt64(1)
+	}
+	t2 := fieldMul(t, t)
+	u3p7 := fieldCurve(u)
+	if fieldAdd(u3p7, t2).Sign() == 0 {
+		t = fieldAdd(t, t)
+		t2 = fieldMul(t, t)
+	}
+	x := fieldDiv(fieldSub(u3p7, t2), fieldAdd(t, t))
+	y := fieldDiv(fieldAdd(x, t), fieldMul(fieldMinus3Sq, u))
+
+	// x1 = u + 4y^2
+	x1 := fieldAdd(u, fieldMul(big.NewInt(4), fieldMul(y, y)))
+	if fieldValidX(x1) {
+		return x1
+	}
+	xy := fieldDiv(x, y)
+	two := big.NewInt(2)
+	// x2 = (-x/y - u) / 2
+	x2 := fieldDiv(fieldSub(fieldNeg(xy), u), two)
+	if fieldValidX(x2) {
+		return x2
+	}
+	// x3 = (x/y - u) / 2
+	return fieldDiv(fieldSub(xy, u), two)
+}
+
+// xSwiftECInv returns t such that xSwiftEC(u, t) = x or nil when there is
+// none. The case selects which of the up to eight preimages is returned.
+func xSwiftECInv(x, u *big.Int, c int) *big.Int {
+	var v, s *big.Int
+	if c&2 == 0 {
+		if fieldValidX(fieldSub(fieldNeg(x), u)) {
+			return nil
+		}
+		v = x
+		// s = -(u^3 + 7) / (u^2 + uv + v^2)
+		d := fieldAdd(fieldAdd(fieldMul(u, u), fieldMul(u, v)), fieldMul(v, v))
+		if d.Sign() == 0 {
+			return nil
+		}
+		s = fieldDiv(fieldNeg(fieldCurve(u)), d)
+	} else {
+		s = fieldSub(x, u)
+		if s.Sign() == 0 {
+			return nil
+		}
+		// r = sqrt(-s(4(u^3 + 7) + 3su^2))
+		uu := fieldMul(u, u)
+		r := fieldSqrt(fieldNeg(fieldMul(s, fieldAdd(
+			fieldMul(big.NewInt(4), fieldCurve(u)),
+			fieldMul(big.NewInt(3), fieldMul(s, uu))))))
+		if r == nil {
+			return nil
+		}
+		if c&1 != 0 && r.Sign() == 0 {
+			return nil
+		}
+		// v = (-u + r/s) / 2
+		v = fieldDiv(fieldAdd(fieldNeg(u), fieldDiv(r, s)), big.NewInt(2))
+	}
+	w := fieldSqrt(s)
+	if w == nil {
+		return nil
+	}
+	two := big.NewInt(2)
+	one := big.NewInt(1)
+	switch c & 5 {
+	case 0:
+		return fieldNeg(fieldMul(w, fieldAdd(fieldDiv(fieldMul(u,
+			fieldSub(one, fieldMinus3Sq)), two), v)))
+	case 1:
+		return fieldMul(w, fieldAdd(fieldDiv(fieldMul(u,
+			fieldAdd(one, fieldMinus3Sq)), two), v))
+	case 4:
+		return fieldMul(w, fieldAdd(fieldDiv(fieldMul(u,
+			fieldSub(one, fieldMinus3Sq)), two), v))
+	default: // 5
+		return fieldNeg(fieldMul(w, fieldAdd(fieldDiv(fieldMul(u,
+			fieldAdd(one, fieldMinus3Sq)), two), v)))
+	}
+}
+
+// ellSwiftEncode returns a uniformly random 64 byte encoding of the x
+// coordinate x.
+func ellSwiftEncode(x *big.Int) ([v2EllSwiftLen]byte, error) {
+	var (
+		encoding [v2EllSwiftLen]byte
+		rnd      [33]byte
+	)
+	for {
+		if _, err := rand.Read(rnd[:]); err != nil {
+			return encoding, err
+		}
+		u := fieldMod(new(big.Int).SetBytes(rnd[:32]))
+		if u.Sign() == 0 {
+			continue
+		}
+		t := xSwiftECInv(x, u, int(rnd[32]&7))
+		if t == nil {
+			continue
+		}
+		// Paranoia, the encoding must decode to our key.
+		if xSwiftEC(u, t).Cmp(x) != 0 {
+			continue
+		}
+		u.FillBytes(encoding[:32])
+		t.FillBytes(encoding[32:])
+		return encoding, nil
+	}
+}
+
+// ellSwiftDecode returns the x coordinate an encoding decodes to.
+func ellSwiftDecode(encoding []byte) *big.Int {
+	u := new(big.Int).SetBytes(encoding[:32])
+	t := new(big.Int).SetBytes(encoding[32:v2EllSwiftLen])
+	return xSwiftEC(u, t)
+}
+
+// ellSwiftCreate returns a new private key and the ElligatorSwift encoding
+// of its public key.
+func ellSwiftCreate() (*btcec.PrivateKey, [v2EllSwiftLen]byte, error) {
+	priv, err := btcec.NewPrivateKey()
+	if err != nil {
+		return nil, [v2EllSwiftLen]byte{}, err
+	}
+	x := new(big.Int).SetBytes(priv.PubKey().SerializeCompressed()[1:])
+	encoding, err := ellSwiftEncode(x)
+	if err != nil {
+		return nil, [v2EllSwiftLen]byte{}, err
+	}
+	return priv, encoding, nil
+}
+
+// ellSwiftECDH returns the BIP324 shared secret. The initiator encoding
+// always goes first.
+func ellSwiftECDH(priv *btcec.PrivateKey, theirs, ours []byte, initiator bool) ([]byte, error) {
+	var x [33]byte
+	x[0] = 0x02 // either point works, only the x coordinate is used
+	ellSwiftDecode(theirs).FillBytes(x[1:])
+	pub, err := btcec.ParsePubKey(x[:])
+	if err != nil {
+		return nil, fmt.Errorf("remote key: %w", err)
+	}
+	secret := btcec.GenerateSharedSecret(priv, pub)
+	a, b := ours, theirs
+	if !initiator {
+		a, b = theirs, ours
+	}
+	h := chainhash.TaggedHash([]byte("bip324_ellswift_xonly_ecdh"),
+		a, b, secret)
+	return h[:], nil
+}
+
+// fsChaCha20 is the forward secure ChaCha20 stream cipher that encrypts
+// packet lengths.
+type fsChaCha20 struct {
+	c      *chacha20.Cipher
+	chunk  uint64
+	rekeys uint64
+}
+
+func v2Nonce(a uint32, b uint64) []byte {
+	nonce := binary.LittleEndian.AppendUint32(nil, a)
+	return binary.LittleEndian.AppendUint64(nonce, b)
+}
+
+func newFSChaCha20(key []byte) (*fsChaCha20, error) {
+	c, err := chacha20.NewUnauthenticatedCipher(key, v2Nonce(0, 0))
+	if err != nil {
+		return nil, err
+	}
+	return &fsChaCha20{c: c}, nil
+}
+
+func (f *fsChaCha20) crypt(chunk []byte) error {
+	f.c.XORKeyStream(chunk, chunk)
+	f.chunk++
+	if f.chunk%v2RekeyInterval != 0 {
+		return nil
+	}
+	key := make([]byte, chacha20.KeySize)
+	f.c.XORKeyStream(key, key)
+	f.rekeys++
+	c, err := chacha20.NewUnauthenticatedCipher(key, v2Nonce(0, f.rekeys))
+	if err != nil {
+		return err
+	}
+	f.c = c
+	return nil
+}
+
+// fsChaCha20Poly1305 is the forward secure AEAD that encrypts packet
+// contents.
+type fsChaCha20Poly1305 struct {
+	key    []byte
+	packet uint64
+}
+
+func (f *fsChaCha20Poly1305) nonce() []byte {
+	return v2Nonce(uint32(f.packet%v2RekeyInterval),
+		f.packet/v2RekeyInterval)
+}
+
+func (f *fsChaCha20Poly1305) next() error {
+	if (f.packet+1)%v2RekeyInterval == 0 {
+		aead, err := chacha20poly1305.New(f.key)
+		if err != nil {
+			return err
+		}
+		nonce := v2Nonce(0xffffffff, f.packet/v2RekeyInterval)
+		f.key = aead.Seal(nil, nonce, make([]byte, chacha20.KeySize),
+			nil)[:chacha20.KeySize]
+	}
+	f.packet++
+	return nil
+}
+
+func (f *fsChaCha20Poly1305) seal(dst, plaintext, aad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(f.key)
+	if err != nil {
+		return nil, err
+	}
+	dst = aead.Seal(dst, f.nonce(), plaintext, aad)
+	return dst, f.next()
+}
+
+func (f *fsChaCha20Poly1305) open(ciphertext, aad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(f.key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(ciphertext[:0], f.nonce(), ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	return plaintext, f.next()
+}
+
+// v2Transport reads and writes messages on an established BIP324 session.
+type v2Transport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	btcnet wire.BitcoinNet
+
+	rmtx  sync.Mutex
+	recvL *fsChaCha20
+	recvP *fsChaCha20Poly1305
+
+	wmtx  sync.Mutex
+	sendL *fsChaCha20
+	sendP *fsChaCha20Poly1305
+}
+
+// v2Handshake performs the BIP324 key exchange on conn. An initiator sends
+// its key first. A responder has already read the first bytes of the remote
+// key, which are provided in prefix, to rule out a v1 initiator.
+func v2Handshake(conn net.Conn, btcnet wire.BitcoinNet, initiator bool, prefix []byte) (*v2Transport, error) {
+	priv, ours, err := ellSwiftCreate()
+	if err != nil {
+		return nil, err
+	}
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	garbage := make([]byte, int(binary.LittleEndian.Uint16(n[:]))%(v2MaxGarbageLen+1))
+	if _, err := rand.Read(garbage); err != nil {
+		return nil, err
+	}
+
+	t := &v2Transport{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		btcnet: btcnet,
+	}
+
+	// Exchange keys.
+	theirs := make([]byte, v2EllSwiftLen)
+	if initiator {
+		if _, err := conn.Write(append(ours[:], garbage...)); err != nil {
+			return nil, fmt.Errorf("write key: %w", err)
+		}
+		if _, err := io.ReadFull(t.reader, theirs); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrV2Rejected, err)
+		}
+	} else {
+		copy(theirs, prefix)
+		if _, err := io.ReadFull(t.reader, theirs[len(prefix):]); err != nil {
+			return nil, fmt.Errorf("read key: %w", err)
+		}
+	}
+	secret, err := ellSwiftECDH(priv, theirs, ours[:], initiator)
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive session keys, the network magic is included so that peers on
+	// different networks fail the handshake.
+	salt := append([]byte("bitcoin_v2_shared_secret"),
+		binary.LittleEndian.AppendUint32(nil, uint32(btcnet))...)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+	expand := func(info string, n int) ([]byte, error) {
+		key := make([]byte, n)
+		_, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(info)), key)
+		return key, err
+	}
+	keys := make(map[string][]byte, 5)
+	for _, info := range []string{
+		"initiator_L", "initiator_P", "responder_L", "responder_P",
+		"garbage_terminators",
+	} {
+		keys[info], err = expand(info, 32)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sendDir, recvDir := "initiator_", "responder_"
+	sendTerm := keys["garbage_terminators"][:v2GarbageTerminatorLen]
+	recvTerm := keys["garbage_terminators"][v2GarbageTerminatorLen:]
+	if !initiator {
+		sendDir, recvDir = recvDir, sendDir
+		sendTerm, recvTerm = recvTerm, sendTerm
+	}
+	if t.sendL, err = newFSChaCha20(keys[sendDir+"L"]); err != nil {
+		return nil, err
+	}
+	if t.recvL, err = newFSChaCha20(keys[recvDir+"L"]); err != nil {
+		return nil, err
+	}
+	t.sendP = &fsChaCha20Poly1305{key: keys[sendDir+"P"]}
+	t.recvP = &fsChaCha20Poly1305{key: keys[recvDir+"P"]}
+
+	// Send garbage terminator and our version packet, which authenticates
+	// the garbage we sent.
+	var out []byte
+	if !initiator {
+		out = append(ours[:], garbage...)
+	}
+	out = append(out, sendTerm...)
+	out, err = t.packet(out, nil, garbage, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(out); err != nil {
+		return nil, fmt.Errorf("write version: %w", err)
+	}
+
+	// Skip remote garbage up to its terminator.
+	var theirGarbage []byte
+	for {
+		b, err := t.reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("read garbage: %w", err)
+		}
+		theirGarbage = append(theirGarbage, b)
+		if bytes.HasSuffix(theirGarbage, recvTerm) {
+			theirGarbage = theirGarbage[:len(theirGarbage)-len(recvTerm)]
+			break
+		}
+		if len(theirGarbage) > v2MaxGarbageLen+v2GarbageTerminatorLen {
+			return nil, errors.New("garbage terminator not found")
+		}
+	}
+
+	// The first packet authenticates the remote garbage. The version
+	// packet contents are reserved for future extensions and ignored.
+	aad := theirGarbage
+	for {
+		_, ignore, err := t.readPacket(aad)
+		if err != nil {
+			return nil, fmt.Errorf("read version: %w", err)
+		}
+		aad = nil
+		if !ignore {
+			break
+		}
+	}
+
+	return t, nil
+}
+
+// packet appends an encrypted packet with the provided contents to dst.
+func (t *v2Transport) packet(dst, contents, aad []byte, ignore bool) ([]byte, error) {
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(contents)))
+	if err := t.sendL.crypt(length[:v2LengthLen]); err != nil {
+		return nil, err
+	}
+	dst = append(dst, length[:v2LengthLen]...)
+
+	plaintext := make([]byte, v2HeaderLen, v2HeaderLen+len(contents))
+	if ignore {
+		plaintext[0] = v2IgnoreBit
+	}
+	plaintext = append(plaintext, contents...)
+	return t.sendP.seal(dst, plaintext, aad)
+}
+
+// readPacket reads and decrypts a packet and returns its contents and
+// whether the remote asked for it to be ignored.
+func (t *v2Transport) readPacket(aad []byte) ([]byte, bool, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(t.reader, length[:v2LengthLen]); err != nil {
+		return nil, false, err
+	}
+	if err := t.recvL.crypt(length[:v2LengthLen]); err != nil {
+		return nil, false, err
+	}
+	n := binary.LittleEndian.Uint32(length[:])
+	if n > v2MaxContentsLen {
+		return nil, false, fmt.Errorf("packet too large: %v", n)
+	}
+	ciphertext := make([]byte, v2HeaderLen+int(n)+v2TagLen)
+	if _, err := io.ReadFull(t.reader, ciphertext); err != nil {
+		return nil, false, err
+	}
+	plaintext, err := t.recvP.open(ciphertext, aad)
+	if err != nil {
+		return nil, false, fmt.Errorf("decrypt packet: %w", err)
+	}
+	return plaintext[v2HeaderLen:], plaintext[0]&v2IgnoreBit != 0, nil
+}
+
+// writeMessage encodes msg into a single packet.
+func (t *v2Transport) writeMessage(msg wire.Message, pver uint32, enc wire.MessageEncoding) error {
+	var payload bytes.Buffer
+	if err := msg.BtcEncode(&payload, pver, enc); err != nil {
+		return err
+	}
+	if payload.Len() > wire.MaxMessagePayload {
+		return fmt.Errorf("message payload too large: %v", payload.Len())
+	}
+
+	cmd := msg.Command()
+	var contents []byte
+	if id, ok := v2ShortIDsByCommand[cmd]; ok {
+		contents = make([]byte, 1, 1+payload.Len())
+		contents[0] = id
+	} else {
+		if len(cmd) > v2CommandLen {
+			return fmt.Errorf("command too long: %v", cmd)
+		}
+		contents = make([]byte, 1+v2CommandLen, 1+v2CommandLen+payload.Len())
+		copy(contents[1:], cmd)
+	}
+	contents = append(contents, payload.Bytes()...)
+
+	t.wmtx.Lock()
+	defer t.wmtx.Unlock()
+	packet, err := t.packet(nil, contents, nil, false)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.Write(packet)
+	return err
+}
+
+// readMessage reads the next message, decoy packets are skipped. The payload
+// is decoded by wire so that a v1 frame is reconstructed around it.
+func (t *v2Transport) readMessage(pver uint32, enc wire.MessageEncoding) (wire.Message, []byte, error) {
+	t.rmtx.Lock()
+	defer t.rmtx.Unlock()
+
+	var contents []byte
+	for {
+		c, ignore, err := t.readPacket(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ignore {
+			contents = c
+			break
+		}
+	}
+	if len(contents) == 0 {
+		return nil, nil, errors.New("empty packet")
+	}
+
+	var (
+		cmd     string
+		payload []byte
+	)
+	if id := contents[0]; id != 0 {
+		if int(id) >= len(v2ShortIDs) || v2ShortIDs[id] == "" {
+			return nil, nil, fmt.Errorf("short id %v: %w", id,
+				wire.ErrUnknownMessage)
+		}
+		cmd = v2ShortIDs[id]
+		payload = contents[1:]
+	} else {
+		if len(contents) < 1+v2CommandLen {
+			return nil, nil, errors.New("short packet")
+		}
+		cmd = strings.TrimRight(string(contents[1:1+v2CommandLen]), "\x00")
+		payload = contents[1+v2CommandLen:]
+	}
+
+	frame := make([]byte, 0, wire.MessageHeaderSize+len(payload))
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(t.btcnet))
+	var command [v2CommandLen]byte
+	copy(command[:], cmd)
+	frame = append(frame, command[:]...)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, chainhash.DoubleHashB(payload)[:4]...)
+	frame = append(frame, payload...)
+	_, msg, buf, err := wire.ReadMessageWithEncodingN(bytes.NewReader(frame),
+		pver, t.btcnet, enc)
+	return msg, buf, err
+}
@@ -9,9 +9,11 @@
 package rawpeer
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand/v2"
 	"net"
 	"sync"
@@ -25,6 +27,9 @@ import (
 
 const (
 	logLevel = "INFO"
+
+	defaultDialTimeout        = 5 * time.Second
+	defaultV2HandshakeTimeout = 5 * time.Second
 )
 
 var (
@@ -43,24 +48,41 @@ func init() {
 
 // XXX wire could use some contexts.
 
-func writeTimeout(timeout time.Duration, conn net.Conn, msg wire.Message, pver uint32, btcnet wire.BitcoinNet) error {
+func (r *RawPeer) writeTimeout(timeout time.Duration, conn net.Conn, msg wire.Message) error {
 	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
 		return err
 	}
-	_, err := wire.WriteMessageWithEncodingN(conn, msg, pver, btcnet,
-		wire.LatestEncoding)
+	if r.v2 != nil {
+		return r.v2.writeMessage(msg, r.protocolVersion, wire.LatestEncoding)
+	}
+	_, err := wire.WriteMessageWithEncodingN(conn, msg, r.protocolVersion,
+		r.network, wire.LatestEncoding)
 	return err
 }
 
-func readTimeout(timeout time.Duration, conn net.Conn, pver uint32, btcnet wire.BitcoinNet) (wire.Message, error) {
+func (r *RawPeer) readTimeout(timeout time.Duration, conn net.Conn) (wire.Message, error) {
 	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
 		return nil, err
 	}
-	_, msg, _, err := wire.ReadMessageWithEncodingN(conn, pver, btcnet,
-		wire.LatestEncoding)
+	if r.v2 != nil {
+		msg, _, err := r.v2.readMessage(r.protocolVersion, wire.LatestEncoding)
+		return msg, err
+	}
+	_, msg, _, err := wire.ReadMessageWithEncodingN(conn, r.protocolVersion,
+		r.network, wire.LatestEncoding)
 	return msg, err
 }
 
+// prefixConn replays bytes that were read while detecting the transport.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 type RawPeer struct {
 	mtx       sync.RWMutex
 	isDialing bool
@@ -69,6 +91,10 @@ type RawPeer struct {
 
 	address string
 	id      int
+	proxy   *Proxy // dial through a SOCKS5 proxy when set
+
+	transportV2 bool         // try the BIP324 transport first
+	v2          *v2Transport // BIP324 session, nil for v1
 
 	protocolVersion uint32
 	network         wire.BitcoinNet
@@ -78,15 +104,25 @@ type RawPeer struct {
 }
 
 func New(network wire.BitcoinNet, id int, address string) (*RawPeer, error) {
+	return NewWithProxy(network, id, address, nil)
+}
+
+// NewWithProxy returns a peer that is dialed through the provided SOCKS5
+// proxy. A nil proxy dials the peer directly.
+func NewWithProxy(network wire.BitcoinNet, id int, address string, proxy *Proxy) (*RawPeer, error) {
 	_, _, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, fmt.Errorf("%v: %w", address, err)
 	}
+	if proxy == nil && IsOnion(address) {
+		return nil, fmt.Errorf("%v: %w", address, ErrOnionNoProxy)
+	}
 	return &RawPeer{
 		protocolVersion: wire.ProtocolVersion,
 		network:         network,
 		address:         address,
 		id:              id,
+		proxy:           proxy,
 	}, nil
 }
 
@@ -95,6 +131,7 @@ func NewFromConn(conn net.Conn, network wire.BitcoinNet, protocolVersion uint32,
 		conn:            conn,
 		connected:       time.Now(),
 		address:         conn.RemoteAddr().String(),
+		id:              id,
 		protocolVersion: wire.AddrV2Version,
 		network:         network,
 	}, nil
@@ -108,9 +145,31 @@ func (r *RawPeer) Id() int {
 	return r.id
 }
 
+// SetTransportV2 sets whether Connect tries the BIP324 encrypted transport
+// first. Peers that do not support it are redialed using the v1 transport.
+func (r *RawPeer) SetTransportV2(enable bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.transportV2 = enable
+}
+
+// TransportV2 returns true if the connection uses the BIP324 encrypted
+// transport.
+func (r *RawPeer) TransportV2() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.v2 != nil
+}
+
 func (r *RawPeer) Write(timeout time.Duration, msg wire.Message) error {
+	return r.WriteEncoding(timeout, msg, wire.LatestEncoding)
+}
+
+// WriteEncoding writes msg using the provided encoding. This is used to strip
+// witness data when the remote did not ask for it.
+func (r *RawPeer) WriteEncoding(timeout time.Duration, msg wire.Message, enc wire.MessageEncoding) error {
 	r.mtx.Lock()
-	conn := r.conn
+	conn, v2 := r.conn, r.v2
 	r.mtx.Unlock()
 	if conn == nil {
 		return fmt.Errorf("write: %w", ErrNoConn)
@@ -126,8 +185,13 @@ func (r *RawPeer) Write(timeout time.Duration, msg wire.Message) error {
 		}
 	}
 	// XXX contexts would be nice
-	_, err := wire.WriteMessageWithEncodingN(conn, msg, r.protocolVersion,
-		r.network, wire.LatestEncoding)
+	var err error
+	if v2 != nil {
+		err = v2.writeMessage(msg, r.protocolVersion, enc)
+	} else {
+		_, err = wire.WriteMessageWithEncodingN(conn, msg,
+			r.protocolVersion, r.network, enc)
+	}
 	if err != nil {
 		conn.Close()
 	}
@@ -136,7 +200,7 @@ func (r *RawPeer) Write(timeout time.Duration, msg wire.Message) error {
 
 func (r *RawPeer) Read(timeout time.Duration) (wire.Message, []byte, error) {
 	r.mtx.Lock()
-	conn := r.conn
+	conn, v2 := r.conn, r.v2
 	r.mtx.Unlock()
 	if conn == nil {
 		return nil, nil, fmt.Errorf("read: %w", ErrNoConn)
@@ -152,8 +216,17 @@ func (r *RawPeer) Read(timeout time.Duration) (wire.Message, []byte, error) {
 		}
 	}
 	// XXX contexts would be nice
-	_, msg, buf, err := wire.ReadMessageWithEncodingN(conn, r.protocolVersion,
-		r.network, wire.LatestEncoding)
+	var (
+		msg wire.Message
+		buf []byte
+		err error
+	)
+	if v2 != nil {
+		msg, buf, err = v2.readMessage(r.protocolVersion, wire.LatestEncoding)
+	} else {
+		_, msg, buf, err = wire.ReadMessageWithEncodingN(conn,
+			r.protocolVersion, r.network, wire.LatestEncoding)
+	}
 	if err != nil && !errors.Is(err, wire.ErrUnknownMessage) {
 		conn.Close()
 	}
@@ -171,13 +244,13 @@ func (r *RawPeer) handshake(ctx context.Context, conn net.Conn) error {
 	msg := wire.NewMsgVersion(us, them, rand.Uint64(), 0)
 	msg.UserAgent = fmt.Sprintf("/%v:%v/", version.Component, version.String())
 	msg.ProtocolVersion = int32(wire.AddrV2Version)
-	err := writeTimeout(defaultHandshakeTimeout, conn, msg, r.protocolVersion, r.network)
+	err := r.writeTimeout(defaultHandshakeTimeout, conn, msg)
 	if err != nil {
 		return fmt.Errorf("could not write version message: %w", err)
 	}
 
 	// 2. receive version
-	rmsg, err := readTimeout(defaultHandshakeTimeout, conn, r.protocolVersion, r.network)
+	rmsg, err := r.readTimeout(defaultHandshakeTimeout, conn)
 	if err != nil {
 		return fmt.Errorf("could not read version message: %w", err)
 	}
@@ -190,8 +263,7 @@ func (r *RawPeer) handshake(ctx context.Context, conn net.Conn) error {
 	// 3. ask for v2 addresses, this has to be done before verack despite
 	// what the spec says.
 	if uint32(v.ProtocolVersion) >= wire.AddrV2Version {
-		err = writeTimeout(defaultHandshakeTimeout, conn, wire.NewMsgSendAddrV2(),
-			r.protocolVersion, r.network)
+		err = r.writeTimeout(defaultHandshakeTimeout, conn, wire.NewMsgSendAddrV2())
 		if err != nil {
 			return fmt.Errorf("could not send addrv2: %w", err)
 		}
@@ -199,15 +271,14 @@ func (r *RawPeer) handshake(ctx context.Context, conn net.Conn) error {
 
 	// 4. ask for headers.
 	if uint32(v.ProtocolVersion) >= wire.SendHeadersVersion {
-		err = writeTimeout(defaultHandshakeTimeout, conn, wire.NewMsgSendHeaders(),
-			r.protocolVersion, r.network)
+		err = r.writeTimeout(defaultHandshakeTimeout, conn, wire.NewMsgSendHeaders())
 		if err != nil {
 			return fmt.Errorf("could not send addrv2: %w", err)
 		}
 	}
 
 	// 5. send verack
-	err = writeTimeout(defaultHandshakeTimeout, conn, wire.NewMsgVerAck(), r.protocolVersion, r.network)
+	err = r.writeTimeout(defaultHandshakeTimeout, conn, wire.NewMsgVerAck())
 	if err != nil {
 		return fmt.Errorf("could not send verack: %w", err)
 	}
@@ -217,7 +288,7 @@ func (r *RawPeer) handshake(ctx context.Context, conn net.Conn) error {
 		if time.Now().After(expire) {
 			return fmt.Errorf("timeout")
 		}
-		msg, err := readTimeout(defaultHandshakeTimeout, conn, r.protocolVersion, r.network)
+		msg, err := r.readTimeout(defaultHandshakeTimeout, conn)
 		if errors.Is(err, wire.ErrUnknownMessage) {
 			continue
 		} else if err != nil {
@@ -237,6 +308,186 @@ func (r *RawPeer) handshake(ctx context.Context, conn net.Conn) error {
 	}
 }
 
+// acceptHandshake is the responder side of handshake. The remote sends its
+// version first and we answer with ours.
+func (r *RawPeer) acceptHandshake(ctx context.Context, conn net.Conn, services wire.ServiceFlag, lastBlock int32) error {
+	log.Tracef("acceptHandshake %v -> %v", conn.RemoteAddr(), conn.LocalAddr())
+	defer log.Tracef("acceptHandshake exit %v -> %v", conn.RemoteAddr(), conn.LocalAddr())
+
+	// 1. receive version
+	defaultHandshakeTimeout := 2 * time.Second // This is cumulative.
+	rmsg, err := r.readTimeout(defaultHandshakeTimeout, conn)
+	if err != nil {
+		return fmt.Errorf("could not read version message: %w", err)
+	}
+	v, ok := rmsg.(*wire.MsgVersion)
+	if !ok {
+		return errors.New("expected version message")
+	}
+	r.mtx.Lock()
+	r.remoteVersion = v
+	r.mtx.Unlock()
+
+	// 2. send our version
+	us := &wire.NetAddress{Timestamp: time.Now(), Services: services}
+	them := &wire.NetAddress{Timestamp: time.Now()}
+	msg := wire.NewMsgVersion(us, them, rand.Uint64(), lastBlock)
+	msg.UserAgent = fmt.Sprintf("/%v:%v/", version.Component, version.String())
+	msg.ProtocolVersion = int32(wire.AddrV2Version)
+	msg.Services = services
+	err = r.writeTimeout(defaultHandshakeTimeout, conn, msg)
+	if err != nil {
+		return fmt.Errorf("could not write version message: %w", err)
+	}
+
+	// 3. ask for v2 addresses, this has to be done before verack.
+	if uint32(v.ProtocolVersion) >= wire.AddrV2Version {
+		err = r.writeTimeout(defaultHandshakeTimeout, conn, wire.NewMsgSendAddrV2())
+		if err != nil {
+			return fmt.Errorf("could not send addrv2: %w", err)
+		}
+	}
+
+	// 4. send verack
+	err = r.writeTimeout(defaultHandshakeTimeout, conn, wire.NewMsgVerAck())
+	if err != nil {
+		return fmt.Errorf("could not send verack: %w", err)
+	}
+
+	// 5. wait for verack, the remote may send feature negotiation
+	// messages (e.g. sendaddrv2 or wtxidrelay) first.
+	expire := time.Now().Add(defaultHandshakeTimeout)
+	for {
+		if time.Now().After(expire) {
+			return fmt.Errorf("timeout")
+		}
+		msg, err := r.readTimeout(defaultHandshakeTimeout, conn)
+		if errors.Is(err, wire.ErrUnknownMessage) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("handshake read: %w", err)
+		}
+
+		switch msg.(type) {
+		case *wire.MsgVerAck:
+			log.Debugf("accept handshake: %v %v %v %v",
+				r, v.UserAgent, v.ProtocolVersion, v.LastBlock)
+			return nil
+		case *wire.MsgSendAddrV2:
+			r.addrV2 = true
+		default:
+			log.Debugf("accept handshake %v: ignoring %T", r, msg)
+		}
+	}
+}
+
+// acceptTransport detects whether the remote initiated a v1 or a BIP324
+// connection and completes the key exchange of the latter.
+func (r *RawPeer) acceptTransport(conn net.Conn) error {
+	v1 := v1Prefix(r.network)
+	prefix := make([]byte, len(v1))
+	if err := conn.SetDeadline(time.Now().Add(defaultV2HandshakeTimeout)); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return fmt.Errorf("read prefix: %w", err)
+	}
+	if bytes.Equal(prefix, v1) {
+		r.mtx.Lock()
+		r.conn = &prefixConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(prefix), conn),
+		}
+		r.mtx.Unlock()
+		return conn.SetDeadline(time.Time{})
+	}
+
+	v2, err := v2Handshake(conn, r.network, false, prefix)
+	if err != nil {
+		return fmt.Errorf("v2 handshake: %w", err)
+	}
+	r.mtx.Lock()
+	r.v2 = v2
+	r.mtx.Unlock()
+	return conn.SetDeadline(time.Time{})
+}
+
+// Accept completes the handshake on a peer that was created with NewFromConn.
+// The provided services and last block are advertised to the remote.
+func (r *RawPeer) Accept(ctx context.Context, services wire.ServiceFlag, lastBlock int32) error {
+	log.Tracef("Accept %v", r.address)
+	defer log.Tracef("Accept exit %v", r.address)
+
+	r.mtx.Lock()
+	conn := r.conn
+	r.mtx.Unlock()
+	if conn == nil {
+		return fmt.Errorf("accept: %w", ErrNoConn)
+	}
+
+	if err := r.acceptTransport(conn); err != nil {
+		conn.Close()
+		return fmt.Errorf("accept transport %v: %w", r.address, err)
+	}
+	r.mtx.Lock()
+	conn = r.conn
+	r.mtx.Unlock()
+
+	if err := r.acceptHandshake(ctx, conn, services, lastBlock); err != nil {
+		conn.Close()
+		return fmt.Errorf("accept handshake %v: %w", r.address, err)
+	}
+
+	return nil
+}
+
+func (r *RawPeer) dial(ctx context.Context, d *net.Dialer) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if r.proxy != nil {
+		log.Debugf("dialing %s via %v", r.address, r.proxy)
+		conn, err = r.proxy.dial(ctx, d, r.address)
+	} else {
+		log.Debugf("dialing %s", r.address)
+		conn, err = d.DialContext(ctx, "tcp", r.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dial %v: %w", r.address, err)
+	}
+	return conn, nil
+}
+
+// connectV2 performs the BIP324 key exchange on conn. When the remote does
+// not answer it is redialed and the v1 connection is returned instead.
+func (r *RawPeer) connectV2(ctx context.Context, d *net.Dialer, conn net.Conn) (net.Conn, error) {
+	if err := conn.SetDeadline(time.Now().Add(defaultV2HandshakeTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	v2, err := v2Handshake(conn, r.network, true, nil)
+	if err == nil {
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		r.mtx.Lock()
+		r.v2 = v2
+		r.mtx.Unlock()
+		return conn, nil
+	}
+	conn.Close()
+	if !errors.Is(err, ErrV2Rejected) {
+		return nil, fmt.Errorf("v2 handshake %v: %w", r.address, err)
+	}
+
+	log.Debugf("%v: v2 transport rejected, falling back to v1: %v",
+		r.address, err)
+	d.Deadline = time.Now().Add(defaultDialTimeout)
+	return r.dial(ctx, d)
+}
+
 func (r *RawPeer) Connect(ctx context.Context) error {
 	log.Tracef("Connect %v", r.address) // not locked but ok
 	defer log.Tracef("Connect exit %v", r.address)
@@ -254,7 +505,7 @@ func (r *RawPeer) Connect(ctx context.Context) error {
 	r.mtx.Unlock()
 
 	d := net.Dialer{
-		Deadline: time.Now().Add(5 * time.Second),
+		Deadline: time.Now().Add(defaultDialTimeout),
 		KeepAliveConfig: net.KeepAliveConfig{
 			Enable:   true,
 			Idle:     7 * time.Second,
@@ -263,10 +514,20 @@ func (r *RawPeer) Connect(ctx context.Context) error {
 		},
 	}
 
-	log.Debugf("dialing %s", r.address)
-	conn, err := d.DialContext(ctx, "tcp", r.address)
+	conn, err := r.dial(ctx, &d)
 	if err != nil {
-		return fmt.Errorf("dial %v: %w", r.address, err)
+		return err
+	}
+
+	r.mtx.Lock()
+	transportV2 := r.transportV2
+	r.v2 = nil
+	r.mtx.Unlock()
+	if transportV2 {
+		conn, err = r.connectV2(ctx, &d, conn)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = r.handshake(ctx, conn)
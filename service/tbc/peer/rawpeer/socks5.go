@@ -0,0 +1,207 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package rawpeer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks5Version = 5
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5AuthPasswordVersion = 1
+
+	socks5CmdConnect = 1
+
+	socks5AtypIPv4   = 1
+	socks5AtypDomain = 3
+	socks5AtypIPv6   = 4
+)
+
+var (
+	ErrSOCKS5Auth    = errors.New("socks5 authentication failed")
+	ErrOnionNoProxy  = errors.New("onion address requires a proxy")
+	socks5ReplyCodes = map[byte]string{
+		1: "general failure",
+		2: "connection not allowed by ruleset",
+		3: "network unreachable",
+		4: "host unreachable",
+		5: "connection refused",
+		6: "ttl expired",
+		7: "command not supported",
+		8: "address type not supported",
+	}
+)
+
+// IsOnion returns true if the host of address is a tor onion service.
+func IsOnion(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
+
+// Proxy is a SOCKS5 proxy that is used to dial peers. Host names are resolved
+// by the proxy, this is required to reach tor onion services. User and
+// Password are optional.
+type Proxy struct {
+	Address  string
+	User     string
+	Password string
+}
+
+func (p *Proxy) String() string {
+	return p.Address
+}
+
+// dial connects to address through the proxy.
+func (p *Proxy) dial(ctx context.Context, d *net.Dialer, address string) (net.Conn, error) {
+	host, portS, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portS, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("port: %w", err)
+	}
+
+	conn, err := d.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %v: %w", p.Address, err)
+	}
+	if !d.Deadline.IsZero() {
+		if err := conn.SetDeadline(d.Deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := p.connect(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %v: %w", p.Address, err)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// connect negotiates authentication and issues a CONNECT to host:port on an
+// established proxy connection.
+func (p *Proxy) connect(rw io.ReadWriter, host string, port uint16) error {
+	// Greeting
+	methods := []byte{socks5AuthNone}
+	if p.User != "" || p.Password != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := rw.Write(greeting); err != nil {
+		return fmt.Errorf("write greeting: %w", err)
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(rw, reply[:]); err != nil {
+		return fmt.Errorf("read greeting: %w", err)
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("invalid version: %v", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if len(p.User) > 255 || len(p.Password) > 255 {
+			return errors.New("user or password too long")
+		}
+		auth := []byte{socks5AuthPasswordVersion, byte(len(p.User))}
+		auth = append(auth, p.User...)
+		auth = append(auth, byte(len(p.Password)))
+		auth = append(auth, p.Password...)
+		if _, err := rw.Write(auth); err != nil {
+			return fmt.Errorf("write auth: %w", err)
+		}
+		if _, err := io.ReadFull(rw, reply[:]); err != nil {
+			return fmt.Errorf("read auth: %w", err)
+		}
+		if reply[1] != 0 {
+			return ErrSOCKS5Auth
+		}
+	case socks5AuthNoAcceptable:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("invalid authentication method: %v", reply[1])
+	}
+
+	// Connect
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host too long: %v", len(host))
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := rw.Write(req); err != nil {
+		return fmt.Errorf("write connect: %w", err)
+	}
+
+	// Reply, the bound address is read and discarded.
+	var hdr [4]byte
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return fmt.Errorf("read connect: %w", err)
+	}
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("invalid version: %v", hdr[0])
+	}
+	if hdr[1] != 0 {
+		if reason, ok := socks5ReplyCodes[hdr[1]]; ok {
+			return fmt.Errorf("connect %v: %v", host, reason)
+		}
+		return fmt.Errorf("connect %v: reply %v", host, hdr[1])
+	}
+	var n int
+	switch hdr[3] {
+	case socks5AtypIPv4:
+		n = net.IPv4len
+	case socks5AtypIPv6:
+		n = net.IPv6len
+	case socks5AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(rw, l[:]); err != nil {
+			return fmt.Errorf("read bound address: %w", err)
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("invalid address type: %v", hdr[3])
+	}
+	bound := make([]byte, n+2) // address + port
+	if _, err := io.ReadFull(rw, bound); err != nil {
+		return fmt.Errorf("read bound address: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package rawpeer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+const testOnion = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion:18444"
+
+// testSOCKS5Proxy is a minimal SOCKS5 proxy that connects every CONNECT
+// request to target, regardless of the requested destination, which is sent
+// on the returned channel.
+func testSOCKS5Proxy(ctx context.Context, t *testing.T, user, password, target string) (string, <-chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	destC := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dest, err := testSOCKS5Serve(conn, user, password)
+				if err != nil {
+					t.Logf("socks5 serve: %v", err)
+					return
+				}
+				destC <- dest
+
+				tconn, err := net.Dial("tcp", target)
+				if err != nil {
+					t.Logf("socks5 dial: %v", err)
+					return
+				}
+				defer tconn.Close()
+				go func() {
+					_, _ = io.Copy(tconn, conn)
+				}()
+				_, _ = io.Copy(conn, tconn)
+			}()
+		}
+	}()
+
+	return l.Addr().String(), destC
+}
+
+func testSOCKS5Serve(rw io.ReadWriter, user, password string) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return "", err
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+	method := byte(socks5AuthNone)
+	if user != "" {
+		method = socks5AuthPassword
+	}
+	if _, err := rw.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5AuthPassword {
+		var l [2]byte
+		if _, err := io.ReadFull(rw, l[:]); err != nil {
+			return "", err
+		}
+		u := make([]byte, l[1])
+		if _, err := io.ReadFull(rw, u); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(rw, l[:1]); err != nil {
+			return "", err
+		}
+		p := make([]byte, l[0])
+		if _, err := io.ReadFull(rw, p); err != nil {
+			return "", err
+		}
+		if string(u) != user || string(p) != password {
+			_, _ = rw.Write([]byte{socks5AuthPasswordVersion, 1})
+			return "", ErrSOCKS5Auth
+		}
+		if _, err := rw.Write([]byte{socks5AuthPasswordVersion, 0}); err != nil {
+			return "", err
+		}
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(rw, req[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socks5CmdConnect {
+		return "", errors.New("not a connect")
+	}
+	var host string
+	switch req[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(rw, l[:]); err != nil {
+			return "", err
+		}
+		h := make([]byte, l[0])
+		if _, err := io.ReadFull(rw, h); err != nil {
+			return "", err
+		}
+		host = string(h)
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(rw, port[:]); err != nil {
+		return "", err
+	}
+	_, err := rw.Write([]byte{socks5Version, 0, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host,
+		strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// testNode accepts a single bitcoin p2p connection and completes the
+// handshake.
+func testNode(ctx context.Context, t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		p, err := NewFromConn(conn, wire.TestNet, wire.AddrV2Version, 0)
+		if err != nil {
+			t.Logf("new from conn: %v", err)
+			return
+		}
+		if err := p.Accept(ctx, wire.SFNodeNetwork, 0); err != nil {
+			t.Logf("accept: %v", err)
+			return
+		}
+		<-ctx.Done()
+		p.Close()
+	}()
+	return l.Addr().String()
+}
+
+func TestSOCKS5(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := New(wire.TestNet, 0, testOnion); !errors.Is(err, ErrOnionNoProxy) {
+		t.Fatalf("expected %v, got %v", ErrOnionNoProxy, err)
+	}
+
+	node := testNode(ctx, t)
+	proxy, destC := testSOCKS5Proxy(ctx, t, "user", "password", node)
+
+	// Wrong password
+	p, err := NewWithProxy(wire.TestNet, 0, testOnion, &Proxy{
+		Address:  proxy,
+		User:     "user",
+		Password: "nope",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(ctx); !errors.Is(err, ErrSOCKS5Auth) {
+		t.Fatalf("expected %v, got %v", ErrSOCKS5Auth, err)
+	}
+
+	// The onion address is resolved by the proxy.
+	p, err = NewWithProxy(wire.TestNet, 0, testOnion, &Proxy{
+		Address:  proxy,
+		User:     "user",
+		Password: "password",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if dest := <-destC; dest != testOnion {
+		t.Fatalf("expected %v, got %v", testOnion, dest)
+	}
+	if _, err := p.RemoteVersion(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -10,17 +10,31 @@ import (
 	"fmt"
 	"math/rand/v2"
 	"net"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/wire"
 
+	"github.com/hemilabs/heminetwork/bitcoin"
+	"github.com/hemilabs/heminetwork/database/tbcd"
 	"github.com/hemilabs/heminetwork/service/tbc/peer/rawpeer"
 )
 
 const (
 	maxPeersGood = 1024
 	maxPeersBad  = 1024
+	maxPeersBook = 4096 // maximum address book entries
+
+	banScore    = 100            // misbehavior score that bans a peer
+	banDuration = 24 * time.Hour // default ban duration
+
+	// Misbehavior scores.
+	misbehaviorInvalidHeaders   = banScore
+	misbehaviorUnsolicitedBlock = 10
+	misbehaviorStall            = 20
 )
 
 var (
@@ -30,6 +44,13 @@ var (
 		"seed.testnet.bitcoin.sprovoost.nl:18333",
 		"testnet-seed.bluematt.me:18333",
 	}
+	testnet4Seeds = []string{
+		"seed.testnet4.bitcoin.sprovoost.nl:48333",
+		"seed.testnet4.wiz.biz:48333",
+	}
+	signetSeeds = []string{
+		"seed.signet.bitcoin.sprovoost.nl:38333",
+	}
 	mainnetSeeds = []string{
 		"seed.bitcoin.sipa.be:8333",
 		"dnsseed.bluematt.me:8333",
@@ -43,6 +64,8 @@ var (
 	ErrNoAddresses      = errors.New("no addresses")
 	ErrDNSSeed          = errors.New("could not dns seed")
 	ErrNoConnectedPeers = errors.New("no connected peers")
+	ErrPeerBanned       = errors.New("peer banned")
+	ErrPeerNotBanned    = errors.New("peer not banned")
 )
 
 // PeerManager keeps track of the available peers and their quality.
@@ -53,22 +76,38 @@ type PeerManager struct {
 
 	want int // number of peers we want to be connected to
 
-	dnsSeeds []string // hard coded dns seeds
-	seeds    []string // seeds obtained from DNS
+	proxy       *rawpeer.Proxy // dial peers through a SOCKS5 proxy
+	onionOnly   bool           // only connect to onion peers
+	transportV2 bool           // try the BIP324 transport first
+
+	dnsSeeds   []string // hard coded dns seeds
+	seeds      []string // seeds obtained from DNS or the address book
+	bookSeeded bool     // seeds were obtained from the address book
 
 	peers map[string]*rawpeer.RawPeer // connected peers
 	good  map[string]struct{}
 	bad   map[string]struct{}
 
+	book   map[string]*tbcd.Peer // persistent address book
+	dirty  map[string]struct{}   // address book entries not yet persisted
+	banned map[string]time.Time  // banned hosts
+
 	peersC chan *rawpeer.RawPeer // blocking channel for RandomConnect
 	slotsC chan int
 }
 
-// NewPeerManager returns a new peer manager.
-func NewPeerManager(net wire.BitcoinNet, seeds []string, want int) (*PeerManager, error) {
+// NewPeerManager returns a new peer manager. When proxy is not nil all peers
+// and DNS seeds are dialed through it, this is required to reach onion peers
+// and avoids leaking DNS lookups. In onion only mode all other peers are
+// ignored. When transportV2 is set peers are dialed using the BIP324 encrypted
+// transport and fall back to v1.
+func NewPeerManager(net wire.BitcoinNet, seeds []string, want int, proxy *rawpeer.Proxy, onionOnly, transportV2 bool) (*PeerManager, error) {
 	if want < 1 {
 		return nil, errors.New("peers wanted must not be 0")
 	}
+	if onionOnly && proxy == nil {
+		return nil, errors.New("onion only requires a proxy")
+	}
 
 	var dnsSeeds []string
 	switch net {
@@ -76,20 +115,33 @@ func NewPeerManager(net wire.BitcoinNet, seeds []string, want int) (*PeerManager
 		dnsSeeds = mainnetSeeds
 	case wire.TestNet3:
 		dnsSeeds = testnet3Seeds
+	case bitcoin.TestNet4:
+		dnsSeeds = testnet4Seeds
+	case chaincfg.SigNetParams.Net:
+		dnsSeeds = signetSeeds
 	case wire.TestNet:
 	default:
-		return nil, fmt.Errorf("invalid network: %v", net)
+		// Custom signets have no dns seeds.
+		if len(seeds) == 0 {
+			return nil, fmt.Errorf("invalid network: %v", net)
+		}
 	}
 
 	return &PeerManager{
-		net:      net,
-		want:     want,
-		dnsSeeds: dnsSeeds,
-		seeds:    seeds,
-		good:     make(map[string]struct{}, maxPeersGood),
-		bad:      make(map[string]struct{}, maxPeersBad),
-		peers:    make(map[string]*rawpeer.RawPeer, want),
-		peersC:   make(chan *rawpeer.RawPeer),
+		net:         net,
+		want:        want,
+		proxy:       proxy,
+		onionOnly:   onionOnly,
+		transportV2: transportV2,
+		dnsSeeds:    dnsSeeds,
+		seeds:       seeds,
+		good:        make(map[string]struct{}, maxPeersGood),
+		bad:         make(map[string]struct{}, maxPeersBad),
+		book:        make(map[string]*tbcd.Peer),
+		dirty:       make(map[string]struct{}),
+		banned:      make(map[string]time.Time),
+		peers:       make(map[string]*rawpeer.RawPeer, want),
+		peersC:      make(chan *rawpeer.RawPeer),
 	}, nil
 }
 
@@ -105,6 +157,16 @@ func (pm *PeerManager) seed(pctx context.Context) error {
 	log.Tracef("seed")
 	defer log.Tracef("seed exit")
 
+	// Resolving the seeds locally would leak DNS around the proxy, dial
+	// the seed host names instead and let the proxy resolve them.
+	if pm.proxy != nil {
+		pm.seeds = append(pm.seeds, pm.dnsSeeds...)
+		if len(pm.seeds) == 0 {
+			return ErrDNSSeed
+		}
+		return nil
+	}
+
 	// Seed
 	resolver := &net.Resolver{}
 	ctx, cancel := context.WithTimeout(pctx, 15*time.Second)
@@ -145,6 +207,15 @@ func (pm *PeerManager) Stats() (int, int, int) {
 	return len(pm.peers), len(pm.good), len(pm.bad)
 }
 
+// reachable returns true if address can be connected to. Onion peers require a
+// proxy and in onion only mode all other peers are unreachable.
+func (pm *PeerManager) reachable(address string) bool {
+	if rawpeer.IsOnion(address) {
+		return pm.proxy != nil
+	}
+	return !pm.onionOnly
+}
+
 // handleAddr adds peers to the good list if they do not exist in the connected
 // and bad list.
 // Note that this function requires the mutex to be held.
@@ -154,6 +225,10 @@ func (pm *PeerManager) handleAddr(peers []string) {
 		if err != nil {
 			continue
 		}
+		if !pm.reachable(addr) {
+			// Skip peers we can't connect to.
+			continue
+		}
 		if _, ok := pm.peers[addr]; ok {
 			// Skip connected peers.
 			continue
@@ -162,6 +237,10 @@ func (pm *PeerManager) handleAddr(peers []string) {
 			// Skip bad peers.
 			continue
 		}
+		if pm.isBanned(addr, time.Now()) {
+			// Skip banned peers.
+			continue
+		}
 		pm.good[addr] = struct{}{}
 	}
 	log.Debugf("HandleAddr exit %v good %v bad %v",
@@ -197,6 +276,9 @@ func (pm *PeerManager) Good(address string) error {
 	if _, ok := pm.good[address]; ok {
 		return fmt.Errorf("peer good: %v", address)
 	}
+	if pm.isBanned(address, time.Now()) {
+		return fmt.Errorf("%w: %v", ErrPeerBanned, address)
+	}
 
 	// Remove peer from bad.
 	delete(pm.bad, address)
@@ -320,6 +402,292 @@ func (pm *PeerManager) RandomConnect(ctx context.Context) (*rawpeer.RawPeer, err
 	}
 }
 
+// bookPeer returns the address book entry of address and creates it if it
+// does not exist yet. When the address book is full the least recently seen
+// entry that is not banned is evicted. The entry is marked dirty since the
+// caller is expected to modify it. It returns nil for invalid addresses.
+// Note that this function requires the mutex to be held.
+func (pm *PeerManager) bookPeer(address string) *tbcd.Peer {
+	if bp, ok := pm.book[address]; ok {
+		pm.dirty[address] = struct{}{}
+		return bp
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil
+	}
+	if len(pm.book) >= maxPeersBook {
+		now := time.Now()
+		var oldest *tbcd.Peer
+		for _, bp := range pm.book {
+			if bp.Banned(now) {
+				continue
+			}
+			if oldest == nil || bp.LastSeen.Before(oldest.LastSeen) {
+				oldest = bp
+			}
+		}
+		if oldest == nil {
+			// Everyone is banned, don't forget any of them.
+			return nil
+		}
+		delete(pm.book, oldest.Address)
+		pm.dirty[oldest.Address] = struct{}{}
+	}
+	bp := &tbcd.Peer{Address: address}
+	pm.book[address] = bp
+	pm.dirty[address] = struct{}{}
+	return bp
+}
+
+// bookSeeds returns the addresses in the address book that were connected to
+// before and are not banned, most recently seen first.
+func (pm *PeerManager) bookSeeds() []string {
+	pm.mtx.RLock()
+	defer pm.mtx.RUnlock()
+
+	now := time.Now()
+	peers := make([]*tbcd.Peer, 0, len(pm.book))
+	for _, bp := range pm.book {
+		if bp.Successes == 0 || bp.Banned(now) || !pm.reachable(bp.Address) {
+			continue
+		}
+		peers = append(peers, bp)
+	}
+	slices.SortFunc(peers, func(a, b *tbcd.Peer) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	seeds := make([]string, 0, len(peers))
+	for _, bp := range peers {
+		seeds = append(seeds, bp.Address)
+	}
+	return seeds
+}
+
+// addressBookLoad replaces the address book with the provided peers.
+func (pm *PeerManager) addressBookLoad(peers []tbcd.Peer) {
+	pm.mtx.Lock()
+	defer pm.mtx.Unlock()
+
+	clear(pm.book)
+	clear(pm.dirty)
+	clear(pm.banned)
+	for k := range peers {
+		bp := peers[k]
+		pm.book[bp.Address] = &bp
+		pm.banUpdate(bp.Address)
+	}
+}
+
+// addressBookFlush calls f with the address book entries that were modified
+// and the addresses that were evicted since the last flush. The entries remain
+// dirty if f returns an error.
+func (pm *PeerManager) addressBookFlush(f func(peers []tbcd.Peer, evicted []string) error) error {
+	pm.mtx.Lock()
+	var (
+		peers   []tbcd.Peer
+		evicted []string
+	)
+	for address := range pm.dirty {
+		if bp, ok := pm.book[address]; ok {
+			peers = append(peers, *bp)
+		} else {
+			evicted = append(evicted, address)
+		}
+	}
+	clear(pm.dirty)
+	pm.mtx.Unlock()
+
+	if len(peers) == 0 && len(evicted) == 0 {
+		return nil
+	}
+	if err := f(peers, evicted); err != nil {
+		pm.mtx.Lock()
+		for k := range peers {
+			pm.dirty[peers[k].Address] = struct{}{}
+		}
+		for _, address := range evicted {
+			pm.dirty[address] = struct{}{}
+		}
+		pm.mtx.Unlock()
+		return err
+	}
+	return nil
+}
+
+// AddressBook returns a copy of the address book ordered by address.
+func (pm *PeerManager) AddressBook() []tbcd.Peer {
+	pm.mtx.RLock()
+	defer pm.mtx.RUnlock()
+
+	peers := make([]tbcd.Peer, 0, len(pm.book))
+	for _, bp := range pm.book {
+		peers = append(peers, *bp)
+	}
+	slices.SortFunc(peers, func(a, b tbcd.Peer) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+	return peers
+}
+
+// banUpdate recalculates the ban of the host of address from the address
+// book.
+// Note that this function requires the mutex to be held.
+func (pm *PeerManager) banUpdate(address string) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	var until time.Time
+	for _, bp := range pm.book {
+		h, _, err := net.SplitHostPort(bp.Address)
+		if err != nil || h != host {
+			continue
+		}
+		if bp.BanUntil.After(until) {
+			until = bp.BanUntil
+		}
+	}
+	if until.IsZero() {
+		delete(pm.banned, host)
+	} else {
+		pm.banned[host] = until
+	}
+}
+
+// isBanned returns true if the host of address is banned at time now.
+// Note that this function requires the mutex to be held.
+func (pm *PeerManager) isBanned(address string, now time.Time) bool {
+	if len(pm.banned) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	return now.Before(pm.banned[host])
+}
+
+// Banned returns true if the host of address is banned. Bans apply to all
+// ports of a host.
+func (pm *PeerManager) Banned(address string) bool {
+	pm.mtx.RLock()
+	defer pm.mtx.RUnlock()
+
+	return pm.isBanned(address, time.Now())
+}
+
+// disconnectHost disconnects all connected peers of the host of address.
+func (pm *PeerManager) disconnectHost(ctx context.Context, address string) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+
+	var addresses []string
+	pm.mtx.RLock()
+	for k := range pm.peers {
+		if h, _, err := net.SplitHostPort(k); err == nil && h == host {
+			addresses = append(addresses, k)
+		}
+	}
+	pm.mtx.RUnlock()
+
+	for _, k := range addresses {
+		_ = pm.Bad(ctx, k) // Not interesting, the peer may be gone.
+	}
+}
+
+// Ban bans the host of address for duration d and disconnects it.
+func (pm *PeerManager) Ban(ctx context.Context, address string, d time.Duration) error {
+	log.Tracef("Ban %v %v", address, d)
+	defer log.Tracef("Ban exit")
+
+	if d <= 0 {
+		return fmt.Errorf("invalid ban duration: %v", d)
+	}
+
+	pm.mtx.Lock()
+	bp := pm.bookPeer(address)
+	if bp == nil {
+		pm.mtx.Unlock()
+		return fmt.Errorf("invalid address: %v", address)
+	}
+	bp.BanUntil = time.Now().Add(d)
+	pm.banUpdate(address)
+	pm.mtx.Unlock()
+
+	log.Infof("Banned %v for %v", address, d)
+	pm.disconnectHost(ctx, address)
+
+	return nil
+}
+
+// Unban lifts the ban of the host of address and resets the misbehavior
+// scores of its address book entries.
+func (pm *PeerManager) Unban(address string) error {
+	log.Tracef("Unban %v", address)
+	defer log.Tracef("Unban exit")
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	pm.mtx.Lock()
+	defer pm.mtx.Unlock()
+
+	if !pm.isBanned(address, time.Now()) {
+		return fmt.Errorf("%w: %v", ErrPeerNotBanned, address)
+	}
+	for k, bp := range pm.book {
+		if h, _, err := net.SplitHostPort(k); err != nil || h != host {
+			continue
+		}
+		bp.BanUntil = time.Time{}
+		bp.Score = 0
+		pm.dirty[k] = struct{}{}
+	}
+	delete(pm.banned, host)
+
+	log.Infof("Unbanned %v", host)
+
+	return nil
+}
+
+// Misbehaving adds score to the misbehavior score of a peer. The peer is
+// banned for banDuration and disconnected once the score reaches banScore.
+func (pm *PeerManager) Misbehaving(ctx context.Context, address string, score uint32, reason string) {
+	log.Tracef("Misbehaving %v %v", address, score)
+	defer log.Tracef("Misbehaving exit")
+
+	now := time.Now()
+	pm.mtx.Lock()
+	bp := pm.bookPeer(address)
+	if bp == nil {
+		pm.mtx.Unlock()
+		return
+	}
+	if !bp.BanUntil.IsZero() && !bp.Banned(now) {
+		// Previous ban expired, start over.
+		bp.BanUntil = time.Time{}
+		bp.Score = 0
+	}
+	bp.Score += score
+	total := bp.Score
+	ban := total >= banScore && !bp.Banned(now)
+	if ban {
+		bp.BanUntil = now.Add(banDuration)
+		pm.banUpdate(address)
+	}
+	pm.mtx.Unlock()
+
+	log.Infof("Misbehaving %v: %v score %v", address, reason, total)
+	if ban {
+		log.Infof("Banned %v for %v", address, banDuration)
+		pm.disconnectHost(ctx, address)
+	}
+}
+
 func (pm *PeerManager) randomPeer(ctx context.Context, slot int) (*rawpeer.RawPeer, error) {
 	pm.mtx.Lock()
 	defer pm.mtx.Unlock()
@@ -345,13 +713,23 @@ func (pm *PeerManager) randomPeer(ctx context.Context, slot int) (*rawpeer.RawPe
 			log.Errorf("found addres on bad list: %v", k)
 			continue
 		}
+		if pm.isBanned(k, time.Now()) {
+			// Banned after it was added to the good list.
+			delete(pm.good, k)
+			continue
+		}
 
 		// Remove from good list and add to bad list. Thus active peers
 		// are len(bad)-len(peers)
 		delete(pm.good, k)
 		pm.bad[k] = struct{}{}
 
-		return rawpeer.New(pm.net, slot, k)
+		p, err := rawpeer.NewWithProxy(pm.net, slot, k, pm.proxy)
+		if err != nil {
+			return nil, err
+		}
+		p.SetTransportV2(pm.transportV2)
+		return p, nil
 	}
 	return nil, ErrNoAddresses
 }
@@ -361,10 +739,19 @@ func (pm *PeerManager) connect(ctx context.Context, p *rawpeer.RawPeer) error {
 	defer log.Tracef("connect exit: %v %v", p.Id(), p)
 
 	if err := p.Connect(ctx); err != nil {
+		pm.mtx.Lock()
+		if bp := pm.bookPeer(p.String()); bp != nil {
+			bp.Failures++
+		}
+		pm.mtx.Unlock()
 		return fmt.Errorf("new peer: %w", err)
 	}
 
 	pm.mtx.Lock()
+	if bp := pm.bookPeer(p.String()); bp != nil {
+		bp.LastSeen = time.Now()
+		bp.Successes++
+	}
 	if _, ok := pm.peers[p.String()]; ok {
 		// This race does indeed happen because Good can add this.
 		p.Close() // close new peer and don't add it
@@ -388,30 +775,49 @@ func (pm *PeerManager) connectSlot(ctx context.Context, p *rawpeer.RawPeer) {
 	}
 }
 
+// dnsSeed seeds the peer manager from DNS and retries until it succeeds.
+func (pm *PeerManager) dnsSeed(ctx context.Context) error {
+	log.Infof("Starting DNS seeder")
+	minW := 5
+	maxW := 59
+	for {
+		err := pm.seed(ctx)
+		if err != nil {
+			log.Debugf("seed: %v", err)
+		} else {
+			break
+		}
+
+		holdOff := time.Duration(minW+rand.IntN(maxW-minW)) * time.Second
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(holdOff):
+		}
+	}
+	log.Infof("DNS seeding complete")
+	return nil
+}
+
 func (pm *PeerManager) Run(ctx context.Context) error {
 	log.Tracef("Run")
 	defer log.Tracef("Run")
 
 	if len(pm.seeds) == 0 {
-		log.Infof("Starting DNS seeder")
-		minW := 5
-		maxW := 59
-		for {
-			err := pm.seed(ctx)
-			if err != nil {
-				log.Debugf("seed: %v", err)
-			} else {
-				break
-			}
-
-			holdOff := time.Duration(minW+rand.IntN(maxW-minW)) * time.Second
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-time.After(holdOff):
-			}
+		pm.seeds = pm.bookSeeds()
+		pm.bookSeeded = len(pm.seeds) > 0
+		if pm.bookSeeded {
+			log.Infof("Seeded %v peers from address book", len(pm.seeds))
+		}
+	}
+	if len(pm.seeds) == 0 {
+		if pm.onionOnly {
+			// DNS seeds only return IP addresses.
+			return errors.New("onion only requires seeds")
+		}
+		if err := pm.dnsSeed(ctx); err != nil {
+			return err
 		}
-		log.Infof("DNS seeding complete")
 	}
 	pm.HandleAddr(pm.seeds) // Add all seeds to good list
 
@@ -427,6 +833,15 @@ func (pm *PeerManager) Run(ctx context.Context) error {
 		select {
 		case slot := <-pm.slotsC:
 			p, err := pm.randomPeer(ctx, slot)
+			if errors.Is(err, ErrReset) && pm.bookSeeded && !pm.onionOnly {
+				// None of the address book peers could be
+				// reached, fall back to DNS seeding.
+				pm.bookSeeded = false
+				if err := pm.dnsSeed(ctx); err != nil {
+					return err
+				}
+				pm.HandleAddr(pm.seeds)
+			}
 			if err != nil {
 				// basically no addresses, hold-off
 				<-time.After(7 * time.Second)
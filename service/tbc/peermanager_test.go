@@ -7,12 +7,14 @@ package tbc
 import (
 	"context"
 	"errors"
+	"slices"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/btcsuite/btcd/wire"
 
+	"github.com/hemilabs/heminetwork/database/tbcd"
 	"github.com/hemilabs/heminetwork/service/tbc/peer/rawpeer"
 )
 
@@ -40,7 +42,7 @@ func TestPeerManager(t *testing.T) {
 	t.Skip("this test connects to testnet3")
 	want := 2
 	wantLoop := want * 2
-	pm, err := NewPeerManager(wire.TestNet3, []string{}, want)
+	pm, err := NewPeerManager(wire.TestNet3, []string{}, want, nil, false, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -87,3 +89,134 @@ func TestPeerManager(t *testing.T) {
 		t.Fatalf("not enough peers, got %v wanted %v", len(pm.peers), 0)
 	}
 }
+
+func TestPeerManagerAddressBook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	pm, err := NewPeerManager(wire.TestNet, []string{}, 1, nil, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	pm.addressBookLoad([]tbcd.Peer{
+		{Address: "127.0.0.1:18444", LastSeen: now.Add(-time.Hour), Successes: 1},
+		{Address: "127.0.0.2:18444", LastSeen: now, Successes: 1},
+		{Address: "127.0.0.3:18444", Failures: 1},
+		{Address: "127.0.0.4:18444", Successes: 1, BanUntil: now.Add(time.Hour)},
+	})
+
+	// Only reachable unbanned peers seed, most recent first.
+	seeds := pm.bookSeeds()
+	if !slices.Equal(seeds, []string{"127.0.0.2:18444", "127.0.0.1:18444"}) {
+		t.Fatalf("unexpected seeds: %v", seeds)
+	}
+
+	// Bans apply to all ports of a host.
+	if !pm.Banned("127.0.0.4:8333") {
+		t.Fatal("host not banned")
+	}
+	pm.HandleAddr([]string{"127.0.0.4:8333", "127.0.0.5:8333"})
+	if _, ok := pm.good["127.0.0.4:8333"]; ok {
+		t.Fatal("banned peer added to good list")
+	}
+
+	// Misbehaving peers are banned once they reach the ban score.
+	pm.Misbehaving(ctx, "127.0.0.5:8333", banScore/2, "test")
+	if pm.Banned("127.0.0.5:8333") {
+		t.Fatal("peer banned too early")
+	}
+	pm.Misbehaving(ctx, "127.0.0.5:8333", banScore/2, "test")
+	if !pm.Banned("127.0.0.5:8333") {
+		t.Fatal("peer not banned")
+	}
+	if _, err := pm.randomPeer(ctx, 0); !errors.Is(err, ErrNoAddresses) {
+		t.Fatalf("expected %v, got %v", ErrNoAddresses, err)
+	}
+
+	if err := pm.Unban("127.0.0.5:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.Unban("127.0.0.5:1"); !errors.Is(err, ErrPeerNotBanned) {
+		t.Fatalf("expected %v, got %v", ErrPeerNotBanned, err)
+	}
+	if pm.Banned("127.0.0.5:8333") {
+		t.Fatal("peer still banned")
+	}
+
+	// Only modified entries are flushed.
+	var flushed []tbcd.Peer
+	flush := func(peers []tbcd.Peer, evicted []string) error {
+		flushed = append(flushed, peers...)
+		return nil
+	}
+	if err := pm.addressBookFlush(flush); err != nil {
+		t.Fatal(err)
+	}
+	if len(flushed) != 1 || flushed[0].Address != "127.0.0.5:8333" ||
+		flushed[0].Score != 0 || !flushed[0].BanUntil.IsZero() {
+		t.Fatalf("unexpected flush: %v", flushed)
+	}
+	flushed = nil
+	if err := pm.addressBookFlush(flush); err != nil || len(flushed) != 0 {
+		t.Fatalf("unexpected flush: %v %v", flushed, err)
+	}
+	if len(pm.AddressBook()) != 5 {
+		t.Fatalf("unexpected address book: %v", pm.AddressBook())
+	}
+}
+
+func TestPeerManagerReachable(t *testing.T) {
+	const onion = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid.onion:8333"
+	addrs := []string{"127.0.0.1:8333", onion}
+	proxy := &rawpeer.Proxy{Address: "127.0.0.1:9050"}
+
+	if _, err := NewPeerManager(wire.TestNet, nil, 1, nil, true, false); err == nil {
+		t.Fatal("expected onion only without proxy to fail")
+	}
+
+	tests := []struct {
+		name      string
+		proxy     *rawpeer.Proxy
+		onionOnly bool
+		want      []string
+	}{
+		{name: "direct", want: addrs[:1]},
+		{name: "proxy", proxy: proxy, want: addrs},
+		{name: "onion only", proxy: proxy, onionOnly: true, want: addrs[1:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm, err := NewPeerManager(wire.TestNet, nil, 1, tt.proxy,
+				tt.onionOnly, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pm.HandleAddr(addrs)
+			if len(pm.good) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, pm.good)
+			}
+			for _, addr := range tt.want {
+				if _, ok := pm.good[addr]; !ok {
+					t.Fatalf("expected %v, got %v", tt.want, pm.good)
+				}
+			}
+		})
+	}
+}
+
+func TestPeerManagerSeedProxy(t *testing.T) {
+	proxy := &rawpeer.Proxy{Address: "127.0.0.1:9050"}
+	pm, err := NewPeerManager(wire.TestNet3, nil, 1, proxy, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seed host names are handed to the proxy and not resolved locally.
+	if err := pm.seed(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(pm.seeds, testnet3Seeds) {
+		t.Fatalf("expected %v, got %v", testnet3Seeds, pm.seeds)
+	}
+}
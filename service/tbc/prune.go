@@ -0,0 +1,256 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/dustin/go-humanize"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+const (
+	// minPruneBlocks is the minimum number of blocks that is always
+	// retained when pruning. This is the same as bitcoind and allows for
+	// reasonable reorgs.
+	minPruneBlocks = 288
+
+	// pruneUndoBatch is the number of undo records that are deleted at
+	// once.
+	pruneUndoBatch = 10000
+)
+
+// pruning returns true if raw blocks are pruned.
+func (s *Server) pruning() bool {
+	return s.cfg.PruneBlocks > 0 || s.cfg.PruneGB > 0
+}
+
+// blockFilesToPrune returns the raw block files that may be pruned. A file is
+// only pruned once all blocks in it have been indexed and are at least
+// minPruneBlocks deep. Beyond that it is pruned when all its blocks are older
+// than pruneBlocks or when the raw block storage exceeds pruneBytes. A zero
+// pruneBlocks or pruneBytes disables the respective retention.
+func blockFilesToPrune(bfs []tbcd.BlockFile, best, indexed, pruneBlocks, pruneBytes uint64) []tbcd.BlockFile {
+	if best < minPruneBlocks {
+		return nil
+	}
+	horizon := min(indexed, best-minPruneBlocks)
+
+	var size uint64
+	for _, bf := range bfs {
+		if !bf.Pruned {
+			size += uint64(bf.Size)
+		}
+	}
+
+	var prune []tbcd.BlockFile
+	for k, bf := range bfs {
+		if k == len(bfs)-1 {
+			// Active file.
+			break
+		}
+		if bf.Pruned || bf.Size == 0 || bf.Height > horizon {
+			continue
+		}
+		byBlocks := pruneBlocks > 0 && bf.Height+pruneBlocks <= best
+		bySize := pruneBytes > 0 && size > pruneBytes
+		if !byBlocks && !bySize {
+			continue
+		}
+		prune = append(prune, bf)
+		size -= uint64(bf.Size)
+	}
+	return prune
+}
+
+// utxoUndoAvailable returns true if the undo records of all blocks above the
+// provided height up to the utxo index hash have been recorded. Those blocks
+// can be unwound without the blocks that created the outputs they spend.
+// Undo records are recorded for every block that is indexed thus it suffices
+// to check the lowest one.
+func (s *Server) utxoUndoAvailable(ctx context.Context, utxoHH *HashHeight, height uint64) (bool, error) {
+	if utxoHH.Height <= height {
+		return true, nil
+	}
+	bh, err := s.db.BlockHeaderByHash(ctx, &utxoHH.Hash)
+	if err != nil {
+		return false, fmt.Errorf("block header by hash: %w", err)
+	}
+	for bh.Height > height+1 {
+		bh, err = s.db.BlockHeaderByHash(ctx, bh.ParentHash())
+		if err != nil {
+			return false, fmt.Errorf("block header by hash: %w", err)
+		}
+	}
+	_, err = s.db.BlockUndoByHash(ctx, &bh.Hash)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("block undo %v: %w", bh, err)
+	}
+	return true, nil
+}
+
+// pruneBlocks deletes the raw block files that both the utxo and the tx
+// indexers have moved past and that fall outside of the configured retention.
+// Nothing is pruned while the blocks that may still be unwound lack an undo
+// record, e.g. when they were indexed by an older release. Unwinding those
+// requires the blocks that created the outputs they spend.
+//
+// The utxo index is unwound from undo records alone but the tx index still
+// requires the blocks. Thus, like bitcoind, reorgs deeper than the retained
+// blocks cannot be unwound and the undo records of pruned blocks are pruned as
+// well. The pk scripts of spent outputs are deleted when the outputs are
+// spent and thus need no pruning.
+func (s *Server) pruneBlocks(ctx context.Context) error {
+	log.Tracef("pruneBlocks")
+	defer log.Tracef("pruneBlocks exit")
+
+	if !s.pruning() {
+		return nil
+	}
+
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return fmt.Errorf("block header best: %w", err)
+	}
+	utxoHH, err := s.UtxoIndexHash(ctx)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("utxo index hash: %w", err)
+	}
+	txHH, err := s.TxIndexHash(ctx)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("tx index hash: %w", err)
+	}
+
+	if bhb.Height < minPruneBlocks {
+		return nil
+	}
+	indexed := min(utxoHH.Height, txHH.Height)
+	ok, err := s.utxoUndoAvailable(ctx, utxoHH,
+		min(indexed, bhb.Height-minPruneBlocks))
+	if err != nil {
+		return fmt.Errorf("utxo undo available: %w", err)
+	}
+	if !ok {
+		log.Infof("Not pruning until the utxo index recorded undo " +
+			"records for all retained blocks")
+		return nil
+	}
+
+	bfs, err := s.db.BlockFiles(ctx)
+	if err != nil {
+		return fmt.Errorf("block files: %w", err)
+	}
+	prune := blockFilesToPrune(bfs, bhb.Height, indexed, s.cfg.PruneBlocks,
+		s.cfg.PruneGB*humanize.GiByte)
+	var pruned uint64
+	for _, bf := range bfs {
+		if bf.Pruned {
+			pruned = max(pruned, bf.Height)
+		}
+	}
+	for _, bf := range prune {
+		if err := s.db.BlockFilePrune(ctx, bf.Number); err != nil {
+			return fmt.Errorf("block file prune %v: %w", bf.Number, err)
+		}
+		log.Infof("Pruned raw block file %v height %v size %v",
+			bf.Number, bf.Height, humanize.IBytes(uint64(bf.Size)))
+		pruned = max(pruned, bf.Height)
+	}
+
+	// Unwinding stops at the highest pruned block thus no undo record at
+	// or below it is ever used again.
+	if err := s.pruneUndo(ctx, utxoHH, pruned); err != nil {
+		return fmt.Errorf("prune undo: %w", err)
+	}
+
+	return nil
+}
+
+// pruneUndo deletes the undo records of the blocks at or below the provided
+// height on the utxo index chain. Undo records only exist for the blocks on
+// that chain since they are deleted when a block is unwound. The highest
+// pruned height is recorded so that every record is deleted once.
+func (s *Server) pruneUndo(ctx context.Context, utxoHH *HashHeight, height uint64) error {
+	if height == 0 || utxoHH.Height <= height {
+		return nil
+	}
+	var last uint64
+	value, err := s.db.MetadataGet(ctx, UtxoUndoPrunedKey)
+	switch {
+	case err == nil && len(value) == 8:
+		last = binary.BigEndian.Uint64(value)
+	case err == nil:
+		return fmt.Errorf("invalid undo pruned height length: %v",
+			len(value))
+	case !errors.Is(err, database.ErrNotFound):
+		return fmt.Errorf("metadata undo pruned: %w", err)
+	}
+	if last >= height {
+		return nil
+	}
+
+	bh, err := s.db.BlockHeaderByHash(ctx, &utxoHH.Hash)
+	if err != nil {
+		return fmt.Errorf("block header by hash: %w", err)
+	}
+	undo := make(map[chainhash.Hash]*tbcd.BlockUndo, pruneUndoBatch)
+	for bh.Height > last {
+		if bh.Height <= height {
+			undo[bh.Hash] = nil // delete from disk
+		}
+		if len(undo) >= pruneUndoBatch || bh.Height == last+1 {
+			// BlockUndoUpdate empties the map.
+			if err := s.db.BlockUndoUpdate(ctx, -1, undo); err != nil {
+				return fmt.Errorf("block undo update: %w", err)
+			}
+		}
+		bh, err = s.db.BlockHeaderByHash(ctx, bh.ParentHash())
+		if err != nil {
+			return fmt.Errorf("block header by hash: %w", err)
+		}
+	}
+
+	err = s.db.MetadataPut(ctx, UtxoUndoPrunedKey,
+		binary.BigEndian.AppendUint64(nil, height))
+	if err != nil {
+		return fmt.Errorf("metadata undo pruned: %w", err)
+	}
+	log.Infof("Pruned undo records up to height %v", height)
+
+	return nil
+}
+
+// BlockFiles returns the raw block storage files and their pruning state.
+func (s *Server) BlockFiles(ctx context.Context) ([]tbcd.BlockFile, error) {
+	log.Tracef("BlockFiles")
+	defer log.Tracef("BlockFiles exit")
+
+	return s.db.BlockFiles(ctx)
+}
+
+// BlockFileCompact rewrites a raw block storage file with the configured block
+// compression. Blocks stored by older releases are upgraded to checksummed
+// records.
+func (s *Server) BlockFileCompact(ctx context.Context, number uint32) error {
+	log.Tracef("BlockFileCompact")
+	defer log.Tracef("BlockFileCompact exit")
+
+	return s.db.BlockFileCompact(ctx, number)
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/davecgh/go-spew/spew"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+func TestBlockFilesToPrune(t *testing.T) {
+	bfs := []tbcd.BlockFile{
+		{Number: 0, Size: 100, Height: 1000},
+		{Number: 1, Size: 100, Height: 2000, Pruned: true},
+		{Number: 2, Size: 100, Height: 3000},
+		{Number: 3, Size: 100, Height: 4000},
+		{Number: 4, Size: 50, Height: 4500}, // active
+	}
+	type testTableItem struct {
+		name        string
+		best        uint64
+		indexed     uint64
+		pruneBlocks uint64
+		pruneBytes  uint64
+		want        []uint32
+	}
+	testTable := []testTableItem{
+		{
+			name:        "too short",
+			best:        minPruneBlocks - 1,
+			indexed:     minPruneBlocks - 1,
+			pruneBlocks: minPruneBlocks,
+		},
+		{
+			name:        "blocks",
+			best:        4500,
+			indexed:     4500,
+			pruneBlocks: 1500,
+			want:        []uint32{0, 2},
+		},
+		{
+			name:        "blocks not indexed",
+			best:        4500,
+			indexed:     2500,
+			pruneBlocks: 1000,
+			want:        []uint32{0},
+		},
+		{
+			name:        "minimum retention",
+			best:        4100,
+			indexed:     4100,
+			pruneBlocks: 1,
+			want:        []uint32{0, 2},
+		},
+		{
+			name:       "size",
+			best:       4500,
+			indexed:    4500,
+			pruneBytes: 200,
+			want:       []uint32{0, 2},
+		},
+		{
+			name:       "size within budget",
+			best:       4500,
+			indexed:    4500,
+			pruneBytes: 450,
+		},
+		{
+			name:        "blocks or size",
+			best:        4500,
+			indexed:     4500,
+			pruneBlocks: 3000,
+			pruneBytes:  300,
+			want:        []uint32{0},
+		},
+		{
+			name:        "active file",
+			best:        1e6,
+			indexed:     1e6,
+			pruneBlocks: minPruneBlocks,
+			want:        []uint32{0, 2, 3},
+		},
+	}
+	for _, tti := range testTable {
+		t.Run(tti.name, func(t *testing.T) {
+			var got []uint32
+			for _, bf := range blockFilesToPrune(bfs, tti.best,
+				tti.indexed, tti.pruneBlocks, tti.pruneBytes) {
+				got = append(got, bf.Number)
+			}
+			if !slices.Equal(got, tti.want) {
+				t.Fatalf("got %v, want %v", got, tti.want)
+			}
+		})
+	}
+}
+
+// prunedDB mimics a database whose raw blocks have all been pruned.
+type prunedDB struct {
+	tbcd.Database
+}
+
+func (db *prunedDB) BlockByHash(_ context.Context, hash *chainhash.Hash) (*btcutil.Block, error) {
+	return nil, database.BlockPrunedError{Hash: *hash}
+}
+
+func TestUtxoUnwindUndo(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg := NewDefaultConfig()
+	cfg.Network = networkLocalnet
+	cfg.LevelDBHome = t.TempDir()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spend the coinbase of the first block in the last one.
+	blocks := testBlocks(*chaincfg.RegressionNetParams.GenesisHash, 0, 4, 0)
+	spent := tbcd.NewOutpoint(*blocks[0].Transactions()[0].Hash(), 0)
+	spend := wire.NewMsgTx(1)
+	spend.AddTxIn(wire.NewTxIn(wire.NewOutPoint(blocks[0].Transactions()[0].Hash(), 0),
+		nil, nil))
+	spend.AddTxOut(wire.NewTxOut(49*1e8, testPkScript))
+	mb := blocks[3].MsgBlock()
+	mb.Transactions = append(mb.Transactions, spend)
+	mb.Header.MerkleRoot = blockchain.CalcMerkleRoot(btcutil.NewBlock(mb).Transactions(), false)
+	blocks[3] = btcutil.NewBlock(mb)
+	testBlocksInsert(ctx, t, s, blocks)
+
+	unlock, err := s.indexingLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if err := s.TxIndexer(ctx, blocks[3].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UtxoIndexer(ctx, blocks[3].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	bu, err := s.db.BlockUndoByHash(ctx, blocks[3].Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sos := bu.SpentOutputs()
+	if len(bu.Txs) != 2 || len(sos) != 1 || sos[0].Outpoint != spent ||
+		sos[0].Value != 50*1e8 ||
+		!bytes.Equal(sos[0].PkScript, testPkScript) {
+		t.Fatalf("unexpected undo record: %v", spew.Sdump(bu))
+	}
+	// The pk scripts of spent outputs are deleted.
+	_, err = s.db.ScriptByOutpoint(ctx, spent)
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", database.ErrNotFound, err)
+	}
+	utxoHH, err := s.UtxoIndexHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := s.utxoUndoAvailable(ctx, utxoHH, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected spent outputs to be available")
+	}
+
+	// Unwinding must require neither the block itself nor the block that
+	// created the spent output.
+	if err := s.db.TxIndexDrop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	scripts, err := s.prevOutScripts(ctx, blocks[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) != 1 || !bytes.Equal(scripts[0], testPkScript) {
+		t.Fatalf("unexpected prevout scripts: %x", scripts)
+	}
+	db := s.db
+	s.db = &prunedDB{Database: db}
+	err = s.UtxoIndexer(ctx, blocks[2].Hash())
+	s.db = db
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxo, err := s.db.UtxoByOutpoint(ctx, spent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utxo.Value() != 50*1e8 {
+		t.Fatalf("unexpected value: %v", utxo.Value())
+	}
+	script, err := s.db.ScriptByOutpoint(ctx, spent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(script, testPkScript) {
+		t.Fatalf("unexpected script: %x", script)
+	}
+	_, err = s.db.ScriptByOutpoint(ctx, tbcd.NewOutpoint(spend.TxHash(), 0))
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", database.ErrNotFound, err)
+	}
+	_, err = s.db.BlockUndoByHash(ctx, blocks[3].Hash())
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", database.ErrNotFound, err)
+	}
+
+	// Blocks indexed by older releases have no undo record.
+	err = s.db.BlockUndoUpdate(ctx, -1, map[chainhash.Hash]*tbcd.BlockUndo{
+		*blocks[0].Hash(): nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if utxoHH, err = s.UtxoIndexHash(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err = s.utxoUndoAvailable(ctx, utxoHH, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected spent outputs to be unavailable")
+	}
+	if ok, err = s.utxoUndoAvailable(ctx, utxoHH, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected spent outputs to be available")
+	}
+
+	// Undo records are pruned up to the provided height, once.
+	if err := s.pruneUndo(ctx, utxoHH, 2); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.db.BlockUndoByHash(ctx, blocks[1].Hash())
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected %v, got %v", database.ErrNotFound, err)
+	}
+	if _, err = s.db.BlockUndoByHash(ctx, blocks[2].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	value, err := s.db.MetadataGet(ctx, UtxoUndoPrunedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, []byte{0, 0, 0, 0, 0, 0, 0, 2}) {
+		t.Fatalf("unexpected undo pruned height: %x", value)
+	}
+	if err := s.pruneUndo(ctx, utxoHH, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.db.BlockUndoByHash(ctx, blocks[2].Hash()); err != nil {
+		t.Fatal(err)
+	}
+}
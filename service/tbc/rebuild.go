@@ -0,0 +1,222 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+
+	"github.com/hemilabs/heminetwork/database"
+)
+
+// indexRebuildProgress is how often rebuild progress is logged.
+const indexRebuildProgress = 10 * time.Second
+
+var ErrUtxoSnapshotRebuild = errors.New("utxo index imported from snapshot")
+
+// indexProgress logs the progress of index towards end until ctx is canceled.
+func (s *Server) indexProgress(ctx context.Context, name string, key []byte, end *HashHeight) {
+	start := time.Now()
+	ticker := time.NewTicker(indexRebuildProgress)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		hh, err := s.mdHashHeight(ctx, key)
+		if err != nil {
+			continue // nothing flushed yet
+		}
+		var pct float64
+		if end.Height > 0 {
+			pct = float64(hh.Height) / float64(end.Height) * 100
+		}
+		log.Infof("Rebuilding %v index %v/%v (%.2f%%) elapsed %v", name,
+			hh.Height, end.Height, pct, time.Since(start).Round(time.Second))
+	}
+}
+
+// IndexRebuild drops the utxo and/or tx index and rebuilds it from the blocks
+// in the database up to endHash. When endHash is nil each index is rebuilt up
+// to the hash it was at. A tx index that was started from a utxo snapshot is
+// rebuilt from the snapshot block. Nothing is dropped unless all blocks up to
+// the end are available. An interrupted rebuild is restarted by calling
+// IndexRebuild again with the same endHash. This must not be called while
+// tbcd is running.
+func (s *Server) IndexRebuild(ctx context.Context, utxo, tx bool, endHash *chainhash.Hash) error {
+	log.Tracef("IndexRebuild")
+	defer log.Tracef("IndexRebuild exit")
+
+	if !utxo && !tx {
+		return errors.New("no index selected")
+	}
+
+	unlock, err := s.indexingLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// A snapshot does not come with the blocks that are required to
+	// rebuild the utxo index.
+	if utxo {
+		_, err := s.db.MetadataGet(ctx, UtxoSnapshotKey)
+		if err == nil {
+			return ErrUtxoSnapshotRebuild
+		} else if !errors.Is(err, database.ErrNotFound) {
+			return fmt.Errorf("metadata utxo snapshot: %w", err)
+		}
+	}
+
+	// The blocks below the index lower bound are not stored.
+	start := s.chainParams.GenesisHash
+	lowerBound, err := s.IndexLowerBound(ctx)
+	if err == nil {
+		start = &lowerBound.Hash
+	} else if !errors.Is(err, database.ErrNotFound) {
+		return fmt.Errorf("index lower bound: %w", err)
+	}
+
+	// Determine where to rebuild to before the index hashes are reset.
+	// Without an end hash every index is rebuilt to where it was.
+	indexers := []struct {
+		enabled bool
+		name    string
+		key     []byte
+		hash    func(context.Context) (*HashHeight, error)
+		indexer func(context.Context, *chainhash.Hash) error
+		drop    func(context.Context) error
+		end     *HashHeight
+	}{
+		// The tx index goes first, matching the order in which the
+		// indexers are wound.
+		{
+			enabled: tx,
+			name:    "tx",
+			key:     TxIndexHashKey,
+			hash:    s.TxIndexHash,
+			indexer: s.TxIndexer,
+			drop:    s.db.TxIndexDrop,
+		},
+		{
+			enabled: utxo,
+			name:    "utxo",
+			key:     UtxoIndexHashKey,
+			hash:    s.UtxoIndexHash,
+			indexer: s.UtxoIndexer,
+			drop:    s.db.UtxoIndexDrop,
+		},
+	}
+	available := make(map[chainhash.Hash]struct{}, len(indexers))
+	for k := range indexers {
+		i := &indexers[k]
+		if !i.enabled {
+			continue
+		}
+		h := endHash
+		if h == nil {
+			hh, err := i.hash(ctx)
+			if err != nil {
+				return fmt.Errorf("%v index hash: %w", i.name, err)
+			}
+			h = &hh.Hash
+		}
+		bh, err := s.db.BlockHeaderByHash(ctx, h)
+		if err != nil {
+			return fmt.Errorf("%v end block header: %w", i.name, err)
+		}
+		i.end = &HashHeight{Hash: bh.Hash, Height: bh.Height}
+
+		// Nothing may be dropped unless all blocks are available.
+		if _, ok := available[i.end.Hash]; ok {
+			continue
+		}
+		if err := s.blocksAvailable(ctx, start, &i.end.Hash); err != nil {
+			return fmt.Errorf("%v index: %w", i.name, err)
+		}
+		available[i.end.Hash] = struct{}{}
+	}
+
+	// Reset the index hash first so that an interrupted drop is never
+	// mistaken for a valid index.
+	for _, i := range indexers {
+		if !i.enabled {
+			continue
+		}
+		if err := s.db.MetadataDel(ctx, i.key); err != nil {
+			return fmt.Errorf("%v index hash: %w", i.name, err)
+		}
+		log.Infof("Dropping %v index", i.name)
+		if err := i.drop(ctx); err != nil {
+			return fmt.Errorf("%v index drop: %w", i.name, err)
+		}
+		if lowerBound != nil {
+			err := s.db.MetadataPut(ctx, i.key, lowerBound.Hash[:])
+			if err != nil {
+				return fmt.Errorf("%v index hash: %w", i.name, err)
+			}
+		}
+	}
+
+	for _, i := range indexers {
+		if !i.enabled {
+			continue
+		}
+		log.Infof("Rebuilding %v index to %v", i.name, i.end)
+		start := time.Now()
+		pctx, cancel := context.WithCancel(ctx)
+		go s.indexProgress(pctx, i.name, i.key, i.end)
+		err := i.indexer(ctx, &i.end.Hash)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("%v indexer: %w", i.name, err)
+		}
+		log.Infof("Rebuilt %v index to %v took %v", i.name, i.end,
+			time.Since(start))
+	}
+
+	return nil
+}
+
+// blocksAvailable returns an error when a block between start, exclusive, and
+// hash is missing or when blocks have been pruned.
+func (s *Server) blocksAvailable(ctx context.Context, start, hash *chainhash.Hash) error {
+	bfs, err := s.db.BlockFiles(ctx)
+	if err != nil {
+		return fmt.Errorf("block files: %w", err)
+	}
+	for _, bf := range bfs {
+		if bf.Pruned {
+			return fmt.Errorf("block file %v: %w", bf.Number,
+				database.ErrBlockPruned)
+		}
+	}
+
+	h := hash
+	for !h.IsEqual(start) && !h.IsEqual(s.chainParams.GenesisHash) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ok, err := s.db.BlockExistsByHash(ctx, h)
+		if err != nil {
+			return fmt.Errorf("block exists %v: %w", h, err)
+		}
+		if !ok {
+			return database.BlockNotFoundError{Hash: *h}
+		}
+		bh, err := s.db.BlockHeaderByHash(ctx, h)
+		if err != nil {
+			return fmt.Errorf("block header %v: %w", h, err)
+		}
+		h = bh.ParentHash()
+	}
+	return nil
+}
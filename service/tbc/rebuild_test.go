@@ -0,0 +1,157 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+func TestIndexRebuild(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg := NewDefaultConfig()
+	cfg.Network = networkLocalnet
+	cfg.LevelDBHome = t.TempDir()
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := testBlocks(*chaincfg.RegressionNetParams.GenesisHash, 0, 5, 0)
+	testBlocksInsert(ctx, t, s, blocks)
+	tip := blocks[len(blocks)-1].Hash()
+	unlock, err := s.indexingLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TxIndexer(ctx, blocks[2].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UtxoIndexer(ctx, blocks[2].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	// Corrupt the utxo index.
+	sh := tbcd.NewScriptHashFromScript(testPkScript)
+	bogus := tbcd.NewOutpoint(chainhash.DoubleHashH([]byte("bogus")), 0)
+	err = s.db.BlockUtxoUpdate(ctx, 1, map[tbcd.Outpoint]tbcd.CacheOutput{
+		bogus: tbcd.NewCacheOutput(sh, 1, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuild to where the indexes are.
+	if err := s.IndexRebuild(ctx, true, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.UtxoByOutpoint(ctx, bogus); !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected bogus utxo to be dropped, got %v", err)
+	}
+	balance, err := s.db.BalanceByScriptHash(ctx, sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 3*50*1e8 {
+		t.Fatalf("unexpected balance: %v", balance)
+	}
+
+	// Rebuild the tx index only, to the tip.
+	if err := s.IndexRebuild(ctx, false, true, tip); err != nil {
+		t.Fatal(err)
+	}
+	txHH, err := s.TxIndexHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxoHH, err := s.UtxoIndexHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !txHH.Hash.IsEqual(tip) || !utxoHH.Hash.IsEqual(blocks[2].Hash()) {
+		t.Fatalf("unexpected indexes: tx %v utxo %v", txHH, utxoHH)
+	}
+	txId := blocks[4].Transactions()[0].Hash()
+	if hash, err := s.db.BlockHashByTxId(ctx, txId); err != nil || !hash.IsEqual(tip) {
+		t.Fatalf("unexpected tx block: %v %v", hash, err)
+	}
+
+	r, err := s.DBVerify(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 {
+		t.Fatalf("unexpected problems: %v", r.Problems)
+	}
+
+	// Without an end hash every index is rebuilt to where it was.
+	if err := s.IndexRebuild(ctx, true, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	if txHH, err = s.TxIndexHash(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if utxoHH, err = s.UtxoIndexHash(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !txHH.Hash.IsEqual(tip) || !utxoHH.Hash.IsEqual(blocks[2].Hash()) {
+		t.Fatalf("unexpected indexes: tx %v utxo %v", txHH, utxoHH)
+	}
+
+	// Nothing is dropped when a block is missing.
+	missing := testBlocks(*tip, 5, 1, 0)[0]
+	testHeadersInsert(ctx, t, s, []*wire.BlockHeader{&missing.MsgBlock().Header})
+	err = s.IndexRebuild(ctx, true, true, missing.Hash())
+	if !errors.Is(err, database.ErrBlockNotFound) {
+		t.Fatalf("expected %v, got %v", database.ErrBlockNotFound, err)
+	}
+	if txHH, err = s.TxIndexHash(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if utxoHH, err = s.UtxoIndexHash(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !txHH.Hash.IsEqual(tip) || !utxoHH.Hash.IsEqual(blocks[2].Hash()) {
+		t.Fatalf("unexpected indexes: tx %v utxo %v", txHH, utxoHH)
+	}
+	balance, err = s.db.BalanceByScriptHash(ctx, sh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 3*50*1e8 {
+		t.Fatalf("unexpected balance: %v", balance)
+	}
+
+	// Utxo indexes imported from a snapshot cannot be rebuilt.
+	if err := s.db.MetadataPut(ctx, UtxoSnapshotKey, []byte("digest")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.IndexRebuild(ctx, true, false, nil); !errors.Is(err, ErrUtxoSnapshotRebuild) {
+		t.Fatalf("expected %v, got %v", ErrUtxoSnapshotRebuild, err)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/hemilabs/heminetwork/api/protocol"
 	"github.com/hemilabs/heminetwork/api/tbcapi"
 	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
 	"github.com/hemilabs/heminetwork/database/tbcd/level"
 )
 
@@ -44,6 +45,11 @@ type tbcWs struct {
 	conn           *protocol.WSConn
 	sessionID      string
 	requestContext context.Context
+
+	// Subscriptions, protected by the server mutex.
+	notify        map[notificationId]struct{}
+	scriptHashes  map[tbcd.ScriptHash]struct{}
+	notifications chan any
 }
 
 func (s *Server) handleWebsocketRead(ctx context.Context, ws *tbcWs) {
@@ -134,6 +140,20 @@ func (s *Server) handleWebsocketRead(ctx context.Context, ws *tbcWs) {
 				return s.handleUtxosByAddressRequest(ctx, req)
 			}
 
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdTxsByAddressRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.TxsByAddressRequest)
+				return s.handleTxsByAddressRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdTxsByScriptHashRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.TxsByScriptHashRequest)
+				return s.handleTxsByScriptHashRequest(ctx, req)
+			}
+
 			go s.handleRequest(ctx, ws, id, cmd, handler)
 		case tbcapi.CmdTxByIdRequest:
 			handler := func(ctx context.Context) (any, error) {
@@ -148,6 +168,20 @@ func (s *Server) handleWebsocketRead(ctx context.Context, ws *tbcWs) {
 				return s.handleTxByIdRawRequest(ctx, req)
 			}
 
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdTxMerkleProofRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.TxMerkleProofRequest)
+				return s.handleTxMerkleProofRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdOutpointSpentByRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.OutpointSpentByRequest)
+				return s.handleOutpointSpentByRequest(ctx, req)
+			}
+
 			go s.handleRequest(ctx, ws, id, cmd, handler)
 		case tbcapi.CmdTxBroadcastRequest:
 			handler := func(ctx context.Context) (any, error) {
@@ -190,6 +224,90 @@ func (s *Server) handleWebsocketRead(ctx context.Context, ws *tbcWs) {
 				return s.handleBlockDownloadAsyncRawRequest(ctx, req)
 			}
 
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdBlockFilterByHashRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.BlockFilterByHashRequest)
+				return s.handleBlockFilterByHashRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdBlockFiltersByHeightRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.BlockFiltersByHeightRequest)
+				return s.handleBlockFiltersByHeightRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdBlockFilterHeaderByHashRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.BlockFilterHeaderByHashRequest)
+				return s.handleBlockFilterHeaderByHashRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdBlockFilterHeadersByHeightRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.BlockFilterHeadersByHeightRequest)
+				return s.handleBlockFilterHeadersByHeightRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdFeeEstimateRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.FeeEstimateRequest)
+				return s.handleFeeEstimateRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdMempoolInfoRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.MempoolInfoRequest)
+				return s.handleMempoolInfoRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdMempoolTxsRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.MempoolTxsRequest)
+				return s.handleMempoolTxsRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdPeersRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.PeersRequest)
+				return s.handlePeersRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdPeerBanRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.PeerBanRequest)
+				return s.handlePeerBanRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdPeerUnbanRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.PeerUnbanRequest)
+				return s.handlePeerUnbanRequest(ctx, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdSubscribeRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.SubscribeRequest)
+				return s.handleSubscribeRequest(ctx, ws, req)
+			}
+
+			go s.handleRequest(ctx, ws, id, cmd, handler)
+		case tbcapi.CmdUnsubscribeRequest:
+			handler := func(ctx context.Context) (any, error) {
+				req := payload.(*tbcapi.UnsubscribeRequest)
+				return s.handleUnsubscribeRequest(ctx, ws, req)
+			}
+
 			go s.handleRequest(ctx, ws, id, cmd, handler)
 		default:
 			err = fmt.Errorf("unknown command: %v", cmd)
@@ -481,6 +599,76 @@ func (s *Server) handleUtxosByAddressRequest(ctx context.Context, req *tbcapi.UT
 	}, nil
 }
 
+func (s *Server) handleTxsByAddressRequest(ctx context.Context, req *tbcapi.TxsByAddressRequest) (any, error) {
+	log.Tracef("handleTxsByAddressRequest")
+	defer log.Tracef("handleTxsByAddressRequest exit")
+
+	if req.Count == 0 || req.Count > maxTxHistory {
+		return &tbcapi.TxsByAddressResponse{
+			Error: protocol.RequestErrorf("count must be between 1 and %d", maxTxHistory),
+		}, nil
+	}
+	if len(req.Cursor) != 0 && len(req.Cursor) != tbcd.HistoryCursorSize {
+		return &tbcapi.TxsByAddressResponse{
+			Error: protocol.RequestErrorf("invalid cursor"),
+		}, nil
+	}
+
+	txs, next, err := s.TxsByAddress(ctx, req.Address, req.Cursor, uint64(req.Count))
+	if err != nil {
+		if errors.Is(err, level.ErrIterator) {
+			e := protocol.NewInternalError(err)
+			return &tbcapi.TxsByAddressResponse{
+				Error: e.ProtocolError(),
+			}, e
+		}
+
+		return &tbcapi.TxsByAddressResponse{
+			Error: protocol.RequestErrorf("error getting txs for address: %s", req.Address),
+		}, nil
+	}
+
+	return &tbcapi.TxsByAddressResponse{
+		Txs:        txHistoryToTBC(txs),
+		NextCursor: next,
+	}, nil
+}
+
+func (s *Server) handleTxsByScriptHashRequest(ctx context.Context, req *tbcapi.TxsByScriptHashRequest) (any, error) {
+	log.Tracef("handleTxsByScriptHashRequest")
+	defer log.Tracef("handleTxsByScriptHashRequest exit")
+
+	sh, err := tbcd.NewScriptHashFromBytes(req.ScriptHash)
+	if err != nil {
+		return &tbcapi.TxsByScriptHashResponse{
+			Error: protocol.RequestErrorf("invalid script hash: %v", err),
+		}, nil
+	}
+	if req.Count == 0 || req.Count > maxTxHistory {
+		return &tbcapi.TxsByScriptHashResponse{
+			Error: protocol.RequestErrorf("count must be between 1 and %d", maxTxHistory),
+		}, nil
+	}
+	if len(req.Cursor) != 0 && len(req.Cursor) != tbcd.HistoryCursorSize {
+		return &tbcapi.TxsByScriptHashResponse{
+			Error: protocol.RequestErrorf("invalid cursor"),
+		}, nil
+	}
+
+	txs, next, err := s.TxsByScriptHash(ctx, sh, req.Cursor, uint64(req.Count))
+	if err != nil {
+		e := protocol.NewInternalError(err)
+		return &tbcapi.TxsByScriptHashResponse{
+			Error: e.ProtocolError(),
+		}, e
+	}
+
+	return &tbcapi.TxsByScriptHashResponse{
+		Txs:        txHistoryToTBC(txs),
+		NextCursor: next,
+	}, nil
+}
+
 func (s *Server) handleTxByIdRawRequest(ctx context.Context, req *tbcapi.TxByIdRawRequest) (any, error) {
 	log.Tracef("handleTxByIdRawRequest")
 	defer log.Tracef("handleTxByIdRawRequest exit")
@@ -537,6 +725,77 @@ func (s *Server) handleTxByIdRequest(ctx context.Context, req *tbcapi.TxByIdRequ
 	}, nil
 }
 
+func (s *Server) handleTxMerkleProofRequest(ctx context.Context, req *tbcapi.TxMerkleProofRequest) (any, error) {
+	log.Tracef("handleTxMerkleProofRequest")
+	defer log.Tracef("handleTxMerkleProofRequest exit")
+
+	if req.TxID == nil {
+		return &tbcapi.TxMerkleProofResponse{
+			Error: protocol.RequestErrorf("tx id must be provided"),
+		}, nil
+	}
+
+	mp, err := s.TxMerkleProof(ctx, req.TxID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return &tbcapi.TxMerkleProofResponse{
+				Error: protocol.RequestErrorf("tx not found: %s", req.TxID),
+			}, nil
+		}
+		if errors.Is(err, database.ErrBlockPruned) {
+			return &tbcapi.TxMerkleProofResponse{
+				Error: protocol.RequestErrorf("block of tx %s pruned", req.TxID),
+			}, nil
+		}
+
+		responseErr := protocol.NewInternalError(err)
+		return &tbcapi.TxMerkleProofResponse{
+			Error: responseErr.ProtocolError(),
+		}, responseErr
+	}
+
+	return &tbcapi.TxMerkleProofResponse{
+		BlockHash:    &mp.BlockHash,
+		BlockHeight:  mp.BlockHeight,
+		TxIndex:      mp.TxIndex,
+		MerkleHashes: mp.MerkleHashes,
+	}, nil
+}
+
+func (s *Server) handleOutpointSpentByRequest(ctx context.Context, req *tbcapi.OutpointSpentByRequest) (any, error) {
+	log.Tracef("handleOutpointSpentByRequest")
+	defer log.Tracef("handleOutpointSpentByRequest exit")
+
+	if req.OutPoint == nil {
+		return &tbcapi.OutpointSpentByResponse{
+			Error: protocol.RequestErrorf("outpoint must be provided"),
+		}, nil
+	}
+
+	op := wire.OutPoint{Hash: req.OutPoint.Hash, Index: req.OutPoint.Index}
+	sb, err := s.OutpointSpentBy(ctx, op)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return &tbcapi.OutpointSpentByResponse{
+				Error: protocol.RequestErrorf("spend not found: %s", op),
+			}, nil
+		}
+
+		responseErr := protocol.NewInternalError(err)
+		return &tbcapi.OutpointSpentByResponse{
+			Error: responseErr.ProtocolError(),
+		}, responseErr
+	}
+
+	return &tbcapi.OutpointSpentByResponse{
+		TxId:        &sb.TxId,
+		InputIndex:  sb.InputIndex,
+		BlockHash:   sb.BlockHash,
+		BlockHeight: sb.BlockHeight,
+		Mempool:     sb.BlockHash == nil,
+	}, nil
+}
+
 func (s *Server) handleTxBroadcastRequest(ctx context.Context, req *tbcapi.TxBroadcastRequest) (any, error) {
 	log.Tracef("handleTxBroadcastRequest")
 	defer log.Tracef("handleTxBroadcastRequest exit")
@@ -688,6 +947,315 @@ func (s *Server) handleBlockDownloadAsyncRawRequest(ctx context.Context, req *tb
 	return &tbcapi.BlockDownloadAsyncRawResponse{Block: rb}, nil
 }
 
+func (s *Server) handleBlockFilterByHashRequest(ctx context.Context, req *tbcapi.BlockFilterByHashRequest) (any, error) {
+	log.Tracef("handleBlockFilterByHashRequest")
+	defer log.Tracef("handleBlockFilterByHashRequest exit")
+
+	if req.Hash == nil {
+		return &tbcapi.BlockFilterByHashResponse{
+			Error: protocol.RequestErrorf("hash must be provided"),
+		}, nil
+	}
+
+	bf, err := s.BlockFilterByHash(ctx, req.Hash)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return &tbcapi.BlockFilterByHashResponse{
+				Error: protocol.RequestErrorf("block filter not found with hash: %s", req.Hash),
+			}, nil
+		}
+
+		e := protocol.NewInternalError(err)
+		return &tbcapi.BlockFilterByHashResponse{
+			Error: e.ProtocolError(),
+		}, e
+	}
+	_, height, err := s.BlockHeaderByHash(ctx, req.Hash)
+	if err != nil {
+		e := protocol.NewInternalError(err)
+		return &tbcapi.BlockFilterByHashResponse{
+			Error: e.ProtocolError(),
+		}, e
+	}
+
+	return &tbcapi.BlockFilterByHashResponse{
+		BlockFilter: blockFilterToTBC(bf, height),
+	}, nil
+}
+
+func (s *Server) handleBlockFiltersByHeightRequest(ctx context.Context, req *tbcapi.BlockFiltersByHeightRequest) (any, error) {
+	log.Tracef("handleBlockFiltersByHeightRequest")
+	defer log.Tracef("handleBlockFiltersByHeightRequest exit")
+
+	if req.Count == 0 || req.Count > maxBlockFilters {
+		return &tbcapi.BlockFiltersByHeightResponse{
+			Error: protocol.RequestErrorf("count must be between 1 and %d", maxBlockFilters),
+		}, nil
+	}
+
+	bfs, err := s.BlockFiltersByHeight(ctx, req.Height, uint64(req.Count))
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return &tbcapi.BlockFiltersByHeightResponse{
+				Error: protocol.RequestErrorf("block filters not found at height %d", req.Height),
+			}, nil
+		}
+
+		e := protocol.NewInternalError(err)
+		return &tbcapi.BlockFiltersByHeightResponse{
+			Error: e.ProtocolError(),
+		}, e
+	}
+
+	blockFilters := make([]*tbcapi.BlockFilter, 0, len(bfs))
+	for k, bf := range bfs {
+		blockFilters = append(blockFilters,
+			blockFilterToTBC(bf, req.Height+uint64(k)))
+	}
+
+	return &tbcapi.BlockFiltersByHeightResponse{
+		BlockFilters: blockFilters,
+	}, nil
+}
+
+func (s *Server) handleBlockFilterHeaderByHashRequest(ctx context.Context, req *tbcapi.BlockFilterHeaderByHashRequest) (any, error) {
+	log.Tracef("handleBlockFilterHeaderByHashRequest")
+	defer log.Tracef("handleBlockFilterHeaderByHashRequest exit")
+
+	if req.Hash == nil {
+		return &tbcapi.BlockFilterHeaderByHashResponse{
+			Error: protocol.RequestErrorf("hash must be provided"),
+		}, nil
+	}
+
+	bf, err := s.BlockFilterByHash(ctx, req.Hash)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return &tbcapi.BlockFilterHeaderByHashResponse{
+				Error: protocol.RequestErrorf("block filter header not found with hash: %s", req.Hash),
+			}, nil
+		}
+
+		e := protocol.NewInternalError(err)
+		return &tbcapi.BlockFilterHeaderByHashResponse{
+			Error: e.ProtocolError(),
+		}, e
+	}
+	_, height, err := s.BlockHeaderByHash(ctx, req.Hash)
+	if err != nil {
+		e := protocol.NewInternalError(err)
+		return &tbcapi.BlockFilterHeaderByHashResponse{
+			Error: e.ProtocolError(),
+		}, e
+	}
+
+	return &tbcapi.BlockFilterHeaderByHashResponse{
+		BlockFilterHeader: blockFilterHeaderToTBC(bf, height),
+	}, nil
+}
+
+func (s *Server) handleBlockFilterHeadersByHeightRequest(ctx context.Context, req *tbcapi.BlockFilterHeadersByHeightRequest) (any, error) {
+	log.Tracef("handleBlockFilterHeadersByHeightRequest")
+	defer log.Tracef("handleBlockFilterHeadersByHeightRequest exit")
+
+	if req.Count == 0 || req.Count > maxBlockFilterHeaders {
+		return &tbcapi.BlockFilterHeadersByHeightResponse{
+			Error: protocol.RequestErrorf("count must be between 1 and %d", maxBlockFilterHeaders),
+		}, nil
+	}
+
+	bfs, err := s.BlockFiltersByHeight(ctx, req.Height, uint64(req.Count))
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return &tbcapi.BlockFilterHeadersByHeightResponse{
+				Error: protocol.RequestErrorf("block filter headers not found at height %d", req.Height),
+			}, nil
+		}
+
+		e := protocol.NewInternalError(err)
+		return &tbcapi.BlockFilterHeadersByHeightResponse{
+			Error: e.ProtocolError(),
+		}, e
+	}
+
+	headers := make([]*tbcapi.BlockFilterHeader, 0, len(bfs))
+	for k, bf := range bfs {
+		headers = append(headers,
+			blockFilterHeaderToTBC(bf, req.Height+uint64(k)))
+	}
+
+	return &tbcapi.BlockFilterHeadersByHeightResponse{
+		BlockFilterHeaders: headers,
+	}, nil
+}
+
+func (s *Server) handleFeeEstimateRequest(ctx context.Context, _ *tbcapi.FeeEstimateRequest) (any, error) {
+	log.Tracef("handleFeeEstimateRequest")
+	defer log.Tracef("handleFeeEstimateRequest exit")
+
+	fes, err := s.FeeEstimate(ctx)
+	if err != nil {
+		if errors.Is(err, ErrMempoolDisabled) {
+			return &tbcapi.FeeEstimateResponse{
+				Error: protocol.RequestErrorf("mempool disabled"),
+			}, nil
+		}
+
+		e := protocol.NewInternalError(err)
+		return &tbcapi.FeeEstimateResponse{
+			Error: e.ProtocolError(),
+		}, e
+	}
+
+	estimates := make([]*tbcapi.FeeEstimate, 0, len(fes))
+	for _, fe := range fes {
+		estimates = append(estimates, &tbcapi.FeeEstimate{
+			Blocks:       fe.Blocks,
+			SatsPerVByte: fe.SatsPerVByte,
+		})
+	}
+
+	return &tbcapi.FeeEstimateResponse{
+		FeeEstimates: estimates,
+	}, nil
+}
+
+func (s *Server) handleMempoolInfoRequest(ctx context.Context, _ *tbcapi.MempoolInfoRequest) (any, error) {
+	log.Tracef("handleMempoolInfoRequest")
+	defer log.Tracef("handleMempoolInfoRequest exit")
+
+	mi, err := s.MempoolInfo(ctx)
+	if err != nil {
+		if errors.Is(err, ErrMempoolDisabled) {
+			return &tbcapi.MempoolInfoResponse{
+				Error: protocol.RequestErrorf("mempool disabled"),
+			}, nil
+		}
+
+		e := protocol.NewInternalError(err)
+		return &tbcapi.MempoolInfoResponse{
+			Error: e.ProtocolError(),
+		}, e
+	}
+
+	histogram := make([]*tbcapi.FeeRateBucket, 0, len(mi.Histogram))
+	for _, b := range mi.Histogram {
+		histogram = append(histogram, &tbcapi.FeeRateBucket{
+			SatsPerVByte: b.SatsPerVByte,
+			VSize:        b.VSize,
+		})
+	}
+
+	return &tbcapi.MempoolInfoResponse{
+		Count:     mi.Count,
+		Pending:   mi.Pending,
+		Size:      mi.Size,
+		MaxSize:   mi.MaxSize,
+		Histogram: histogram,
+	}, nil
+}
+
+func (s *Server) handleMempoolTxsRequest(ctx context.Context, req *tbcapi.MempoolTxsRequest) (any, error) {
+	log.Tracef("handleMempoolTxsRequest")
+	defer log.Tracef("handleMempoolTxsRequest exit")
+
+	if req.Count == 0 || req.Count > maxMempoolTxs {
+		return &tbcapi.MempoolTxsResponse{
+			Error: protocol.RequestErrorf("count must be between 1 and %d", maxMempoolTxs),
+		}, nil
+	}
+
+	mts, err := s.MempoolTxs(ctx, int(req.Start), int(req.Count))
+	if err != nil {
+		if errors.Is(err, ErrMempoolDisabled) {
+			return &tbcapi.MempoolTxsResponse{
+				Error: protocol.RequestErrorf("mempool disabled"),
+			}, nil
+		}
+
+		e := protocol.NewInternalError(err)
+		return &tbcapi.MempoolTxsResponse{
+			Error: e.ProtocolError(),
+		}, e
+	}
+
+	txs := make([]*tbcapi.MempoolTx, 0, len(mts))
+	for _, mt := range mts {
+		txs = append(txs, &tbcapi.MempoolTx{
+			TxId:         mt.TxId,
+			Size:         mt.Size,
+			VSize:        mt.VSize,
+			Fee:          mt.Fee,
+			SatsPerVByte: mt.FeeRate(),
+			Time:         mt.Added.Unix(),
+		})
+	}
+
+	return &tbcapi.MempoolTxsResponse{
+		Txs: txs,
+	}, nil
+}
+
+// unixOrZero returns the unix time of t or 0 for the zero time.
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func (s *Server) handlePeersRequest(_ context.Context, _ *tbcapi.PeersRequest) (any, error) {
+	log.Tracef("handlePeersRequest")
+	defer log.Tracef("handlePeersRequest exit")
+
+	book := s.Peers()
+	peers := make([]*tbcapi.Peer, 0, len(book))
+	for _, p := range book {
+		peers = append(peers, &tbcapi.Peer{
+			Address:   p.Address,
+			LastSeen:  unixOrZero(p.LastSeen),
+			Successes: p.Successes,
+			Failures:  p.Failures,
+			Score:     p.Score,
+			BanUntil:  unixOrZero(p.BanUntil),
+		})
+	}
+
+	return &tbcapi.PeersResponse{
+		Peers: peers,
+	}, nil
+}
+
+func (s *Server) handlePeerBanRequest(ctx context.Context, req *tbcapi.PeerBanRequest) (any, error) {
+	log.Tracef("handlePeerBanRequest")
+	defer log.Tracef("handlePeerBanRequest exit")
+
+	d := banDuration
+	if req.Duration != 0 {
+		d = time.Duration(req.Duration) * time.Second
+	}
+	if err := s.PeerBan(ctx, req.Address, d); err != nil {
+		return &tbcapi.PeerBanResponse{
+			Error: protocol.RequestErrorf("ban %v: %v", req.Address, err),
+		}, nil
+	}
+
+	return &tbcapi.PeerBanResponse{}, nil
+}
+
+func (s *Server) handlePeerUnbanRequest(_ context.Context, req *tbcapi.PeerUnbanRequest) (any, error) {
+	log.Tracef("handlePeerUnbanRequest")
+	defer log.Tracef("handlePeerUnbanRequest exit")
+
+	if err := s.PeerUnban(req.Address); err != nil {
+		return &tbcapi.PeerUnbanResponse{
+			Error: protocol.RequestErrorf("unban %v: %v", req.Address, err),
+		}, nil
+	}
+
+	return &tbcapi.PeerUnbanResponse{}, nil
+}
+
 func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	log.Tracef("handleWebsocket: %v", r.RemoteAddr)
 	defer log.Tracef("handleWebsocket exit: %v", r.RemoteAddr)
@@ -706,6 +1274,9 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 		addr:           r.RemoteAddr,
 		conn:           protocol.NewWSConn(conn),
 		requestContext: r.Context(),
+		notify:         make(map[notificationId]struct{}),
+		scriptHashes:   make(map[tbcd.ScriptHash]struct{}),
+		notifications:  make(chan any, notificationQueueSize),
 	}
 
 	if ws.sessionID, err = s.newSession(ws); err != nil {
@@ -717,6 +1288,9 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	ws.wg.Add(1)
 	go s.handleWebsocketRead(r.Context(), ws)
 
+	// Exits when the request context is canceled on return.
+	go s.handleWebsocketNotifications(r.Context(), ws)
+
 	// Always ping, required by protocol.
 	ping := &tbcapi.PingRequest{
 		Timestamp: time.Now().Unix(),
@@ -843,3 +1417,31 @@ func wireTxToTBC(w *wire.MsgTx) *tbcapi.Tx {
 
 	return tx
 }
+
+func blockFilterToTBC(bf *tbcd.BlockFilter, height uint64) *tbcapi.BlockFilter {
+	return &tbcapi.BlockFilter{
+		BlockHash: bf.BlockHash,
+		Height:    height,
+		Header:    bf.Header,
+		Filter:    bf.Filter,
+	}
+}
+
+func blockFilterHeaderToTBC(bf *tbcd.BlockFilter, height uint64) *tbcapi.BlockFilterHeader {
+	return &tbcapi.BlockFilterHeader{
+		BlockHash: bf.BlockHash,
+		Height:    height,
+		Header:    bf.Header,
+	}
+}
+
+func txHistoryToTBC(txs []tbcd.TxHistory) []*tbcapi.TxHistory {
+	th := make([]*tbcapi.TxHistory, 0, len(txs))
+	for _, tx := range txs {
+		th = append(th, &tbcapi.TxHistory{
+			TxId:   tx.TxId,
+			Height: tx.Height,
+		})
+	}
+	return th
+}
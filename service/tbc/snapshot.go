@@ -0,0 +1,656 @@
+// Copyright (c) 2024 Hemi Labs, Inc.
+// Use of this source code is governed by the MIT License,
+// which can be found in the LICENSE file.
+
+package tbc
+
+// UTxo snapshots allow a fresh node to skip building the indexes from
+// genesis. A snapshot file is laid out as follows, integers are big endian:
+//
+//	magic   [8]byte  "tbcutxos"
+//	version uint32
+//	network uint32   wire.BitcoinNet
+//	hash    [32]byte block hash of the utxo index
+//	height  uint64   block height of the utxo index
+//	count   uint64   number of records
+//	fheader [32]byte filter header of the block
+//	flen    uint32   length of the filter
+//	filter  flen * byte BIP158 filter of the block
+//	records count * (txid [32]byte, index uint32, script_hash [32]byte,
+//	                 value uint64, script_len uint32, script)
+//	digest  [32]byte sha256 of all preceding bytes
+//
+// The digest identifies the snapshot contents and can be pinned in the
+// configuration to verify imports.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/hemilabs/heminetwork/database"
+	"github.com/hemilabs/heminetwork/database/tbcd"
+)
+
+const (
+	utxoSnapshotVersion    = 2
+	utxoSnapshotHeaderSize = 8 + 4 + 4 + 32 + 8 + 8 + 32 + 4
+	utxoSnapshotRecordSize = 32 + 4 + 32 + 8 + 4 // without script
+
+	// utxoSnapshotMaxFilter is the maximum filter length, a filter cannot
+	// be larger than its block.
+	utxoSnapshotMaxFilter = wire.MaxBlockPayload
+)
+
+var (
+	utxoSnapshotMagic = [8]byte{'t', 'b', 'c', 'u', 't', 'x', 'o', 's'}
+
+	ErrUtxoSnapshotInvalid      = errors.New("invalid utxo snapshot")
+	ErrUtxoSnapshotNotCanonical = errors.New("utxo snapshot block not canonical")
+	ErrUtxoIndexNotEmpty        = errors.New("utxo index not empty")
+)
+
+// UtxoSnapshot describes a utxo snapshot file.
+type UtxoSnapshot struct {
+	Hash         chainhash.Hash
+	Height       uint64
+	Count        uint64
+	FilterHeader chainhash.Hash
+	Filter       []byte
+	Digest       [sha256.Size]byte
+}
+
+// DigestString returns the hex encoded snapshot digest.
+func (u UtxoSnapshot) DigestString() string {
+	return hex.EncodeToString(u.Digest[:])
+}
+
+func (u UtxoSnapshot) String() string {
+	return fmt.Sprintf("%v @ %v utxos %v digest %v", u.Hash, u.Height,
+		u.Count, u.DigestString())
+}
+
+func encodeUtxoSnapshotHeader(net wire.BitcoinNet, us *UtxoSnapshot) []byte {
+	h := make([]byte, utxoSnapshotHeaderSize)
+	copy(h[0:8], utxoSnapshotMagic[:])
+	binary.BigEndian.PutUint32(h[8:12], utxoSnapshotVersion)
+	binary.BigEndian.PutUint32(h[12:16], uint32(net))
+	copy(h[16:48], us.Hash[:])
+	binary.BigEndian.PutUint64(h[48:56], us.Height)
+	binary.BigEndian.PutUint64(h[56:64], us.Count)
+	copy(h[64:96], us.FilterHeader[:])
+	binary.BigEndian.PutUint32(h[96:100], uint32(len(us.Filter)))
+	return h
+}
+
+// decodeUtxoSnapshotHeader decodes the snapshot header. The filter is not
+// part of the header and is only allocated.
+func decodeUtxoSnapshotHeader(net wire.BitcoinNet, h []byte) (*UtxoSnapshot, error) {
+	if len(h) != utxoSnapshotHeaderSize {
+		return nil, fmt.Errorf("%w: header size %v", ErrUtxoSnapshotInvalid,
+			len(h))
+	}
+	if !bytes.Equal(h[0:8], utxoSnapshotMagic[:]) {
+		return nil, fmt.Errorf("%w: magic %x", ErrUtxoSnapshotInvalid, h[0:8])
+	}
+	if v := binary.BigEndian.Uint32(h[8:12]); v != utxoSnapshotVersion {
+		return nil, fmt.Errorf("%w: version %v", ErrUtxoSnapshotInvalid, v)
+	}
+	if n := wire.BitcoinNet(binary.BigEndian.Uint32(h[12:16])); n != net {
+		return nil, fmt.Errorf("%w: network %v", ErrUtxoSnapshotInvalid, n)
+	}
+	flen := binary.BigEndian.Uint32(h[96:100])
+	if flen == 0 || flen > utxoSnapshotMaxFilter {
+		return nil, fmt.Errorf("%w: filter length %v",
+			ErrUtxoSnapshotInvalid, flen)
+	}
+	us := &UtxoSnapshot{
+		Height: binary.BigEndian.Uint64(h[48:56]),
+		Count:  binary.BigEndian.Uint64(h[56:64]),
+		Filter: make([]byte, flen),
+	}
+	copy(us.Hash[:], h[16:48])
+	copy(us.FilterHeader[:], h[64:96])
+	return us, nil
+}
+
+func encodeUtxoSnapshotRecord(r []byte, op tbcd.Outpoint, co tbcd.CacheOutput, script []byte) []byte {
+	r = append(r, op.TxId()...)
+	r = append(r, op.TxIndexBytes()...)
+	r = append(r, co.ScriptHashSlice()...)
+	r = append(r, co.ValueBytes()...)
+	r = binary.BigEndian.AppendUint32(r, uint32(len(script)))
+	return append(r, script...)
+}
+
+func decodeUtxoSnapshotRecord(rd io.Reader, r []byte) (tbcd.Outpoint, tbcd.CacheOutput, []byte, error) {
+	if _, err := io.ReadFull(rd, r[:utxoSnapshotRecordSize]); err != nil {
+		return tbcd.Outpoint{}, tbcd.CacheOutput{}, nil, err
+	}
+	var txId, sh [32]byte
+	copy(txId[:], r[0:32])
+	index := binary.BigEndian.Uint32(r[32:36])
+	copy(sh[:], r[36:68])
+	value := binary.BigEndian.Uint64(r[68:76])
+	slen := binary.BigEndian.Uint32(r[76:80])
+	if slen > txscript.MaxScriptSize {
+		return tbcd.Outpoint{}, tbcd.CacheOutput{}, nil,
+			fmt.Errorf("%w: script length %v", ErrUtxoSnapshotInvalid,
+				slen)
+	}
+	script := make([]byte, slen)
+	if _, err := io.ReadFull(rd, script); err != nil {
+		return tbcd.Outpoint{}, tbcd.CacheOutput{}, nil, err
+	}
+	if tbcd.NewScriptHashFromScript(script) != sh {
+		return tbcd.Outpoint{}, tbcd.CacheOutput{}, nil,
+			fmt.Errorf("%w: script hash mismatch %x:%v",
+				ErrUtxoSnapshotInvalid, txId, index)
+	}
+	return tbcd.NewOutpoint(txId, index), tbcd.NewCacheOutput(sh, value, index),
+		script, nil
+}
+
+// indexingLock marks the server as indexing. The returned function must be
+// called to release it.
+func (s *Server) indexingLock() (func(), error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.indexing {
+		return nil, ErrAlreadyIndexing
+	}
+	s.indexing = true
+	return func() {
+		s.mtx.Lock()
+		s.indexing = false
+		s.mtx.Unlock()
+	}, nil
+}
+
+// UtxoSnapshotExport writes the utxo index to filename. When hash is not nil
+// the utxo index is moved to hash first, otherwise the utxo index is exported
+// where it currently is.
+func (s *Server) UtxoSnapshotExport(ctx context.Context, filename string, hash *chainhash.Hash) (*UtxoSnapshot, error) {
+	log.Tracef("UtxoSnapshotExport")
+	defer log.Tracef("UtxoSnapshotExport exit")
+
+	unlock, err := s.indexingLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if hash != nil {
+		if err := s.UtxoIndexer(ctx, hash); err != nil {
+			return nil, fmt.Errorf("utxo indexer: %w", err)
+		}
+	}
+	utxoHH, err := s.UtxoIndexHash(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("utxo index hash: %w", err)
+	}
+
+	// The filter of the snapshot block lets the filter index of the
+	// importing node continue from there.
+	bf, err := s.db.BlockFilterByHash(ctx, &utxoHH.Hash)
+	if errors.Is(err, database.ErrNotFound) && !s.pruning() {
+		if err := s.FilterIndexer(ctx, &utxoHH.Hash); err != nil {
+			return nil, fmt.Errorf("filter indexer: %w", err)
+		}
+		bf, err = s.db.BlockFilterByHash(ctx, &utxoHH.Hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("block filter %v: %w", utxoHH, err)
+	}
+	us := &UtxoSnapshot{
+		Hash:         utxoHH.Hash,
+		Height:       utxoHH.Height,
+		FilterHeader: bf.Header,
+		Filter:       bf.Filter,
+	}
+
+	// Write to a temporary file first to not leave partial snapshots
+	// behind.
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	// The record count is not known until the walk completes. Write
+	// the header again once it is.
+	hw := sha256.New()
+	w := bufio.NewWriter(f)
+	if _, err := w.Write(encodeUtxoSnapshotHeader(s.wireNet, us)); err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+	if _, err := w.Write(us.Filter); err != nil {
+		return nil, fmt.Errorf("write filter: %w", err)
+	}
+	hw.Write(us.Filter)
+	start := time.Now()
+	r := make([]byte, 0, utxoSnapshotRecordSize+txscript.MaxScriptSize)
+	err = s.db.UtxosWalk(ctx, func(op tbcd.Outpoint, co tbcd.CacheOutput) error {
+		script, err := s.utxoSnapshotScript(ctx, op)
+		if err != nil {
+			return err
+		}
+		r = encodeUtxoSnapshotRecord(r[:0], op, co, script)
+		if _, err := w.Write(r); err != nil {
+			return err
+		}
+		hw.Write(r)
+		us.Count++
+		if us.Count%1e6 == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			log.Infof("Utxo snapshot exported %v utxos", us.Count)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("utxos walk: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("flush: %w", err)
+	}
+	records := hw.Sum(nil)
+
+	// Digest is calculated over the final header and the records.
+	header := encodeUtxoSnapshotHeader(s.wireNet, us)
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return nil, fmt.Errorf("write header: %w", err)
+	}
+	dw := sha256.New()
+	dw.Write(header)
+	if _, err := f.Seek(utxoSnapshotHeaderSize, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek: %w", err)
+	}
+	rw := sha256.New() // filter and records
+	if _, err := io.Copy(io.MultiWriter(dw, rw), f); err != nil {
+		return nil, fmt.Errorf("digest: %w", err)
+	}
+	// Paranoia, make sure what is on disk is what was walked.
+	if !bytes.Equal(rw.Sum(nil), records) {
+		return nil, fmt.Errorf("%w: records changed", ErrUtxoSnapshotInvalid)
+	}
+	copy(us.Digest[:], dw.Sum(nil))
+	if _, err := f.Write(us.Digest[:]); err != nil {
+		return nil, fmt.Errorf("write digest: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return nil, fmt.Errorf("sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("close: %w", err)
+	}
+	f = nil
+	if err := os.Rename(tmp, filename); err != nil {
+		return nil, fmt.Errorf("rename: %w", err)
+	}
+
+	log.Infof("Utxo snapshot exported %v took %v", us, time.Since(start))
+
+	return us, nil
+}
+
+// utxoSnapshotScript returns the pk script of a utxo. Utxos that were indexed
+// by older releases have no pk script recorded, those are looked up via the tx
+// index.
+func (s *Server) utxoSnapshotScript(ctx context.Context, op tbcd.Outpoint) ([]byte, error) {
+	script, err := s.db.ScriptByOutpoint(ctx, op)
+	if err == nil {
+		return script, nil
+	}
+	if !errors.Is(err, database.ErrNotFound) {
+		return nil, fmt.Errorf("script %v: %w", op, err)
+	}
+	tx, err := s.TxById(ctx, op.TxIdHash())
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, fmt.Errorf("utxo %v: %w", op, ErrPkScriptUnknown)
+		}
+		return nil, fmt.Errorf("tx %v: %w", op, err)
+	}
+	if int(op.TxIndex()) >= len(tx.TxOut) {
+		return nil, fmt.Errorf("utxo %v: invalid index", op)
+	}
+	return tx.TxOut[op.TxIndex()].PkScript, nil
+}
+
+// utxoSnapshotVerify reads the snapshot header and verifies the digest of
+// the snapshot contents. When digest is not empty it must match the hex
+// encoded snapshot digest.
+func (s *Server) utxoSnapshotVerify(f *os.File, digest string) (*UtxoSnapshot, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, utxoSnapshotHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	us, err := decodeUtxoSnapshotHeader(s.wireNet, header)
+	if err != nil {
+		return nil, err
+	}
+	// Records have variable length, the exact size is only known once
+	// they are decoded.
+	size := fi.Size()
+	if us.Count > uint64(size)/utxoSnapshotRecordSize ||
+		size < utxoSnapshotHeaderSize+int64(len(us.Filter))+
+			int64(us.Count)*utxoSnapshotRecordSize+sha256.Size {
+		return nil, fmt.Errorf("%w: size %v", ErrUtxoSnapshotInvalid, size)
+	}
+
+	dw := sha256.New()
+	dw.Write(header)
+	if _, err := io.ReadFull(f, us.Filter); err != nil {
+		return nil, fmt.Errorf("read filter: %w", err)
+	}
+	dw.Write(us.Filter)
+	records := size - utxoSnapshotHeaderSize - int64(len(us.Filter)) - sha256.Size
+	if _, err := io.CopyN(dw, f, records); err != nil {
+		return nil, fmt.Errorf("read records: %w", err)
+	}
+	if _, err := io.ReadFull(f, us.Digest[:]); err != nil {
+		return nil, fmt.Errorf("read digest: %w", err)
+	}
+	if !bytes.Equal(dw.Sum(nil), us.Digest[:]) {
+		return nil, fmt.Errorf("%w: digest mismatch", ErrUtxoSnapshotInvalid)
+	}
+	if digest != "" && digest != us.DigestString() {
+		return nil, fmt.Errorf("%w: digest %v, expected %v",
+			ErrUtxoSnapshotInvalid, us.DigestString(), digest)
+	}
+
+	return us, nil
+}
+
+// utxoSnapshotHeader reads the header of the utxo snapshot in filename.
+func (s *Server) utxoSnapshotHeader(filename string) (*UtxoSnapshot, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, utxoSnapshotHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	return decodeUtxoSnapshotHeader(s.wireNet, header)
+}
+
+// utxoSnapshotPending returns true while the configured utxo snapshot has not
+// been imported. Blocks are not downloaded until then since the import drops
+// the blocks up to the snapshot block from the missing blocks. The snapshot is
+// imported as soon as its block header is known.
+func (s *Server) utxoSnapshotPending(ctx context.Context) bool {
+	if s.cfg.UtxoSnapshot == "" {
+		return false
+	}
+	_, err := s.UtxoIndexHash(ctx)
+	if err == nil {
+		return false
+	} else if !errors.Is(err, database.ErrNotFound) {
+		log.Errorf("utxo index hash: %v", err)
+		return true
+	}
+	us, err := s.utxoSnapshotHeader(s.cfg.UtxoSnapshot)
+	if err != nil {
+		log.Errorf("utxo snapshot: %v", err)
+		return true
+	}
+	if _, err := s.db.BlockHeaderByHash(ctx, &us.Hash); err != nil {
+		return true // wait for the block header
+	}
+
+	go func() {
+		us, err := s.UtxoSnapshotImport(ctx, s.cfg.UtxoSnapshot,
+			s.cfg.UtxoSnapshotDigest)
+		switch {
+		case err == nil:
+			log.Infof("Utxo snapshot bootstrapped: %v", us)
+			s.syncBlocks(ctx)
+		case errors.Is(err, ErrAlreadyIndexing),
+			errors.Is(err, context.Canceled):
+		default:
+			log.Errorf("utxo snapshot: %v", err)
+		}
+	}()
+	return true
+}
+
+// UtxoSnapshotImport loads the utxo snapshot in filename into an empty utxo
+// index and records the snapshot block as the utxo index hash. When digest is
+// not empty it must match the hex encoded snapshot digest. The block header
+// of the snapshot must be known and on the canonical chain.
+//
+// The snapshot block becomes the lower bound of the indexes. The tx and filter
+// indexes continue from there and the blocks up to the snapshot block are no
+// longer downloaded. Thus txs up to the snapshot block cannot be looked up,
+// the script hash history only covers blocks after the snapshot and the
+// indexes cannot be unwound past the snapshot block.
+func (s *Server) UtxoSnapshotImport(ctx context.Context, filename string, digest string) (*UtxoSnapshot, error) {
+	log.Tracef("UtxoSnapshotImport")
+	defer log.Tracef("UtxoSnapshotImport exit")
+
+	unlock, err := s.indexingLock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return s.utxoSnapshotImport(ctx, filename, digest)
+}
+
+func (s *Server) utxoSnapshotImport(ctx context.Context, filename string, digest string) (*UtxoSnapshot, error) {
+	// Refuse to clobber an existing utxo index.
+	_, err := s.UtxoIndexHash(ctx)
+	if err == nil {
+		return nil, ErrUtxoIndexNotEmpty
+	} else if !errors.Is(err, database.ErrNotFound) {
+		return nil, fmt.Errorf("utxo index hash: %w", err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	us, err := s.utxoSnapshotVerify(f, digest)
+	if err != nil {
+		return nil, err
+	}
+	bh, err := s.db.BlockHeaderByHash(ctx, &us.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot block header %v: %w", us.Hash, err)
+	}
+	if bh.Height != us.Height {
+		return nil, fmt.Errorf("%w: height %v, expected %v",
+			ErrUtxoSnapshotInvalid, us.Height, bh.Height)
+	}
+	canonical, err := s.isCanonical(ctx, bh)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot block canonical %v: %w", bh, err)
+	}
+	if !canonical {
+		return nil, fmt.Errorf("%w: %v", ErrUtxoSnapshotNotCanonical, bh)
+	}
+	log.Infof("Utxo snapshot verified %v took %v", us, time.Since(start))
+
+	// An interrupted import of the same snapshot may be resumed since
+	// inserting utxos is idempotent.
+	resume := false
+	d, err := s.db.MetadataGet(ctx, UtxoSnapshotKey)
+	if err == nil {
+		resume = bytes.Equal(d, us.Digest[:])
+	} else if !errors.Is(err, database.ErrNotFound) {
+		return nil, fmt.Errorf("metadata utxo snapshot: %w", err)
+	}
+	if !resume {
+		errNotEmpty := errors.New("not empty")
+		err = s.db.UtxosWalk(ctx, func(tbcd.Outpoint, tbcd.CacheOutput) error {
+			return errNotEmpty
+		})
+		if errors.Is(err, errNotEmpty) {
+			return nil, ErrUtxoIndexNotEmpty
+		} else if err != nil {
+			return nil, fmt.Errorf("utxos walk: %w", err)
+		}
+		err = s.db.MetadataPut(ctx, UtxoSnapshotKey, us.Digest[:])
+		if err != nil {
+			return nil, fmt.Errorf("metadata utxo snapshot: %w", err)
+		}
+	}
+
+	// Contents have been verified, insert utxos and their scripts.
+	offset := int64(utxoSnapshotHeaderSize + len(us.Filter))
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	lr := &io.LimitedReader{R: f, N: fi.Size() - offset - sha256.Size}
+	r := bufio.NewReader(lr)
+	utxos := make(map[tbcd.Outpoint]tbcd.CacheOutput, s.cfg.MaxCachedTxs)
+	scripts := make(map[tbcd.Outpoint][]byte, s.cfg.MaxCachedTxs)
+	record := make([]byte, utxoSnapshotRecordSize)
+	for i := uint64(0); i < us.Count; i++ {
+		op, co, script, err := decodeUtxoSnapshotRecord(r, record)
+		if err != nil {
+			return nil, fmt.Errorf("read record %v: %w", i, err)
+		}
+		utxos[op] = co
+		scripts[op] = script
+		if len(utxos) < s.cfg.MaxCachedTxs && i != us.Count-1 {
+			continue
+		}
+
+		// Flush to disk, this empties the caches.
+		if err := s.db.BlockScriptUpdate(ctx, 1, scripts); err != nil {
+			return nil, fmt.Errorf("block script update: %w", err)
+		}
+		if err := s.db.BlockUtxoUpdate(ctx, 1, utxos); err != nil {
+			return nil, fmt.Errorf("block utxo update: %w", err)
+		}
+		log.Infof("Utxo snapshot imported %v/%v utxos", i+1, us.Count)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+	}
+	if _, err := r.ReadByte(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: trailing records", ErrUtxoSnapshotInvalid)
+	}
+
+	if err := s.indexLowerBoundSet(ctx, us); err != nil {
+		return nil, err
+	}
+
+	// Record snapshot block in metadata, the utxo indexer continues from
+	// there.
+	if err := s.db.MetadataPut(ctx, UtxoIndexHashKey, us.Hash[:]); err != nil {
+		return nil, fmt.Errorf("metadata utxo hash: %w", err)
+	}
+
+	log.Infof("Utxo snapshot imported %v took %v", us, time.Since(start))
+
+	return us, nil
+}
+
+// indexLowerBoundSet records the snapshot block as the lower bound of the
+// indexes. The tx and filter indexes are moved to the snapshot block, the
+// filter index is seeded with the snapshot filter so that the filter headers
+// chain, and the blocks up to the snapshot block are no longer downloaded.
+func (s *Server) indexLowerBoundSet(ctx context.Context, us *UtxoSnapshot) error {
+	err := s.db.MetadataPut(ctx, IndexLowerBoundKey, us.Hash[:])
+	if err != nil {
+		return fmt.Errorf("metadata index lower bound: %w", err)
+	}
+
+	txHH, err := s.TxIndexHash(ctx)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return fmt.Errorf("tx index hash: %w", err)
+	}
+	if err != nil || txHH.Height < us.Height {
+		err := s.db.MetadataPut(ctx, TxIndexHashKey, us.Hash[:])
+		if err != nil {
+			return fmt.Errorf("metadata tx hash: %w", err)
+		}
+	}
+
+	filterHH, err := s.FilterIndexHash(ctx)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return fmt.Errorf("filter index hash: %w", err)
+	}
+	if err != nil || filterHH.Height < us.Height {
+		err := s.db.BlockFilterUpdate(ctx, 1,
+			map[chainhash.Hash]*tbcd.BlockFilter{
+				us.Hash: {
+					BlockHash: us.Hash,
+					Header:    us.FilterHeader,
+					Filter:    us.Filter,
+				},
+			})
+		if err != nil {
+			return fmt.Errorf("block filter update: %w", err)
+		}
+		err = s.db.MetadataPut(ctx, FilterIndexHashKey, us.Hash[:])
+		if err != nil {
+			return fmt.Errorf("metadata filter hash: %w", err)
+		}
+	}
+
+	// Missing blocks are ordered by height.
+	for {
+		bis, err := s.db.BlocksMissing(ctx, 1024)
+		if err != nil {
+			return fmt.Errorf("blocks missing: %w", err)
+		}
+		var deleted int
+		for _, bi := range bis {
+			if bi.Height > us.Height {
+				break
+			}
+			err := s.db.BlockMissingDelete(ctx, int64(bi.Height), bi.Hash)
+			if err != nil {
+				return fmt.Errorf("block missing delete %v: %w",
+					bi.Hash, err)
+			}
+			deleted++
+		}
+		if deleted == 0 || deleted < len(bis) {
+			return nil
+		}
+	}
+}
@@ -33,10 +33,12 @@ import (
 
 	"github.com/hemilabs/heminetwork/api"
 	"github.com/hemilabs/heminetwork/api/tbcapi"
+	"github.com/hemilabs/heminetwork/bitcoin"
 	"github.com/hemilabs/heminetwork/database"
 	dbnames "github.com/hemilabs/heminetwork/database/level"
 	"github.com/hemilabs/heminetwork/database/tbcd"
 	"github.com/hemilabs/heminetwork/database/tbcd/level"
+	"github.com/hemilabs/heminetwork/rawdb"
 	"github.com/hemilabs/heminetwork/service/deucalion"
 	"github.com/hemilabs/heminetwork/service/pprof"
 	"github.com/hemilabs/heminetwork/service/tbc/peer/rawpeer"
@@ -48,10 +50,21 @@ const (
 	appName  = "tbc"
 
 	defaultPeersWanted   = 64
+	defaultPeersInbound  = 16
 	minPeersRequired     = 64  // minimum number of peers in good map before cache is purged
 	defaultPendingBlocks = 128 // 128 * ~4MB max memory use
 
-	defaultMaxCachedTxs = 1e6 // dual purpose cache, max key 69, max value 36
+	defaultMaxCachedTxs     = 1e6 // dual purpose cache, max key 69, max value 36
+	defaultMaxCachedFilters = 1e4 // ~20KB per filter on mainnet
+
+	defaultMempoolMaxSize        = 300 * 1024 * 1024 // same as bitcoind
+	defaultMempoolExpiryHours    = 14 * 24           // same as bitcoind
+	defaultMempoolExpireInterval = 5 * time.Minute
+
+	maxBlockFilters       = 1000 // max filters returned per request
+	maxBlockFilterHeaders = 2000 // max filter headers returned per request
+	maxTxHistory          = 1000 // max history entries returned per request
+	maxMempoolTxs         = 1000 // max mempool txs returned per request
 
 	networkLocalnet = "localnet" // XXX this needs to be rethought
 
@@ -80,21 +93,46 @@ func init() {
 }
 
 type Config struct {
+	AssumeValid             string // skip script validation of this block and its ancestors
 	AutoIndex               bool
 	BlockCache              int
+	BlockCompression        string // none, snappy or zstd
 	BlockheaderCache        int
 	BlockSanity             bool
+	Checkpoints             []string // extra checkpoints, height:hash
+	ElectrumListenAddress   string   // electrum server is disabled when empty
+	ElectrumMaxConnections  int      // maximum concurrent electrum connections
+	EsploraListenAddress    string   // esplora server is disabled when empty
+	FullValidation          bool     // validate all input scripts during indexing
+	JSONRPCListenAddress    string   // json-rpc server is disabled when empty
+	JSONRPCPassword         string
+	JSONRPCUser             string
 	LevelDBHome             string
 	ListenAddress           string
 	LogLevel                string
+	MaxCachedFilters        int
 	MaxCachedTxs            int
 	MempoolEnabled          bool
+	MempoolExpiryHours      int // expire mempool txs after this many hours
+	MempoolMaxSize          int // evict lowest fee rate txs beyond this size
 	Network                 string
+	OnionOnly               bool   // only connect to onion peers, requires SOCKS5Proxy
+	P2PListenAddress        string // inbound p2p is disabled when empty
+	P2PV2                   bool   // try the BIP324 transport on outbound peers
+	PeersInbound            int    // maximum number of inbound p2p peers
 	PeersWanted             int
 	PrometheusListenAddress string
 	PrometheusNamespace     string
 	PprofListenAddress      string
-	Seeds                   []string
+	PruneBlocks             uint64   // keep raw blocks this deep, 0 disables
+	PruneGB                 uint64   // keep this many GiB of raw blocks, 0 disables
+	Seeds                   []string // host:port, the network default port is used when omitted
+	SignetChallenge         string   // hex encoded custom signet challenge, default signet when empty
+	SOCKS5Proxy             string   // dial peers through this proxy when set
+	SOCKS5ProxyPassword     string
+	SOCKS5ProxyUser         string
+	UtxoSnapshot            string // imported when the utxo index is empty
+	UtxoSnapshotDigest      string // hex encoded digest UtxoSnapshot must match
 
 	// Fields used for running TBC in External Header Mode, where P2P is disabled
 	// and TBC is used to determine consensus based on headers fed from external
@@ -107,15 +145,21 @@ type Config struct {
 
 func NewDefaultConfig() *Config {
 	return &Config{
-		ListenAddress:       tbcapi.DefaultListen,
-		BlockCache:          250,
-		BlockheaderCache:    1e6,
-		LogLevel:            logLevel,
-		MaxCachedTxs:        defaultMaxCachedTxs,
-		MempoolEnabled:      false, // XXX default to false until it is fixed
-		PeersWanted:         defaultPeersWanted,
-		PrometheusNamespace: appName,
-		ExternalHeaderMode:  false, // Default anyway, but for readability
+		ListenAddress:          tbcapi.DefaultListen,
+		BlockCache:             250,
+		BlockheaderCache:       1e6,
+		ElectrumMaxConnections: defaultElectrumMaxConnections,
+		LogLevel:               logLevel,
+		MaxCachedFilters:       defaultMaxCachedFilters,
+		MaxCachedTxs:           defaultMaxCachedTxs,
+		MempoolEnabled:         false,
+		MempoolExpiryHours:     defaultMempoolExpiryHours,
+		MempoolMaxSize:         defaultMempoolMaxSize,
+		P2PV2:                  true,
+		PeersInbound:           defaultPeersInbound,
+		PeersWanted:            defaultPeersWanted,
+		PrometheusNamespace:    appName,
+		ExternalHeaderMode:     false, // Default anyway, but for readability
 	}
 }
 
@@ -144,13 +188,21 @@ type Server struct {
 	chainParams *chaincfg.Params
 	timeSource  blockchain.MedianTimeSource
 	checkpoints map[chainhash.Hash]uint64
+	assumeValid *chainhash.Hash // nil when all scripts are validated
 	pm          *PeerManager
 
-	blocks *ttl.TTL // outstanding block downloads [hash]when/where
-	pings  *ttl.TTL // outstanding pings
+	// inbound p2p peers
+	inbound map[string]*rawpeer.RawPeer
+
+	blocks *blockScheduler // outstanding block downloads
+	pings  *ttl.TTL        // outstanding pings
 
 	indexing bool // when set we are indexing
 
+	mempoolStale bool // set when a loaded mempool must be revalidated
+
+	notifiedTip *tbcd.BlockHeader // last indexed tip that was notified
+
 	db tbcd.Database
 
 	// Prometheus
@@ -174,24 +226,44 @@ func NewServer(cfg *Config) (*Server, error) {
 		cfg = NewDefaultConfig()
 	}
 
-	if cfg.MempoolEnabled {
-		cfg.MempoolEnabled = false // XXX
-		log.Infof("mempool forced disabled")
+	if cfg.MaxCachedFilters <= 0 {
+		cfg.MaxCachedFilters = defaultMaxCachedFilters
+	}
+
+	if cfg.ElectrumMaxConnections <= 0 {
+		cfg.ElectrumMaxConnections = defaultElectrumMaxConnections
+	}
+
+	if cfg.PruneBlocks > 0 || cfg.PruneGB > 0 {
+		// Script validation requires the blocks that created the
+		// spent outputs.
+		if cfg.FullValidation {
+			return nil, errors.New("full validation cannot be " +
+				"combined with pruning")
+		}
+		if cfg.PruneBlocks > 0 && cfg.PruneBlocks < minPruneBlocks {
+			log.Infof("prune blocks raised to minimum: %v",
+				minPruneBlocks)
+			cfg.PruneBlocks = minPruneBlocks
+		}
+		log.Infof("pruning enabled, filter index disabled")
+	}
+
+	if cfg.JSONRPCListenAddress != "" &&
+		(cfg.JSONRPCUser == "" || cfg.JSONRPCPassword == "") {
+		return nil, errors.New("json-rpc requires a user and password")
 	}
 
 	// Only populate pings and blocks if not in External Header Mode
 	var pings *ttl.TTL
-	var blocks *ttl.TTL
+	var blocks *blockScheduler
 	var err error
 	if !cfg.ExternalHeaderMode {
 		pings, err = ttl.New(cfg.PeersWanted, true)
 		if err != nil {
 			return nil, err
 		}
-		blocks, err = ttl.New(defaultPendingBlocks, true)
-		if err != nil {
-			return nil, err
-		}
+		blocks = blockSchedulerNew(defaultPendingBlocks)
 	}
 
 	defaultRequestTimeout := 10 * time.Second // XXX: make config option?
@@ -209,6 +281,7 @@ func NewServer(cfg *Config) (*Server, error) {
 		sessions:        make(map[string]*tbcWs),
 		requestTimeout:  defaultRequestTimeout,
 		broadcast:       make(map[chainhash.Hash]*wire.MsgTx, 16),
+		inbound:         make(map[string]*rawpeer.RawPeer, cfg.PeersInbound),
 		invBlocks:       make([]*chainhash.Hash, 0, 16),
 		promPollVerbose: false,
 	}
@@ -224,12 +297,17 @@ func NewServer(cfg *Config) (*Server, error) {
 			// Cannot combine mempool behavior with External Header Mode
 			panic("cannot enable mempool on an external-header-only mode TBC instance")
 		}
-		s.mempool, err = mempoolNew()
+		s.mempool, err = mempoolNew(cfg.MempoolMaxSize,
+			time.Duration(cfg.MempoolExpiryHours)*time.Hour)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	if cfg.SignetChallenge != "" && cfg.Network != "signet" {
+		return nil, fmt.Errorf("signet challenge on network %v", cfg.Network)
+	}
+
 	wanted := defaultPeersWanted
 	switch cfg.Network {
 	case "mainnet":
@@ -242,6 +320,26 @@ func NewServer(cfg *Config) (*Server, error) {
 		s.chainParams = &chaincfg.TestNet3Params
 		s.checkpoints = testnet3Checkpoints
 
+	case "testnet4":
+		s.wireNet = bitcoin.TestNet4
+		s.chainParams = &bitcoin.TestNet4Params
+		s.checkpoints = genesisCheckpoints(s.chainParams)
+
+	case "signet":
+		s.chainParams, err = bitcoin.NetworkParams(cfg.Network,
+			cfg.SignetChallenge)
+		if err != nil {
+			return nil, err
+		}
+		s.wireNet = s.chainParams.Net
+		s.checkpoints = genesisCheckpoints(s.chainParams)
+
+	case "regtest":
+		s.wireNet = wire.TestNet
+		s.chainParams = &chaincfg.RegressionNetParams
+		s.checkpoints = genesisCheckpoints(s.chainParams)
+		wanted = max(1, len(cfg.Seeds)) // regtest has no dns seeds
+
 	case networkLocalnet:
 		s.wireNet = wire.TestNet
 		s.chainParams = &chaincfg.RegressionNetParams
@@ -252,9 +350,48 @@ func NewServer(cfg *Config) (*Server, error) {
 		return nil, fmt.Errorf("invalid network: %v", cfg.Network)
 	}
 
+	s.checkpoints, err = checkpointsAdd(s.checkpoints, cfg.Checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AssumeValid != "" {
+		s.assumeValid, err = chainhash.NewHashFromStr(cfg.AssumeValid)
+		if err != nil {
+			return nil, fmt.Errorf("assume valid: %w", err)
+		}
+	}
+
 	// Only create a PeerManager if not in External Header Mode
 	if !s.cfg.ExternalHeaderMode {
-		pm, err := NewPeerManager(s.wireNet, s.cfg.Seeds, wanted)
+		var proxy *rawpeer.Proxy
+		if s.cfg.SOCKS5Proxy != "" {
+			if _, _, err := net.SplitHostPort(s.cfg.SOCKS5Proxy); err != nil {
+				return nil, fmt.Errorf("socks5 proxy: %w", err)
+			}
+			proxy = &rawpeer.Proxy{
+				Address:  s.cfg.SOCKS5Proxy,
+				User:     s.cfg.SOCKS5ProxyUser,
+				Password: s.cfg.SOCKS5ProxyPassword,
+			}
+		}
+		// Seeds without a port use the network default.
+		seeds := make([]string, 0, len(s.cfg.Seeds))
+		for _, seed := range s.cfg.Seeds {
+			if _, _, err := net.SplitHostPort(seed); err != nil {
+				seed = net.JoinHostPort(seed, s.chainParams.DefaultPort)
+			}
+			seeds = append(seeds, seed)
+		}
+		if s.cfg.OnionOnly {
+			for _, seed := range seeds {
+				if !rawpeer.IsOnion(seed) {
+					return nil, fmt.Errorf("onion only seed is not "+
+						"an onion address: %v", seed)
+				}
+			}
+		}
+		pm, err := NewPeerManager(s.wireNet, seeds, wanted,
+			proxy, s.cfg.OnionOnly, s.cfg.P2PV2)
 		if err != nil {
 			return nil, err
 		}
@@ -388,6 +525,24 @@ func (s *Server) mempoolPeer(ctx context.Context, p *rawpeer.RawPeer) {
 	}
 }
 
+// mempoolExpire periodically expires stale mempool txs.
+func (s *Server) mempoolExpire(ctx context.Context) {
+	log.Tracef("mempoolExpire")
+	defer log.Tracef("mempoolExpire exit")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(defaultMempoolExpireInterval):
+		}
+
+		if expired := s.mempool.expire(ctx, time.Now()); expired > 0 {
+			log.Debugf("mempool expired %v txs", expired)
+		}
+	}
+}
+
 func (s *Server) headersPeer(ctx context.Context, p *rawpeer.RawPeer) {
 	log.Tracef("headersPeer %v", p)
 	defer log.Tracef("headersPeer %v exit", p)
@@ -480,7 +635,7 @@ func (s *Server) handlePeer(ctx context.Context, p *rawpeer.RawPeer) error {
 			}
 			return false
 		}
-		blks := s.blocks.DeleteByValue(findPeer)
+		blks := s.blocks.peerRemove(p)
 		pings := s.pings.DeleteByValue(findPeer)
 		log.Infof("Disconnected: %v blocks %v pings %v%v", p, blks, pings, re)
 
@@ -541,6 +696,7 @@ func (s *Server) handlePeer(ctx context.Context, p *rawpeer.RawPeer) error {
 	// this is a fork indeed.
 
 	// Only now can we consider the peer connected
+	s.blocks.peerAdd(p)
 	verbose := false
 	log.Infof("Connected: %v version %v agent %v", p,
 		remoteVersion.ProtocolVersion, remoteVersion.UserAgent)
@@ -640,6 +796,12 @@ func (s *Server) promTx() float64 {
 	return deucalion.Uint64ToFloat(s.prom.syncInfo.Tx.Height)
 }
 
+func (s *Server) promFilter() float64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return deucalion.Uint64ToFloat(s.prom.syncInfo.Filter.Height)
+}
+
 func (s *Server) promConnectedPeers() float64 {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -688,7 +850,7 @@ func (s *Server) promPoll(ctx context.Context) error {
 			s.mtx.RLock()
 			log.Infof("Pending blocks %v/%v connected peers %v "+
 				"good peers %v bad peers %v mempool %v %v",
-				s.blocks.Len(), defaultPendingBlocks, s.prom.connected,
+				s.blocks.count(), defaultPendingBlocks, s.prom.connected,
 				s.prom.good, s.prom.bad, s.prom.mempoolCount,
 				humanize.Bytes(uint64(s.prom.mempoolSize)))
 			s.mtx.RUnlock()
@@ -703,7 +865,7 @@ func (s *Server) promPoll(ctx context.Context) error {
 // XXX do we still need a locked/unlocked version of this code?
 func (s *Server) blksMissing(ctx context.Context) bool {
 	// Do cheap memory check first
-	if s.blocks.Len() != 0 {
+	if s.blocks.count() != 0 {
 		return true
 	}
 
@@ -736,12 +898,22 @@ func (s *Server) handleAddrV2(_ context.Context, p *rawpeer.RawPeer, msg *wire.M
 
 	peers := make([]string, 0, len(msg.AddrList))
 	for _, a := range msg.AddrList {
-		addr := net.JoinHostPort(a.Addr.String(), strconv.Itoa(int(a.Port)))
-		if len(addr) < 7 {
-			// 0.0.0.0
-			continue
+		var host string
+		switch {
+		case a.IsTorV3():
+			// Reachable through the SOCKS5 proxy, the peer
+			// manager drops them when there is none.
+			host = a.Addr.String()
+		default:
+			// Skip tor v2, which is no longer supported by the
+			// tor network, and unspecified addresses.
+			ip := net.ParseIP(a.Addr.String())
+			if ip == nil || ip.IsUnspecified() {
+				continue
+			}
+			host = ip.String()
 		}
-		peers = append(peers, addr)
+		peers = append(peers, net.JoinHostPort(host, strconv.Itoa(int(a.Port))))
 	}
 
 	s.pm.HandleAddr(peers)
@@ -775,42 +947,22 @@ func (s *Server) handlePong(ctx context.Context, p *rawpeer.RawPeer, pong *wire.
 	return nil
 }
 
-func (s *Server) downloadBlock(ctx context.Context, p *rawpeer.RawPeer, ch *chainhash.Hash) error {
-	log.Tracef("downloadBlock")
-	defer log.Tracef("downloadBlock exit")
-
-	getData := wire.NewMsgGetData()
-	getData.InvList = append(getData.InvList,
-		&wire.InvVect{
-			Type: wire.InvTypeBlock,
-			Hash: *ch,
-		})
-
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	err := p.Write(defaultCmdTimeout, getData)
-	if err != nil {
-		if !errors.Is(err, net.ErrClosed) &&
-			!errors.Is(err, os.ErrDeadlineExceeded) {
-			log.Errorf("download block write: %v %v", p, err)
-		}
-	}
-	return err
-}
-
+// downloadBlockFromRandomPeer adds a block to the download window regardless
+// of the window size and schedules it ahead of all higher blocks.
 func (s *Server) downloadBlockFromRandomPeer(ctx context.Context, block *chainhash.Hash) error {
 	log.Tracef("downloadBlockFromRandomPeer")
 	defer log.Tracef("downloadBlockFromRandomPeer exit")
 
-	rp, err := s.pm.Random()
+	bh, err := s.db.BlockHeaderByHash(ctx, block)
 	if err != nil {
-		return fmt.Errorf("random peer %v: %w", block, err)
+		return fmt.Errorf("block header %v: %w", block, err)
+	}
+	s.blocks.add(*block, bh.Height)
+	requests := s.blocks.schedule(nil, time.Now())
+	if len(requests) == 0 {
+		return fmt.Errorf("schedule %v: %w", block, ErrNoConnectedPeers)
 	}
-	s.blocks.Put(ctx, defaultBlockPendingTimeout, block.String(), rp,
-		s.blockExpired, nil)
-	// Not an error. Checking and logging this will fill up logs with EOF.
-	//nolint:errcheck // Error is intentionally ignored.
-	go s.downloadBlock(ctx, rp, block)
+	s.blockRequestsSend(ctx, requests)
 
 	return nil
 }
@@ -822,12 +974,18 @@ func (s *Server) DownloadBlockFromRandomPeers(ctx context.Context, block *chainh
 	blk, err := s.db.BlockByHash(ctx, block)
 	if err != nil {
 		if errors.Is(err, database.ErrBlockNotFound) {
-			for range count {
-				err := s.downloadBlockFromRandomPeer(ctx, block)
+			if err := s.downloadBlockFromRandomPeer(ctx, block); err != nil {
+				log.Errorf("async download: %v", err)
+			}
+			// Ask additional peers, duplicate blocks are ignored.
+			for range max(count, 1) - 1 {
+				rp, err := s.pm.Random()
 				if err != nil {
 					log.Errorf("async download: %v", err)
-					continue
+					break
 				}
+				//nolint:errcheck // Error is intentionally ignored.
+				go s.downloadBlocks(ctx, rp, []chainhash.Hash{*block})
 			}
 			return nil, nil
 		}
@@ -837,66 +995,6 @@ func (s *Server) DownloadBlockFromRandomPeers(ctx context.Context, block *chainh
 	return blk, nil
 }
 
-func (s *Server) handleBlockExpired(ctx context.Context, key any, value any) error {
-	log.Tracef("handleBlockExpired")
-	defer log.Tracef("handleBlockExpired exit")
-
-	p, ok := value.(*rawpeer.RawPeer)
-	if !ok {
-		// this really should not happen
-		return fmt.Errorf("invalid peer type: %T", value)
-	}
-	if _, ok := key.(string); !ok {
-		// this really should not happen
-		return fmt.Errorf("invalid key type: %T", key)
-	}
-
-	// Ensure block is on main chain, if it is not it is deleted from
-	// blocks missing database.
-	hash, err := chainhash.NewHashFromStr(key.(string))
-	if err != nil {
-		return fmt.Errorf("new hash: %w", err)
-	}
-	bhX, err := s.db.BlockHeaderByHash(ctx, hash)
-	if err != nil {
-		return fmt.Errorf("block header by hash: %w", err)
-	}
-	canonical, err := s.isCanonical(ctx, bhX)
-	if err != nil {
-		return fmt.Errorf("is canonical: %w", err)
-	}
-	if !canonical {
-		log.Infof("Deleting from blocks missing database: %v %v %v",
-			p, bhX.Height, bhX)
-		err := s.db.BlockMissingDelete(ctx, int64(bhX.Height), &bhX.Hash)
-		if err != nil {
-			return fmt.Errorf("block expired delete missing: %w", err)
-		}
-
-		// Block exists on a fork, stop downloading it.
-		return nil
-	}
-
-	log.Infof("Block expired: %v %v", p, hash)
-
-	// Legit timeout, return error so that it can be retried.
-	return fmt.Errorf("timeout %v", key)
-}
-
-func (s *Server) blockExpired(ctx context.Context, key any, value any) {
-	log.Tracef("blockExpired")
-	defer log.Tracef("blockExpired exit")
-
-	err := s.handleBlockExpired(ctx, key, value)
-	if err != nil {
-		// Close peer.
-		if p, ok := value.(*rawpeer.RawPeer); ok {
-			p.Close() // kill peer
-			log.Errorf("block expired: %v %v", p, err)
-		}
-	}
-}
-
 func (s *Server) downloadMissingTx(ctx context.Context, p *rawpeer.RawPeer) error {
 	log.Tracef("downloadMissingTx")
 	defer log.Tracef("downloadMissingTx exit")
@@ -921,7 +1019,56 @@ func (s *Server) handleTx(ctx context.Context, p *rawpeer.RawPeer, msg *wire.Msg
 	log.Tracef("handleTx")
 	defer log.Tracef("handleTx exit")
 
-	return s.mempool.txsInsert(ctx, msg, raw)
+	if !s.cfg.MempoolEnabled {
+		return nil
+	}
+
+	mt := newMempoolTx(msg, len(raw))
+	fee, err := s.txFee(ctx, msg)
+	if err != nil {
+		// Fee is unknown when inputs are not indexed yet.
+		log.Debugf("tx fee %v: %v", msg.TxHash(), err)
+	} else {
+		mt.fee = fee
+	}
+
+	// Rejected txs are not the peer's fault.
+	err = s.mempool.txsInsert(ctx, mt)
+	if err != nil {
+		log.Debugf("mempool insert %v: %v", msg.TxHash(), err)
+		return nil
+	}
+
+	s.notifyMempoolTx(ctx, msg)
+
+	return nil
+}
+
+// txFee returns the fee of a transaction. Inputs are looked up in the mempool
+// and the utxo index.
+func (s *Server) txFee(ctx context.Context, tx *wire.MsgTx) (int64, error) {
+	var in int64
+	for _, txIn := range tx.TxIn {
+		prev := txIn.PreviousOutPoint
+		if txOut, ok := s.mempool.txOut(prev); ok {
+			in += txOut.Value
+			continue
+		}
+		co, err := s.db.UtxoByOutpoint(ctx,
+			tbcd.NewOutpoint(prev.Hash, prev.Index))
+		if err != nil {
+			return 0, fmt.Errorf("utxo %v: %w", prev, err)
+		}
+		in += int64(co.Value())
+	}
+	var out int64
+	for _, txOut := range tx.TxOut {
+		out += txOut.Value
+	}
+	if in < out {
+		return 0, fmt.Errorf("outputs exceed inputs: %v < %v", in, out)
+	}
+	return in - out, nil
 }
 
 func (s *Server) syncBlocks(ctx context.Context) {
@@ -942,16 +1089,14 @@ func (s *Server) syncBlocks(ctx context.Context) {
 		}
 	}
 
-	// Prevent race condition with 'want', which may cause the cache
-	// capacity to be exceeded.
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-
-	want := defaultPendingBlocks - s.blocks.Len()
-	if want <= 0 {
+	// Blocks up to a configured utxo snapshot are not downloaded.
+	if s.utxoSnapshotPending(ctx) {
 		return
 	}
-	bm, err := s.db.BlocksMissing(ctx, want)
+
+	// The scheduler is handed the lowest missing blocks, which are the
+	// blocks the indexers need next.
+	bm, err := s.db.BlocksMissing(ctx, defaultPendingBlocks)
 	if err != nil {
 		log.Errorf("blocks missing: %v", err)
 		return
@@ -1029,22 +1174,7 @@ func (s *Server) syncBlocks(ctx context.Context) {
 		return
 	}
 
-	for k := range bm {
-		bi := bm[k]
-		hash, _ := chainhash.NewHash(bi.Hash[:])
-		hashS := hash.String()
-		if _, _, err := s.blocks.Get(hashS); err == nil {
-			// Already being downloaded.
-			continue
-		}
-		if err := s.downloadBlockFromRandomPeer(ctx, hash); err != nil {
-			// This can happen during startup or when the network
-			// is starved.
-			// XXX: Probably too loud, remove later.
-			log.Errorf("random peer %v: %v", hashS, err)
-			return
-		}
-	}
+	s.blockRequestsSend(ctx, s.blocks.schedule(bm, time.Now()))
 }
 
 // RemoveExternalHeaders removes the provided headers from TBC's state knowledge,
@@ -1228,13 +1358,35 @@ func (s *Server) handleHeaders(ctx context.Context, p *rawpeer.RawPeer, msg *wir
 	//
 	// There really is no good way of determining if we can escape the
 	// expensive calls so we just eat it.
-	var pbhHash *chainhash.Hash
-	for k := range msg.Headers {
-		if pbhHash != nil && pbhHash.IsEqual(&msg.Headers[k].PrevBlock) {
+	for k := 1; k < len(msg.Headers); k++ {
+		if msg.Headers[k].PrevBlock != msg.Headers[k-1].BlockHash() {
+			s.pm.Misbehaving(ctx, p.String(), misbehaviorInvalidHeaders,
+				"non-contiguous headers")
 			return fmt.Errorf("cannot connect %v index %v",
 				msg.Headers[k].PrevBlock, k)
 		}
-		pbhHash = &msg.Headers[k].PrevBlock
+	}
+	if err := s.checkpointsVerify(ctx, msg.Headers); err != nil {
+		if errors.Is(err, ErrCheckpointMismatch) {
+			s.pm.Misbehaving(ctx, p.String(),
+				misbehaviorInvalidHeaders, err.Error())
+		}
+		return err
+	}
+	if err := s.headersVerify(ctx, msg.Headers); err != nil {
+		if errors.Is(err, ErrInvalidHeader) {
+			s.pm.Misbehaving(ctx, p.String(),
+				misbehaviorInvalidHeaders, err.Error())
+		}
+		return err
+	}
+	// Do not let blocks that failed validation become canonical again.
+	if err := s.invalidHeadersVerify(ctx, msg.Headers); err != nil {
+		if errors.Is(err, ErrBlockInvalid) {
+			s.pm.Misbehaving(ctx, p.String(),
+				misbehaviorInvalidHeaders, err.Error())
+		}
+		return err
 	}
 
 	// When running in normal (not External Header) mode, do not set upstream state IDs
@@ -1326,8 +1478,8 @@ func (s *Server) handleBlock(ctx context.Context, p *rawpeer.RawPeer, msg *wire.
 
 	block := btcutil.NewBlock(msg)
 	bhs := block.Hash().String()
-	// Not an error due to normal racing conditions.
-	_, _ = s.blocks.Delete(bhs) // remove block from ttl regardless of insert result
+	// Remove block from the download window regardless of insert result.
+	requested := s.blocks.received(*block.Hash(), p, len(raw), time.Now())
 
 	// Whatever happens, kick cache in the nuts on the way out.
 	defer func() {
@@ -1360,6 +1512,12 @@ func (s *Server) handleBlock(ctx context.Context, p *rawpeer.RawPeer, msg *wire.
 
 	height, err := s.db.BlockInsert(ctx, block) // XXX see if we can use raw here
 	if err != nil {
+		if !requested && errors.Is(err, database.ErrNotFound) {
+			// Block is not in the window and we don't know its
+			// header thus we never asked for it.
+			s.pm.Misbehaving(ctx, p.String(),
+				misbehaviorUnsolicitedBlock, "unsolicited block")
+		}
 		return fmt.Errorf("database block insert %v: %w", bhs, err)
 	} else {
 		log.Infof("Insert block %v at %v txs %v %v", bhs, height,
@@ -1377,9 +1535,10 @@ func (s *Server) handleBlock(ctx context.Context, p *rawpeer.RawPeer, msg *wire.
 	}
 	s.mtx.Unlock()
 
-	// Reap txs from mempool, no need to log error.
+	// Reap mined and conflicting txs from mempool.
 	if s.cfg.MempoolEnabled {
-		_ = s.mempool.txsRemove(ctx, txHashes)
+		removed := s.mempool.blockRemove(ctx, block.MsgBlock())
+		log.Debugf("mempool removed %v txs", removed)
 	}
 
 	log.Debugf("inserted block at height %d, parent hash %s", height, block.MsgBlock().Header.PrevBlock)
@@ -1411,7 +1570,7 @@ func (s *Server) handleBlock(ctx context.Context, p *rawpeer.RawPeer, msg *wire.
 			s.blocksInserted, humanize.Bytes(s.blocksSize), delta)
 		log.Infof("Pending blocks %v/%v connected peers %v good peers %v "+
 			"bad peers %v mempool %v %v",
-			s.blocks.Len(), defaultPendingBlocks, connectedPeers, goodPeers,
+			s.blocks.count(), defaultPendingBlocks, connectedPeers, goodPeers,
 			badPeers, mempoolCount, humanize.Bytes(uint64(mempoolSize)))
 
 		// Reset stats
@@ -1484,6 +1643,18 @@ func (s *Server) handleNotFound(ctx context.Context, p *rawpeer.RawPeer, msg *wi
 	// // XXX keep here to see if it spams logs
 	// log.Infof("NotFound: %v %v", p, spew.Sdump(msg))
 
+	// Request the blocks the peer does not have from another peer.
+	var hashes []chainhash.Hash
+	for _, iv := range msg.InvList {
+		if iv.Type == wire.InvTypeBlock || iv.Type == wire.InvTypeWitnessBlock {
+			hashes = append(hashes, iv.Hash)
+		}
+	}
+	if len(hashes) > 0 {
+		s.blocks.notFound(p, hashes)
+		go s.syncBlocks(ctx)
+	}
+
 	return nil
 }
 
@@ -1491,39 +1662,85 @@ func (s *Server) handleGetData(ctx context.Context, p *rawpeer.RawPeer, msg *wir
 	log.Tracef("handleGetData %v", p)
 	defer log.Tracef("handleGetData %v exit", p)
 
+	notFound := wire.NewMsgNotFound()
 	for _, v := range msg.InvList {
+		var (
+			data wire.Message
+			err  error
+		)
+		enc := wire.BaseEncoding
 		switch v.Type {
 		case wire.InvTypeError:
 			log.Errorf("get data error: %v", v.Hash)
+			continue
+		case wire.InvTypeWitnessTx:
+			enc = wire.WitnessEncoding
+			fallthrough
 		case wire.InvTypeTx:
-			s.mtx.RLock()
-			if tx, ok := s.broadcast[v.Hash]; ok {
-				log.Debugf("handleGetData %v", spew.Sdump(msg))
-				txc := tx.Copy()
-				err := p.Write(defaultCmdTimeout, txc)
-				if err != nil {
-					log.Errorf("write tx: %v", err)
-				}
-			}
-			s.mtx.RUnlock()
+			data, err = s.getDataTx(ctx, &v.Hash)
+		case wire.InvTypeWitnessBlock:
+			enc = wire.WitnessEncoding
+			fallthrough
 		case wire.InvTypeBlock:
-			log.Infof("get data block: %v", v.Hash)
+			data, err = s.getDataBlock(ctx, &v.Hash)
 		case wire.InvTypeFilteredBlock:
 			log.Infof("get data filtered block: %v", v.Hash)
-		case wire.InvTypeWitnessBlock:
-			log.Infof("get data witness block: %v", v.Hash)
-		case wire.InvTypeWitnessTx:
-			log.Infof("get data witness tx: %v", v.Hash)
 		case wire.InvTypeFilteredWitnessBlock:
 			log.Infof("get data filtered witness block: %v", v.Hash)
 		default:
 			log.Errorf("get data unknown: %v", spew.Sdump(v.Hash))
 		}
+		if err != nil && !errors.Is(err, database.ErrNotFound) &&
+			!errors.Is(err, database.ErrBlockNotFound) &&
+			!errors.Is(err, database.ErrBlockPruned) {
+			return fmt.Errorf("get data %v: %w", v.Hash, err)
+		}
+		if data == nil {
+			if err := notFound.AddInvVect(v); err != nil {
+				return fmt.Errorf("not found: %w", err)
+			}
+			continue
+		}
+		if err := p.WriteEncoding(defaultCmdTimeout, data, enc); err != nil {
+			return fmt.Errorf("write data %v: %w", v.Hash, err)
+		}
+	}
+	if len(notFound.InvList) != 0 {
+		if err := p.Write(defaultCmdTimeout, notFound); err != nil {
+			return fmt.Errorf("write not found: %w", err)
+		}
 	}
 
 	return nil
 }
 
+// getDataTx returns a transaction that was either broadcast by us or is in
+// the mempool. Like bitcoind, mined transactions are not served, peers
+// request blocks for those.
+func (s *Server) getDataTx(ctx context.Context, hash *chainhash.Hash) (wire.Message, error) {
+	s.mtx.RLock()
+	tx, ok := s.broadcast[*hash]
+	s.mtx.RUnlock()
+	if ok {
+		return tx.Copy(), nil
+	}
+	if s.cfg.MempoolEnabled {
+		if tx, ok := s.mempool.txById(*hash); ok {
+			return tx.Copy(), nil
+		}
+	}
+	return nil, database.NotFoundError(fmt.Sprintf("tx not found: %v", hash))
+}
+
+// getDataBlock returns a block from the raw block database.
+func (s *Server) getDataBlock(ctx context.Context, hash *chainhash.Hash) (wire.Message, error) {
+	b, err := s.db.BlockByHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return b.MsgBlock(), nil
+}
+
 func (s *Server) insertGenesis(ctx context.Context, height uint64, diff *big.Int) error {
 	log.Tracef("insertGenesis")
 	defer log.Tracef("insertGenesis exit")
@@ -1738,6 +1955,44 @@ func (s *Server) UtxosByScriptHash(ctx context.Context, hash tbcd.ScriptHash, st
 	return s.db.UtxosByScriptHash(ctx, hash, start, count)
 }
 
+// TxsByAddress returns up to count transactions that created or spent outputs
+// of the provided address, ordered by height. The returned cursor must be
+// provided to retrieve the next page and is nil when there are no more
+// transactions.
+func (s *Server) TxsByAddress(ctx context.Context, encodedAddress string, cursor []byte, count uint64) ([]tbcd.TxHistory, []byte, error) {
+	log.Tracef("TxsByAddress")
+	defer log.Tracef("TxsByAddress exit")
+
+	if s.cfg.ExternalHeaderMode {
+		return nil, nil, errors.New("cannot call TxsByAddress on TBC running in External Header mode")
+	}
+
+	addr, err := btcutil.DecodeAddress(encodedAddress, s.chainParams)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.db.TxsByScriptHash(ctx, tbcd.NewScriptHashFromScript(script),
+		cursor, count)
+}
+
+// TxsByScriptHash returns up to count transactions that created or spent
+// outputs of the provided script hash. See TxsByAddress.
+func (s *Server) TxsByScriptHash(ctx context.Context, hash tbcd.ScriptHash, cursor []byte, count uint64) ([]tbcd.TxHistory, []byte, error) {
+	log.Tracef("TxsByScriptHash")
+	defer log.Tracef("TxsByScriptHash exit")
+
+	if s.cfg.ExternalHeaderMode {
+		return nil, nil, errors.New("cannot call TxsByScriptHash on TBC running in External Header mode")
+	}
+
+	return s.db.TxsByScriptHash(ctx, hash, cursor, count)
+}
+
 // ScriptHashAvailableToSpend returns a boolean which indicates whether
 // a specific output (uniquely identified by TxId output index) is
 // available for spending in the UTXO table.
@@ -1784,6 +2039,64 @@ func (s *Server) SpentOutputsByTxId(ctx context.Context, txId *chainhash.Hash) (
 	return si, nil
 }
 
+// OutpointSpend is the tx input that spends an outpoint. BlockHash is nil when
+// the spending tx is in the mempool.
+type OutpointSpend struct {
+	TxId        chainhash.Hash
+	InputIndex  uint32
+	BlockHash   *chainhash.Hash
+	BlockHeight uint64
+}
+
+// OutpointSpentBy returns the tx that spends the provided outpoint per the tx
+// index or, when the spend is not confirmed, per the mempool.
+func (s *Server) OutpointSpentBy(ctx context.Context, op wire.OutPoint) (*OutpointSpend, error) {
+	log.Tracef("OutpointSpentBy")
+	defer log.Tracef("OutpointSpentBy exit")
+
+	if s.cfg.ExternalHeaderMode {
+		return nil, errors.New("cannot call OutpointSpentBy on TBC running in External Header mode")
+	}
+
+	si, err := s.db.SpentOutputsByOutpoint(ctx, tbcd.NewOutpoint(op.Hash, op.Index))
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		return nil, err
+	}
+
+	// An outpoint may be spent in blocks on different forks, only the
+	// canonical spend counts.
+	for _, v := range si {
+		bh, err := s.db.BlockHeaderByHash(ctx, v.BlockHash)
+		if err != nil {
+			return nil, fmt.Errorf("block header %v: %w", v.BlockHash, err)
+		}
+		canonical, err := s.isCanonical(ctx, bh)
+		if err != nil {
+			return nil, fmt.Errorf("is canonical %v: %w", bh, err)
+		}
+		if canonical {
+			return &OutpointSpend{
+				TxId:        *v.TxId,
+				InputIndex:  v.InputIndex,
+				BlockHash:   &bh.Hash,
+				BlockHeight: bh.Height,
+			}, nil
+		}
+	}
+
+	// Not spent on the canonical chain, try the mempool.
+	if s.cfg.MempoolEnabled {
+		txId, index, err := s.mempool.spentBy(op)
+		if err == nil {
+			return &OutpointSpend{TxId: txId, InputIndex: index}, nil
+		}
+		if !errors.Is(err, database.ErrNotFound) {
+			return nil, fmt.Errorf("mempool: %w", err)
+		}
+	}
+	return nil, database.ErrNotFound
+}
+
 func (s *Server) BlockInTxIndex(ctx context.Context, blkid *chainhash.Hash) (bool, error) {
 	log.Tracef("BlockInTxIndex")
 	defer log.Tracef("BlockInTxIndex exit")
@@ -1832,6 +2145,243 @@ func (s *Server) TxById(ctx context.Context, txId *chainhash.Hash) (*wire.MsgTx,
 	return nil, database.ErrNotFound
 }
 
+// txBlockHeader returns the header of the block a tx was mined in per the tx
+// index.
+func (s *Server) txBlockHeader(ctx context.Context, txId *chainhash.Hash) (*tbcd.BlockHeader, error) {
+	blockHash, err := s.db.BlockHashByTxId(ctx, txId)
+	if err != nil {
+		return nil, fmt.Errorf("block hash by tx id %v: %w", txId, err)
+	}
+	bh, err := s.db.BlockHeaderByHash(ctx, blockHash)
+	if err != nil {
+		return nil, fmt.Errorf("block header %v: %w", blockHash, err)
+	}
+	return bh, nil
+}
+
+// utxoBlockHeader returns the header of the block that created the unspent
+// outputs of txId. The height comes from the script hash history, which is
+// indexed along with the utxos, so that the tx index is not needed. The
+// highest entry wins since a duplicate tx replaces the outputs of the earlier
+// one.
+func (s *Server) utxoBlockHeader(ctx context.Context, txId *chainhash.Hash, sh tbcd.ScriptHash, utxoHH *HashHeight) (*tbcd.BlockHeader, error) {
+	var (
+		cursor []byte
+		height uint64
+		found  bool
+	)
+	for {
+		txs, next, err := s.db.TxsByScriptHash(ctx, sh, cursor, 1000)
+		if err != nil {
+			return nil, fmt.Errorf("history %v: %w", sh, err)
+		}
+		for _, th := range txs {
+			if th.TxId.IsEqual(txId) && th.Height <= utxoHH.Height {
+				height = th.Height
+				found = true
+			}
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	if !found {
+		return nil, database.NotFoundError(fmt.Sprintf("history not found: %v", txId))
+	}
+	bhs, err := s.db.BlockHeadersByHeight(ctx, height)
+	if err != nil {
+		return nil, fmt.Errorf("block headers by height %v: %w", height, err)
+	}
+	index, err := s.findPathFromHash(ctx, &utxoHH.Hash, bhs)
+	if err != nil {
+		return nil, fmt.Errorf("find path %v: %w", height, err)
+	}
+	return &bhs[index], nil
+}
+
+// txLookup returns a confirmed tx and the header of the block it was mined in
+// or, when the tx is not confirmed, a mempool tx and a nil header.
+func (s *Server) txLookup(ctx context.Context, txId *chainhash.Hash) (*wire.MsgTx, *tbcd.BlockHeader, error) {
+	bh, err := s.txBlockHeader(ctx, txId)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			return nil, nil, err
+		}
+		if s.cfg.MempoolEnabled {
+			if tx, ok := s.mempool.txById(*txId); ok {
+				return tx, nil, nil
+			}
+		}
+		return nil, nil, err
+	}
+	b, err := s.db.BlockByHash(ctx, &bh.Hash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("block %v: %w", bh.Hash, err)
+	}
+	for _, tx := range b.Transactions() {
+		if tx.Hash().IsEqual(txId) {
+			return tx.MsgTx(), bh, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("tx %v not in block %v", txId, bh.Hash)
+}
+
+// canonicalBlockHeaderByHeight returns the canonical block header at height.
+func (s *Server) canonicalBlockHeaderByHeight(ctx context.Context, height uint64) (*tbcd.BlockHeader, error) {
+	bhb, err := s.db.BlockHeaderBest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("block header best: %w", err)
+	}
+	if height > bhb.Height {
+		return nil, fmt.Errorf("height %v: %w", height, database.ErrNotFound)
+	}
+	bhs, err := s.db.BlockHeadersByHeight(ctx, height)
+	if err != nil {
+		return nil, fmt.Errorf("block headers by height %v: %w", height, err)
+	}
+	index, err := s.findPathFromHash(ctx, &bhb.Hash, bhs)
+	if err != nil {
+		return nil, fmt.Errorf("find path %v: %w", height, err)
+	}
+	return &bhs[index], nil
+}
+
+// merkleBranch returns the hashes needed to prove that the hash at index is
+// part of the merkle root of hashes, from the leaf up.
+func merkleBranch(hashes []chainhash.Hash, index int) []chainhash.Hash {
+	var branch []chainhash.Hash
+	level := hashes
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level[:len(level):len(level)], level[len(level)-1])
+		}
+		branch = append(branch, level[index^1])
+
+		next := make([]chainhash.Hash, 0, len(level)/2)
+		for k := 0; k < len(level); k += 2 {
+			next = append(next, blockchain.HashMerkleBranches(&level[k],
+				&level[k+1]))
+		}
+		level = next
+		index /= 2
+	}
+	return branch
+}
+
+// MerkleProof proves that a tx is included in a block. MerkleHashes are
+// ordered from the leaf up, see bitcoin.CheckMerkleChain.
+type MerkleProof struct {
+	BlockHash    chainhash.Hash
+	BlockHeight  uint64
+	TxIndex      uint32
+	MerkleHashes []chainhash.Hash
+}
+
+// TxMerkleProof returns the merkle inclusion proof of a confirmed tx, computed
+// from the block it was mined in per the tx index.
+func (s *Server) TxMerkleProof(ctx context.Context, txId *chainhash.Hash) (*MerkleProof, error) {
+	log.Tracef("TxMerkleProof")
+	defer log.Tracef("TxMerkleProof exit")
+
+	if s.cfg.ExternalHeaderMode {
+		return nil, errors.New("cannot call TxMerkleProof on TBC running in External Header mode")
+	}
+
+	bh, err := s.txBlockHeader(ctx, txId)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.db.BlockByHash(ctx, &bh.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("block %v: %w", bh.Hash, err)
+	}
+	txs := b.Transactions()
+	hashes := make([]chainhash.Hash, 0, len(txs))
+	index := -1
+	for k, tx := range txs {
+		if tx.Hash().IsEqual(txId) {
+			index = k
+		}
+		hashes = append(hashes, *tx.Hash())
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("tx %v not in block %v", txId, bh.Hash)
+	}
+	return &MerkleProof{
+		BlockHash:    bh.Hash,
+		BlockHeight:  bh.Height,
+		TxIndex:      uint32(index),
+		MerkleHashes: merkleBranch(hashes, index),
+	}, nil
+}
+
+// BlockFilterByHash returns the BIP158 basic filter and filter header for the
+// provided block hash.
+func (s *Server) BlockFilterByHash(ctx context.Context, hash *chainhash.Hash) (*tbcd.BlockFilter, error) {
+	log.Tracef("BlockFilterByHash")
+	defer log.Tracef("BlockFilterByHash exit")
+
+	if s.cfg.ExternalHeaderMode {
+		return nil, errors.New("cannot call BlockFilterByHash on TBC running in External Header mode")
+	}
+
+	return s.db.BlockFilterByHash(ctx, hash)
+}
+
+// BlockFiltersByHeight returns up to count BIP158 basic filters starting at
+// the provided height. Filters are returned along the chain that is currently
+// filter indexed and the range is truncated at the filter index tip.
+func (s *Server) BlockFiltersByHeight(ctx context.Context, height, count uint64) ([]*tbcd.BlockFilter, error) {
+	log.Tracef("BlockFiltersByHeight")
+	defer log.Tracef("BlockFiltersByHeight exit")
+
+	if s.cfg.ExternalHeaderMode {
+		return nil, errors.New("cannot call BlockFiltersByHeight on TBC running in External Header mode")
+	}
+
+	if count == 0 {
+		return nil, errors.New("count must be greater than 0")
+	}
+	filterHH, err := s.FilterIndexHash(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("filter index hash: %w", err)
+	}
+	if height > filterHH.Height {
+		return nil, database.NotFoundError(fmt.Sprintf("block filters not "+
+			"found at height: %v", height))
+	}
+
+	// Find the last block in the range and walk backwards from there.
+	top := min(height+count-1, filterHH.Height)
+	bhs, err := s.db.BlockHeadersByHeight(ctx, top)
+	if err != nil {
+		return nil, fmt.Errorf("block headers by height %v: %w", top, err)
+	}
+	index, err := s.findPathFromHash(ctx, &filterHH.Hash, bhs)
+	if err != nil {
+		return nil, fmt.Errorf("could not determine canonical path %v: %w",
+			top, err)
+	}
+	bh := &bhs[index]
+	bfs := make([]*tbcd.BlockFilter, top-height+1)
+	for i := len(bfs) - 1; i >= 0; i-- {
+		bfs[i], err = s.db.BlockFilterByHash(ctx, &bh.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("block filter by hash: %w", err)
+		}
+		if i == 0 {
+			break
+		}
+		bh, err = s.db.BlockHeaderByHash(ctx, bh.ParentHash())
+		if err != nil {
+			return nil, fmt.Errorf("block header by hash: %w", err)
+		}
+	}
+
+	return bfs, nil
+}
+
 func (s *Server) TxBroadcastAllToPeer(ctx context.Context, p *rawpeer.RawPeer) error {
 	log.Tracef("TxBroadcastAllToPeer %v", p)
 	defer log.Tracef("TxBroadcastAllToPeer %v exit", p)
@@ -1967,6 +2517,41 @@ func (s *Server) FeesAtHeight(ctx context.Context, height, count int64) (uint64,
 	return fees, errors.New("not yet")
 }
 
+// FeeEstimate returns the recommended fee rates for several confirmation
+// targets based on the contents of the mempool.
+func (s *Server) FeeEstimate(ctx context.Context) ([]FeeEstimate, error) {
+	log.Tracef("FeeEstimate")
+	defer log.Tracef("FeeEstimate exit")
+
+	if !s.cfg.MempoolEnabled {
+		return nil, ErrMempoolDisabled
+	}
+	return s.mempool.feeEstimate(ctx, feeEstimateTargets), nil
+}
+
+// MempoolInfo returns the mempool statistics and fee rate histogram.
+func (s *Server) MempoolInfo(ctx context.Context) (*MempoolInfo, error) {
+	log.Tracef("MempoolInfo")
+	defer log.Tracef("MempoolInfo exit")
+
+	if !s.cfg.MempoolEnabled {
+		return nil, ErrMempoolDisabled
+	}
+	return s.mempool.info(ctx), nil
+}
+
+// MempoolTxs returns up to count mempool txs, starting at start, ordered by
+// descending fee rate.
+func (s *Server) MempoolTxs(ctx context.Context, start, count int) ([]MempoolTx, error) {
+	log.Tracef("MempoolTxs")
+	defer log.Tracef("MempoolTxs exit")
+
+	if !s.cfg.MempoolEnabled {
+		return nil, ErrMempoolDisabled
+	}
+	return s.mempool.txsByFeeRate(ctx, start, count), nil
+}
+
 // FullBlockAvailable returns whether TBC has the full block
 // corresponding to the specified hash available in its database.
 func (s *Server) FullBlockAvailable(ctx context.Context, hash *chainhash.Hash) (bool, error) {
@@ -2031,6 +2616,7 @@ type SyncInfo struct {
 	BlockHeader    HashHeight
 	Utxo           HashHeight
 	Tx             HashHeight
+	Filter         HashHeight
 }
 
 func (s *Server) synced(ctx context.Context) (si SyncInfo) {
@@ -2078,6 +2664,13 @@ func (s *Server) synced(ctx context.Context) (si SyncInfo) {
 	}
 	si.Tx = *txHH
 
+	// filter index
+	filterHH, err := s.FilterIndexHash(ctx)
+	if err != nil {
+		filterHH = &HashHeight{}
+	}
+	si.Filter = *filterHH
+
 	// Find out how many blocks are missing.
 	var (
 		blksMissing bool = true
@@ -2099,7 +2692,7 @@ func (s *Server) synced(ctx context.Context) (si SyncInfo) {
 	}
 
 	if utxoHH.Hash.IsEqual(&bhb.Hash) && txHH.Hash.IsEqual(&bhb.Hash) &&
-		!s.indexing && !blksMissing {
+		filterHH.Hash.IsEqual(&bhb.Hash) && !s.indexing && !blksMissing {
 		si.Synced = true
 	}
 	return
@@ -2127,8 +2720,7 @@ func (s *Server) DBOpen(ctx context.Context) error {
 
 	// This should have been verified but let's not make assumptions.
 	switch s.cfg.Network {
-	case "testnet3":
-	case "mainnet":
+	case "mainnet", "testnet3", "testnet4", "signet", "regtest":
 	case networkLocalnet: // XXX why is this here?, this breaks the filepath.Join
 	default:
 		return fmt.Errorf("unsupported network: %v", s.cfg.Network)
@@ -2139,6 +2731,10 @@ func (s *Server) DBOpen(ctx context.Context) error {
 	cfg := level.NewConfig(filepath.Join(s.cfg.LevelDBHome, s.cfg.Network))
 	cfg.BlockCache = s.cfg.BlockCache
 	cfg.BlockheaderCache = s.cfg.BlockheaderCache
+	cfg.BlockCompression, err = rawdb.ParseCompression(s.cfg.BlockCompression)
+	if err != nil {
+		return err
+	}
 	s.db, err = level.New(ctx, cfg)
 	if err != nil {
 		return fmt.Errorf("open level database: %w", err)
@@ -2194,6 +2790,11 @@ func (s *Server) Collectors() []prometheus.Collector {
 				Name:      "tx_sync_height",
 				Help:      "Height of transaction indexer",
 			}, s.promTx),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: s.cfg.PrometheusNamespace,
+				Name:      "filter_sync_height",
+				Help:      "Height of block filter indexer",
+			}, s.promFilter),
 			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 				Namespace: s.cfg.PrometheusNamespace,
 				Name:      "peers_connected",
@@ -2281,6 +2882,15 @@ func (s *Server) Run(pctx context.Context) error {
 	if err == nil {
 		log.Infof("Tx index %v", txHH)
 	}
+	filterHH, err := s.FilterIndexHash(ctx)
+	if err == nil {
+		log.Infof("Filter index %v", filterHH)
+	}
+	if s.cfg.MempoolEnabled {
+		if err := s.mempoolLoad(ctx); err != nil {
+			log.Errorf("mempool load: %v", err)
+		}
+	}
 
 	// HTTP server
 	mux := http.NewServeMux()
@@ -2352,6 +2962,21 @@ func (s *Server) Run(pctx context.Context) error {
 		}()
 	}
 
+	// Address book, must be loaded before the peer manager runs.
+	if err := s.addressBookLoad(ctx); err != nil {
+		return fmt.Errorf("address book: %w", err)
+	}
+	defer func() {
+		if err := s.addressBookFlush(ctx); err != nil {
+			log.Errorf("address book flush: %v", err)
+		}
+	}()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.addressBookFlusher(ctx)
+	}()
+
 	errC := make(chan error)
 	s.wg.Add(1)
 	go func() {
@@ -2387,6 +3012,83 @@ func (s *Server) Run(pctx context.Context) error {
 		}
 	}()
 
+	// inbound peers
+	if s.cfg.P2PListenAddress != "" {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.p2pListen(ctx); err != nil {
+				select {
+				case errC <- err:
+				default:
+				}
+			}
+		}()
+	}
+
+	// electrum server
+	if s.cfg.ElectrumListenAddress != "" {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.electrumListen(ctx); err != nil {
+				select {
+				case errC <- err:
+				default:
+				}
+			}
+		}()
+	}
+
+	// esplora server
+	if s.cfg.EsploraListenAddress != "" {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.esploraListen(ctx); err != nil {
+				select {
+				case errC <- err:
+				default:
+				}
+			}
+		}()
+	}
+
+	// json-rpc server
+	if s.cfg.JSONRPCListenAddress != "" {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.jsonrpcListen(ctx); err != nil {
+				select {
+				case errC <- err:
+				default:
+				}
+			}
+		}()
+	}
+
+	// block download timeouts
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.blockDownloadExpire(ctx)
+	}()
+
+	// mempool expiry and persistence
+	if s.cfg.MempoolEnabled {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.mempoolExpire(ctx)
+		}()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.mempoolPersist(ctx)
+		}()
+	}
+
 	// ping loop
 	s.wg.Add(1)
 	go func() {
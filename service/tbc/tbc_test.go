@@ -22,6 +22,8 @@ import (
 
 	"github.com/hemilabs/heminetwork/database/tbcd"
 
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
@@ -98,6 +100,33 @@ func TestBlockHeaderEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestMerkleBranch(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		txs := make([]*btcutil.Tx, 0, count)
+		hashes := make([]chainhash.Hash, 0, count)
+		for k := range count {
+			tx := wire.NewMsgTx(wire.TxVersion)
+			tx.LockTime = uint32(k)
+			txs = append(txs, btcutil.NewTx(tx))
+			hashes = append(hashes, tx.TxHash())
+		}
+		root := blockchain.CalcMerkleRoot(txs, false)
+
+		for index := range count {
+			branch := merkleBranch(hashes, index)
+			merkleHashes := make([][]byte, 0, len(branch))
+			for _, h := range branch {
+				merkleHashes = append(merkleHashes, h[:])
+			}
+			err := bitcoin.CheckMerkleChain(hashes[index][:], uint32(index),
+				merkleHashes, root[:])
+			if err != nil {
+				t.Fatalf("count %v index %v: %v", count, index, err)
+			}
+		}
+	}
+}
+
 func TestServerBlockHeadersBest(t *testing.T) {
 	skipIfNoDocker(t)
 
@@ -1924,3 +1953,79 @@ func TestExternalHeaderModeSimpleIncorrectRemoval(t *testing.T) {
 		t.Errorf("best hash %x does not match expected hash %x", bestHash[:], lastHashToAdd[:])
 	}
 }
+
+func TestServerNetworks(t *testing.T) {
+	tests := []struct {
+		network   string
+		challenge string
+		net       wire.BitcoinNet
+		genesis   *chainhash.Hash
+		seeds     []string
+		wantErr   bool
+	}{
+		{
+			network: "testnet4",
+			net:     bitcoin.TestNet4,
+			genesis: bitcoin.TestNet4Params.GenesisHash,
+			seeds:   []string{"127.0.0.1:48333"},
+		},
+		{
+			network: "signet",
+			net:     chaincfg.SigNetParams.Net,
+			genesis: chaincfg.SigNetParams.GenesisHash,
+			seeds:   []string{"127.0.0.1:38333"},
+		},
+		{
+			network: "regtest",
+			net:     wire.TestNet,
+			genesis: chaincfg.RegressionNetParams.GenesisHash,
+			seeds:   []string{"127.0.0.1:18444"},
+		},
+		{
+			network:   "signet",
+			challenge: "51",
+			genesis:   chaincfg.SigNetParams.GenesisHash,
+			seeds:     []string{"127.0.0.1:38333"},
+		},
+		{
+			network:   "mainnet",
+			challenge: "51",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network+tt.challenge, func(t *testing.T) {
+			cfg := NewDefaultConfig()
+			cfg.Network = tt.network
+			cfg.SignetChallenge = tt.challenge
+			cfg.Seeds = []string{"127.0.0.1"}
+			s, err := NewServer(cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.challenge == "" && s.wireNet != tt.net {
+				t.Fatalf("net %v, want %v", s.wireNet, tt.net)
+			}
+			if tt.challenge != "" && s.wireNet == chaincfg.SigNetParams.Net {
+				t.Fatal("custom signet uses default magic")
+			}
+			if !s.chainParams.GenesisHash.IsEqual(tt.genesis) {
+				t.Fatalf("genesis %v, want %v", s.chainParams.GenesisHash,
+					tt.genesis)
+			}
+			if h, ok := s.checkpoints[*tt.genesis]; !ok || h != 0 {
+				t.Fatal("genesis checkpoint missing")
+			}
+			// The default port is added to seeds.
+			if diff := deep.Equal(s.pm.seeds, tt.seeds); len(diff) > 0 {
+				t.Fatalf("seeds: %v", diff)
+			}
+		})
+	}
+}
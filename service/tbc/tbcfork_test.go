@@ -9,10 +9,19 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -20,14 +29,24 @@ import (
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/gcs"
+	"github.com/btcsuite/btcd/btcutil/gcs/builder"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/juju/loggo"
 
+	"github.com/hemilabs/heminetwork/api"
+	"github.com/hemilabs/heminetwork/api/protocol"
+	"github.com/hemilabs/heminetwork/api/tbcapi"
+	"github.com/hemilabs/heminetwork/bitcoin"
+	"github.com/hemilabs/heminetwork/database"
 	"github.com/hemilabs/heminetwork/database/tbcd"
+	"github.com/hemilabs/heminetwork/hemi/electrs"
 	"github.com/hemilabs/heminetwork/service/tbc/peer/rawpeer"
 )
 
@@ -359,26 +378,25 @@ func (b *btcNode) handleGetHeaders(m *wire.MsgGetHeaders) (*wire.MsgHeaders, err
 	return nmh, nil
 }
 
-func (b *btcNode) handleGetData(m *wire.MsgGetData) (*wire.MsgBlock, error) {
+func (b *btcNode) handleGetData(m *wire.MsgGetData) ([]*wire.MsgBlock, error) {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
 
 	// b.logf("get data: %v", spew.Sdump(m))
-	if len(m.InvList) != 1 {
-		return nil, errors.New("not supported multi invlist requests")
-	}
-
-	v := m.InvList[0]
-	if v.Type != wire.InvTypeBlock {
-		return nil, fmt.Errorf("unsuported data type: %v", v.Type)
-	}
+	blocks := make([]*wire.MsgBlock, 0, len(m.InvList))
+	for _, v := range m.InvList {
+		if v.Type != wire.InvTypeBlock {
+			return nil, fmt.Errorf("unsuported data type: %v", v.Type)
+		}
 
-	blk, ok := b.chain[v.Hash.String()]
-	if !ok {
-		return nil, fmt.Errorf("block not found: %v", v.Hash)
+		blk, ok := b.chain[v.Hash.String()]
+		if !ok {
+			return nil, fmt.Errorf("block not found: %v", v.Hash)
+		}
+		blocks = append(blocks, blk.b.MsgBlock())
 	}
 
-	return blk.b.MsgBlock(), nil
+	return blocks, nil
 }
 
 func (b *btcNode) handleRPC(ctx context.Context, conn net.Conn) error {
@@ -449,13 +467,15 @@ func (b *btcNode) handleMsg(ctx context.Context, p *rawpeer.RawPeer, msg wire.Me
 
 	case *wire.MsgGetData:
 		// b.logf("get data %v", spew.Sdump(m))
-		data, err := b.handleGetData(m)
+		blocks, err := b.handleGetData(m)
 		if err != nil {
 			return fmt.Errorf("handle get data: %w", err)
 		}
-		// b.logf("%v", spew.Sdump(data))
-		if err = p.Write(time.Second, data); err != nil {
-			return fmt.Errorf("write data: %w", err)
+		for _, data := range blocks {
+			// b.logf("%v", spew.Sdump(data))
+			if err = p.Write(time.Second, data); err != nil {
+				return fmt.Errorf("write data: %w", err)
+			}
 		}
 
 	default:
@@ -1243,11 +1263,123 @@ func TestIndexNoFork(t *testing.T) {
 	// t.Logf("%v: %v", b2.b.Transactions()[1].Hash(), spew.Sdump(si))
 	_ = si
 
+	// Verify filter headers commit to the chain of filters
+	filterHH, err := s.FilterIndexHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filterHH.Hash.IsEqual(b3.Hash()) {
+		t.Fatalf("expected filter index at b3, got %v", filterHH)
+	}
+	bfs, err := s.BlockFiltersByHeight(ctx, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bfs) != 4 {
+		t.Fatalf("expected 4 filters, got %v", len(bfs))
+	}
+	var prevHeader chainhash.Hash
+	for k, bf := range bfs {
+		f, err := gcs.FromNBytes(builder.DefaultP, builder.DefaultM, bf.Filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := builder.MakeHeaderForFilter(f, prevHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !header.IsEqual(&bf.Header) {
+			t.Fatalf("filter header %v mismatch: got %v, want %v",
+				k, bf.Header, header)
+		}
+		prevHeader = bf.Header
+	}
+
+	// b2 filter must match an output script created in b2
+	f, err := gcs.FromNBytes(builder.DefaultP, builder.DefaultM, bfs[2].Filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := builder.DeriveKey(b2.Hash())
+	ok, err := f.Match(key, tx.MsgTx().TxOut[0].PkScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected b2 filter to match output script")
+	}
+
+	// Verify miner history, it mined all blocks and funded tx 1 in b2
+	history, _, err := s.TxsByAddress(ctx, address.String(), nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[chainhash.Hash]uint64{}
+	for k, th := range history {
+		if k > 0 && th.Height < history[k-1].Height {
+			t.Fatalf("history not ordered by height: %v", spew.Sdump(history))
+		}
+		found[th.TxId] = th.Height
+	}
+	for _, x := range []struct {
+		txId   *chainhash.Hash
+		height uint64
+	}{
+		{b1.b.Transactions()[0].Hash(), 1},
+		{b2.b.Transactions()[0].Hash(), 2},
+		{tx.Hash(), 2},
+		{b3.b.Transactions()[0].Hash(), 3},
+	} {
+		if height, ok := found[*x.txId]; !ok || height != x.height {
+			t.Fatalf("tx %v @ %v not found in history: %v", x.txId,
+				x.height, spew.Sdump(history))
+		}
+	}
+
+	// Page through the history one tx at a time
+	var (
+		cursor []byte
+		paged  []tbcd.TxHistory
+	)
+	for {
+		page, next, err := s.TxsByAddress(ctx, address.String(), cursor, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paged = append(paged, page...)
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	if !reflect.DeepEqual(history, paged) {
+		t.Fatalf("paged history mismatch: %v != %v", spew.Sdump(history),
+			spew.Sdump(paged))
+	}
+
 	// unwind back to b3 (removes b3 and b2)
 	err = s.SyncIndexersToHash(ctx, b2.Hash())
 	if err != nil {
 		t.Fatalf("unwinding to genesis should have returned nil, got %v", err)
 	}
+	history, _, err = s.TxsByAddress(ctx, address.String(), nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, th := range history {
+		if th.Height > 2 {
+			t.Fatalf("unexpected history at height %v: %v", th.Height,
+				th.TxId)
+		}
+	}
+	_, err = s.BlockFilterByHash(ctx, b3.Hash())
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected b3 filter to be removed, got %v", err)
+	}
+	_, err = s.BlockFilterByHash(ctx, b2.Hash())
+	if err != nil {
+		t.Fatalf("expected b2 filter: %v", err)
+	}
 	err = mustHave(ctx, s, n.genesis, b1)
 	if err != nil {
 		t.Fatalf("expected an error from mustHave: %v", err)
@@ -1262,12 +1394,20 @@ func TestIndexNoFork(t *testing.T) {
 		t.Fatal("expected genesis")
 	}
 
-	// Expect 0 balances everywhere
+	// Expect 0 balances and no history everywhere
 	for address, key := range n.keys {
 		balance, err := s.BalanceByAddress(ctx, address)
 		if err != nil {
 			t.Fatal(err)
 		}
+		history, _, err := s.TxsByAddress(ctx, address, nil, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 0 {
+			t.Fatalf("%v (%v) expected no history, got %v",
+				key.name, address, spew.Sdump(history))
+		}
 		log.Infof("balance address %v  %v", address, btcutil.Amount(balance))
 		if balance != 0 {
 			t.Fatalf("%v (%v) invalid balance expected 0, got %v",
@@ -1276,7 +1416,7 @@ func TestIndexNoFork(t *testing.T) {
 	}
 }
 
-func TestIndexFork(t *testing.T) {
+func TestFullValidation(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer func() {
 		cancel()
@@ -1286,12 +1426,14 @@ func TestIndexFork(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
 	defer func() {
 		err := n.Stop()
 		if err != nil {
 			t.Logf("node stop: %v", err)
 		}
 	}()
+
 	go func() {
 		if err := n.Run(ctx); !errorIsOneOf(err, []error{net.ErrClosed, context.Canceled, rawpeer.ErrNoConn}) {
 			panic(err)
@@ -1305,14 +1447,14 @@ func TestIndexFork(t *testing.T) {
 		BlockCache:       1000,
 		BlockheaderCache: 1000,
 		BlockSanity:      false,
+		FullValidation:   true,
 		LevelDBHome:      t.TempDir(),
-		ListenAddress:    "localhost:8883",
+		ListenAddress:    "localhost:8882",
 		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
 		MaxCachedTxs:            1000, // XXX
 		Network:                 networkLocalnet,
 		PeersWanted:             1,
 		PrometheusListenAddress: "",
-		MempoolEnabled:          false,
 		Seeds:                   []string{"127.0.0.1:18444"},
 	}
 	_ = loggo.ConfigureLoggers(cfg.LogLevel)
@@ -1320,23 +1462,17 @@ func TestIndexFork(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
 	go func() {
 		err := s.Run(ctx)
 		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
 			panic(err)
 		}
 	}()
-	time.Sleep(2 * time.Second)
 
-	// Create a bunch of weird geometries to catch all corner cases in the indexer.
+	time.Sleep(2 * time.Second)
 
-	//   /-> b1a -> b2a
 	// g ->  b1 ->  b2 -> b3
-	//   \-> b1b -> b2b
-
-	// best is b3
-
-	// best chain
 	parent := chaincfg.RegressionNetParams.GenesisHash
 	address := n.address
 	b1, err := n.MineAndSend(ctx, "b1", parent, address)
@@ -1352,426 +1488,2256 @@ func TestIndexFork(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// a chain
-	b1a, err := n.MineAndSend(ctx, "b1a", parent, address)
+	// Index to b3, all scripts are valid
+	err = s.SyncIndexersToHash(ctx, b3.Hash())
 	if err != nil {
 		t.Fatal(err)
 	}
-	b2a, err := n.MineAndSend(ctx, "b2a", b1a.Hash(), address)
+	err = mustHave(ctx, s, n.genesis, b1, b2, b3)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// b chain
-	b1b, err := n.MineAndSend(ctx, "b1b", parent, address)
+	bh2, err := s.db.BlockHeaderByHash(ctx, b2.Hash())
 	if err != nil {
 		t.Fatal(err)
 	}
-	b2b, err := n.MineAndSend(ctx, "b2b", b1b.Hash(), address)
+	bu, err := s.db.BlockUndoByHash(ctx, b2.Hash())
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Verify linear indexing. Current TxIndex is sitting at genesis
-
-	// genesis -> b3 should work with negative direction (cdiff is less than target)
-	direction, err := s.TxIndexIsLinear(ctx, b3.Hash())
+	spent := bu.SpentOutputs()
+	err = s.validateBlockScripts(ctx, b2.b, bh2, spent)
 	if err != nil {
-		t.Fatalf("expected success g -> b3, got %v", err)
+		t.Fatalf("expected valid b2, got %v", err)
 	}
-	if direction <= 0 {
-		t.Fatalf("expected 1 going from genesis to b3, got %v", direction)
+
+	// Unrecorded pk scripts require a utxo index rebuild, the block is
+	// not invalid.
+	unknown := slices.Clone(spent)
+	for k := range unknown {
+		unknown[k].PkScript = nil
+	}
+	err = s.validateBlockScripts(ctx, b2.b, bh2, unknown)
+	if !errors.Is(err, ErrPkScriptUnknown) || errors.Is(err, ErrBlockInvalid) {
+		t.Fatalf("expected %v, got %v", ErrPkScriptUnknown, err)
 	}
 
-	// Index to b3
-	err = s.SyncIndexersToHash(ctx, b3.Hash())
+	// Corrupt the signature of the b2 tx that spends the b1 coinbase
+	raw, err := b2.b.Bytes()
 	if err != nil {
 		t.Fatal(err)
 	}
-	// XXX verify indexes
-	err = mustHave(ctx, s, n.genesis, b1, b2, b3)
+	bb2, err := btcutil.NewBlockFromBytes(raw)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// XXX add mustNotHave
-	// verify tx
-	for address := range n.keys {
-		balance, err := s.BalanceByAddress(ctx, address)
-		if err != nil {
-			t.Fatal(err)
-		}
-		t.Logf("%v: %v", address, balance)
-		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
-		if err != nil {
-			t.Fatal(err)
-		}
-		t.Logf("%v: %v", address, utxos)
+	txIn := bb2.MsgBlock().Transactions[1].TxIn[0]
+	txIn.SignatureScript[10] ^= 0xff
+	err = s.validateBlockScripts(ctx, btcutil.NewBlock(bb2.MsgBlock()), bh2,
+		spent)
+	if !errors.Is(err, ErrBlockInvalid) {
+		t.Fatalf("expected invalid b2, got %v", err)
 	}
 
-	// Verify linear indexing. Current TxIndex is sitting at b3
-	t.Logf("b3: %v", b3)
-
-	// b3 -> genesis should work with postive direction (cdiff is greater than target)
-	direction, err = s.TxIndexIsLinear(ctx, s.chainParams.GenesisHash)
+	// Marking b2 invalid must keep the indexers at b1
+	err = s.markBlockInvalid(ctx, b2.Hash())
 	if err != nil {
-		t.Fatalf("expected success b3 -> genesis, got %v", err)
-	}
-	if direction != -1 {
-		t.Fatalf("expected -1 going from b3 to genesis, got %v", direction)
+		t.Fatal(err)
 	}
-
-	// b3 -> b1 should work with positive direction
-	direction, err = s.TxIndexIsLinear(ctx, b1.Hash())
+	bh3, err := s.db.BlockHeaderByHash(ctx, b3.Hash())
 	if err != nil {
-		t.Fatalf("expected success b3 -> b1, got %v", err)
-	}
-	if direction != -1 {
-		t.Fatalf("expected -1 going from b3 to genesis, got %v", direction)
+		t.Fatal(err)
 	}
-
-	// b3 -> b2a should fail
-	_, err = s.TxIndexIsLinear(ctx, b2a.Hash())
-	if !errors.Is(err, ErrNotLinear) {
-		t.Fatalf("b2a is not linear to b3: %v", err)
+	target, err := s.validIndexTarget(ctx, bh3)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	// b3 -> b2b should fail
-	_, err = s.TxIndexIsLinear(ctx, b2b.Hash())
-	if !errors.Is(err, ErrNotLinear) {
-		t.Fatalf("b2b is not linear to b3: %v", err)
+	if !target.BlockHash().IsEqual(b1.Hash()) {
+		t.Fatalf("expected target b1, got %v", target)
 	}
+}
 
-	// make sure syncing to iself is non linear
-	err = s.SyncIndexersToHash(ctx, b3.Hash())
-	if err != nil {
-		t.Fatalf("at b3, should have returned nil, got %v", err)
-	}
+func TestInboundPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+	}()
 
-	// unwind back to genesis
-	err = s.SyncIndexersToHash(ctx, s.chainParams.GenesisHash)
+	n, err := newFakeNode(t, "18444")
 	if err != nil {
-		t.Fatalf("unwinding to genesis should have returned nil, got %v", err)
-	}
-	err = mustHave(ctx, s, n.genesis, b1, b2, b3)
-	if err == nil {
-		t.Fatalf("expected an error from mustHave")
+		t.Fatal(err)
 	}
 
-	for address := range n.keys {
-		balance, err := s.BalanceByAddress(ctx, address)
-		if err != nil {
-			t.Fatal(err)
-		}
-		t.Logf("%v: %v", address, balance)
-		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
+	defer func() {
+		err := n.Stop()
 		if err != nil {
-			t.Fatal(err)
+			t.Logf("node stop: %v", err)
 		}
-		t.Logf("%v: %v", address, utxos)
-	}
+	}()
 
-	// XXX verify indexes
-	txHH, err := s.TxIndexHash(ctx)
-	if err != nil {
-		t.Fatalf("expected success getting tx index hash, got: %v", err)
-	}
-	if !txHH.Hash.IsEqual(s.chainParams.GenesisHash) {
-		t.Fatalf("expected tx index hash to be equal to genesis, got: %v", txHH)
-	}
-	if txHH.Height != 0 {
-		t.Fatalf("expected tx index height to be 0, got: %v", txHH.Height)
-	}
+	go func() {
+		if err := n.Run(ctx); !errorIsOneOf(err, []error{net.ErrClosed, context.Canceled, rawpeer.ErrNoConn}) {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second * 2)
 
-	// see if we can move to b2a
-	direction, err = s.TxIndexIsLinear(ctx, b2a.Hash())
-	if err != nil {
-		t.Fatalf("expected success genesis -> b2a, got %v", err)
-	}
-	if direction != 1 {
-		t.Fatalf("expected 1 going from genesis to b2a, got %v", direction)
+	// Connect tbc service that serves inbound peers
+	cfg := &Config{
+		AutoIndex:        false,
+		BlockCache:       1000,
+		BlockheaderCache: 1000,
+		BlockSanity:      false,
+		LevelDBHome:      t.TempDir(),
+		ListenAddress:    "localhost:8882",
+		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
+		MaxCachedTxs:            1000, // XXX
+		Network:                 networkLocalnet,
+		P2PListenAddress:        "127.0.0.1:18555",
+		PeersInbound:            1,
+		PeersWanted:             1,
+		PrometheusListenAddress: "",
+		Seeds:                   []string{"127.0.0.1:18444"},
 	}
-
-	err = s.SyncIndexersToHash(ctx, b2a.Hash())
+	_ = loggo.ConfigureLoggers(cfg.LogLevel)
+	s, err := NewServer(cfg)
 	if err != nil {
-		t.Fatalf("wind to b2a: %v", err)
+		t.Fatal(err)
 	}
 
-	for address := range n.keys {
-		balance, err := s.BalanceByAddress(ctx, address)
-		if err != nil {
-			t.Fatal(err)
-		}
-		t.Logf("%v: %v", address, balance)
-		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
-		if err != nil {
-			t.Fatal(err)
+	go func() {
+		err := s.Run(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
+			panic(err)
 		}
-		t.Logf("%v: %v", address, utxos)
-	}
+	}()
 
-	// unwind back to genesis
-	err = s.SyncIndexersToHash(ctx, s.chainParams.GenesisHash)
+	time.Sleep(2 * time.Second)
+
+	// g ->  b1 ->  b2 -> b3
+	parent := chaincfg.RegressionNetParams.GenesisHash
+	address := n.address
+	b1, err := n.MineAndSend(ctx, "b1", parent, address)
 	if err != nil {
-		t.Fatalf("unwinding to genesis should have returned nil, got %v", err)
+		t.Fatal(err)
 	}
-	err = mustHave(ctx, s, n.genesis, b1, b2, b3)
-	if err == nil {
-		t.Fatalf("expected an error from mustHave")
+	b2, err := n.MineAndSend(ctx, "b2", b1.Hash(), address)
+	if err != nil {
+		t.Fatal(err)
 	}
-	txHH, err = s.TxIndexHash(ctx)
+	b3, err := n.MineAndSend(ctx, "b3", b2.Hash(), address)
 	if err != nil {
-		t.Fatalf("expected success getting tx index hash, got: %v", err)
+		t.Fatal(err)
 	}
-	if !txHH.Hash.IsEqual(s.chainParams.GenesisHash) {
-		t.Fatalf("expected tx index hash to be equal to genesis, got: %v", txHH)
+	time.Sleep(2 * time.Second)
+
+	// Connect tbc service that syncs from the first one
+	cfg2 := &Config{
+		AutoIndex:        false,
+		BlockCache:       1000,
+		BlockheaderCache: 1000,
+		BlockSanity:      false,
+		LevelDBHome:      t.TempDir(),
+		ListenAddress:    "localhost:8883",
+		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
+		MaxCachedTxs:            1000, // XXX
+		Network:                 networkLocalnet,
+		PeersWanted:             1,
+		PrometheusListenAddress: "",
+		Seeds:                   []string{"127.0.0.1:18555"},
 	}
-	if txHH.Height != 0 {
-		t.Fatalf("expected tx index height to be 0, got: %v", txHH.Height)
+	s2, err := NewServer(cfg2)
+	if err != nil {
+		t.Fatal(err)
 	}
-	for address := range n.keys {
-		balance, err := s.BalanceByAddress(ctx, address)
+
+	go func() {
+		err := s2.Run(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
+			panic(err)
+		}
+	}()
+
+	// Wait for the second service to download all blocks
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-timeout:
+			t.Fatal("timeout waiting for inbound sync")
+		case <-time.After(time.Second):
+		}
+		if !s2.Running() {
+			continue
+		}
+		bhb, err := s2.db.BlockHeaderBest(ctx)
 		if err != nil {
 			t.Fatal(err)
 		}
-		t.Logf("%v: %v", address, balance)
-		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
+		if !bhb.Hash.IsEqual(b3.Hash()) {
+			continue
+		}
+		if _, err := s2.db.BlockByHash(ctx, b3.Hash()); err == nil {
+			break
+		}
+	}
+	for _, b := range []*block{b1, b2, b3} {
+		blk, err := s2.db.BlockByHash(ctx, b.Hash())
 		if err != nil {
-			t.Fatal(err)
+			t.Fatalf("%v: %v", b, err)
+		}
+		if !blk.Hash().IsEqual(b.Hash()) {
+			t.Fatalf("expected %v, got %v", b.Hash(), blk.Hash())
 		}
-		t.Logf("%v: %v", address, utxos)
 	}
 
-	t.Logf("---------------------------------------- going to b2b")
-	err = s.SyncIndexersToHash(ctx, b2b.Hash())
+	// All inbound slots are taken
+	if s.InboundPeers() != 1 {
+		t.Fatalf("expected 1 inbound peer, got %v", s.InboundPeers())
+	}
+	p, err := rawpeer.New(wire.TestNet, 0, "127.0.0.1:18555")
 	if err != nil {
-		t.Fatalf("wind to b2b: %v", err)
+		t.Fatal(err)
 	}
-
-	for address := range n.keys {
-		balance, err := s.BalanceByAddress(ctx, address)
-		if err != nil {
-			t.Fatal(err)
-		}
-		t.Logf("%v: %v", address, balance)
-		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
-		if err != nil {
-			t.Fatal(err)
-		}
-		t.Logf("%v: %v", address, utxos)
+	if err := p.Connect(ctx); err == nil {
+		t.Fatal("expected inbound connect to fail")
 	}
+}
 
-	// t.Logf("---------------------------------------- going to b3")
-	// unwind back to genesis
-	err = s.SyncIndexersToHash(ctx, s.chainParams.GenesisHash)
+func TestIndexFork(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+	}()
+
+	n, err := newFakeNode(t, "18444")
 	if err != nil {
-		t.Fatalf("xxxx %v", err)
+		t.Fatal(err)
 	}
-	for address := range n.keys {
-		balance, err := s.BalanceByAddress(ctx, address)
+	defer func() {
+		err := n.Stop()
 		if err != nil {
-			t.Fatal(err)
+			t.Logf("node stop: %v", err)
 		}
-		t.Logf("%v: %v", address, balance)
-		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
-		if err != nil {
-			t.Fatal(err)
+	}()
+	go func() {
+		if err := n.Run(ctx); !errorIsOneOf(err, []error{net.ErrClosed, context.Canceled, rawpeer.ErrNoConn}) {
+			panic(err)
 		}
-		t.Logf("%v: %v", address, utxos)
-	}
-	// err = mustHave(ctx, s, n.genesis, b1, b2, b3)
-	// if err == nil {
-	//	t.Fatalf("expected an error from mustHave")
-	// }
-	// txHH, err = s.TxIndexHash(ctx)
-	// if err != nil {
-	//	t.Fatalf("expected success getting tx index hash, got: %v", err)
-	// }
-	// if !txHH.Hash.IsEqual(s.chainParams.GenesisHash) {
-	//	t.Fatalf("expected tx index hash to be equal to genesis, got: %v", txHH)
-	// }
-	// if txHH.Height != 0 {
-	//	t.Fatalf("expected tx index height to be 0, got: %v", txHH.Height)
-	// }
+	}()
+	time.Sleep(time.Second * 2)
 
-	// // Index to b3
-	// err = s.SyncIndexersToHash(ctx, b3.Hash())
-	// if err != nil {
-	//	t.Fatal(err)
-	// }
-	// // XXX verify indexes
-	// err = mustHave(ctx, s, n.genesis, b1, b2, b3)
-	// if err != nil {
-	//	t.Fatal(err)
-	// }
+	// Connect tbc service
+	cfg := &Config{
+		AutoIndex:        false,
+		BlockCache:       1000,
+		BlockheaderCache: 1000,
+		BlockSanity:      false,
+		LevelDBHome:      t.TempDir(),
+		ListenAddress:    "localhost:8883",
+		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
+		MaxCachedTxs:            1000, // XXX
+		Network:                 networkLocalnet,
+		PeersWanted:             1,
+		PrometheusListenAddress: "",
+		MempoolEnabled:          false,
+		Seeds:                   []string{"127.0.0.1:18444"},
+	}
+	_ = loggo.ConfigureLoggers(cfg.LogLevel)
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		err := s.Run(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
+			panic(err)
+		}
+	}()
+	time.Sleep(2 * time.Second)
 
-	// // Should fail
-	// t.Logf("=== index b2a ===")
-	// err = s.SyncIndexersToHash(ctx, b2a.Hash())
-	// if err != nil {
-	//	t.Fatal(err)
-	// }
+	// Create a bunch of weird geometries to catch all corner cases in the indexer.
 
-	// t.Logf("=== index b2b ===")
-	// err = s.SyncIndexersToHash(ctx, b2b.Hash())
-	// if err != nil {
-	//	t.Fatal(err)
-	// }
+	//   /-> b1a -> b2a
+	// g ->  b1 ->  b2 -> b3
+	//   \-> b1b -> b2b
 
-	// time.Sleep(time.Second)
-}
+	// best is b3
 
-func TestTransactions(t *testing.T) {
-	params := &chaincfg.RegressionNetParams
-	nextBlockHeight := int32(2)
-	extraNonce := uint64(nextBlockHeight)
-	coinbaseScript, err := standardCoinbaseScript(nextBlockHeight, extraNonce)
+	// best chain
+	parent := chaincfg.RegressionNetParams.GenesisHash
+	address := n.address
+	b1, err := n.MineAndSend(ctx, "b1", parent, address)
 	if err != nil {
 		t.Fatal(err)
 	}
-	payToKey, err := btcec.NewPrivateKey()
+	b2, err := n.MineAndSend(ctx, "b2", b1.Hash(), address)
 	if err != nil {
 		t.Fatal(err)
 	}
-	payToKeyPublic := payToKey.PubKey()
-	payToAddress, err := btcutil.NewAddressPubKeyHash(
-		btcutil.Hash160(payToKeyPublic.SerializeCompressed()), params)
+	b3, err := n.MineAndSend(ctx, "b3", b2.Hash(), address)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	coinbaseTx, err := createCoinbaseTx(params, coinbaseScript,
-		nextBlockHeight, payToAddress)
+	// a chain
+	b1a, err := n.MineAndSend(ctx, "b1a", parent, address)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("coinbase: %v", spew.Sdump(coinbaseTx))
-	wireCoinbaseTx := coinbaseTx.MsgTx()
-	disasm, err := txscript.DisasmString(wireCoinbaseTx.TxOut[0].PkScript)
+	b2a, err := n.MineAndSend(ctx, "b2a", b1a.Hash(), address)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("coinbase: %v", disasm)
 
-	// now create a tx that spends  the above TxIn
-	redeemKey, err := btcec.NewPrivateKey()
+	// b chain
+	b1b, err := n.MineAndSend(ctx, "b1b", parent, address)
 	if err != nil {
 		t.Fatal(err)
 	}
-	redeemKeyPublic := redeemKey.PubKey()
-	redeemAddress, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(redeemKeyPublic.SerializeCompressed()), params)
+	b2b, err := n.MineAndSend(ctx, "b2b", b1b.Hash(), address)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	redeemTx := wire.NewMsgTx(wire.TxVersion)
-	prevOut := wire.NewOutPoint(coinbaseTx.Hash(), 0)
-	txIn := wire.NewTxIn(prevOut, nil, nil)
-	redeemTx.AddTxIn(txIn)
-	pkScript, err := txscript.PayToAddrScript(redeemAddress)
+	// Verify linear indexing. Current TxIndex is sitting at genesis
+
+	// genesis -> b3 should work with negative direction (cdiff is less than target)
+	direction, err := s.TxIndexIsLinear(ctx, b3.Hash())
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("expected success g -> b3, got %v", err)
 	}
-	txOut := wire.NewTxOut(3000000000, pkScript)
-	redeemTx.AddTxOut(txOut)
-	sc, as, sigs, err := txscript.ExtractPkScriptAddrs(pkScript, params)
-	if err != nil {
-		t.Fatal(err)
+	if direction <= 0 {
+		t.Fatalf("expected 1 going from genesis to b3, got %v", direction)
 	}
-	t.Logf("%v %v: %v", sc, sigs, spew.Sdump(as))
 
-	// add cgange
-	changeScript, err := txscript.PayToAddrScript(payToAddress)
+	// Index to b3
+	err = s.SyncIndexersToHash(ctx, b3.Hash())
 	if err != nil {
 		t.Fatal(err)
 	}
-	txOutChange := wire.NewTxOut(2000000000, changeScript)
-	redeemTx.AddTxOut(txOutChange)
-	// sign
-	lookupKey := func(a btcutil.Address) (*btcec.PrivateKey, bool, error) {
-		return payToKey, true, nil
-	}
-	sigScript, err := txscript.SignTxOutput(&chaincfg.MainNetParams,
-		redeemTx, 0, wireCoinbaseTx.TxOut[0].PkScript, txscript.SigHashAll,
-		txscript.KeyClosure(lookupKey), nil, nil)
+	// XXX verify indexes
+	err = mustHave(ctx, s, n.genesis, b1, b2, b3)
 	if err != nil {
 		t.Fatal(err)
 	}
-	redeemTx.TxIn[0].SignatureScript = sigScript
-	log.Infof("redeem tx: %v", spew.Sdump(redeemTx))
+	// XXX add mustNotHave
+	// verify tx
+	for address := range n.keys {
+		balance, err := s.BalanceByAddress(ctx, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, balance)
+		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, utxos)
+	}
 
-	flags := txscript.ScriptBip16 | txscript.ScriptVerifyDERSignatures |
-		txscript.ScriptStrictMultiSig |
-		txscript.ScriptDiscourageUpgradableNops
-	vm, err := txscript.NewEngine(wireCoinbaseTx.TxOut[0].PkScript, redeemTx, 0,
-		flags, nil, nil, -1, nil)
+	// Verify linear indexing. Current TxIndex is sitting at b3
+	t.Logf("b3: %v", b3)
+
+	// b3 -> genesis should work with postive direction (cdiff is greater than target)
+	direction, err = s.TxIndexIsLinear(ctx, s.chainParams.GenesisHash)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("expected success b3 -> genesis, got %v", err)
 	}
-	if err := vm.Execute(); err != nil {
+	if direction != -1 {
+		t.Fatalf("expected -1 going from b3 to genesis, got %v", direction)
+	}
+
+	// b3 -> b1 should work with positive direction
+	direction, err = s.TxIndexIsLinear(ctx, b1.Hash())
+	if err != nil {
+		t.Fatalf("expected success b3 -> b1, got %v", err)
+	}
+	if direction != -1 {
+		t.Fatalf("expected -1 going from b3 to genesis, got %v", direction)
+	}
+
+	// b3 -> b2a should fail
+	_, err = s.TxIndexIsLinear(ctx, b2a.Hash())
+	if !errors.Is(err, ErrNotLinear) {
+		t.Fatalf("b2a is not linear to b3: %v", err)
+	}
+
+	// b3 -> b2b should fail
+	_, err = s.TxIndexIsLinear(ctx, b2b.Hash())
+	if !errors.Is(err, ErrNotLinear) {
+		t.Fatalf("b2b is not linear to b3: %v", err)
+	}
+
+	// make sure syncing to iself is non linear
+	err = s.SyncIndexersToHash(ctx, b3.Hash())
+	if err != nil {
+		t.Fatalf("at b3, should have returned nil, got %v", err)
+	}
+
+	// unwind back to genesis
+	err = s.SyncIndexersToHash(ctx, s.chainParams.GenesisHash)
+	if err != nil {
+		t.Fatalf("unwinding to genesis should have returned nil, got %v", err)
+	}
+	err = mustHave(ctx, s, n.genesis, b1, b2, b3)
+	if err == nil {
+		t.Fatalf("expected an error from mustHave")
+	}
+
+	for address := range n.keys {
+		balance, err := s.BalanceByAddress(ctx, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, balance)
+		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, utxos)
+	}
+
+	// XXX verify indexes
+	txHH, err := s.TxIndexHash(ctx)
+	if err != nil {
+		t.Fatalf("expected success getting tx index hash, got: %v", err)
+	}
+	if !txHH.Hash.IsEqual(s.chainParams.GenesisHash) {
+		t.Fatalf("expected tx index hash to be equal to genesis, got: %v", txHH)
+	}
+	if txHH.Height != 0 {
+		t.Fatalf("expected tx index height to be 0, got: %v", txHH.Height)
+	}
+
+	// see if we can move to b2a
+	direction, err = s.TxIndexIsLinear(ctx, b2a.Hash())
+	if err != nil {
+		t.Fatalf("expected success genesis -> b2a, got %v", err)
+	}
+	if direction != 1 {
+		t.Fatalf("expected 1 going from genesis to b2a, got %v", direction)
+	}
+
+	err = s.SyncIndexersToHash(ctx, b2a.Hash())
+	if err != nil {
+		t.Fatalf("wind to b2a: %v", err)
+	}
+
+	for address := range n.keys {
+		balance, err := s.BalanceByAddress(ctx, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, balance)
+		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, utxos)
+	}
+
+	// unwind back to genesis
+	err = s.SyncIndexersToHash(ctx, s.chainParams.GenesisHash)
+	if err != nil {
+		t.Fatalf("unwinding to genesis should have returned nil, got %v", err)
+	}
+	err = mustHave(ctx, s, n.genesis, b1, b2, b3)
+	if err == nil {
+		t.Fatalf("expected an error from mustHave")
+	}
+	txHH, err = s.TxIndexHash(ctx)
+	if err != nil {
+		t.Fatalf("expected success getting tx index hash, got: %v", err)
+	}
+	if !txHH.Hash.IsEqual(s.chainParams.GenesisHash) {
+		t.Fatalf("expected tx index hash to be equal to genesis, got: %v", txHH)
+	}
+	if txHH.Height != 0 {
+		t.Fatalf("expected tx index height to be 0, got: %v", txHH.Height)
+	}
+	for address := range n.keys {
+		balance, err := s.BalanceByAddress(ctx, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, balance)
+		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, utxos)
+	}
+
+	t.Logf("---------------------------------------- going to b2b")
+	err = s.SyncIndexersToHash(ctx, b2b.Hash())
+	if err != nil {
+		t.Fatalf("wind to b2b: %v", err)
+	}
+
+	for address := range n.keys {
+		balance, err := s.BalanceByAddress(ctx, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, balance)
+		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, utxos)
+	}
+
+	// t.Logf("---------------------------------------- going to b3")
+	// unwind back to genesis
+	err = s.SyncIndexersToHash(ctx, s.chainParams.GenesisHash)
+	if err != nil {
+		t.Fatalf("xxxx %v", err)
+	}
+	for address := range n.keys {
+		balance, err := s.BalanceByAddress(ctx, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, balance)
+		utxos, err := s.UtxosByAddress(ctx, address, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %v", address, utxos)
+	}
+	// err = mustHave(ctx, s, n.genesis, b1, b2, b3)
+	// if err == nil {
+	//	t.Fatalf("expected an error from mustHave")
+	// }
+	// txHH, err = s.TxIndexHash(ctx)
+	// if err != nil {
+	//	t.Fatalf("expected success getting tx index hash, got: %v", err)
+	// }
+	// if !txHH.Hash.IsEqual(s.chainParams.GenesisHash) {
+	//	t.Fatalf("expected tx index hash to be equal to genesis, got: %v", txHH)
+	// }
+	// if txHH.Height != 0 {
+	//	t.Fatalf("expected tx index height to be 0, got: %v", txHH.Height)
+	// }
+
+	// // Index to b3
+	// err = s.SyncIndexersToHash(ctx, b3.Hash())
+	// if err != nil {
+	//	t.Fatal(err)
+	// }
+	// // XXX verify indexes
+	// err = mustHave(ctx, s, n.genesis, b1, b2, b3)
+	// if err != nil {
+	//	t.Fatal(err)
+	// }
+
+	// // Should fail
+	// t.Logf("=== index b2a ===")
+	// err = s.SyncIndexersToHash(ctx, b2a.Hash())
+	// if err != nil {
+	//	t.Fatal(err)
+	// }
+
+	// t.Logf("=== index b2b ===")
+	// err = s.SyncIndexersToHash(ctx, b2b.Hash())
+	// if err != nil {
+	//	t.Fatal(err)
+	// }
+
+	// time.Sleep(time.Second)
+}
+
+func TestTransactions(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	nextBlockHeight := int32(2)
+	extraNonce := uint64(nextBlockHeight)
+	coinbaseScript, err := standardCoinbaseScript(nextBlockHeight, extraNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payToKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payToKeyPublic := payToKey.PubKey()
+	payToAddress, err := btcutil.NewAddressPubKeyHash(
+		btcutil.Hash160(payToKeyPublic.SerializeCompressed()), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coinbaseTx, err := createCoinbaseTx(params, coinbaseScript,
+		nextBlockHeight, payToAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("coinbase: %v", spew.Sdump(coinbaseTx))
+	wireCoinbaseTx := coinbaseTx.MsgTx()
+	disasm, err := txscript.DisasmString(wireCoinbaseTx.TxOut[0].PkScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("coinbase: %v", disasm)
+
+	// now create a tx that spends  the above TxIn
+	redeemKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	redeemKeyPublic := redeemKey.PubKey()
+	redeemAddress, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(redeemKeyPublic.SerializeCompressed()), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redeemTx := wire.NewMsgTx(wire.TxVersion)
+	prevOut := wire.NewOutPoint(coinbaseTx.Hash(), 0)
+	txIn := wire.NewTxIn(prevOut, nil, nil)
+	redeemTx.AddTxIn(txIn)
+	pkScript, err := txscript.PayToAddrScript(redeemAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txOut := wire.NewTxOut(3000000000, pkScript)
+	redeemTx.AddTxOut(txOut)
+	sc, as, sigs, err := txscript.ExtractPkScriptAddrs(pkScript, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%v %v: %v", sc, sigs, spew.Sdump(as))
+
+	// add cgange
+	changeScript, err := txscript.PayToAddrScript(payToAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txOutChange := wire.NewTxOut(2000000000, changeScript)
+	redeemTx.AddTxOut(txOutChange)
+	// sign
+	lookupKey := func(a btcutil.Address) (*btcec.PrivateKey, bool, error) {
+		return payToKey, true, nil
+	}
+	sigScript, err := txscript.SignTxOutput(&chaincfg.MainNetParams,
+		redeemTx, 0, wireCoinbaseTx.TxOut[0].PkScript, txscript.SigHashAll,
+		txscript.KeyClosure(lookupKey), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redeemTx.TxIn[0].SignatureScript = sigScript
+	log.Infof("redeem tx: %v", spew.Sdump(redeemTx))
+
+	flags := txscript.ScriptBip16 | txscript.ScriptVerifyDERSignatures |
+		txscript.ScriptStrictMultiSig |
+		txscript.ScriptDiscourageUpgradableNops
+	vm, err := txscript.NewEngine(wireCoinbaseTx.TxOut[0].PkScript, redeemTx, 0,
+		flags, nil, nil, -1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	disasm, err = vm.DisasmScript(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("coinbase signed tx in 0: %v", disasm)
+	disasm, err = vm.DisasmScript(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("coinbase signed tx out 0: %v", disasm)
+}
+
+// borrowed from btcd
+//
+// Copyright (c) 2014-2016 The btcsuite developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+var (
+	CoinbaseFlags = "/P2SH/btcd/"
+	vbTopBits     = 0x20000000
+)
+
+func standardCoinbaseScript(nextBlockHeight int32, extraNonce uint64) ([]byte, error) {
+	return txscript.NewScriptBuilder().AddInt64(int64(nextBlockHeight)).
+		AddInt64(int64(extraNonce)).AddData([]byte(CoinbaseFlags)).
+		Script()
+}
+
+func createCoinbaseTx(params *chaincfg.Params, coinbaseScript []byte, nextBlockHeight int32, addr btcutil.Address) (*btcutil.Tx, error) {
+	// Create the script to pay to the provided payment address if one was
+	// specified.  Otherwise, create a script that allows the coinbase to be
+	// redeemable by anyone.
+	var pkScript []byte
+	if addr != nil {
+		var err error
+		pkScript, err = txscript.PayToAddrScript(addr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		scriptBuilder := txscript.NewScriptBuilder()
+		pkScript, err = scriptBuilder.AddOp(txscript.OP_TRUE).Script()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(&wire.TxIn{
+		// Coinbase transactions have no inputs, so previous outpoint is
+		// zero hash and max index.
+		PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{},
+			wire.MaxPrevOutIndex),
+		SignatureScript: coinbaseScript,
+		Sequence:        wire.MaxTxInSequenceNum,
+	})
+	tx.AddTxOut(&wire.TxOut{
+		Value:    blockchain.CalcBlockSubsidy(nextBlockHeight, params),
+		PkScript: pkScript,
+	})
+	return btcutil.NewTx(tx), nil
+}
+
+// end borrowed from btcd
+
+func TestUtxoSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+	}()
+
+	n, err := newFakeNode(t, "18444")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		err := n.Stop()
+		if err != nil {
+			t.Logf("node stop: %v", err)
+		}
+	}()
+
+	go func() {
+		if err := n.Run(ctx); !errorIsOneOf(err, []error{net.ErrClosed, context.Canceled, rawpeer.ErrNoConn}) {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second * 2)
+
+	// Connect tbc service
+	cfg := &Config{
+		AutoIndex:        false,
+		BlockCache:       1000,
+		BlockheaderCache: 1000,
+		BlockSanity:      false,
+		LevelDBHome:      t.TempDir(),
+		ListenAddress:    "localhost:8884",
+		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
+		MaxCachedTxs:            1000, // XXX
+		Network:                 networkLocalnet,
+		PeersWanted:             1,
+		PrometheusListenAddress: "",
+		Seeds:                   []string{"127.0.0.1:18444"},
+	}
+	_ = loggo.ConfigureLoggers(cfg.LogLevel)
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		err := s.Run(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(2 * time.Second)
+
+	// g ->  b1 ->  b2 -> b3
+	parent := chaincfg.RegressionNetParams.GenesisHash
+	address := n.address
+	b1, err := n.MineAndSend(ctx, "b1", parent, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := n.MineAndSend(ctx, "b2", b1.Hash(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b3, err := n.MineAndSend(ctx, "b3", b2.Hash(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SyncIndexersToHash(ctx, b3.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utxos := func(s *Server) map[tbcd.Outpoint]tbcd.CacheOutput {
+		m := make(map[tbcd.Outpoint]tbcd.CacheOutput)
+		err := s.db.UtxosWalk(ctx, func(op tbcd.Outpoint, co tbcd.CacheOutput) error {
+			m[op] = co
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// Export at current utxo index
+	filename := filepath.Join(t.TempDir(), "utxos.snapshot")
+	us, err := s.UtxoSnapshotExport(ctx, filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := utxos(s)
+	if !us.Hash.IsEqual(b3.Hash()) || us.Height != 3 ||
+		us.Count != uint64(len(want)) {
+		t.Fatalf("unexpected snapshot: %v", us)
+	}
+
+	// Import into a fresh database that only has the headers.
+	cfg2 := *cfg
+	cfg2.LevelDBHome = t.TempDir()
+	s2, err := NewServer(&cfg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s2.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s2.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Snapshot header unknown
+	_, err = s2.UtxoSnapshotImport(ctx, filename, "")
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	msgHeaders := wire.NewMsgHeaders()
+	for _, b := range []*block{b1, b2, b3} {
+		if err := msgHeaders.AddBlockHeader(&b.MsgBlock().Header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, _, _, err = s2.db.BlockHeadersInsert(ctx, msgHeaders, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pinned digest mismatch
+	_, err = s2.UtxoSnapshotImport(ctx, filename, strings.Repeat("00", 32))
+	if !errors.Is(err, ErrUtxoSnapshotInvalid) {
+		t.Fatalf("expected invalid snapshot, got %v", err)
+	}
+
+	// Corrupt contents
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(t.TempDir(), "corrupt.snapshot")
+	raw[utxoSnapshotHeaderSize] ^= 0xff
+	if err := os.WriteFile(corrupt, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s2.UtxoSnapshotImport(ctx, corrupt, "")
+	if !errors.Is(err, ErrUtxoSnapshotInvalid) {
+		t.Fatalf("expected invalid snapshot, got %v", err)
+	}
+
+	us2, err := s2.UtxoSnapshotImport(ctx, filename, us.DigestString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if us2.Digest != us.Digest {
+		t.Fatalf("digest mismatch %v != %v", us2, us)
+	}
+	if got := utxos(s2); !reflect.DeepEqual(got, want) {
+		t.Fatalf("utxos mismatch got %v want %v", len(got), len(want))
+	}
+	utxoHH, err := s2.UtxoIndexHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utxoHH.Hash.IsEqual(b3.Hash()) {
+		t.Fatalf("utxo index hash %v, want %v", utxoHH, b3)
+	}
+
+	// The snapshot block is the lower bound of all indexes and the blocks
+	// up to it are no longer downloaded.
+	for name, f := range map[string]func(context.Context) (*HashHeight, error){
+		"tx":          s2.TxIndexHash,
+		"filter":      s2.FilterIndexHash,
+		"lower bound": s2.IndexLowerBound,
+	} {
+		hh, err := f(ctx)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if !hh.Hash.IsEqual(b3.Hash()) {
+			t.Fatalf("%v hash %v, want %v", name, hh, b3)
+		}
+	}
+	bm, err := s2.db.BlocksMissing(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bm) != 0 {
+		t.Fatalf("unexpected missing blocks: %v", bm)
+	}
+	for op := range want {
+		script, err := s.db.ScriptByOutpoint(ctx, op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script2, err := s2.db.ScriptByOutpoint(ctx, op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(script, script2) {
+			t.Fatalf("script mismatch %v: %x != %x", op, script, script2)
+		}
+	}
+	bf, err := s.db.BlockFilterByHash(ctx, b3.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf2, err := s2.db.BlockFilterByHash(ctx, b3.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bf, bf2) {
+		t.Fatalf("filter mismatch %v != %v", spew.Sdump(bf), spew.Sdump(bf2))
+	}
+
+	// Do not clobber an existing utxo index
+	_, err = s2.UtxoSnapshotImport(ctx, filename, "")
+	if !errors.Is(err, ErrUtxoIndexNotEmpty) {
+		t.Fatalf("expected not empty, got %v", err)
+	}
+
+	// Export at an earlier block
+	us, err = s.UtxoSnapshotExport(ctx, filename, b2.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !us.Hash.IsEqual(b2.Hash()) || us.Height != 2 {
+		t.Fatalf("unexpected snapshot: %v", us)
+	}
+
+	// Reject snapshots of blocks that are not canonical.
+	cfg3 := *cfg
+	cfg3.LevelDBHome = t.TempDir()
+	s3, err := NewServer(&cfg3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s3.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s3.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	testHeadersInsert(ctx, t, s3, []*wire.BlockHeader{
+		&b1.MsgBlock().Header, &b2.MsgBlock().Header,
+	})
+	// Fork off b1 with more work than b2.
+	var fork []*wire.BlockHeader
+	prev := *b1.Hash()
+	for k := range 3 {
+		bh := testBlocks(prev, uint64(k+1), 1, 'f')[0].MsgBlock().Header
+		bh.Bits = b2.MsgBlock().Header.Bits
+		fork = append(fork, &bh)
+		prev = bh.BlockHash()
+	}
+	testHeadersInsert(ctx, t, s3, fork)
+	_, err = s3.UtxoSnapshotImport(ctx, filename, "")
+	if !errors.Is(err, ErrUtxoSnapshotNotCanonical) {
+		t.Fatalf("expected not canonical, got %v", err)
+	}
+
+	// Index b3 on top of the b2 snapshot without the earlier blocks. The
+	// b3 txs spend b2 outputs, their pk scripts come from the snapshot.
+	cfg4 := *cfg
+	cfg4.LevelDBHome = t.TempDir()
+	s4, err := NewServer(&cfg4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s4.DBOpen(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := s4.DBClose(); err != nil {
+			t.Logf("db close: %v", err)
+		}
+	}()
+	if err := s4.insertGenesis(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	testHeadersInsert(ctx, t, s4, []*wire.BlockHeader{
+		&b1.MsgBlock().Header, &b2.MsgBlock().Header, &b3.MsgBlock().Header,
+	})
+	if _, err := s4.UtxoSnapshotImport(ctx, filename, us.DigestString()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s4.db.BlockInsert(ctx, b3.b); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := s4.indexingLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, indexer := range map[string]func(context.Context, *chainhash.Hash) error{
+		"tx":     s4.TxIndexer,
+		"utxo":   s4.UtxoIndexer,
+		"filter": s4.FilterIndexer,
+	} {
+		if err := indexer(ctx, b3.Hash()); err != nil {
+			t.Fatalf("%v indexer: %v", name, err)
+		}
+	}
+	unlock()
+	if got := utxos(s4); !reflect.DeepEqual(got, want) {
+		t.Fatalf("utxos mismatch got %v want %v", len(got), len(want))
+	}
+	bf4, err := s4.db.BlockFilterByHash(ctx, b3.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bf, bf4) {
+		t.Fatalf("filter mismatch %v != %v", spew.Sdump(bf), spew.Sdump(bf4))
+	}
+	if _, err := s4.TxById(ctx, b3.b.Transactions()[1].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s4.TxById(ctx, b2.b.Transactions()[1].Hash())
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	n, err := newFakeNode(t, "18444")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := n.Stop()
+		if err != nil {
+			t.Logf("node stop: %v", err)
+		}
+	}()
+
+	go func() {
+		if err := n.Run(ctx); !errorIsOneOf(err, []error{net.ErrClosed, context.Canceled, rawpeer.ErrNoConn}) {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second * 2)
+
+	// Connect tbc service
+	cfg := &Config{
+		AutoIndex:        false,
+		BlockCache:       1000,
+		BlockheaderCache: 1000,
+		BlockSanity:      false,
+		LevelDBHome:      t.TempDir(),
+		ListenAddress:    "localhost:8885",
+		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
+		MaxCachedTxs:            1000, // XXX
+		Network:                 networkLocalnet,
+		PeersWanted:             1,
+		PrometheusListenAddress: "",
+		Seeds:                   []string{"127.0.0.1:18444"},
+	}
+	_ = loggo.ConfigureLoggers(cfg.LogLevel)
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		err := s.Run(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(2 * time.Second)
+
+	c, _, err := websocket.Dial(ctx, "ws://"+cfg.ListenAddress+tbcapi.RouteWebsocket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseNow()
+	assertPing(ctx, t, c, tbcapi.CmdPingRequest)
+	conn := protocol.NewWSConn(c)
+
+	// read returns the payload of the next message with the provided
+	// command, other messages are skipped.
+	read := func(cmd protocol.Command, payload any) {
+		t.Helper()
+		for {
+			var v protocol.Message
+			if err := wsjson.Read(ctx, c, &v); err != nil {
+				t.Fatal(err)
+			}
+			if v.Header.Command != cmd {
+				continue
+			}
+			if err := json.Unmarshal(v.Payload, payload); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+
+	address := n.address
+	pkScript, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := tbcd.NewScriptHashFromScript(pkScript)
+
+	// Invalid topic.
+	err = tbcapi.Write(ctx, conn, "1", tbcapi.SubscribeRequest{
+		Topics: []string{"nope"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sr tbcapi.SubscribeResponse
+	read(tbcapi.CmdSubscribeResponse, &sr)
+	if sr.Error == nil {
+		t.Fatal("expected invalid topic error")
+	}
+
+	err = tbcapi.Write(ctx, conn, "2", tbcapi.SubscribeRequest{
+		Topics:       []string{tbcapi.TopicBlocks, tbcapi.TopicReorgs},
+		ScriptHashes: []api.ByteSlice{sh[:]},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr = tbcapi.SubscribeResponse{}
+	read(tbcapi.CmdSubscribeResponse, &sr)
+	if sr.Error != nil {
+		t.Fatal(sr.Error)
+	}
+
+	// waitIndex waits for the block of the tip to be stored and syncs the
+	// indexers to it, which sends the notifications.
+	waitIndex := func(tip *chainhash.Hash) {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case <-ctx.Done():
+				t.Fatal(ctx.Err())
+			case <-timeout:
+				t.Fatalf("timeout waiting for %v", tip)
+			case <-time.After(100 * time.Millisecond):
+			}
+			bhb, err := s.db.BlockHeaderBest(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bhb.Hash.IsEqual(tip) {
+				continue
+			}
+			if _, err := s.db.BlockByHash(ctx, tip); err == nil {
+				break
+			}
+		}
+		if err := s.SyncIndexersToBest(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// g -> b1 -> b2
+	parent := chaincfg.RegressionNetParams.GenesisHash
+	b1, err := n.MineAndSend(ctx, "b1", parent, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitIndex(b1.Hash())
+	var bn tbcapi.BlockNotification
+	read(tbcapi.CmdBlockNotification, &bn)
+	if !bn.Hash.IsEqual(b1.Hash()) || bn.Height != 1 {
+		t.Fatalf("unexpected block notification: %v", spew.Sdump(bn))
+	}
+	b2, err := n.MineAndSend(ctx, "b2", b1.Hash(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitIndex(b2.Hash())
+	bn = tbcapi.BlockNotification{}
+	read(tbcapi.CmdBlockNotification, &bn)
+	if !bn.Hash.IsEqual(b2.Hash()) || bn.Height != 2 {
+		t.Fatalf("unexpected block notification: %v", spew.Sdump(bn))
+	}
+
+	// b1 -> b2a -> b3a, reorgs b2 out.
+	b2a, err := n.MineAndSend(ctx, "b2a", b1.Hash(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b3a, err := n.MineAndSend(ctx, "b3a", b2a.Hash(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitIndex(b3a.Hash())
+
+	// Unwinding b2 notifies all its txs since they all touch the address.
+	unwound := make(map[chainhash.Hash]struct{})
+	for _, tx := range b2.b.Transactions() {
+		unwound[*tx.Hash()] = struct{}{}
+	}
+	for range len(unwound) {
+		var shn tbcapi.ScriptHashNotification
+		read(tbcapi.CmdScriptHashNotification, &shn)
+		if _, ok := unwound[shn.TxId]; !ok ||
+			!bytes.Equal(shn.ScriptHash, sh[:]) || shn.Mempool ||
+			!shn.Unwound || shn.Height != 2 {
+			t.Fatalf("unexpected unwound notification: %v",
+				spew.Sdump(shn))
+		}
+		delete(unwound, shn.TxId)
+	}
+
+	// Indexing b3a notifies the coinbase paying to the address.
+	coinbase := b3a.b.Transactions()[0].Hash()
+	for {
+		var shn tbcapi.ScriptHashNotification
+		read(tbcapi.CmdScriptHashNotification, &shn)
+		if !bytes.Equal(shn.ScriptHash, sh[:]) || shn.Mempool || shn.Unwound {
+			t.Fatalf("unexpected script hash notification: %v",
+				spew.Sdump(shn))
+		}
+		if shn.TxId.IsEqual(coinbase) {
+			if shn.Height != 3 {
+				t.Fatalf("unexpected height: %v", shn.Height)
+			}
+			break
+		}
+	}
+
+	// The tip is notified once the indexes have caught up.
+	var rn tbcapi.ReorgNotification
+	read(tbcapi.CmdReorgNotification, &rn)
+	if !rn.OldTip.Hash.IsEqual(b2.Hash()) ||
+		!rn.NewTip.Hash.IsEqual(b3a.Hash()) ||
+		!rn.ForkPoint.Hash.IsEqual(b1.Hash()) || rn.ForkPoint.Height != 1 {
+		t.Fatalf("unexpected reorg notification: %v", spew.Sdump(rn))
+	}
+	bn = tbcapi.BlockNotification{}
+	read(tbcapi.CmdBlockNotification, &bn)
+	if !bn.Hash.IsEqual(b3a.Hash()) || bn.Height != 3 {
+		t.Fatalf("unexpected block notification: %v", spew.Sdump(bn))
+	}
+	utxoHH, err := s.UtxoIndexHash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utxoHH.Hash.IsEqual(b3a.Hash()) {
+		t.Fatalf("utxo index not at tip: %v", utxoHH)
+	}
+}
+
+func TestElectrum(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	n, err := newFakeNode(t, "18444")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := n.Stop()
+		if err != nil {
+			t.Logf("node stop: %v", err)
+		}
+	}()
+
+	go func() {
+		if err := n.Run(ctx); !errorIsOneOf(err, []error{net.ErrClosed, context.Canceled, rawpeer.ErrNoConn}) {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second * 2)
+
+	// Connect tbc service
+	cfg := &Config{
+		AutoIndex:              false,
+		BlockCache:             1000,
+		BlockheaderCache:       1000,
+		BlockSanity:            false,
+		ElectrumListenAddress:  "127.0.0.1:18556",
+		ElectrumMaxConnections: 2,
+		LevelDBHome:            t.TempDir(),
+		ListenAddress:          "localhost:8886",
+		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
+		MaxCachedTxs:            1000, // XXX
+		Network:                 networkLocalnet,
+		PeersWanted:             1,
+		PrometheusListenAddress: "",
+		Seeds:                   []string{"127.0.0.1:18444"},
+	}
+	_ = loggo.ConfigureLoggers(cfg.LogLevel)
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		err := s.Run(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(2 * time.Second)
+
+	// g -> b1 -> b2 -> b3
+	address := n.address
+	pkScript, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := chaincfg.RegressionNetParams.GenesisHash
+	var blocks []*block
+	for _, name := range []string{"b1", "b2", "b3"} {
+		b, err := n.MineAndSend(ctx, name, parent, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+		parent = b.Hash()
+	}
+	if err := s.SyncIndexersToHash(ctx, parent); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := electrs.NewClient(cfg.ElectrumListenAddress, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	height, err := c.Height(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 3 {
+		t.Fatalf("expected height 3, got %v", height)
+	}
+
+	unspent := make(map[wire.OutPoint]int64)
+	for k, b := range blocks {
+		bh, err := c.RawBlockHeader(ctx, uint64(k+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want bytes.Buffer
+		if err := b.MsgBlock().Header.Serialize(&want); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(bh[:], want.Bytes()) {
+			t.Fatalf("header %v: got %x, want %x", b.name, bh[:],
+				want.Bytes())
+		}
+
+		for _, tx := range b.b.Transactions() {
+			for _, txIn := range tx.MsgTx().TxIn {
+				delete(unspent, txIn.PreviousOutPoint)
+			}
+			for i, txOut := range tx.MsgTx().TxOut {
+				if bytes.Equal(txOut.PkScript, pkScript) {
+					unspent[*wire.NewOutPoint(tx.Hash(), uint32(i))] = txOut.Value
+				}
+			}
+		}
+	}
+	var balance uint64
+	for _, value := range unspent {
+		balance += uint64(value)
+	}
+
+	sh := tbcd.NewScriptHashFromScript(pkScript)
+	eb, err := c.Balance(ctx, sh[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eb.Confirmed != balance || eb.Unconfirmed != 0 {
+		t.Fatalf("unexpected balance: %v, want %v", spew.Sdump(eb), balance)
+	}
+	utxos, err := c.UTXOs(ctx, sh[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != len(unspent) {
+		t.Fatalf("expected %v utxos, got %v", len(unspent), len(utxos))
+	}
+	for _, utxo := range utxos {
+		txId, err := chainhash.NewHash(utxo.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, ok := unspent[*wire.NewOutPoint(txId, utxo.Index)]
+		if !ok || value != utxo.Value || utxo.Height < 1 || utxo.Height > 3 {
+			t.Fatalf("unexpected utxo: %v", spew.Sdump(utxo))
+		}
+	}
+
+	// Every tx in b2 proves against the merkle root.
+	b2 := blocks[1].b
+	root := b2.MsgBlock().Header.MerkleRoot
+	for k, tx := range b2.Transactions() {
+		txHash, merkle, err := c.TransactionAtPosition(ctx, 2, uint64(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(txHash, tx.Hash()[:]) {
+			t.Fatalf("tx %v: got %x, want %v", k, txHash, tx.Hash())
+		}
+		err = bitcoin.ValidateMerkleRoot(hex.EncodeToString(txHash), merkle,
+			uint32(k), hex.EncodeToString(root[:]))
+		if err != nil {
+			t.Fatalf("tx %v: %v", k, err)
+		}
+	}
+	_, _, err = c.TransactionAtPosition(ctx, 2, uint64(len(b2.Transactions())))
+	if !errors.Is(err, electrs.ErrNoTxAtPosition) {
+		t.Fatalf("expected no tx at position, got %v", err)
+	}
+
+	coinbase := b2.Transactions()[0]
+	rtx, err := c.RawTransaction(ctx, coinbase.Hash()[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := coinbase.MsgTx().Serialize(&want); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rtx, want.Bytes()) {
+		t.Fatalf("raw tx: got %x, want %x", rtx, want.Bytes())
+	}
+	txJSON, err := c.Transaction(ctx, coinbase.Hash()[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var etx electrumTx
+	if err := json.Unmarshal(txJSON, &etx); err != nil {
+		t.Fatal(err)
+	}
+	if etx.TxId != coinbase.Hash().String() || etx.Confirmations != 2 ||
+		etx.BlockHash != b2.Hash().String() {
+		t.Fatalf("unexpected tx: %v", spew.Sdump(etx))
+	}
+
+	// Broadcast a tx spending the b1 coinbase, twice.
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(blocks[0].b.Transactions()[0].Hash(), 0),
+		nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, pkScript))
+	var rawTx bytes.Buffer
+	if err := tx.Serialize(&rawTx); err != nil {
+		t.Fatal(err)
+	}
+	txId, err := c.Broadcast(ctx, rawTx.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantId := tx.TxHash(); !bytes.Equal(txId, wantId[:]) {
+		t.Fatalf("broadcast: got %x, want %v", txId, wantId)
+	}
+	_, err = c.Broadcast(ctx, rawTx.Bytes())
+	if err == nil || err.Error() != ErrTxAlreadyBroadcast.Error() {
+		t.Fatalf("expected already broadcast, got %v", err)
+	}
+
+	// Batches are limited.
+	batch := make([]electrumRequest, electrumMaxBatch+1)
+	for k := range batch {
+		batch[k] = electrumRequest{
+			JSONRPC: "2.0",
+			Method:  "server.ping",
+			ID:      json.RawMessage(fmt.Sprint(k)),
+		}
+	}
+	msg, err := json.Marshal(batch[:electrumMaxBatch])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := s.handleElectrumMessage(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies []electrumResponse
+	if err := json.Unmarshal(reply, &replies); err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != electrumMaxBatch {
+		t.Fatalf("expected %v replies, got %v", electrumMaxBatch,
+			len(replies))
+	}
+	if msg, err = json.Marshal(batch); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err = s.handleElectrumMessage(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	var res electrumResponse
+	if err := json.Unmarshal(reply, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Error == "" {
+		t.Fatalf("expected batch error, got %s", reply)
+	}
+
+	// Connections are limited, the client holds both.
+	conn, err := net.Dial("tcp", cfg.ElectrumListenAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected %v, got %v", io.EOF, err)
+	}
+}
+
+func TestEsplora(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	n, err := newFakeNode(t, "18444")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := n.Stop()
+		if err != nil {
+			t.Logf("node stop: %v", err)
+		}
+	}()
+
+	go func() {
+		if err := n.Run(ctx); !errorIsOneOf(err, []error{net.ErrClosed, context.Canceled, rawpeer.ErrNoConn}) {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second * 2)
+
+	// Connect tbc service
+	cfg := &Config{
+		AutoIndex:            false,
+		BlockCache:           1000,
+		BlockheaderCache:     1000,
+		BlockSanity:          false,
+		EsploraListenAddress: "127.0.0.1:18557",
+		LevelDBHome:          t.TempDir(),
+		ListenAddress:        "localhost:8887",
+		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
+		MaxCachedTxs:            1000, // XXX
+		Network:                 networkLocalnet,
+		PeersWanted:             1,
+		PrometheusListenAddress: "",
+		Seeds:                   []string{"127.0.0.1:18444"},
+	}
+	_ = loggo.ConfigureLoggers(cfg.LogLevel)
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		err := s.Run(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(2 * time.Second)
+
+	// g -> b1 -> b2 -> b3
+	address := n.address
+	parent := chaincfg.RegressionNetParams.GenesisHash
+	var blocks []*block
+	for _, name := range []string{"b1", "b2", "b3"} {
+		b, err := n.MineAndSend(ctx, name, parent, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+		parent = b.Hash()
+	}
+	if err := s.SyncIndexersToHash(ctx, parent); err != nil {
+		t.Fatal(err)
+	}
+
+	// request returns the response body and fails when the status is not
+	// the expected status.
+	request := func(method, path string, body []byte, status int) []byte {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, method,
+			"http://"+cfg.EsploraListenAddress+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != status {
+			t.Fatalf("%v %v: status %v, want %v: %s", method, path,
+				res.StatusCode, status, b)
+		}
+		return b
+	}
+
+	if tip := request("GET", "/blocks/tip/height", nil, http.StatusOK); string(tip) != "3" {
+		t.Fatalf("unexpected tip height: %s", tip)
+	}
+	b2 := blocks[1].b
+	if hash := request("GET", "/block-height/2", nil, http.StatusOK); string(hash) != b2.Hash().String() {
+		t.Fatalf("unexpected hash at height 2: %s", hash)
+	}
+	request("GET", "/block-height/4", nil, http.StatusNotFound)
+
+	var eb esploraBlock
+	err = json.Unmarshal(request("GET", "/block/"+b2.Hash().String(), nil,
+		http.StatusOK), &eb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eb.Id != b2.Hash().String() || eb.Height != 2 ||
+		eb.TxCount != len(b2.Transactions()) ||
+		eb.PreviousBlockHash != blocks[0].Hash().String() ||
+		eb.MedianTime != blocks[0].b.MsgBlock().Header.Timestamp.Unix() {
+		t.Fatalf("unexpected block: %v", spew.Sdump(eb))
+	}
+	raw, err := b2.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := request("GET", "/block/"+b2.Hash().String()+"/raw", nil, http.StatusOK); !bytes.Equal(got, raw) {
+		t.Fatalf("unexpected raw block: %x", got)
+	}
+	if got := request("GET", "/block/"+b2.Hash().String()+"/header", nil, http.StatusOK); string(got) != hex.EncodeToString(raw[:80]) {
+		t.Fatalf("unexpected header: %s", got)
+	}
+	request("GET", "/block/nothex", nil, http.StatusBadRequest)
+
+	coinbase := b2.Transactions()[0]
+	var etx esploraTx
+	err = json.Unmarshal(request("GET", "/tx/"+coinbase.Hash().String(), nil,
+		http.StatusOK), &etx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etx.TxId != coinbase.Hash().String() || !etx.Status.Confirmed ||
+		etx.Status.BlockHeight != 2 || !etx.Vin[0].IsCoinbase ||
+		len(etx.Vout) != len(coinbase.MsgTx().TxOut) {
+		t.Fatalf("unexpected tx: %v", spew.Sdump(etx))
+	}
+	var want bytes.Buffer
+	if err := coinbase.MsgTx().Serialize(&want); err != nil {
+		t.Fatal(err)
+	}
+	if got := request("GET", "/tx/"+coinbase.Hash().String()+"/hex", nil, http.StatusOK); string(got) != hex.EncodeToString(want.Bytes()) {
+		t.Fatalf("unexpected tx hex: %s", got)
+	}
+	request("GET", "/tx/"+chainhash.Hash{}.String(), nil, http.StatusNotFound)
+
+	// The b2 tx spends the b1 coinbase, its prevout is in the undo record.
+	if len(b2.Transactions()) < 2 {
+		t.Fatalf("b2 has no spending tx")
+	}
+	spend := b2.Transactions()[1]
+	err = json.Unmarshal(request("GET", "/tx/"+spend.Hash().String(), nil,
+		http.StatusOK), &etx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevOut := blocks[0].b.Transactions()[0].MsgTx().TxOut[0]
+	var out int64
+	for _, txOut := range spend.MsgTx().TxOut {
+		out += txOut.Value
+	}
+	if etx.Vin[0].PrevOut == nil ||
+		etx.Vin[0].PrevOut.Value != prevOut.Value ||
+		etx.Vin[0].PrevOut.ScriptPubKey != hex.EncodeToString(prevOut.PkScript) ||
+		etx.Fee != prevOut.Value-out {
+		t.Fatalf("unexpected prevout: %v", spew.Sdump(etx))
+	}
+
+	// Every utxo of the address is confirmed.
+	var eus []esploraUtxo
+	err = json.Unmarshal(request("GET", "/address/"+address.String()+"/utxo",
+		nil, http.StatusOK), &eus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, err := s.BalanceByAddress(ctx, address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var utxoBalance uint64
+	for _, eu := range eus {
+		if !eu.Status.Confirmed || eu.Status.BlockHeight < 1 ||
+			eu.Status.BlockHeight > 3 {
+			t.Fatalf("unexpected utxo: %v", spew.Sdump(eu))
+		}
+		utxoBalance += eu.Value
+	}
+	if len(eus) == 0 || utxoBalance != balance {
+		t.Fatalf("utxo balance %v, want %v", utxoBalance, balance)
+	}
+	request("GET", "/address/invalid/utxo", nil, http.StatusBadRequest)
+
+	// Broadcast a tx spending the b1 coinbase.
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(blocks[0].b.Transactions()[0].Hash(), 0),
+		nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, nil))
+	var rawTx bytes.Buffer
+	if err := tx.Serialize(&rawTx); err != nil {
+		t.Fatal(err)
+	}
+	txId := request("POST", "/tx", []byte(hex.EncodeToString(rawTx.Bytes())),
+		http.StatusOK)
+	if string(txId) != tx.TxHash().String() {
+		t.Fatalf("broadcast: got %s, want %v", txId, tx.TxHash())
+	}
+	request("POST", "/tx", []byte("zz"), http.StatusBadRequest)
+}
+
+func TestJSONRPC(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	n, err := newFakeNode(t, "18444")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := n.Stop()
+		if err != nil {
+			t.Logf("node stop: %v", err)
+		}
+	}()
+
+	go func() {
+		if err := n.Run(ctx); !errorIsOneOf(err, []error{net.ErrClosed, context.Canceled, rawpeer.ErrNoConn}) {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second * 2)
+
+	// Connect tbc service
+	cfg := &Config{
+		AutoIndex:            false,
+		BlockCache:           1000,
+		BlockheaderCache:     1000,
+		BlockSanity:          false,
+		JSONRPCListenAddress: "127.0.0.1:18558",
+		JSONRPCPassword:      "password",
+		JSONRPCUser:          "user",
+		LevelDBHome:          t.TempDir(),
+		ListenAddress:        "localhost:8888",
+		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
+		MaxCachedTxs:            1000, // XXX
+		Network:                 networkLocalnet,
+		PeersWanted:             1,
+		PrometheusListenAddress: "",
+		Seeds:                   []string{"127.0.0.1:18444"},
+	}
+	_ = loggo.ConfigureLoggers(cfg.LogLevel)
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		err := s.Run(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(2 * time.Second)
+
+	// g -> b1 -> b2 -> b3
+	address := n.address
+	parent := chaincfg.RegressionNetParams.GenesisHash
+	var blocks []*block
+	for _, name := range []string{"b1", "b2", "b3"} {
+		b, err := n.MineAndSend(ctx, name, parent, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+		parent = b.Hash()
+	}
+	if err := s.SyncIndexersToHash(ctx, parent); err != nil {
 		t.Fatal(err)
 	}
-	disasm, err = vm.DisasmScript(0)
+
+	// call unmarshals the result into v and fails when the status is not
+	// the expected status.
+	call := func(user, method string, params []any, status int, v any) *rpcError {
+		t.Helper()
+		body, err := json.Marshal(map[string]any{
+			"jsonrpc": "1.0",
+			"id":      "test",
+			"method":  method,
+			"params":  params,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST",
+			"http://"+cfg.JSONRPCListenAddress, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth(user, cfg.JSONRPCPassword)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != status {
+			t.Fatalf("%v: status %v, want %v: %s", method,
+				res.StatusCode, status, b)
+		}
+		if status == http.StatusUnauthorized {
+			return nil
+		}
+		var r struct {
+			Result json.RawMessage `json:"result"`
+			Error  *rpcError       `json:"error"`
+		}
+		if err := json.Unmarshal(b, &r); err != nil {
+			t.Fatalf("%v: %v: %s", method, err, b)
+		}
+		if r.Error == nil && v != nil {
+			if err := json.Unmarshal(r.Result, v); err != nil {
+				t.Fatalf("%v: %v: %s", method, err, r.Result)
+			}
+		}
+		return r.Error
+	}
+
+	call("nobody", "getblockcount", nil, http.StatusUnauthorized, nil)
+	if re := call("user", "nomethod", nil, http.StatusNotFound, nil); re.Code != rpcMethodNotFound {
+		t.Fatalf("unexpected error: %v", re)
+	}
+
+	var height uint64
+	call("user", "getblockcount", nil, http.StatusOK, &height)
+	if height != 3 {
+		t.Fatalf("unexpected block count: %v", height)
+	}
+	var hash string
+	call("user", "getbestblockhash", nil, http.StatusOK, &hash)
+	if hash != parent.String() {
+		t.Fatalf("unexpected best block hash: %v", hash)
+	}
+	b2 := blocks[1].b
+	call("user", "getblockhash", []any{2}, http.StatusOK, &hash)
+	if hash != b2.Hash().String() {
+		t.Fatalf("unexpected hash at height 2: %v", hash)
+	}
+	if re := call("user", "getblockhash", []any{4}, http.StatusInternalServerError, nil); re.Code != rpcInvalidParameter {
+		t.Fatalf("unexpected error: %v", re)
+	}
+
+	raw, err := b2.Bytes()
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("coinbase signed tx in 0: %v", disasm)
-	disasm, err = vm.DisasmScript(1)
-	if err != nil {
+	var rawHex string
+	call("user", "getblock", []any{b2.Hash().String(), 0}, http.StatusOK, &rawHex)
+	if rawHex != hex.EncodeToString(raw) {
+		t.Fatalf("unexpected raw block: %v", rawHex)
+	}
+	var rb rpcBlock
+	call("user", "getblock", []any{b2.Hash().String()}, http.StatusOK, &rb)
+	if rb.Hash != b2.Hash().String() || rb.Height != 2 ||
+		rb.Confirmations != 2 || rb.NTx != len(b2.Transactions()) ||
+		len(rb.Tx) != len(b2.Transactions()) ||
+		rb.PreviousBlockHash != blocks[0].Hash().String() ||
+		rb.NextBlockHash != blocks[2].Hash().String() {
+		t.Fatalf("unexpected block: %v", spew.Sdump(rb))
+	}
+	call("user", "getblockheader", []any{b2.Hash().String(), false}, http.StatusOK, &rawHex)
+	if rawHex != hex.EncodeToString(raw[:80]) {
+		t.Fatalf("unexpected header: %v", rawHex)
+	}
+
+	coinbase := blocks[0].b.Transactions()[0]
+	var rtx rpcTx
+	call("user", "getrawtransaction", []any{coinbase.Hash().String(), true}, http.StatusOK, &rtx)
+	if rtx.TxId != coinbase.Hash().String() || rtx.Confirmations != 3 ||
+		rtx.BlockHash != blocks[0].Hash().String() ||
+		rtx.Vin[0].Coinbase == "" ||
+		len(rtx.Vout) != len(coinbase.MsgTx().TxOut) {
+		t.Fatalf("unexpected tx: %v", spew.Sdump(rtx))
+	}
+	if re := call("user", "getrawtransaction", []any{chainhash.Hash{}.String()}, http.StatusInternalServerError, nil); re.Code != rpcInvalidAddressOrKey {
+		t.Fatalf("unexpected error: %v", re)
+	}
+
+	// The b1 coinbase is spent in b2, the b3 coinbase is unspent.
+	var txOut *rpcTxOut
+	call("user", "gettxout", []any{coinbase.Hash().String(), 0}, http.StatusOK, &txOut)
+	if txOut != nil {
+		t.Fatalf("unexpected tx out: %v", spew.Sdump(txOut))
+	}
+	coinbase3 := blocks[2].b.Transactions()[0]
+	call("user", "gettxout", []any{coinbase3.Hash().String(), 0}, http.StatusOK, &txOut)
+	if txOut == nil || !txOut.Coinbase || txOut.Confirmations != 1 ||
+		txOut.BestBlock != parent.String() ||
+		txOut.Value != btcutil.Amount(coinbase3.MsgTx().TxOut[0].Value).ToBTC() {
+		t.Fatalf("unexpected tx out: %v", spew.Sdump(txOut))
+	}
+	// The outputs of the last b3 tx are unspent and not a coinbase.
+	spend := blocks[2].b.Transactions()[2]
+	txOut = nil
+	call("user", "gettxout", []any{spend.Hash().String(), 0}, http.StatusOK, &txOut)
+	if txOut == nil || txOut.Coinbase || txOut.Confirmations != 1 ||
+		txOut.ScriptPubKey.Hex != hex.EncodeToString(spend.MsgTx().TxOut[0].PkScript) ||
+		txOut.Value != btcutil.Amount(spend.MsgTx().TxOut[0].Value).ToBTC() {
+		t.Fatalf("unexpected tx out: %v", spew.Sdump(txOut))
+	}
+
+	var rmi rpcMempoolInfo
+	call("user", "getmempoolinfo", nil, http.StatusOK, &rmi)
+	if rmi.Loaded {
+		t.Fatalf("unexpected mempool info: %v", spew.Sdump(rmi))
+	}
+
+	// Broadcast a tx spending the b3 coinbase.
+	tx := wire.NewMsgTx(wire.TxVersion)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(coinbase3.Hash(), 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, nil))
+	var rawTx bytes.Buffer
+	if err := tx.Serialize(&rawTx); err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("coinbase signed tx out 0: %v", disasm)
+	var txId string
+	call("user", "sendrawtransaction", []any{hex.EncodeToString(rawTx.Bytes())}, http.StatusOK, &txId)
+	if txId != tx.TxHash().String() {
+		t.Fatalf("broadcast: got %v, want %v", txId, tx.TxHash())
+	}
+	if re := call("user", "sendrawtransaction", []any{"zz"}, http.StatusInternalServerError, nil); re.Code != rpcDeserializationErr {
+		t.Fatalf("unexpected error: %v", re)
+	}
 }
 
-// borrowed from btcd
-//
-// Copyright (c) 2014-2016 The btcsuite developers
-// Use of this source code is governed by an ISC
-// license that can be found in the LICENSE file.
-var (
-	CoinbaseFlags = "/P2SH/btcd/"
-	vbTopBits     = 0x20000000
-)
+func TestTxMerkleProof(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
 
-func standardCoinbaseScript(nextBlockHeight int32, extraNonce uint64) ([]byte, error) {
-	return txscript.NewScriptBuilder().AddInt64(int64(nextBlockHeight)).
-		AddInt64(int64(extraNonce)).AddData([]byte(CoinbaseFlags)).
-		Script()
+	n, err := newFakeNode(t, "18444")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := n.Stop()
+		if err != nil {
+			t.Logf("node stop: %v", err)
+		}
+	}()
+
+	go func() {
+		if err := n.Run(ctx); !errorIsOneOf(err, []error{net.ErrClosed, context.Canceled, rawpeer.ErrNoConn}) {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second * 2)
+
+	// Connect tbc service
+	cfg := &Config{
+		AutoIndex:        false,
+		BlockCache:       1000,
+		BlockheaderCache: 1000,
+		BlockSanity:      false,
+		LevelDBHome:      t.TempDir(),
+		ListenAddress:    "localhost:8889",
+		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
+		MaxCachedTxs:            1000, // XXX
+		Network:                 networkLocalnet,
+		PeersWanted:             1,
+		PrometheusListenAddress: "",
+		Seeds:                   []string{"127.0.0.1:18444"},
+	}
+	_ = loggo.ConfigureLoggers(cfg.LogLevel)
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		err := s.Run(ctx)
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
+			panic(err)
+		}
+	}()
+
+	time.Sleep(2 * time.Second)
+
+	// g -> b1 -> b2 -> b3
+	address := n.address
+	parent := chaincfg.RegressionNetParams.GenesisHash
+	var blocks []*block
+	for _, name := range []string{"b1", "b2", "b3"} {
+		b, err := n.MineAndSend(ctx, name, parent, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+		parent = b.Hash()
+	}
+	if err := s.SyncIndexersToHash(ctx, parent); err != nil {
+		t.Fatal(err)
+	}
+
+	for height, b := range blocks {
+		root := b.b.MsgBlock().Header.MerkleRoot
+		for index, tx := range b.b.Transactions() {
+			mp, err := s.TxMerkleProof(ctx, tx.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !mp.BlockHash.IsEqual(b.Hash()) ||
+				mp.BlockHeight != uint64(height+1) ||
+				mp.TxIndex != uint32(index) {
+				t.Fatalf("unexpected merkle proof: %v", spew.Sdump(mp))
+			}
+			merkleHashes := make([][]byte, 0, len(mp.MerkleHashes))
+			for _, h := range mp.MerkleHashes {
+				merkleHashes = append(merkleHashes, h[:])
+			}
+			err = bitcoin.CheckMerkleChain(tx.Hash()[:], mp.TxIndex,
+				merkleHashes, root[:])
+			if err != nil {
+				t.Fatalf("tx %v: %v", tx.Hash(), err)
+			}
+		}
+	}
+
+	_, err = s.TxMerkleProof(ctx, &chainhash.Hash{})
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
 }
 
-func createCoinbaseTx(params *chaincfg.Params, coinbaseScript []byte, nextBlockHeight int32, addr btcutil.Address) (*btcutil.Tx, error) {
-	// Create the script to pay to the provided payment address if one was
-	// specified.  Otherwise, create a script that allows the coinbase to be
-	// redeemable by anyone.
-	var pkScript []byte
-	if addr != nil {
-		var err error
-		pkScript, err = txscript.PayToAddrScript(addr)
+func TestOutpointSpentBy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	n, err := newFakeNode(t, "18444")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := n.Stop()
 		if err != nil {
-			return nil, err
+			t.Logf("node stop: %v", err)
 		}
-	} else {
-		var err error
-		scriptBuilder := txscript.NewScriptBuilder()
-		pkScript, err = scriptBuilder.AddOp(txscript.OP_TRUE).Script()
+	}()
+
+	go func() {
+		if err := n.Run(ctx); !errorIsOneOf(err, []error{net.ErrClosed, context.Canceled, rawpeer.ErrNoConn}) {
+			panic(err)
+		}
+	}()
+	time.Sleep(time.Second * 2)
+
+	// Connect tbc service
+	cfg := &Config{
+		AutoIndex:        false,
+		BlockCache:       1000,
+		BlockheaderCache: 1000,
+		BlockSanity:      false,
+		LevelDBHome:      t.TempDir(),
+		ListenAddress:    "localhost:8889",
+		// LogLevel:                "tbcd=TRACE:tbc=TRACE:level=DEBUG",
+		MaxCachedTxs:            1000, // XXX
+		MempoolEnabled:          true,
+		Network:                 networkLocalnet,
+		PeersWanted:             1,
+		PrometheusListenAddress: "",
+		Seeds:                   []string{"127.0.0.1:18444"},
+	}
+	_ = loggo.ConfigureLoggers(cfg.LogLevel)
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for Run to exit before the temporary directory is removed, the
+	// mempool is saved on shutdown.
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		err := <-runErr
+		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, rawpeer.ErrNoConn) {
+			t.Errorf("run: %v", err)
+		}
+	}()
+
+	time.Sleep(2 * time.Second)
+
+	// g -> b1 -> b2 -> b3
+	address := n.address
+	parent := chaincfg.RegressionNetParams.GenesisHash
+	var blocks []*block
+	for _, name := range []string{"b1", "b2", "b3"} {
+		b, err := n.MineAndSend(ctx, name, parent, address)
 		if err != nil {
-			return nil, err
+			t.Fatal(err)
 		}
+		blocks = append(blocks, b)
+		parent = b.Hash()
+	}
+	if err := s.SyncIndexersToHash(ctx, parent); err != nil {
+		t.Fatal(err)
 	}
 
-	tx := wire.NewMsgTx(wire.TxVersion)
-	tx.AddTxIn(&wire.TxIn{
-		// Coinbase transactions have no inputs, so previous outpoint is
-		// zero hash and max index.
-		PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{},
-			wire.MaxPrevOutIndex),
-		SignatureScript: coinbaseScript,
-		Sequence:        wire.MaxTxInSequenceNum,
-	})
-	tx.AddTxOut(&wire.TxOut{
-		Value:    blockchain.CalcBlockSubsidy(nextBlockHeight, params),
-		PkScript: pkScript,
+	spends := 0
+	for height, b := range blocks {
+		for _, tx := range b.b.Transactions()[1:] {
+			for index, txIn := range tx.MsgTx().TxIn {
+				sb, err := s.OutpointSpentBy(ctx, txIn.PreviousOutPoint)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !sb.TxId.IsEqual(tx.Hash()) ||
+					sb.InputIndex != uint32(index) ||
+					!sb.BlockHash.IsEqual(b.Hash()) ||
+					sb.BlockHeight != uint64(height+1) {
+					t.Fatalf("unexpected spend: %v", spew.Sdump(sb))
+				}
+				spends++
+			}
+		}
+	}
+	if spends == 0 {
+		t.Fatal("no spends")
+	}
+
+	// Unconfirmed spends are found in the mempool.
+	op := *wire.NewOutPoint(blocks[2].b.Transactions()[0].Hash(), 0)
+	_, err = s.OutpointSpentBy(ctx, op)
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, 7), nil, nil))
+	tx.AddTxIn(wire.NewTxIn(&op, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(1000, []byte{txscript.OP_TRUE}))
+	if err := s.mempool.txsInsert(ctx, newMempoolTx(tx, tx.SerializeSize())); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := s.OutpointSpentBy(ctx, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.TxId != tx.TxHash() || sb.InputIndex != 1 || sb.BlockHash != nil {
+		t.Fatalf("unexpected mempool spend: %v", spew.Sdump(sb))
+	}
+
+	r, err := s.handleOutpointSpentByRequest(ctx, &tbcapi.OutpointSpentByRequest{
+		OutPoint: &tbcapi.OutPoint{Hash: op.Hash, Index: op.Index},
 	})
-	return btcutil.NewTx(tx), nil
-}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := r.(*tbcapi.OutpointSpentByResponse); !resp.Mempool ||
+		resp.Error != nil {
+		t.Fatalf("unexpected response: %v", spew.Sdump(resp))
+	}
 
-// end borrowed from btcd
+	// Reorg b3 away without indexing, spends in b3 are no longer
+	// canonical.
+	// g -> b1 -> b2 -> b3
+	//              \-> b3a -> b4a
+	b3a, err := n.MineAndSend(ctx, "b3a", blocks[1].Hash(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b4a, err := n.MineAndSend(ctx, "b4a", b3a.Hash(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-timeout:
+			t.Fatal("timeout waiting for b4a")
+		case <-time.After(100 * time.Millisecond):
+		}
+		bhb, err := s.db.BlockHeaderBest(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bhb.Hash.IsEqual(b4a.Hash()) {
+			break
+		}
+	}
+	for _, tx := range blocks[2].b.Transactions()[1:] {
+		for _, txIn := range tx.MsgTx().TxIn {
+			_, err := s.OutpointSpentBy(ctx, txIn.PreviousOutPoint)
+			if !errors.Is(err, database.ErrNotFound) {
+				t.Fatalf("expected not found, got %v", err)
+			}
+		}
+	}
+}